@@ -3,7 +3,14 @@
 
 package accessor
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+// ErrVersionConflict indicates a conditional write failed because stored data changed after the
+// writer read it. See [Versioned].
+var ErrVersionConflict = errors.New("stored data changed since it was read")
 
 // Accessor accesses data storage.
 type Accessor interface {
@@ -11,3 +18,35 @@ type Accessor interface {
 	Read(context.Context) ([]byte, error)
 	Write(context.Context, []byte) error
 }
+
+// Locker is an optional interface for an Accessor that can coordinate access to its storage. Cache uses
+// an Accessor's Locker instead of a file lock, which can't provide mutual exclusion across hosts sharing
+// remote storage. Note that Cache's timestamp file records only local writes, so a Cache sharing storage
+// across hosts should disable it (see cache.WithTimestampMode).
+type Locker interface {
+	// Lock acquires an exclusive lock on the Accessor's storage, waiting until it succeeds or the context is done.
+	Lock(context.Context) error
+	// Unlock releases the lock.
+	Unlock(context.Context) error
+}
+
+// Versioned is an optional interface for an Accessor that can write conditionally, allowing clients to
+// update shared data without a lock. Versions are opaque strings meaningful only to the Accessor which
+// returned them.
+type Versioned interface {
+	// ReadVersion returns stored data and its version or, if no data is stored, a nil slice and a
+	// version WriteIf accepts for creating data.
+	ReadVersion(context.Context) ([]byte, string, error)
+	// WriteIf stores data only when the stored data's version is "version", returning the new version.
+	// An empty version means no data is stored. When the stored data's version differs, WriteIf
+	// returns an error wrapping [ErrVersionConflict].
+	WriteIf(ctx context.Context, data []byte, version string) (string, error)
+}
+
+// VersionReader is an optional interface for a [Versioned] Accessor that can read the version of stored
+// data without reading the data. A Cache using optimistic concurrency with its timestamp file disabled
+// uses it to detect changes, reading data only when its version changed.
+type VersionReader interface {
+	// Version returns the version ReadVersion would return.
+	Version(context.Context) (string, error)
+}
@@ -0,0 +1,488 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package blob stores data in an Azure Storage block blob. Its Storage implements [accessor.Locker] with
+// a blob lease, which Cache uses instead of a file lock, and [accessor.Versioned] with the blob's ETag,
+// so clients sharing the blob can use either Cache's default locking or its optimistic concurrency mode.
+// Because the timestamp file Cache uses to skip redundant reads records only local writes, clients
+// sharing a blob should disable it:
+//
+//	s, err := blob.New("https://account.blob.core.windows.net/container", "msal.json", blob.WithSAS(sas))
+//	// TODO: handle error
+//	c, err := cache.New(s, p, cache.WithTimestampMode(cache.TimestampDisabled))
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/seal"
+)
+
+const (
+	// apiVersion is the version of the Blob service API Storage uses
+	apiVersion           = "2023-11-03"
+	defaultLeaseDuration = 15 * time.Second
+	// leaseRetryDelay and maxLeaseRetryDelay bound the delay between attempts to acquire the lease
+	leaseRetryDelay, maxLeaseRetryDelay = 50 * time.Millisecond, time.Second
+)
+
+// ErrLeaseExpired indicates Storage's lease on the blob expired, or another client acquired the lease,
+// before Storage finished using it.
+var ErrLeaseExpired = errors.New("the blob lease expired")
+
+type option func(*Storage) error
+
+// WithEncryptionKey makes Storage encrypt data with AES-256-GCM before storing it, so anyone able to read
+// the blob but not the key can't read cached tokens. The key must be 32 bytes. Ciphertext is bound to
+// the blob's path, so it doesn't decrypt when copied to another blob.
+func WithEncryptionKey(key []byte) option {
+	return func(s *Storage) error {
+		if err := seal.CheckKey(key); err != nil {
+			return err
+		}
+		s.encryptionKey = append([]byte{}, key...)
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client Storage uses to send requests. The default is [http.DefaultClient].
+func WithHTTPClient(c *http.Client) option {
+	return func(s *Storage) error {
+		if c == nil {
+			return errors.New("HTTP client can't be nil")
+		}
+		s.client = c
+		return nil
+	}
+}
+
+// WithLeaseDuration sets the duration of the lease Storage acquires to lock the blob. The Blob service
+// allows durations from 15 to 60 seconds. The default is 15 seconds.
+func WithLeaseDuration(d time.Duration) option {
+	return func(s *Storage) error {
+		if d < 15*time.Second || d > time.Minute {
+			return errors.New("lease duration must be from 15 to 60 seconds")
+		}
+		s.leaseDuration = d
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about storage operations. These records never
+// include stored data or credentials. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithSAS authorizes requests with a shared access signature, which must permit reading and writing
+// the blob.
+func WithSAS(token string) option {
+	return func(s *Storage) error {
+		q, err := url.ParseQuery(strings.TrimPrefix(token, "?"))
+		if err != nil || len(q) == 0 {
+			return errors.New("invalid SAS token")
+		}
+		s.sas = q
+		return nil
+	}
+}
+
+// WithSharedKey authorizes requests with a storage account's name and base64 encoded access key.
+func WithSharedKey(account, key string) option {
+	return func(s *Storage) error {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || account == "" || len(b) == 0 {
+			return errors.New("invalid shared key")
+		}
+		s.sharedKey = &sharedKey{account: account, key: b}
+		return nil
+	}
+}
+
+// WithTokenProvider authorizes requests with Microsoft Entra access tokens from the given function,
+// which Storage calls before each request. Tokens must be for the scope "https://storage.azure.com/.default".
+func WithTokenProvider(fn func(context.Context) (string, error)) option {
+	return func(s *Storage) error {
+		if fn == nil {
+			return errors.New("token provider can't be nil")
+		}
+		s.token = fn
+		return nil
+	}
+}
+
+// Storage stores data in a block blob.
+type Storage struct {
+	client        *http.Client
+	encryptionKey []byte
+	leaseDuration time.Duration
+	// leaseExpires is when Storage's lease expires, estimated from the local clock. It's zero when
+	// Storage doesn't hold the lease.
+	leaseExpires time.Time
+	leaseID      string
+	logger       *slog.Logger
+	m            *sync.Mutex
+	sas          url.Values
+	sharedKey    *sharedKey
+	token        func(context.Context) (string, error)
+	u            *url.URL
+}
+
+// New is the constructor for Storage. "containerURL" is the URL of the blob's container, for example
+// "https://account.blob.core.windows.net/container". It may include a SAS token, in which case Storage
+// needs no other authorization option. Otherwise, exactly one of [WithSAS], [WithSharedKey] and
+// [WithTokenProvider] is required.
+func New(containerURL, name string, opts ...option) (*Storage, error) {
+	u, err := url.Parse(containerURL)
+	if err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid container URL %q", containerURL)
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		return nil, fmt.Errorf("invalid blob name %q", name)
+	}
+	s := Storage{
+		client:        http.DefaultClient,
+		leaseDuration: defaultLeaseDuration,
+		m:             &sync.Mutex{},
+	}
+	if u.RawQuery != "" {
+		s.sas = u.Query()
+	}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	auth := 0
+	if s.sas != nil {
+		auth++
+	}
+	if s.sharedKey != nil {
+		auth++
+	}
+	if s.token != nil {
+		auth++
+	}
+	if auth == 0 {
+		return nil, errors.New("no authorization. Specify a SAS token, shared key or token provider")
+	}
+	if auth > 1 {
+		return nil, errors.New("specify only one of a SAS token, shared key and token provider")
+	}
+	u.RawQuery = ""
+	s.u = u.JoinPath(name)
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("blob", s.u.Path))
+	return &s, nil
+}
+
+// Delete deletes the blob, if it exists. When Storage holds the lease, Delete instead replaces the blob's
+// content with nothing, because deleting the blob would end the lease.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.leaseExpires.IsZero() {
+		_, err := s.put(ctx, nil, nil)
+		return err
+	}
+	_, _, err := s.do(ctx, http.MethodDelete, nil, nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		s.logger.DebugContext(ctx, "nothing to delete because the blob doesn't exist")
+		return nil
+	}
+	return err
+}
+
+// Read returns the blob's content or, if the blob doesn't exist or is empty, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	data, _, err := s.ReadVersion(ctx)
+	return data, err
+}
+
+// ReadVersion returns the blob's content and ETag. When the blob doesn't exist, it returns a nil slice
+// and an empty version.
+func (s *Storage) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	body, h, err := s.do(ctx, http.MethodGet, nil, nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		s.logger.DebugContext(ctx, "returning no data because the blob doesn't exist")
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	etag := h.Get("ETag")
+	if len(body) == 0 {
+		// Lock creates an empty blob when the blob doesn't exist because leasing requires a blob
+		s.logger.DebugContext(ctx, "returning no data because the blob is empty")
+		return nil, etag, nil
+	}
+	if s.encryptionKey != nil {
+		if body, err = seal.Open(s.encryptionKey, body, []byte(s.u.Path)); err != nil {
+			return nil, "", err
+		}
+	}
+	return body, etag, nil
+}
+
+// Write stores data in the blob, creating it if necessary. When Storage holds the lease, Write returns
+// [ErrLeaseExpired] instead of writing if the lease may have expired.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err := s.put(ctx, data, nil)
+	return err
+}
+
+// WriteIf stores data in the blob when the blob's ETag is "version" or, when version is empty, when the
+// blob doesn't exist. It returns the blob's new ETag.
+func (s *Storage) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	h := http.Header{}
+	if version == "" {
+		h.Set("If-None-Match", "*")
+	} else {
+		h.Set("If-Match", version)
+	}
+	etag, err := s.put(ctx, data, h)
+	var e *storageError
+	if errors.As(err, &e) && (e.code == "ConditionNotMet" || e.code == "BlobAlreadyExists" || e.code == "BlobNotFound") {
+		s.logger.DebugContext(ctx, "not writing because the blob changed", slog.String("etag", version))
+		return "", fmt.Errorf("%w: %s", accessor.ErrVersionConflict, err)
+	}
+	return etag, err
+}
+
+// Lock acquires a lease on the blob, creating an empty blob first if necessary, and waits until it
+// succeeds or the context is done. The lease expires after the duration set by [WithLeaseDuration], so a
+// client that crashes while holding it can't block others indefinitely.
+func (s *Storage) Lock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.leaseExpires.IsZero() {
+		return errors.New("Storage already holds the lease")
+	}
+	id, err := newLeaseID()
+	if err != nil {
+		return err
+	}
+	delay := leaseRetryDelay
+	for {
+		start := time.Now()
+		h := http.Header{}
+		h.Set("X-Ms-Lease-Action", "acquire")
+		h.Set("X-Ms-Lease-Duration", strconv.Itoa(int(s.leaseDuration/time.Second)))
+		h.Set("X-Ms-Proposed-Lease-Id", id)
+		_, _, err := s.do(ctx, http.MethodPut, url.Values{"comp": {"lease"}}, nil, h)
+		if err == nil {
+			s.leaseExpires, s.leaseID = start.Add(s.leaseDuration), id
+			s.logger.DebugContext(ctx, "acquired lease")
+			return nil
+		}
+		if isStatus(err, http.StatusNotFound) {
+			s.logger.DebugContext(ctx, "creating empty blob to lease")
+			h := http.Header{}
+			h.Set("If-None-Match", "*")
+			_, err = s.put(ctx, nil, h)
+			if err == nil || isStatus(err, http.StatusConflict) || isStatus(err, http.StatusPreconditionFailed) {
+				// the blob exists now, whether this client or another created it. When another client also
+				// leased it, the put fails with 412 because it lacks the lease ID.
+				continue
+			}
+			return err
+		}
+		if !isStatus(err, http.StatusConflict) {
+			return err
+		}
+		d := delay/2 + time.Duration(mrand.Int63n(int64(delay)))
+		s.logger.DebugContext(ctx, "retrying lease acquisition because another client holds the lease", slog.Duration("delay", d))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+			if delay *= 2; delay > maxLeaseRetryDelay {
+				delay = maxLeaseRetryDelay
+			}
+		}
+	}
+}
+
+// Unlock releases the lease. It returns [ErrLeaseExpired] when the lease expired and another client
+// acquired one, because that client may have done so while Storage believed it held the lease.
+func (s *Storage) Unlock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.leaseExpires.IsZero() {
+		return errors.New("Storage doesn't hold the lease")
+	}
+	id := s.leaseID
+	s.leaseExpires, s.leaseID = time.Time{}, ""
+	h := http.Header{}
+	h.Set("X-Ms-Lease-Action", "release")
+	h.Set("X-Ms-Lease-Id", id)
+	_, _, err := s.do(ctx, http.MethodPut, url.Values{"comp": {"lease"}}, nil, h)
+	if isStatus(err, http.StatusConflict) {
+		s.logger.DebugContext(ctx, "lease expired before release")
+		return ErrLeaseExpired
+	}
+	if err == nil {
+		s.logger.DebugContext(ctx, "released lease")
+	}
+	return err
+}
+
+// put uploads data, encrypting it first if Storage has an encryption key, and returns the blob's ETag.
+// Callers must hold s.m.
+func (s *Storage) put(ctx context.Context, data []byte, h http.Header) (string, error) {
+	if !s.leaseExpires.IsZero() {
+		if !time.Now().Before(s.leaseExpires) {
+			return "", ErrLeaseExpired
+		}
+		if h == nil {
+			h = http.Header{}
+		}
+		h.Set("X-Ms-Lease-Id", s.leaseID)
+	}
+	if s.encryptionKey != nil && len(data) > 0 {
+		var err error
+		if data, err = seal.Seal(s.encryptionKey, data, []byte(s.u.Path)); err != nil {
+			return "", err
+		}
+	}
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("X-Ms-Blob-Type", "BlockBlob")
+	_, res, err := s.do(ctx, http.MethodPut, nil, data, h)
+	var e *storageError
+	if errors.As(err, &e) && !s.leaseExpires.IsZero() && strings.HasPrefix(e.code, "Lease") {
+		s.logger.DebugContext(ctx, "not writing because the lease expired", slog.String("code", e.code))
+		return "", fmt.Errorf("%w: %s", ErrLeaseExpired, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	s.logger.DebugContext(ctx, "wrote blob", logging.Size(data))
+	return res.Get("ETag"), nil
+}
+
+// do sends an authorized request for the blob, returning the response body and headers. It returns a
+// *storageError when the Blob service responds with an error status.
+func (s *Storage) do(ctx context.Context, method string, q url.Values, body []byte, h http.Header) ([]byte, http.Header, error) {
+	u := *s.u
+	if q == nil {
+		q = url.Values{}
+	}
+	for k, v := range s.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) == 0 {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", apiVersion)
+	switch {
+	case s.sharedKey != nil:
+		s.sharedKey.sign(req)
+	case s.token != nil:
+		tk, err := s.token(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't get access token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tk)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		e := storageError{code: res.Header.Get("X-Ms-Error-Code"), status: res.StatusCode}
+		var x struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(b, &x) == nil {
+			if e.code == "" {
+				e.code = x.Code
+			}
+			e.message = x.Message
+		}
+		return nil, nil, &e
+	}
+	return b, res.Header, nil
+}
+
+// newLeaseID returns a random UUID, as the Blob service requires of lease IDs
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// storageError is an error response from the Blob service
+type storageError struct {
+	code, message string
+	status        int
+}
+
+func (e *storageError) Error() string {
+	msg := e.message
+	if msg == "" {
+		msg = http.StatusText(e.status)
+	}
+	if e.code != "" {
+		msg = e.code + ": " + msg
+	}
+	return fmt.Sprintf("Blob service responded %d: %s", e.status, msg)
+}
+
+// isStatus returns true when err is a *storageError having the given status
+func isStatus(err error, status int) bool {
+	var e *storageError
+	return errors.As(err, &e) && e.status == status
+}
+
+var (
+	_ accessor.Accessor  = (*Storage)(nil)
+	_ accessor.Locker    = (*Storage)(nil)
+	_ accessor.Versioned = (*Storage)(nil)
+)
@@ -0,0 +1,550 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package blob
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	msal "github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+const (
+	// account and accountKey are Azurite's well-known development credentials
+	account    = "devstoreaccount1"
+	accountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	sasToken   = "sv=2023-11-03&sp=rw&sig=signature"
+	token      = "access-token"
+)
+
+// fakeBlobService implements a subset of the Blob service's API: Get, Put and Delete Blob, and Lease
+// Blob's acquire and release actions. Like Azurite, it addresses blobs as /{account}/{container}/{blob}.
+// It accepts requests authorized with Shared Key, sasToken or token.
+type fakeBlobService struct {
+	blobs map[string]*fakeBlob
+	// etags counts the ETags the service has assigned
+	etags int
+	m     sync.Mutex
+	// onRequest, when set, is called with each authorized request before the service handles it
+	onRequest func(*http.Request)
+}
+
+type fakeBlob struct {
+	data, etag, leaseID string
+	leaseExpires        time.Time
+}
+
+func (b *fakeBlob) leased() bool {
+	return b.leaseID != "" && time.Now().Before(b.leaseExpires)
+}
+
+func newFakeBlobService(t *testing.T) (*fakeBlobService, *httptest.Server) {
+	f := &fakeBlobService{blobs: map[string]*fakeBlob{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeBlobService) locked(fn func()) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fn()
+}
+
+func (f *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fail := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("X-Ms-Error-Code", code)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s message</Message></Error>", code, code)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fail(http.StatusBadRequest, "InvalidInput")
+		return
+	}
+	if !f.authorized(r) {
+		fail(http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	if r.Header.Get("X-Ms-Version") != apiVersion {
+		fail(http.StatusBadRequest, "InvalidHeaderValue")
+		return
+	}
+	if f.onRequest != nil {
+		f.onRequest(r)
+	}
+	b, exists := f.blobs[r.URL.Path]
+	leaseID := r.Header.Get("X-Ms-Lease-Id")
+	checkLease := func() bool {
+		switch {
+		case exists && b.leased() && leaseID == "":
+			fail(http.StatusPreconditionFailed, "LeaseIdMissing")
+		case exists && b.leased() && leaseID != b.leaseID:
+			fail(http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation")
+		case (!exists || !b.leased()) && leaseID != "":
+			fail(http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation")
+		default:
+			return true
+		}
+		return false
+	}
+	f.etags++
+	etag := fmt.Sprintf(`"0x%X"`, f.etags)
+	switch {
+	case r.Method == http.MethodGet:
+		if !exists {
+			fail(http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.Header().Set("ETag", b.etag)
+		_, _ = w.Write([]byte(b.data))
+	case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "lease":
+		if !exists {
+			fail(http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		switch r.Header.Get("X-Ms-Lease-Action") {
+		case "acquire":
+			if b.leased() {
+				fail(http.StatusConflict, "LeaseAlreadyPresent")
+				return
+			}
+			d, err := strconv.Atoi(r.Header.Get("X-Ms-Lease-Duration"))
+			if err != nil || d < 15 || d > 60 {
+				fail(http.StatusBadRequest, "InvalidHeaderValue")
+				return
+			}
+			b.leaseID, b.leaseExpires = r.Header.Get("X-Ms-Proposed-Lease-Id"), time.Now().Add(time.Duration(d)*time.Second)
+			w.Header().Set("X-Ms-Lease-Id", b.leaseID)
+			w.WriteHeader(http.StatusCreated)
+		case "release":
+			if leaseID != b.leaseID {
+				fail(http.StatusConflict, "LeaseIdMismatchWithLeaseOperation")
+				return
+			}
+			b.leaseID = ""
+		default:
+			fail(http.StatusBadRequest, "InvalidHeaderValue")
+		}
+	case r.Method == http.MethodPut:
+		if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" || r.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			fail(http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+		// like the Blob service, check the lease before conditional headers
+		if !checkLease() {
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && (!exists || m != b.etag) {
+			fail(http.StatusPreconditionFailed, "ConditionNotMet")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			fail(http.StatusConflict, "BlobAlreadyExists")
+			return
+		}
+		if !exists {
+			b = &fakeBlob{}
+			f.blobs[r.URL.Path] = b
+		}
+		b.data, b.etag = string(body), etag
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		if !exists {
+			fail(http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if !checkLease() {
+			return
+		}
+		delete(f.blobs, r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		fail(http.StatusMethodNotAllowed, "UnsupportedHttpVerb")
+	}
+}
+
+// authorized returns true when the request has a valid Shared Key signature, SAS token or access token
+func (f *fakeBlobService) authorized(r *http.Request) bool {
+	q := r.URL.Query()
+	if q.Get("sig") != "" {
+		return q.Get("sig") == "signature" && q.Get("sp") == "rw"
+	}
+	auth := r.Header.Get("Authorization")
+	if auth == "Bearer "+token {
+		return true
+	}
+	if r.Header.Get("X-Ms-Date") == "" {
+		return false
+	}
+	key, _ := base64.StdEncoding.DecodeString(accountKey)
+	cp := r.Clone(context.Background())
+	cp.URL.Host = r.Host
+	cp.Header.Del("Authorization")
+	(&sharedKey{account: account, key: key}).sign(cp)
+	return auth != "" && auth == cp.Header.Get("Authorization")
+}
+
+func newTestStorage(t *testing.T, srv *httptest.Server, opts ...option) *Storage {
+	s, err := New(srv.URL+"/"+account+"/container", "dir/msal.json", append([]option{WithSharedKey(account, accountKey)}, opts...)...)
+	require.NoError(t, err)
+	return s
+}
+
+func TestStringToSign(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPut, "https://account.blob.core.windows.net/container/a%20b?comp=lease&Timeout=30", strings.NewReader("data"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("If-Match", `"0x1"`)
+	req.Header.Set("X-Ms-Version", apiVersion)
+	req.Header.Set("X-Ms-Date", "Fri, 26 Jun 2015 23:39:12 GMT")
+	req.Header.Set("X-Ms-Lease-Action", "  acquire  ")
+	k := sharedKey{account: "account", key: []byte("key")}
+	expected := strings.Join([]string{
+		"PUT", "", "", "4", "", "application/octet-stream", "", "", `"0x1"`, "", "", "",
+		"x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT",
+		"x-ms-lease-action:acquire",
+		"x-ms-version:" + apiVersion,
+		"/account/container/a%20b",
+		"comp:lease",
+		"timeout:30",
+	}, "\n")
+	require.Equal(t, expected, k.stringToSign(req))
+
+	req, err = http.NewRequest(http.MethodGet, "https://account.blob.core.windows.net/container/blob", nil)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(k.stringToSign(req), "GET\n\n\n\n"), "empty Content-Length should be empty")
+	k.sign(req)
+	require.True(t, strings.HasPrefix(req.Header.Get("Authorization"), "SharedKey account:"))
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	f, srv := newFakeBlobService(t)
+	s := newTestStorage(t, srv)
+
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.NoError(t, s.Delete(ctx))
+
+	expected := []byte(`{"key":"value"}`)
+	require.NoError(t, s.Write(ctx, expected))
+	f.locked(func() { require.Equal(t, string(expected), f.blobs["/"+account+"/container/dir/msal.json"].data) })
+	data, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+
+	require.NoError(t, s.Delete(ctx))
+	f.locked(func() { require.Empty(t, f.blobs) })
+	data, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	s, err = New(srv.URL+"/"+account+"/container", "blob", WithSharedKey(account, base64.StdEncoding.EncodeToString([]byte("wrong"))))
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorContains(t, err, "AuthenticationFailed")
+}
+
+func TestAuthorization(t *testing.T) {
+	_, srv := newFakeBlobService(t)
+	container := srv.URL + "/" + account + "/container"
+	for _, test := range []struct {
+		desc, url string
+		opts      []option
+	}{
+		{desc: "SAS in URL", url: container + "?" + sasToken},
+		{desc: "SAS", url: container, opts: []option{WithSAS("?" + sasToken)}},
+		{desc: "token", url: container, opts: []option{WithTokenProvider(func(context.Context) (string, error) { return token, nil })}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			s, err := New(test.url, "blob", test.opts...)
+			require.NoError(t, err)
+			require.NoError(t, s.Write(ctx, []byte(test.desc)))
+			require.NoError(t, s.Lock(ctx))
+			data, err := s.Read(ctx)
+			require.NoError(t, err)
+			require.Equal(t, test.desc, string(data))
+			require.NoError(t, s.Unlock(ctx))
+		})
+	}
+
+	expected := errors.New("it didn't work")
+	s, err := New(container, "blob", WithTokenProvider(func(context.Context) (string, error) { return "", expected }))
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorIs(t, err, expected)
+}
+
+func TestWriteIf(t *testing.T) {
+	_, srv := newFakeBlobService(t)
+	s := newTestStorage(t, srv)
+
+	data, version, err := s.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Empty(t, version)
+
+	v1, err := s.WriteIf(ctx, []byte("1"), "")
+	require.NoError(t, err)
+	require.NotEmpty(t, v1)
+	_, err = s.WriteIf(ctx, []byte("x"), "")
+	require.ErrorIs(t, err, accessor.ErrVersionConflict, "blob exists")
+
+	v2, err := s.WriteIf(ctx, []byte("2"), v1)
+	require.NoError(t, err)
+	require.NotEqual(t, v1, v2)
+	_, err = s.WriteIf(ctx, []byte("x"), v1)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict, "stale ETag")
+
+	data, version, err = s.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "2", string(data))
+	require.Equal(t, v2, version)
+
+	require.NoError(t, s.Delete(ctx))
+	_, err = s.WriteIf(ctx, []byte("x"), v2)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict, "blob doesn't exist")
+}
+
+func TestLease(t *testing.T) {
+	f, srv := newFakeBlobService(t)
+	a, b := newTestStorage(t, srv), newTestStorage(t, srv)
+	p := "/" + account + "/container/dir/msal.json"
+
+	require.NoError(t, a.Lock(ctx))
+	require.Error(t, a.Lock(ctx), "Storage already holds the lease")
+	f.locked(func() {
+		require.Contains(t, f.blobs, p, "Lock should create the blob")
+		require.True(t, f.blobs[p].leased())
+	})
+	data, err := a.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data, "the blob Lock creates should have no data")
+
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, b.Lock(short), context.DeadlineExceeded)
+	require.ErrorContains(t, b.Write(ctx, []byte("b")), "LeaseIdMissing")
+
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	data, err = b.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(data))
+	require.NoError(t, a.Delete(ctx))
+	data, err = b.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.NoError(t, a.Unlock(ctx))
+	require.Error(t, a.Unlock(ctx), "Storage doesn't hold the lease")
+
+	require.NoError(t, b.Lock(ctx))
+	require.NoError(t, b.Write(ctx, []byte("b")))
+	// the lease expires and another client acquires one
+	f.locked(func() { f.blobs[p].leaseExpires = time.Now() })
+	require.NoError(t, a.Lock(ctx))
+	require.ErrorIs(t, b.Write(ctx, []byte("x")), ErrLeaseExpired)
+	require.ErrorIs(t, b.Unlock(ctx), ErrLeaseExpired)
+
+	// Storage shouldn't write after its lease may have expired
+	a.leaseExpires = time.Now()
+	require.ErrorIs(t, a.Write(ctx, []byte("x")), ErrLeaseExpired)
+	data, err = a.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "b", string(data))
+	require.NoError(t, a.Unlock(ctx))
+}
+
+func TestConcurrentLock(t *testing.T) {
+	t.Run("interleaved", func(t *testing.T) {
+		f, srv := newFakeBlobService(t)
+		s := newTestStorage(t, srv)
+		// another client creates and leases the blob between s's lease attempt and its creating the blob
+		f.onRequest = func(r *http.Request) {
+			if r.Header.Get("If-None-Match") == "*" && len(f.blobs) == 0 {
+				f.blobs[r.URL.Path] = &fakeBlob{leaseID: "other", leaseExpires: time.Now().Add(100 * time.Millisecond)}
+			}
+		}
+		require.NoError(t, s.Lock(ctx), "Lock should wait for the other client's lease to expire")
+		require.NoError(t, s.Unlock(ctx))
+	})
+	t.Run("first time", func(t *testing.T) {
+		_, srv := newFakeBlobService(t)
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < cap(errs); i++ {
+			s := newTestStorage(t, srv)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := s.Lock(ctx)
+				if err == nil {
+					err = s.Unlock(ctx)
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestEncryption(t *testing.T) {
+	f, srv := newFakeBlobService(t)
+	key := bytes.Repeat([]byte{1}, 32)
+	s := newTestStorage(t, srv, WithEncryptionKey(key))
+
+	expected := []byte(`{"secret":"token"}`)
+	require.NoError(t, s.Write(ctx, expected))
+	f.locked(func() {
+		for _, b := range f.blobs {
+			require.NotContains(t, b.data, "token")
+		}
+	})
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+
+	_, err = newTestStorage(t, srv, WithEncryptionKey(bytes.Repeat([]byte{2}, 32))).Read(ctx)
+	require.Error(t, err, "wrong key")
+}
+
+func TestCache(t *testing.T) {
+	for _, optimistic := range []bool{false, true} {
+		name := "lease"
+		if optimistic {
+			name = "optimistic"
+		}
+		t.Run(name, func(t *testing.T) {
+			f, srv := newFakeBlobService(t)
+			dir := t.TempDir()
+			var caches []*cache.Cache
+			for i := 0; i < 3; i++ {
+				s := newTestStorage(t, srv, WithEncryptionKey(bytes.Repeat([]byte{1}, 32)))
+				mode := cache.WithLockTimeout(time.Minute)
+				if optimistic {
+					mode = cache.WithOptimisticConcurrency()
+				}
+				c, err := cache.New(s, filepath.Join(dir, strconv.Itoa(i)), cache.WithTimestampMode(cache.TimestampDisabled), mode)
+				require.NoError(t, err)
+				caches = append(caches, c)
+			}
+
+			var wg sync.WaitGroup
+			for i, c := range caches {
+				wg.Add(1)
+				go func(i int, c *cache.Cache) {
+					defer wg.Done()
+					for j := 0; j < 5 && !t.Failed(); j++ {
+						m := fakeMarshaler{}
+						err := c.Replace(ctx, &m, msal.ReplaceHints{})
+						if err == nil {
+							// add an entry, as MSAL would after acquiring a token
+							at := map[string]map[string]any{"AccessToken": {}}
+							if len(m.data) > 0 {
+								err = json.Unmarshal(m.data, &at)
+							}
+							if err == nil {
+								at["AccessToken"][fmt.Sprintf("%d-%d", i, j)] = map[string]any{}
+								m.data, _ = json.Marshal(at)
+								err = c.Export(ctx, &m, msal.ExportHints{})
+							}
+						}
+						if err != nil {
+							t.Errorf("%d: %s", i, err)
+						}
+					}
+				}(i, c)
+			}
+			wg.Wait()
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, entries, "Cache shouldn't create a lock file")
+			f.locked(func() {
+				for _, b := range f.blobs {
+					require.False(t, b.leased(), "Cache should release the lease")
+				}
+			})
+			m := fakeMarshaler{}
+			require.NoError(t, caches[0].Replace(ctx, &m, msal.ReplaceHints{}))
+			var actual map[string]map[string]any
+			require.NoError(t, json.Unmarshal(m.data, &actual))
+			require.NotEmpty(t, actual["AccessToken"])
+			if optimistic {
+				require.Len(t, actual["AccessToken"], 15, "Export should have merged concurrent writes")
+			}
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	container := "https://account.blob.core.windows.net/container"
+	sk := WithSharedKey(account, accountKey)
+	for _, test := range []struct {
+		desc, url, name string
+		opts            []option
+	}{
+		{desc: "invalid URL", url: "account.blob.core.windows.net", name: "blob", opts: []option{sk}},
+		{desc: "no container", url: "https://account.blob.core.windows.net/", name: "blob", opts: []option{sk}},
+		{desc: "empty name", url: container, opts: []option{sk}},
+		{desc: "directory name", url: container, name: "dir/", opts: []option{sk}},
+		{desc: "no authorization", url: container, name: "blob"},
+		{desc: "two authorizations", url: container, name: "blob", opts: []option{sk, WithSAS(sasToken)}},
+		{desc: "SAS in URL and shared key", url: container + "?" + sasToken, name: "blob", opts: []option{sk}},
+		{desc: "invalid shared key", url: container, name: "blob", opts: []option{WithSharedKey(account, "not base64")}},
+		{desc: "empty account", url: container, name: "blob", opts: []option{WithSharedKey("", accountKey)}},
+		{desc: "empty SAS", url: container, name: "blob", opts: []option{WithSAS("")}},
+		{desc: "nil token provider", url: container, name: "blob", opts: []option{WithTokenProvider(nil)}},
+		{desc: "short lease", url: container, name: "blob", opts: []option{sk, WithLeaseDuration(time.Second)}},
+		{desc: "long lease", url: container, name: "blob", opts: []option{sk, WithLeaseDuration(2 * time.Minute)}},
+		{desc: "short encryption key", url: container, name: "blob", opts: []option{sk, WithEncryptionKey(make([]byte, 16))}},
+		{desc: "nil client", url: container, name: "blob", opts: []option{sk, WithHTTPClient(nil)}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(test.url, test.name, test.opts...)
+			require.Error(t, err)
+		})
+	}
+}
+
+// fakeMarshaler implements MSAL's cache.Marshaler and cache.Unmarshaler
+type fakeMarshaler struct {
+	data []byte
+}
+
+func (f *fakeMarshaler) Marshal() ([]byte, error) {
+	return f.data, nil
+}
+
+func (f *fakeMarshaler) Unmarshal(b []byte) error {
+	f.data = b
+	return nil
+}
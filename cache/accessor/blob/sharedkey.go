@@ -0,0 +1,79 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sharedKey authorizes requests with a storage account's access key
+type sharedKey struct {
+	account string
+	key     []byte
+}
+
+// sign adds Shared Key authorization to a request having an x-ms-date header
+func (k *sharedKey) sign(req *http.Request) {
+	h := hmac.New(sha256.New, k.key)
+	h.Write([]byte(k.stringToSign(req)))
+	req.Header.Set("Authorization", "SharedKey "+k.account+":"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// stringToSign returns the string Shared Key signs for a request, as specified at
+// https://learn.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (k *sharedKey) stringToSign(req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	lines := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		// Date is empty because requests have x-ms-date
+		"",
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	var names []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, name+":"+strings.Join(strings.Fields(req.Header.Get(name)), " "))
+	}
+
+	resource := "/" + k.account + req.URL.EscapedPath()
+	q := map[string][]string{}
+	for name, values := range req.URL.Query() {
+		name = strings.ToLower(name)
+		q[name] = append(q[name], values...)
+	}
+	params := make([]string, 0, len(q))
+	for name := range q {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		sort.Strings(q[name])
+		resource += "\n" + name + ":" + strings.Join(q[name], ",")
+	}
+	return strings.Join(append(lines, resource), "\n")
+}
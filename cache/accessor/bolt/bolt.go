@@ -0,0 +1,387 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package bolt stores many caches in one local bbolt database, for example one cache per profile of a
+// CLI tool. Each Storage accesses the entry having a given name. Writes are transactional, and each
+// entry has a version which increases with every write. bbolt's file lock on the database coordinates
+// processes, so Storage implements [accessor.Locker] and Cache doesn't need a lock file. Storage also
+// implements [accessor.Versioned] and [accessor.VersionReader], so Cache can instead write optimistically.
+// Only in that mode, with the timestamp file disabled, does Cache create no files beside the database and
+// detect changes by the entry's version, reading the entry only when its version changed:
+//
+//	s, err := bolt.New(filepath.Join(dir, "msal.db"), profile)
+//	// TODO: handle error
+//	c, err := cache.New(s, filepath.Join(dir, profile), cache.WithOptimisticConcurrency(), cache.WithTimestampMode(cache.TimestampDisabled))
+//
+// By default, Cache instead locks the database and, as with other accessors, detects changes with a
+// timestamp file beside it, at the path passed to cache.New. A process holds bbolt's file lock only while
+// accessing the database, or from Lock to Unlock, so that other processes can access the database in the
+// meantime.
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+	"go.etcd.io/bbolt"
+)
+
+const defaultTimeout = 5 * time.Second
+
+var (
+	// dataBucket maps entry names to data
+	dataBucket = []byte("data")
+	// versionBucket maps entry names to versions, which are big endian uint64s. Deleting an entry's
+	// data doesn't delete its version, so a version is never reused.
+	versionBucket = []byte("version")
+)
+
+// databases maps database paths to semaphores serializing this process's access to them. bbolt's
+// file lock can't do so because a process can't open a database more than once.
+var (
+	databases  = map[string]chan struct{}{}
+	databasesM sync.Mutex
+)
+
+type option func(*Storage) error
+
+// WithLogger sets a Logger to receive debug records about database operations. These records never
+// include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithTimeout sets how long Storage waits for another process to release the database when the
+// context has no deadline. The default is 5 seconds.
+func WithTimeout(d time.Duration) option {
+	return func(s *Storage) error {
+		if d <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		s.timeout = d
+		return nil
+	}
+}
+
+// Storage stores data in an entry of a bbolt database.
+type Storage struct {
+	// db is the open database while Storage holds the lock, and otherwise nil
+	db     *bbolt.DB
+	logger *slog.Logger
+	m      *sync.Mutex
+	name   []byte
+	p      string
+	// sem serializes this process's access to the database
+	sem     chan struct{}
+	timeout time.Duration
+}
+
+// New is the constructor for Storage. "p" is the path of the database, which Storage creates when
+// necessary, and "name" is the name of the entry in which Storage stores data.
+func New(p, name string, opts ...option) (*Storage, error) {
+	if name == "" {
+		return nil, errors.New("name can't be empty")
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	s := Storage{m: &sync.Mutex{}, name: []byte(name), p: abs, timeout: defaultTimeout}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	databasesM.Lock()
+	defer databasesM.Unlock()
+	if s.sem = databases[abs]; s.sem == nil {
+		s.sem = make(chan struct{}, 1)
+		databases[abs] = s.sem
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("path", abs), slog.String("name", name))
+	return &s, nil
+}
+
+// Delete deletes the entry's data, if it exists.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, err := os.Stat(s.p); errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "nothing to delete because the database doesn't exist")
+		return nil
+	}
+	return s.update(ctx, func(tx *bbolt.Tx) error {
+		b := tx.Bucket(dataBucket)
+		if b == nil || b.Get(s.name) == nil {
+			s.logger.DebugContext(ctx, "nothing to delete because the entry doesn't exist")
+			return nil
+		}
+		if err := b.Delete(s.name); err != nil {
+			return err
+		}
+		_, err := s.increment(tx)
+		return err
+	})
+}
+
+// Read returns the entry's data or, if the entry doesn't exist, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	data, _, err := s.ReadVersion(ctx)
+	return data, err
+}
+
+// ReadVersion returns the entry's data and version. When the entry has no data, it returns a nil
+// slice and a version WriteIf accepts.
+func (s *Storage) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var (
+		data []byte
+		v    uint64
+	)
+	err := s.view(ctx, func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(dataBucket); b != nil {
+			if d := b.Get(s.name); d != nil {
+				// bbolt's slices are valid only during the transaction
+				data = append([]byte{}, d...)
+			}
+		}
+		v = s.version(tx)
+		return nil
+	})
+	if err == nil && data == nil {
+		s.logger.DebugContext(ctx, "returning no data because the entry doesn't exist")
+	}
+	return data, formatVersion(v), err
+}
+
+// Version returns the entry's version, as ReadVersion does, without reading the entry's data.
+func (s *Storage) Version(ctx context.Context) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var v uint64
+	err := s.view(ctx, func(tx *bbolt.Tx) error {
+		v = s.version(tx)
+		return nil
+	})
+	return formatVersion(v), err
+}
+
+// Write stores data in the entry, creating the database and entry if necessary.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.update(ctx, func(tx *bbolt.Tx) error {
+		return s.put(tx, data)
+	})
+}
+
+// WriteIf stores data in the entry when the entry's version is "version" or, when version is empty,
+// when the entry has no data. It returns the new version.
+func (s *Storage) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var v uint64
+	err := s.update(ctx, func(tx *bbolt.Tx) error {
+		current := formatVersion(s.version(tx))
+		if version != current && (version != "" || s.exists(tx)) {
+			s.logger.DebugContext(ctx, "not writing because the entry changed", slog.String("version", current))
+			return fmt.Errorf("%w: expected version %q, found %q", accessor.ErrVersionConflict, version, current)
+		}
+		if err := s.put(tx, data); err != nil {
+			return err
+		}
+		v = s.version(tx)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatVersion(v), nil
+}
+
+// Lock opens the database, taking bbolt's exclusive file lock, and keeps it open until Unlock. Storage
+// uses the open database in the meantime.
+func (s *Storage) Lock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.db != nil {
+		return errors.New("Storage already holds the lock")
+	}
+	db, err := s.open(ctx, false)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	s.logger.DebugContext(ctx, "acquired lock")
+	return nil
+}
+
+// Unlock closes the database, releasing the lock.
+func (s *Storage) Unlock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.db == nil {
+		return errors.New("Storage doesn't hold the lock")
+	}
+	err := s.close(s.db)
+	s.db = nil
+	s.logger.DebugContext(ctx, "released lock")
+	return err
+}
+
+// exists returns true when the entry has data
+func (s *Storage) exists(tx *bbolt.Tx) bool {
+	b := tx.Bucket(dataBucket)
+	return b != nil && b.Get(s.name) != nil
+}
+
+// increment increments the entry's version, returning the new version
+func (s *Storage) increment(tx *bbolt.Tx) (uint64, error) {
+	b, err := tx.CreateBucketIfNotExists(versionBucket)
+	if err != nil {
+		return 0, err
+	}
+	v := s.version(tx) + 1
+	return v, b.Put(s.name, binary.BigEndian.AppendUint64(nil, v))
+}
+
+// put stores data in the entry and increments its version
+func (s *Storage) put(tx *bbolt.Tx, data []byte) error {
+	b, err := tx.CreateBucketIfNotExists(dataBucket)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		// bbolt doesn't store nil values
+		data = []byte{}
+	}
+	if err = b.Put(s.name, data); err == nil {
+		_, err = s.increment(tx)
+	}
+	return err
+}
+
+// version returns the entry's version, which is 0 when the entry has never had data
+func (s *Storage) version(tx *bbolt.Tx) uint64 {
+	if b := tx.Bucket(versionBucket); b != nil {
+		if v := b.Get(s.name); len(v) == 8 {
+			return binary.BigEndian.Uint64(v)
+		}
+	}
+	return 0
+}
+
+// view runs fn in a read-only transaction. Callers must hold s.m.
+func (s *Storage) view(ctx context.Context, fn func(*bbolt.Tx) error) error {
+	if s.db != nil {
+		return s.db.View(fn)
+	}
+	db, err := s.open(ctx, true)
+	if errors.Is(err, os.ErrNotExist) {
+		// there's no database, so there's no data
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = db.View(fn); err != nil {
+		s.close(db)
+		return err
+	}
+	return s.close(db)
+}
+
+// update runs fn in a read-write transaction. Callers must hold s.m.
+func (s *Storage) update(ctx context.Context, fn func(*bbolt.Tx) error) error {
+	if s.db != nil {
+		return s.db.Update(fn)
+	}
+	db, err := s.open(ctx, false)
+	if err != nil {
+		return err
+	}
+	if err = db.Update(fn); err != nil {
+		s.close(db)
+		return err
+	}
+	return s.close(db)
+}
+
+// open opens the database, waiting for this process's other Storages and then for other processes
+// to release it. A read-only database has a shared lock and fails when the database doesn't exist.
+// Callers must close the database with s.close.
+func (s *Storage) open(ctx context.Context, readOnly bool) (*bbolt.DB, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	db, err := s.openFile(ctx, readOnly)
+	if err != nil {
+		<-s.sem
+	}
+	return db, err
+}
+
+// openFile opens the database file. Callers must hold s.sem.
+func (s *Storage) openFile(ctx context.Context, readOnly bool) (*bbolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(s.p); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(filepath.Dir(s.p), 0700); err != nil {
+		return nil, err
+	}
+	// bbolt polls for the file lock until its timeout, which therefore mustn't exceed the context's deadline
+	deadline, _ := ctx.Deadline()
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	db, err := bbolt.Open(s.p, 0600, &bbolt.Options{ReadOnly: readOnly, Timeout: timeout})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		s.logger.DebugContext(ctx, "timed out waiting for another process to release the database")
+		err = fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+	}
+	return db, err
+}
+
+// close closes a database opened by open
+func (s *Storage) close(db *bbolt.DB) error {
+	defer func() { <-s.sem }()
+	return db.Close()
+}
+
+// formatVersion returns the string form of a version. Version 0 means the entry has never had data.
+func formatVersion(v uint64) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+var (
+	_ accessor.Accessor      = (*Storage)(nil)
+	_ accessor.Locker        = (*Storage)(nil)
+	_ accessor.Versioned     = (*Storage)(nil)
+	_ accessor.VersionReader = (*Storage)(nil)
+)
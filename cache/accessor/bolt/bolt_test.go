@@ -0,0 +1,241 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	msal "github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+var ctx = context.Background()
+
+func TestReadWriteDelete(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "dir", "msal.db")
+	s, err := New(p, "profile")
+	require.NoError(t, err)
+
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	require.NoError(t, s.Delete(ctx))
+	require.NoFileExists(t, p, "Read and Delete shouldn't create the database")
+
+	for _, expected := range [][]byte{[]byte(`{"expected":true}`), {0, 1, 2, 255}, {}} {
+		require.NoError(t, s.Write(ctx, expected))
+		actual, err = s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+
+	require.NoError(t, s.Delete(ctx))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+}
+
+func TestEntries(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "msal.db")
+	var storages []*Storage
+	for _, name := range []string{"a", "b", "c"} {
+		s, err := New(p, name)
+		require.NoError(t, err)
+		require.NoError(t, s.Write(ctx, []byte(name)))
+		storages = append(storages, s)
+	}
+	require.NoError(t, storages[1].Delete(ctx))
+	for i, expected := range []string{"a", "", "c"} {
+		actual, err := storages[i].Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(actual))
+	}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "all entries should be in one database")
+}
+
+func TestWriteIf(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "msal.db")
+	a, err := New(p, "profile")
+	require.NoError(t, err)
+	b, err := New(p, "profile")
+	require.NoError(t, err)
+
+	data, v, err := a.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Empty(t, v)
+	current, err := a.Version(ctx)
+	require.NoError(t, err)
+	require.Empty(t, current)
+
+	va, err := a.WriteIf(ctx, []byte("a"), v)
+	require.NoError(t, err)
+	require.Equal(t, "1", va)
+	_, err = b.WriteIf(ctx, []byte("b"), v)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict, "b should have to read a's write before writing")
+
+	data, v, err = b.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+	require.Equal(t, va, v)
+	vb, err := b.WriteIf(ctx, []byte("b"), v)
+	require.NoError(t, err)
+	require.Equal(t, "2", vb)
+
+	// an unconditional write changes the version
+	require.NoError(t, a.Write(ctx, []byte("c")))
+	_, err = b.WriteIf(ctx, []byte("b"), vb)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+
+	// deleting data changes the version too, and the new version or an empty one should match
+	require.NoError(t, a.Delete(ctx))
+	data, v, err = a.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Equal(t, "4", v)
+	current, err = b.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, v, current, "Version should return the version ReadVersion returns")
+	_, err = b.WriteIf(ctx, []byte("b"), "3")
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+	v, err = b.WriteIf(ctx, []byte("b"), "")
+	require.NoError(t, err)
+	require.Equal(t, "5", v, "versions shouldn't be reused")
+	require.NoError(t, a.Delete(ctx))
+	_, err = a.WriteIf(ctx, []byte("a"), "6")
+	require.NoError(t, err)
+}
+
+func TestLock(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "msal.db")
+	a, err := New(p, "a")
+	require.NoError(t, err)
+	b, err := New(p, "b", WithTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+
+	require.NoError(t, a.Lock(ctx))
+	require.Error(t, a.Lock(ctx), "Lock isn't reentrant")
+	// a can use the database while holding the lock
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	data, err := a.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+
+	// other Storages in this process should wait for a to release the database...
+	_, err = b.Read(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	// ...and so should other processes, which the database's file lock excludes
+	_, err = bbolt.Open(p, 0600, &bbolt.Options{Timeout: 50 * time.Millisecond})
+	require.ErrorIs(t, err, bbolt.ErrTimeout)
+
+	done := make(chan error)
+	go func() { done <- b.Write(ctx, []byte("b")) }()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, a.Unlock(ctx))
+	require.NoError(t, <-done, "b should write after a releases the lock")
+	require.Error(t, a.Unlock(ctx), "Storage doesn't hold the lock")
+
+	db, err := bbolt.Open(p, 0600, &bbolt.Options{Timeout: 50 * time.Millisecond})
+	require.NoError(t, err, "Storage should release the file lock")
+	require.NoError(t, db.Close())
+}
+
+func TestCache(t *testing.T) {
+	for _, optimistic := range []bool{false, true} {
+		name := "lock"
+		if optimistic {
+			name = "optimistic"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := filepath.Join(dir, "msal.db")
+			var caches []*cache.Cache
+			for _, profile := range []string{"a", "a", "b"} {
+				s, err := New(p, profile)
+				require.NoError(t, err)
+				mode := cache.WithLockTimeout(time.Minute)
+				if optimistic {
+					mode = cache.WithOptimisticConcurrency()
+				}
+				c, err := cache.New(s, filepath.Join(dir, profile), cache.WithTimestampMode(cache.TimestampDisabled), mode)
+				require.NoError(t, err)
+				caches = append(caches, c)
+			}
+
+			var wg sync.WaitGroup
+			for i, c := range caches {
+				wg.Add(1)
+				go func(i int, c *cache.Cache) {
+					defer wg.Done()
+					for j := 0; j < 10 && !t.Failed(); j++ {
+						m := fakeMarshaler{}
+						err := c.Replace(ctx, &m, msal.ReplaceHints{})
+						if err == nil {
+							// add an entry, as MSAL would after acquiring a token
+							at := map[string]map[string]any{"AccessToken": {}}
+							if len(m.data) > 0 {
+								err = json.Unmarshal(m.data, &at)
+							}
+							if err == nil {
+								at["AccessToken"][strconv.Itoa(i)] = map[string]any{}
+								m.data, _ = json.Marshal(at)
+								err = c.Export(ctx, &m, msal.ExportHints{})
+							}
+						}
+						if err != nil {
+							t.Errorf("%d: %s", i, err)
+						}
+					}
+				}(i, c)
+			}
+			wg.Wait()
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, entries, 1, "Cache shouldn't create files beside the database")
+			m := fakeMarshaler{}
+			require.NoError(t, caches[2].Replace(ctx, &m, msal.ReplaceHints{}))
+			require.JSONEq(t, `{"AccessToken":{"2":{}}}`, string(m.data))
+			if optimistic {
+				// Export should have merged the concurrent writes of profile a's Caches
+				require.NoError(t, caches[0].Replace(ctx, &m, msal.ReplaceHints{}))
+				require.JSONEq(t, `{"AccessToken":{"0":{},"1":{}}}`, string(m.data))
+			}
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	_, err := New("msal.db", "")
+	require.Error(t, err)
+	_, err = New("msal.db", "name", WithTimeout(0))
+	require.Error(t, err)
+}
+
+// fakeMarshaler implements MSAL's cache.Marshaler and cache.Unmarshaler
+type fakeMarshaler struct {
+	data []byte
+}
+
+func (f *fakeMarshaler) Marshal() ([]byte, error) {
+	return f.data, nil
+}
+
+func (f *fakeMarshaler) Unmarshal(b []byte) error {
+	f.data = b
+	return nil
+}
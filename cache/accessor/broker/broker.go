@@ -0,0 +1,217 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package broker stores data in a cache broker: a process, started with the msalcache-broker command,
+// that holds a cache in memory and serves it over a Unix domain socket to processes of the same user,
+// as ssh-agent serves keys. Sharing a cache through a broker keeps tokens off disk on systems having no
+// keyring. Storage implements [accessor.Locker] with the broker's lock, which Cache uses instead of a
+// file lock:
+//
+//	s, err := broker.New("")
+//	// TODO: handle error
+//	c, err := cache.New(s, p)
+//
+// The broker releases the lock when the client holding it disconnects, so a client that crashes while
+// holding the lock doesn't block others.
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/broker"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+// SocketEnv is the environment variable from which New gets the path of the broker's socket when
+// not given one. msalcache-broker prints a command setting this variable when it starts.
+const SocketEnv = "MSALCACHE_BROKER_SOCK"
+
+// ErrLockLost indicates Storage's connection to the broker closed while Storage held the lock. The
+// broker released the lock when the connection closed, so another client may have acquired it.
+var ErrLockLost = errors.New("lost the broker's lock because the connection closed")
+
+type option func(*Storage) error
+
+// WithLogger sets a Logger to receive debug records about broker operations. These records never
+// include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// Storage stores data in a cache broker.
+type Storage struct {
+	c *broker.Conn
+	// locked indicates whether Storage holds the lock
+	locked bool
+	logger *slog.Logger
+	// lost indicates whether Storage lost the lock after acquiring it. Storage doesn't write after
+	// losing the lock, and Unlock returns ErrLockLost.
+	lost   bool
+	m      *sync.Mutex
+	socket string
+}
+
+// New is the constructor for Storage. "socket" is the path of the broker's socket. When it's empty,
+// New gets the path from $MSALCACHE_BROKER_SOCK. Storage connects when it first needs to, and again
+// after an error.
+func New(socket string, opts ...option) (*Storage, error) {
+	if socket == "" {
+		if socket = os.Getenv(SocketEnv); socket == "" {
+			return nil, fmt.Errorf("no socket path. Specify one or set $%s", SocketEnv)
+		}
+	}
+	s := Storage{m: &sync.Mutex{}, socket: socket}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("socket", socket))
+	return &s, nil
+}
+
+// Close closes Storage's connection to the broker, releasing the lock if Storage holds it.
+func (s *Storage) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.c == nil {
+		return nil
+	}
+	err := s.c.Close()
+	s.c = nil
+	s.locked = false
+	return err
+}
+
+// Delete deletes the broker's data.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err := s.do(ctx, broker.Request{Op: broker.OpDelete})
+	return err
+}
+
+// Read returns the broker's data or, if it has none, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	res, err := s.do(ctx, broker.Request{Op: broker.OpRead})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Data) == 0 {
+		s.logger.DebugContext(ctx, "returning no data because the broker has none")
+		return nil, nil
+	}
+	return res.Data, nil
+}
+
+// Write stores data in the broker. When Storage lost the lock after acquiring it, Write returns
+// [ErrLockLost] instead of writing.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err := s.do(ctx, broker.Request{Data: data, Op: broker.OpWrite})
+	return err
+}
+
+// Lock acquires the broker's lock, waiting until it succeeds or the context is done.
+func (s *Storage) Lock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.locked || s.lost {
+		return errors.New("Storage already holds the lock")
+	}
+	if _, err := s.do(ctx, broker.Request{Op: broker.OpLock}); err != nil {
+		return err
+	}
+	s.locked = true
+	s.logger.DebugContext(ctx, "acquired lock")
+	return nil
+}
+
+// Unlock releases the broker's lock. It returns [ErrLockLost] when Storage's connection closed while
+// Storage held the lock.
+func (s *Storage) Unlock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.lost {
+		s.lost = false
+		return ErrLockLost
+	}
+	if !s.locked {
+		return errors.New("Storage doesn't hold the lock")
+	}
+	_, err := s.do(ctx, broker.Request{Op: broker.OpUnlock})
+	if errors.Is(err, ErrLockLost) {
+		s.lost = false
+	}
+	if err == nil {
+		s.locked = false
+		s.logger.DebugContext(ctx, "released lock")
+	}
+	return err
+}
+
+// do sends a request to the broker, connecting first if necessary, and returns the response. It closes
+// the connection after an I/O error, including one caused by the context ending, because the
+// connection's state is then unknown. Callers must hold s.m.
+func (s *Storage) do(ctx context.Context, req broker.Request) (broker.Response, error) {
+	if s.lost {
+		return broker.Response{}, ErrLockLost
+	}
+	if s.c == nil {
+		var d net.Dialer
+		nc, err := d.DialContext(ctx, "unix", s.socket)
+		if err != nil {
+			return broker.Response{}, fmt.Errorf("couldn't connect to the broker: %w", err)
+		}
+		s.c = broker.NewConn(nc)
+	}
+	c := s.c
+	// clear any deadline set when a previous context ended, then interrupt blocked I/O when this one ends
+	err := c.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() { _ = c.SetDeadline(time.Unix(1, 0)) })
+	req.V = broker.Version
+	res := broker.Response{}
+	if err == nil {
+		err = c.Send(req)
+	}
+	if err == nil {
+		err = c.Receive(&res)
+	}
+	stop()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		s.logger.DebugContext(ctx, "closing connection after an error", slog.Any("error", err))
+		s.c.Close()
+		s.c = nil
+		if s.locked {
+			s.locked, s.lost = false, true
+			return res, fmt.Errorf("%w: %s", ErrLockLost, err)
+		}
+		return res, err
+	}
+	if res.Error != "" {
+		return res, fmt.Errorf("broker error: %s", res.Error)
+	}
+	return res, nil
+}
+
+var (
+	_ accessor.Accessor = (*Storage)(nil)
+	_ accessor.Locker   = (*Storage)(nil)
+)
@@ -0,0 +1,225 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+//go:build darwin || linux
+// +build darwin linux
+
+package broker
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor/file"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/broker"
+	msal "github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// serve serves clients with a broker server and returns the path of its socket
+func serve(t *testing.T, srv *broker.Server) string {
+	// t.TempDir() may return a path too long for a socket
+	dir, err := os.MkdirTemp("", "broker")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	p := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", p)
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() {
+		ln.Close()
+		srv.Close()
+	})
+	return p
+}
+
+// startBroker starts a broker server having the default options and returns the path of its socket
+func startBroker(t *testing.T) string {
+	srv, err := broker.NewServer(ctx)
+	require.NoError(t, err)
+	return serve(t, srv)
+}
+
+func newTestStorage(t *testing.T, socket string) *Storage {
+	s, err := New(socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	p := startBroker(t)
+	a, b := newTestStorage(t, p), newTestStorage(t, p)
+
+	data, err := a.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.NoError(t, a.Delete(ctx))
+
+	expected := []byte(`{"key":"value"}`)
+	require.NoError(t, a.Write(ctx, expected))
+	data, err = b.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+
+	require.NoError(t, b.Delete(ctx))
+	data, err = a.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	// Storage should reconnect after the connection closes
+	require.NoError(t, a.Write(ctx, expected))
+	require.NoError(t, a.Close())
+	data, err = a.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+}
+
+func TestLock(t *testing.T) {
+	p := startBroker(t)
+	a, b := newTestStorage(t, p), newTestStorage(t, p)
+
+	require.NoError(t, a.Lock(ctx))
+	require.Error(t, a.Lock(ctx), "Storage already holds the lock")
+
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, b.Lock(short), context.DeadlineExceeded)
+
+	// the broker should release the lock when its holder disconnects
+	acquired := make(chan error, 1)
+	go func() { acquired <- b.Lock(ctx) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired the lock while another client held it (error %v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, a.Close())
+	select {
+	case err := <-acquired:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the broker didn't release the lock after its holder disconnected")
+	}
+	require.NoError(t, b.Unlock(ctx))
+	require.Error(t, b.Unlock(ctx), "Storage doesn't hold the lock")
+}
+
+func TestLockLost(t *testing.T) {
+	p := startBroker(t)
+	a, b := newTestStorage(t, p), newTestStorage(t, p)
+
+	require.NoError(t, a.Lock(ctx))
+	// break a's connection without a knowing
+	a.m.Lock()
+	a.c.Conn.Close()
+	a.m.Unlock()
+	require.NoError(t, b.Lock(ctx))
+
+	require.ErrorIs(t, a.Write(ctx, []byte("a")), ErrLockLost)
+	require.ErrorIs(t, a.Write(ctx, []byte("a")), ErrLockLost, "Storage shouldn't write after losing the lock")
+	require.ErrorIs(t, a.Unlock(ctx), ErrLockLost)
+
+	require.NoError(t, b.Write(ctx, []byte("b")))
+	require.NoError(t, b.Unlock(ctx))
+	require.NoError(t, a.Lock(ctx))
+	data, err := a.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "b", string(data))
+	require.NoError(t, a.Unlock(ctx))
+}
+
+func TestPersistence(t *testing.T) {
+	f, err := file.New(filepath.Join(t.TempDir(), "cache"))
+	require.NoError(t, err)
+	require.NoError(t, f.Write(ctx, []byte("persisted")))
+
+	srv, err := broker.NewServer(ctx, broker.WithPersistence(f))
+	require.NoError(t, err)
+	p := serve(t, srv)
+	s := newTestStorage(t, p)
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "persisted", string(data))
+
+	require.NoError(t, s.Write(ctx, []byte("written")))
+	data, err = f.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "written", string(data))
+
+	require.NoError(t, s.Delete(ctx))
+	data, err = f.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+}
+
+func TestCache(t *testing.T) {
+	p := startBroker(t)
+	dir := t.TempDir()
+	var caches []*cache.Cache
+	for i := 0; i < 3; i++ {
+		c, err := cache.New(newTestStorage(t, p), filepath.Join(dir, strconv.Itoa(i)))
+		require.NoError(t, err)
+		caches = append(caches, c)
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range caches {
+		wg.Add(1)
+		go func(i int, c *cache.Cache) {
+			defer wg.Done()
+			for j := 0; j < 5 && !t.Failed(); j++ {
+				if err := c.Export(ctx, &fakeMarshaler{data: []byte(strconv.Itoa(i))}, msal.ExportHints{}); err != nil {
+					t.Errorf("%d: %s", i, err)
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	for i := range caches {
+		require.NoFileExists(t, filepath.Join(dir, strconv.Itoa(i)+".lockfile"), "Cache should use the broker's lock")
+	}
+
+	m := fakeMarshaler{}
+	require.NoError(t, caches[0].Replace(ctx, &m, msal.ReplaceHints{}))
+	require.Contains(t, []string{"0", "1", "2"}, string(m.data))
+}
+
+func TestOptions(t *testing.T) {
+	t.Setenv(SocketEnv, "")
+	_, err := New("")
+	require.Error(t, err)
+
+	t.Setenv(SocketEnv, "/run/broker.sock")
+	s, err := New("")
+	require.NoError(t, err)
+	require.Equal(t, "/run/broker.sock", s.socket)
+
+	s, err = New(filepath.Join(t.TempDir(), "missing"))
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.Error(t, err)
+}
+
+// fakeMarshaler implements MSAL's cache.Marshaler and cache.Unmarshaler
+type fakeMarshaler struct {
+	data []byte
+}
+
+func (f *fakeMarshaler) Marshal() ([]byte, error) {
+	return f.data, nil
+}
+
+func (f *fakeMarshaler) Unmarshal(b []byte) error {
+	f.data = b
+	return nil
+}
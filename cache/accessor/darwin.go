@@ -9,7 +9,11 @@ package accessor
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
 
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/compat"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
 	"github.com/keybase/go-keychain"
 )
 
@@ -23,10 +27,36 @@ func WithAccount(name string) option {
 	}
 }
 
+// WithCompatibility declares that Storage shares a cache with applications using the MSAL extension library
+// "p" identifies. All the libraries store the cache's JSON as a generic password identified by service and
+// account names, so Storage's behavior doesn't depend on the profile. Pass the other application's service
+// and account names to New and [WithAccount].
+func WithCompatibility(p compat.Profile) option {
+	return func(s *Storage) error {
+		switch p {
+		case compat.Go, compat.DotNet, compat.Python:
+			return nil
+		default:
+			return fmt.Errorf("unknown compatibility profile %d", p)
+		}
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about keychain operations. These records
+// never include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
 // Storage stores data as a password on the macOS keychain. The keychain must be unlocked before Storage can read
 // or write data. macOS may not allow keychain access from a headless environment such as an SSH session.
 type Storage struct {
 	account, service string
+	// logger receives debug records. It must never receive stored data.
+	logger *slog.Logger
 }
 
 // New is the constructor for Storage. "servName" is the service name for the keychain item holding cached data.
@@ -40,29 +70,34 @@ func New(servName string, opts ...option) (*Storage, error) {
 			return nil, err
 		}
 	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("service", servName))
 	return &s, nil
 }
 
 // Delete deletes the stored data, if any exists.
-func (s *Storage) Delete(context.Context) error {
+func (s *Storage) Delete(ctx context.Context) error {
 	err := keychain.DeleteGenericPasswordItem(s.service, s.account)
 	if errors.Is(err, keychain.ErrorItemNotFound) || errors.Is(err, keychain.ErrorNoSuchKeychain) {
+		s.logger.DebugContext(ctx, "nothing to delete because the keychain item doesn't exist", slog.Any("error", err))
 		return nil
 	}
 	return err
 }
 
 // Read returns data stored on the keychain or, if the keychain item doesn't exist, a nil slice and nil error.
-func (s *Storage) Read(context.Context) ([]byte, error) {
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
 	data, err := keychain.GetGenericPassword(s.service, s.account, "", "")
 	if err != nil {
 		return nil, err
 	}
+	if data == nil {
+		s.logger.DebugContext(ctx, "returning no data because the keychain item doesn't exist")
+	}
 	return data, nil
 }
 
 // Write stores data on the keychain.
-func (s *Storage) Write(_ context.Context, data []byte) error {
+func (s *Storage) Write(ctx context.Context, data []byte) error {
 	pw, err := keychain.GetGenericPassword(s.service, s.account, "", "")
 	if err != nil {
 		return err
@@ -70,6 +105,7 @@ func (s *Storage) Write(_ context.Context, data []byte) error {
 	item := keychain.NewGenericPassword(s.service, s.account, "", nil, "")
 	if pw == nil {
 		// password not found: add it to the keychain
+		s.logger.DebugContext(ctx, "adding keychain item")
 		item.SetData(data)
 		err = keychain.AddItem(item)
 	} else {
@@ -5,53 +5,134 @@ package file
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/lock"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
 )
 
 // Storage stores data in an unencrypted file.
 type Storage struct {
-	m *sync.RWMutex
-	p string
+	logger *slog.Logger
+	m      *sync.RWMutex
+	p      string
+}
+
+type option func(*Storage) error
+
+// WithLogger sets a Logger to receive debug records about file operations. These records never
+// include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
 }
 
 // New is the constructor for Storage. "p" is the path to the file in which to store data.
-func New(p string) (*Storage, error) {
-	return &Storage{m: &sync.RWMutex{}, p: p}, nil
+func New(p string, opts ...option) (*Storage, error) {
+	s := Storage{m: &sync.RWMutex{}, p: p}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("path", p))
+	return &s, nil
 }
 
 // Delete deletes the file, if it exists.
-func (s *Storage) Delete(context.Context) error {
+func (s *Storage) Delete(ctx context.Context) error {
 	s.m.Lock()
 	defer s.m.Unlock()
 	err := os.Remove(s.p)
 	if errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "nothing to delete because the file doesn't exist")
 		return nil
 	}
 	return err
 }
 
 // Read returns the file's content or, if the file doesn't exist, a nil slice and error.
-func (s *Storage) Read(context.Context) ([]byte, error) {
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
 	s.m.RLock()
 	defer s.m.RUnlock()
 	b, err := os.ReadFile(s.p)
 	if errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "returning no data because the file doesn't exist")
 		return nil, nil
 	}
 	return b, err
 }
 
+// ReadVersion returns the file's content and version or, if the file doesn't exist, a nil slice and an
+// empty version. The version is a hash of the content.
+func (s *Storage) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	b, v, err := s.readVersion()
+	if err == nil && b == nil {
+		s.logger.DebugContext(ctx, "returning no data because the file doesn't exist")
+	}
+	return b, v, err
+}
+
+// WriteIf stores data in the file when the file's version is "version". An empty version means the file
+// shouldn't exist. To prevent another process changing the file between the comparison and the write,
+// WriteIf holds a lock on a file whose path is the file's path with ".lock" appended, and it replaces the
+// file by renaming a temporary file. Other processes writing the file should therefore also use WriteIf.
+func (s *Storage) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	l, err := lock.New(s.p+".lock", lock.WithLogger(s.logger), lock.WithPerm(0700, 0600))
+	if err != nil {
+		return "", err
+	}
+	if err = l.Lock(ctx); err != nil {
+		return "", err
+	}
+	defer l.Unlock()
+	_, current, err := s.readVersion()
+	if err != nil {
+		return "", err
+	}
+	if current != version {
+		s.logger.DebugContext(ctx, "not writing because the file changed", slog.String("version", current))
+		return "", fmt.Errorf("%w: expected version %q, found %q", accessor.ErrVersionConflict, version, current)
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.p), filepath.Base(s.p)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.p)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return hash(data), nil
+}
+
 // Write stores data in the file, overwriting any content, and creates the file if necessary.
 func (s *Storage) Write(ctx context.Context, data []byte) error {
 	s.m.Lock()
 	defer s.m.Unlock()
 	err := os.WriteFile(s.p, data, 0600)
 	if errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "creating the file's parent directory")
 		dir := filepath.Dir(s.p)
 		if err = os.MkdirAll(dir, 0700); err == nil {
 			err = os.WriteFile(s.p, data, 0600)
@@ -60,4 +141,25 @@ func (s *Storage) Write(ctx context.Context, data []byte) error {
 	return err
 }
 
-var _ accessor.Accessor = (*Storage)(nil)
+// readVersion reads the file and computes its version. Callers must hold s.m.
+func (s *Storage) readVersion() ([]byte, string, error) {
+	b, err := os.ReadFile(s.p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return b, hash(b), nil
+}
+
+// hash returns the version of a file having the given content
+func hash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+var (
+	_ accessor.Accessor  = (*Storage)(nil)
+	_ accessor.Versioned = (*Storage)(nil)
+)
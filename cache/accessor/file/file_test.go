@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
 	"github.com/stretchr/testify/require"
 )
 
@@ -54,3 +55,48 @@ func TestReadWriteDelete(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteIf(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "dir", "cache.json")
+	a, err := New(p)
+	require.NoError(t, err)
+	b, err := New(p)
+	require.NoError(t, err)
+
+	data, v, err := a.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Empty(t, v)
+
+	va, err := a.WriteIf(ctx, []byte("a"), v)
+	require.NoError(t, err)
+	require.NotEmpty(t, va)
+	_, err = b.WriteIf(ctx, []byte("b"), v)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict, "b should have to read a's write before writing")
+
+	data, v, err = b.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+	require.Equal(t, va, v)
+	vb, err := b.WriteIf(ctx, []byte("b"), v)
+	require.NoError(t, err)
+	require.NotEqual(t, va, vb)
+	_, err = a.WriteIf(ctx, []byte("a"), va)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+
+	// an unconditional write changes the version
+	require.NoError(t, a.Write(ctx, []byte("c")))
+	_, err = b.WriteIf(ctx, []byte("b"), vb)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+
+	// after a deletion, the empty version should match
+	require.NoError(t, a.Delete(ctx))
+	_, err = b.WriteIf(ctx, []byte("b"), vb)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+	_, err = b.WriteIf(ctx, []byte("b"), "")
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(filepath.Dir(p))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "WriteIf shouldn't leave temporary or lock files")
+}
@@ -0,0 +1,536 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package keyvault
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	apiVersion   = "7.4"
+	defaultScope = "https://vault.azure.net/.default"
+	// encodingTag is the name of the tag recording how Storage encoded the secret's value
+	encodingTag = "msalext-encoding"
+	// maxDataSize is the maximum size of data Storage decompresses from a secret value. It exceeds
+	// the size of any data which compresses to maxValueSize, so it affects only tampered secrets.
+	maxDataSize = 32 << 20
+	// maxValueSize is the maximum size of a secret value in bytes
+	maxValueSize = 25 * 1024
+	// minRetryDelay and maxRetryDelay bound the delay between checks of a secret's state
+	// while Key Vault asynchronously deletes or recovers it
+	minRetryDelay, maxRetryDelay = 10 * time.Millisecond, time.Second
+)
+
+// encodings of secret values
+const (
+	// encodingText means the value is the data, which is valid UTF-8
+	encodingText = "text"
+	// encodingBase64 means the value is the data encoded as base64
+	encodingBase64 = "base64"
+	// encodingGzip means the value is the data compressed with gzip, then encoded as base64
+	encodingGzip = "gzip"
+)
+
+var (
+	// ErrConflict indicates Storage didn't write data because the secret changed after Storage last
+	// read or wrote it. See [WithConditionalWrites].
+	ErrConflict = errors.New("the Key Vault secret changed since Storage last read or wrote it")
+
+	// ErrTooLarge indicates data is too large to store in a Key Vault secret, even compressed
+	ErrTooLarge = errors.New("data exceeds Key Vault's secret size limit")
+
+	// errNoETag indicates the service returned no ETag for an existing secret, so Storage can't write conditionally
+	errNoETag = errors.New("Key Vault returned no ETag for the secret, so Storage can't write it conditionally")
+
+	// secretName matches valid secret names
+	secretName = regexp.MustCompile(`^[0-9A-Za-z-]{1,127}$`)
+)
+
+// TokenSource provides access tokens for Key Vault. An implementation can wrap an azidentity credential,
+// for example:
+//
+//	func (c credentialSource) Token(ctx context.Context, scope string) (string, error) {
+//		tk, err := c.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{scope}})
+//		return tk.Token, err
+//	}
+type TokenSource interface {
+	// Token returns an access token having the given scope. Storage calls Token before every request,
+	// so implementations should cache tokens.
+	Token(ctx context.Context, scope string) (string, error)
+}
+
+type option func(*Storage) error
+
+// WithConditionalWrites makes Storage write only when the secret's ETag matches the ETag Storage saw when it
+// last read or wrote the secret. When the secret has changed, Write returns [ErrConflict] and the caller
+// should read the secret again before retrying. By default, the last write wins. Conditional writes require
+// a service that returns ETags for secrets. When Storage last read or wrote the secret without getting an
+// ETag, Write returns an error instead of writing.
+func WithConditionalWrites() option {
+	return func(s *Storage) error {
+		s.conditional = true
+		return nil
+	}
+}
+
+// WithContentType sets the content type of the secret. The default is "application/json".
+func WithContentType(ct string) option {
+	return func(s *Storage) error {
+		s.contentType = ct
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client Storage uses to send requests to Key Vault. The default is [http.DefaultClient].
+func WithHTTPClient(c *http.Client) option {
+	return func(s *Storage) error {
+		if c == nil {
+			return errors.New("HTTP client can't be nil")
+		}
+		s.client = c
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about Key Vault operations. These records never
+// include stored data or tokens. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithScope sets the scope of the access tokens Storage requests. The default is "https://vault.azure.net/.default",
+// which is correct for the Azure public cloud. Sovereign clouds require a different scope such as
+// "https://vault.azure.cn/.default".
+func WithScope(scope string) option {
+	return func(s *Storage) error {
+		if scope == "" {
+			return errors.New("scope can't be empty")
+		}
+		s.scope = scope
+		return nil
+	}
+}
+
+// WithTags sets tags on the secret. Storage reserves the tag "msalext-encoding".
+func WithTags(tags map[string]string) option {
+	return func(s *Storage) error {
+		if _, ok := tags[encodingTag]; ok {
+			return fmt.Errorf("tag %q is reserved", encodingTag)
+		}
+		s.tags = tags
+		return nil
+	}
+}
+
+// Storage stores data in an Azure Key Vault secret. Key Vault limits secret values to 25 KB, so Storage
+// stores data as text when it fits and compresses data that doesn't. Write returns [ErrTooLarge] when data
+// doesn't fit even compressed. Deleting the secret soft-deletes it when the vault has soft delete enabled,
+// in which case a subsequent Write recovers the secret before updating it. This requires the recover
+// permission in addition to get, set and delete. Storage implements [accessor.Versioned] using the secret's
+// ETag, so a Cache can use it with optimistic concurrency when the service returns ETags for secrets. When
+// it doesn't, ReadVersion and WriteIf return errors rather than versions that can't protect the secret.
+type Storage struct {
+	client      *http.Client
+	conditional bool
+	contentType string
+	// etag is the secret's ETag as of Storage's last read or write. It's empty when the secret didn't exist
+	// or the service returned no ETag.
+	etag string
+	// exists indicates whether the secret existed as of Storage's last read or write
+	exists bool
+	logger *slog.Logger
+	m      *sync.Mutex
+	name   string
+	scope  string
+	tags   map[string]string
+	ts     TokenSource
+	vault  *url.URL
+}
+
+// New is the constructor for Storage. "vaultURL" is the vault's URL, for example "https://contoso.vault.azure.net".
+// "name" is the name of the secret, which may contain only letters, digits and dashes. "ts" provides access tokens.
+func New(vaultURL, name string, ts TokenSource, opts ...option) (*Storage, error) {
+	u, err := url.Parse(vaultURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid vault URL %q", vaultURL)
+	}
+	if !secretName.MatchString(name) {
+		return nil, fmt.Errorf("invalid secret name %q", name)
+	}
+	if ts == nil {
+		return nil, errors.New("token source can't be nil")
+	}
+	s := Storage{
+		client:      http.DefaultClient,
+		contentType: "application/json",
+		m:           &sync.Mutex{},
+		name:        name,
+		scope:       defaultScope,
+		ts:          ts,
+		vault:       u,
+	}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("vault", u.Host), slog.String("secret", name))
+	return &s, nil
+}
+
+// secretBundle is the subset of Key Vault's SecretBundle Storage uses
+type secretBundle struct {
+	ContentType string            `json:"contentType,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Value       string            `json:"value"`
+}
+
+// Delete deletes the secret, if it exists.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err := s.do(ctx, http.MethodDelete, s.url("secrets", s.name), nil, nil, nil)
+	if notFound(err) {
+		s.logger.DebugContext(ctx, "nothing to delete because the secret doesn't exist")
+		err = nil
+	}
+	if err == nil {
+		s.etag, s.exists = "", false
+	}
+	return err
+}
+
+// Read returns the secret's data or, if the secret doesn't exist, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.read(ctx)
+}
+
+// ReadVersion returns the secret's data and ETag. When the secret doesn't exist, it returns a nil
+// slice and an empty version, which WriteIf accepts for creating the secret. ReadVersion returns an
+// error when the service returns no ETag for an existing secret.
+func (s *Storage) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	data, err := s.read(ctx)
+	if err == nil && s.exists && s.etag == "" {
+		err = errNoETag
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, s.etag, nil
+}
+
+// read returns the secret's data, recording its ETag and whether it exists. Callers must hold s.m.
+func (s *Storage) read(ctx context.Context) ([]byte, error) {
+	var b secretBundle
+	h, err := s.do(ctx, http.MethodGet, s.url("secrets", s.name), nil, nil, &b)
+	if notFound(err) {
+		s.logger.DebugContext(ctx, "returning no data because the secret doesn't exist")
+		s.etag, s.exists = "", false
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.etag, s.exists = h.Get("ETag"), true
+	return decode(b.Value, b.Tags[encodingTag])
+}
+
+// Write stores data in a new version of the secret, creating the secret if necessary.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	header := http.Header{}
+	if s.conditional {
+		if s.exists && s.etag == "" {
+			// an empty ETag would make the write conditional on the secret not existing
+			return errNoETag
+		}
+		condition(header, s.etag)
+	}
+	_, err := s.put(ctx, data, header)
+	var e *vaultError
+	if errors.As(err, &e) && e.status == http.StatusPreconditionFailed {
+		return fmt.Errorf("%w: %s", ErrConflict, err)
+	}
+	return err
+}
+
+// WriteIf stores data when the secret's ETag is "version" or, when version is empty, when the secret
+// doesn't exist. It returns the new ETag. WriteIf requires a service that returns ETags for secrets. It
+// returns an error without writing when version is empty and Storage last read the secret without an
+// ETag, and after writing when the service returns no ETag for the new version.
+func (s *Storage) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if version == "" && s.exists && s.etag == "" {
+		// an empty version would make the write conditional on the secret not existing
+		return "", errNoETag
+	}
+	header := http.Header{}
+	condition(header, version)
+	etag, err := s.put(ctx, data, header)
+	var e *vaultError
+	if errors.As(err, &e) && e.status == http.StatusPreconditionFailed {
+		return "", fmt.Errorf("%w: %s", accessor.ErrVersionConflict, err)
+	}
+	if err == nil && etag == "" {
+		return "", errNoETag
+	}
+	return etag, err
+}
+
+// condition sets a header making a write conditional on the secret's ETag being "etag" or, when etag is
+// empty, on the secret not existing
+func condition(header http.Header, etag string) {
+	if etag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+}
+
+// put stores data in a new version of the secret and returns its ETag. "header" may make the write
+// conditional (see condition). Callers must hold s.m.
+func (s *Storage) put(ctx context.Context, data []byte, header http.Header) (string, error) {
+	value, encoding, err := encode(data)
+	if err != nil {
+		return "", err
+	}
+	s.logger.DebugContext(ctx, "encoded data", slog.String("encoding", encoding), logging.Size([]byte(value)))
+	tags := map[string]string{encodingTag: encoding}
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	in := secretBundle{ContentType: s.contentType, Tags: tags, Value: value}
+	conditional := header.Get("If-Match") != "" || header.Get("If-None-Match") != ""
+	var (
+		h     http.Header
+		e     *vaultError
+		delay = minRetryDelay
+	)
+	for {
+		h, err = s.do(ctx, http.MethodPut, s.url("secrets", s.name), header, in, nil)
+		if !errors.As(err, &e) || e.status != http.StatusConflict {
+			break
+		}
+		// Key Vault rejects writes to a soft-deleted secret. Deletion is asynchronous, so the secret may
+		// not yet be recoverable; in that case, wait and try again.
+		if e.innerCode == "ObjectIsDeletedButRecoverable" {
+			var etag string
+			if etag, err = s.recover(ctx); err == nil && conditional && etag != "" {
+				// the recovered secret is the one Storage deleted, so Storage may overwrite it
+				header.Del("If-None-Match")
+				header.Set("If-Match", etag)
+			}
+		} else if e.innerCode == "ObjectIsBeingDeleted" {
+			s.logger.DebugContext(ctx, "waiting for the secret's deletion to complete")
+			err = wait(ctx, &delay)
+		} else {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	s.etag, s.exists = h.Get("ETag"), true
+	return s.etag, nil
+}
+
+// recover recovers the soft-deleted secret, waits for recovery to complete, and returns the recovered secret's ETag
+func (s *Storage) recover(ctx context.Context) (string, error) {
+	s.logger.DebugContext(ctx, "recovering deleted secret")
+	if _, err := s.do(ctx, http.MethodPost, s.url("deletedsecrets", s.name, "recover"), nil, nil, nil); err != nil {
+		return "", fmt.Errorf("couldn't recover deleted secret: %w", err)
+	}
+	// recovery is asynchronous. The secret is readable when it's complete.
+	for delay := minRetryDelay; ; {
+		h, err := s.do(ctx, http.MethodGet, s.url("secrets", s.name), nil, nil, nil)
+		if err == nil {
+			return h.Get("ETag"), nil
+		} else if !notFound(err) {
+			return "", err
+		}
+		if err = wait(ctx, &delay); err != nil {
+			return "", err
+		}
+	}
+}
+
+// wait waits for "delay" or until ctx is done, then doubles "delay" up to maxRetryDelay
+func wait(ctx context.Context, delay *time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(*delay):
+		if *delay *= 2; *delay > maxRetryDelay {
+			*delay = maxRetryDelay
+		}
+		return nil
+	}
+}
+
+// url returns the URL of a Key Vault API endpoint
+func (s *Storage) url(elem ...string) string {
+	u := s.vault.JoinPath(elem...)
+	u.RawQuery = url.Values{"api-version": {apiVersion}}.Encode()
+	return u.String()
+}
+
+// vaultError is an error response from Key Vault
+type vaultError struct {
+	// code and innerCode are the codes of the error and its inner error, if any
+	code, innerCode, message string
+	status                   int
+}
+
+func (e *vaultError) Error() string {
+	msg := e.message
+	if msg == "" {
+		msg = http.StatusText(e.status)
+	}
+	if e.code != "" {
+		msg = e.code + ": " + msg
+	}
+	return fmt.Sprintf("Key Vault responded %d: %s", e.status, msg)
+}
+
+// notFound returns true when err indicates the secret doesn't exist
+func notFound(err error) bool {
+	var e *vaultError
+	return errors.As(err, &e) && e.status == http.StatusNotFound && e.code == "SecretNotFound"
+}
+
+// do sends a request to Key Vault and unmarshals the response body into "out". It returns
+// the response's headers, or a *vaultError when Key Vault responds with an error status.
+func (s *Storage) do(ctx context.Context, method, u string, header http.Header, in, out any) (http.Header, error) {
+	token, err := s.ts.Token(ctx, s.scope)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get an access token: %w", err)
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var body struct {
+			Error struct {
+				Code       string `json:"code"`
+				InnerError struct {
+					Code string `json:"code"`
+				} `json:"innererror"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(b, &body)
+		return nil, &vaultError{code: body.Error.Code, innerCode: body.Error.InnerError.Code, message: body.Error.Message, status: res.StatusCode}
+	}
+	if out != nil && len(b) > 0 {
+		err = json.Unmarshal(b, out)
+	}
+	return res.Header, err
+}
+
+// encode returns data encoded as a secret value, and the name of the encoding
+func encode(data []byte) (string, string, error) {
+	if utf8.Valid(data) && len(data) <= maxValueSize {
+		return string(data), encodingText, nil
+	}
+	if base64.StdEncoding.EncodedLen(len(data)) <= maxValueSize {
+		return base64.StdEncoding.EncodeToString(data), encodingBase64, nil
+	}
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return "", "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	if base64.StdEncoding.EncodedLen(buf.Len()) > maxValueSize {
+		return "", "", fmt.Errorf("%w: %d bytes compress to %d bytes", ErrTooLarge, len(data), buf.Len())
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), encodingGzip, nil
+}
+
+// decode returns the data encoded in a secret value
+func decode(value, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", encodingText:
+		// a secret without an encoding tag was written by another tool; its value is the data
+		return []byte(value), nil
+	case encodingBase64:
+		return base64.StdEncoding.DecodeString(value)
+	case encodingGzip:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(r, maxDataSize+1))
+		if err == nil && len(data) > maxDataSize {
+			err = fmt.Errorf("decompressed data exceeds %d bytes", maxDataSize)
+		}
+		return data, err
+	}
+	return nil, fmt.Errorf("secret has unknown encoding %q", encoding)
+}
+
+var (
+	_ accessor.Accessor  = (*Storage)(nil)
+	_ accessor.Versioned = (*Storage)(nil)
+)
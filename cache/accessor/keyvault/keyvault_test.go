@@ -0,0 +1,476 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package keyvault
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+const token = "token"
+
+type fakeTokenSource struct {
+	err    error
+	m      sync.Mutex
+	scopes []string
+}
+
+func (f *fakeTokenSource) Token(ctx context.Context, scope string) (string, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.scopes = append(f.scopes, scope)
+	return token, f.err
+}
+
+type secretState int
+
+const (
+	active secretState = iota
+	deleting
+	deleted
+	recovering
+)
+
+type fakeSecret struct {
+	bundle secretBundle
+	etag   string
+	// pending is the number of requests for which the secret remains in a transitional state
+	pending int
+	state   secretState
+}
+
+// fakeVault implements a subset of Key Vault's secrets API
+type fakeVault struct {
+	etags int
+	m     sync.Mutex
+	// pending is the number of requests for which deletion and recovery remain incomplete
+	pending int
+	// noETags makes the vault omit ETags and ignore conditional headers, as a service lacking ETag support would
+	noETags bool
+	// puts counts PUT requests
+	puts    int
+	secrets map[string]*fakeSecret
+	// softDelete determines whether deleted secrets are recoverable
+	softDelete bool
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	f := &fakeVault{secrets: map[string]*fakeSecret{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeVault) locked(fn func()) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fn()
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	respond := func(status int, body any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if body != nil {
+			_ = json.NewEncoder(w).Encode(body)
+		}
+	}
+	fail := func(status int, code, inner, msg string) {
+		e := map[string]any{"code": code, "message": msg}
+		if inner != "" {
+			e["innererror"] = map[string]any{"code": inner}
+		}
+		respond(status, map[string]any{"error": e})
+	}
+	if r.Header.Get("Authorization") != "Bearer "+token {
+		fail(http.StatusUnauthorized, "Unauthorized", "", "invalid token")
+		return
+	}
+	if v := r.URL.Query().Get("api-version"); v != apiVersion {
+		fail(http.StatusBadRequest, "BadParameter", "", "unexpected API version "+v)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	secret := f.secrets[parts[1]]
+	if secret != nil && secret.pending > 0 {
+		if secret.pending--; secret.pending == 0 {
+			secret.state = map[secretState]secretState{deleting: deleted, recovering: active}[secret.state]
+		}
+	}
+	switch {
+	case len(parts) == 3 && parts[0] == "deletedsecrets" && parts[2] == "recover" && r.Method == http.MethodPost:
+		if secret == nil || secret.state != deleted {
+			fail(http.StatusNotFound, "SecretNotFound", "", "no deleted secret")
+			return
+		}
+		secret.state, secret.pending = recovering, f.pending
+		if secret.pending == 0 {
+			secret.state = active
+		}
+		respond(http.StatusOK, nil)
+	case len(parts) != 2 || parts[0] != "secrets":
+		fail(http.StatusNotFound, "NotFound", "", "unexpected path "+r.URL.Path)
+	case r.Method == http.MethodGet:
+		if secret == nil || secret.state != active {
+			fail(http.StatusNotFound, "SecretNotFound", "", "secret not found")
+			return
+		}
+		if !f.noETags {
+			w.Header().Set("ETag", secret.etag)
+		}
+		respond(http.StatusOK, secret.bundle)
+	case r.Method == http.MethodPut:
+		f.puts++
+		if secret != nil && secret.state == deleting {
+			fail(http.StatusConflict, "Conflict", "ObjectIsBeingDeleted", "secret is being deleted")
+			return
+		}
+		if secret != nil && secret.state == deleted {
+			fail(http.StatusConflict, "Conflict", "ObjectIsDeletedButRecoverable", "secret is deleted but recoverable")
+			return
+		}
+		exists := secret != nil && secret.state == active && !f.noETags
+		if m := r.Header.Get("If-Match"); m != "" && (!exists || m != secret.etag) {
+			fail(http.StatusPreconditionFailed, "PreconditionFailed", "", "ETag mismatch")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			fail(http.StatusPreconditionFailed, "PreconditionFailed", "", "secret exists")
+			return
+		}
+		var b secretBundle
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			fail(http.StatusBadRequest, "BadParameter", "", err.Error())
+			return
+		}
+		if len(b.Value) > maxValueSize {
+			fail(http.StatusBadRequest, "BadParameter", "", "secret value is too large")
+			return
+		}
+		f.etags++
+		f.secrets[parts[1]] = &fakeSecret{bundle: b, etag: fmt.Sprintf(`"%d"`, f.etags)}
+		if !f.noETags {
+			w.Header().Set("ETag", f.secrets[parts[1]].etag)
+		}
+		respond(http.StatusOK, b)
+	case r.Method == http.MethodDelete:
+		if secret == nil || secret.state != active {
+			fail(http.StatusNotFound, "SecretNotFound", "", "secret not found")
+			return
+		}
+		if !f.softDelete {
+			delete(f.secrets, parts[1])
+		} else if secret.state, secret.pending = deleting, f.pending; secret.pending == 0 {
+			secret.state = deleted
+		}
+		respond(http.StatusOK, nil)
+	default:
+		fail(http.StatusMethodNotAllowed, "MethodNotAllowed", "", r.Method)
+	}
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	_, srv := newFakeVault(t)
+	ts := &fakeTokenSource{}
+	s, err := New(srv.URL, "msal-cache", ts)
+	require.NoError(t, err)
+
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	require.NoError(t, s.Delete(ctx))
+
+	for _, expected := range [][]byte{[]byte(`{"expected":true}`), {0, 1, 2, 255}} {
+		require.NoError(t, s.Write(ctx, expected))
+		actual, err = s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+
+	require.NoError(t, s.Delete(ctx))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	require.NotEmpty(t, ts.scopes)
+	for _, scope := range ts.scopes {
+		require.Equal(t, defaultScope, scope)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	f, srv := newFakeVault(t)
+	s, err := New(srv.URL, "secret", &fakeTokenSource{})
+	require.NoError(t, err)
+	random := make([]byte, maxValueSize)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		desc, encoding string
+		data           []byte
+	}{
+		{desc: "text", encoding: encodingText, data: []byte(`{"AccessToken":{}}`)},
+		{desc: "binary", encoding: encodingBase64, data: []byte{0, 1, 2, 255}},
+		{desc: "large text", encoding: encodingGzip, data: bytes.Repeat([]byte(`{"secret":"0123456789abcdef"},`), 4000)},
+		{desc: "large binary", encoding: encodingGzip, data: append(random[:maxValueSize/2], make([]byte, maxValueSize)...)},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			require.NoError(t, s.Write(ctx, test.data))
+			f.locked(func() {
+				b := f.secrets["secret"].bundle
+				require.Equal(t, test.encoding, b.Tags[encodingTag])
+				require.LessOrEqual(t, len(b.Value), maxValueSize)
+				if test.encoding == encodingText {
+					require.Equal(t, string(test.data), b.Value)
+				}
+			})
+			actual, err := s.Read(ctx)
+			require.NoError(t, err)
+			require.Equal(t, test.data, actual)
+		})
+	}
+
+	t.Run("too large", func(t *testing.T) {
+		var puts int
+		f.locked(func() { puts = f.puts })
+		require.ErrorIs(t, s.Write(ctx, append(random, random...)), ErrTooLarge)
+		f.locked(func() { require.Equal(t, puts, f.puts, "Storage shouldn't send data it knows is too large") })
+	})
+
+	t.Run("no encoding tag", func(t *testing.T) {
+		// Storage should read the value of a secret written by another tool as is
+		f.locked(func() { f.secrets["other"] = &fakeSecret{bundle: secretBundle{Value: "value"}} })
+		other, err := New(srv.URL, "other", &fakeTokenSource{})
+		require.NoError(t, err)
+		actual, err := other.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), actual)
+	})
+
+	t.Run("decompression bomb", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(make([]byte, maxDataSize+1))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		f.locked(func() {
+			f.secrets["other"] = &fakeSecret{bundle: secretBundle{
+				Tags: map[string]string{encodingTag: encodingGzip}, Value: base64.StdEncoding.EncodeToString(buf.Bytes()),
+			}}
+		})
+		other, err := New(srv.URL, "other", &fakeTokenSource{})
+		require.NoError(t, err)
+		_, err = other.Read(ctx)
+		require.ErrorContains(t, err, "exceeds")
+	})
+
+	t.Run("unknown encoding", func(t *testing.T) {
+		f.locked(func() {
+			f.secrets["other"] = &fakeSecret{bundle: secretBundle{Tags: map[string]string{encodingTag: "rot13"}, Value: "value"}}
+		})
+		other, err := New(srv.URL, "other", &fakeTokenSource{})
+		require.NoError(t, err)
+		_, err = other.Read(ctx)
+		require.Error(t, err)
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	for _, pending := range []int{0, 3} {
+		t.Run(fmt.Sprint(pending, " pending requests"), func(t *testing.T) {
+			f, srv := newFakeVault(t)
+			f.locked(func() { f.pending, f.softDelete = pending, true })
+			for _, conditional := range []bool{false, true} {
+				opts := []option{}
+				if conditional {
+					opts = append(opts, WithConditionalWrites())
+				}
+				s, err := New(srv.URL, "secret", &fakeTokenSource{}, opts...)
+				require.NoError(t, err)
+				require.NoError(t, s.Write(ctx, []byte("a")))
+				require.NoError(t, s.Delete(ctx))
+				actual, err := s.Read(ctx)
+				require.NoError(t, err)
+				require.Nil(t, actual)
+
+				// Storage should wait for deletion to complete, recover the secret, then write
+				require.NoError(t, s.Write(ctx, []byte("b")))
+				actual, err = s.Read(ctx)
+				require.NoError(t, err)
+				require.Equal(t, []byte("b"), actual)
+				require.NoError(t, s.Delete(ctx))
+			}
+		})
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	_, srv := newFakeVault(t)
+	a, err := New(srv.URL, "secret", &fakeTokenSource{}, WithConditionalWrites())
+	require.NoError(t, err)
+	b, err := New(srv.URL, "secret", &fakeTokenSource{}, WithConditionalWrites())
+	require.NoError(t, err)
+
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	require.ErrorIs(t, b.Write(ctx, []byte("b")), ErrConflict, "b should have to read a's write before writing")
+	actual, err := b.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), actual)
+	require.NoError(t, b.Write(ctx, []byte("b")))
+	require.ErrorIs(t, a.Write(ctx, []byte("a")), ErrConflict)
+
+	// without conditional writes, the last write wins
+	c, err := New(srv.URL, "secret", &fakeTokenSource{})
+	require.NoError(t, err)
+	require.NoError(t, c.Write(ctx, []byte("c")))
+	actual, err = a.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), actual)
+}
+
+func TestWriteIf(t *testing.T) {
+	_, srv := newFakeVault(t)
+	a, err := New(srv.URL, "secret", &fakeTokenSource{})
+	require.NoError(t, err)
+	b, err := New(srv.URL, "secret", &fakeTokenSource{})
+	require.NoError(t, err)
+
+	data, v, err := a.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Empty(t, v)
+
+	va, err := a.WriteIf(ctx, []byte("a"), v)
+	require.NoError(t, err)
+	require.NotEmpty(t, va)
+	_, err = b.WriteIf(ctx, []byte("b"), v)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict, "b should have to read a's write before writing")
+
+	data, v, err = b.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+	require.Equal(t, va, v)
+	vb, err := b.WriteIf(ctx, []byte("b"), v)
+	require.NoError(t, err)
+	require.NotEqual(t, va, vb)
+	_, err = a.WriteIf(ctx, []byte("a"), va)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+}
+
+func TestWriteIfWithoutETags(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.noETags = true
+	a, err := New(srv.URL, "secret", &fakeTokenSource{})
+	require.NoError(t, err)
+	b, err := New(srv.URL, "secret", &fakeTokenSource{})
+	require.NoError(t, err)
+
+	// the write succeeds but WriteIf can't return a version for it
+	_, err = a.WriteIf(ctx, []byte("a"), "")
+	require.ErrorIs(t, err, errNoETag)
+
+	// ReadVersion shouldn't return an empty version, which means the secret doesn't exist, for an existing secret
+	_, v, err := b.ReadVersion(ctx)
+	require.ErrorIs(t, err, errNoETag)
+	require.Empty(t, v)
+	actual, err := b.Read(ctx)
+	require.NoError(t, err, "Read doesn't need an ETag")
+	require.Equal(t, []byte("a"), actual)
+	puts := f.puts
+	_, err = b.WriteIf(ctx, []byte("b"), "")
+	require.ErrorIs(t, err, errNoETag)
+	require.Equal(t, puts, f.puts, "WriteIf shouldn't write when it knows the secret exists without an ETag")
+}
+
+func TestConditionalWritesWithoutETags(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.noETags = true
+	a, err := New(srv.URL, "secret", &fakeTokenSource{}, WithConditionalWrites())
+	require.NoError(t, err)
+	b, err := New(srv.URL, "secret", &fakeTokenSource{}, WithConditionalWrites())
+	require.NoError(t, err)
+
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	puts := f.puts
+	require.ErrorIs(t, a.Write(ctx, []byte("a")), errNoETag, "Write shouldn't claim the existing secret doesn't exist")
+	_, err = b.Read(ctx)
+	require.NoError(t, err)
+	require.ErrorIs(t, b.Write(ctx, []byte("b")), errNoETag)
+	require.Equal(t, puts, f.puts)
+
+	// Storage can write conditionally again after deleting the secret
+	require.NoError(t, b.Delete(ctx))
+	require.NoError(t, b.Write(ctx, []byte("b")))
+}
+
+func TestOptions(t *testing.T) {
+	f, srv := newFakeVault(t)
+	ts := &fakeTokenSource{}
+	tags := map[string]string{"app": "test"}
+	s, err := New(srv.URL, "secret", ts, WithContentType("text/plain"), WithScope("scope"), WithTags(tags))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	f.locked(func() {
+		b := f.secrets["secret"].bundle
+		require.Equal(t, "text/plain", b.ContentType)
+		require.Equal(t, "test", b.Tags["app"])
+	})
+	require.Equal(t, []string{"scope"}, ts.scopes)
+
+	for _, test := range []struct {
+		desc, url, name string
+		ts              TokenSource
+		opts            []option
+	}{
+		{desc: "invalid URL", url: "vault", name: "secret", ts: ts},
+		{desc: "invalid name", url: srv.URL, name: "a_b", ts: ts},
+		{desc: "empty name", url: srv.URL, ts: ts},
+		{desc: "no token source", url: srv.URL, name: "secret"},
+		{desc: "reserved tag", url: srv.URL, name: "secret", ts: ts, opts: []option{WithTags(map[string]string{encodingTag: ""})}},
+		{desc: "empty scope", url: srv.URL, name: "secret", ts: ts, opts: []option{WithScope("")}},
+		{desc: "nil client", url: srv.URL, name: "secret", ts: ts, opts: []option{WithHTTPClient(nil)}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(test.url, test.name, test.ts, test.opts...)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, srv := newFakeVault(t)
+	expected := errors.New("expected")
+	s, err := New(srv.URL, "secret", &fakeTokenSource{err: expected})
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorIs(t, err, expected)
+	require.ErrorIs(t, s.Write(ctx, []byte("data")), expected)
+	require.ErrorIs(t, s.Delete(ctx), expected)
+
+	s, err = New(srv.URL+"/unexpected", "secret", &fakeTokenSource{})
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorContains(t, err, "unexpected path")
+}
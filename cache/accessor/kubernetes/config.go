@@ -0,0 +1,223 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// serviceAccountDir is where Kubernetes mounts a pod's service account credentials. Tests change it.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// config describes how to connect to the API server
+type config struct {
+	client *http.Client
+	// namespace is the default namespace, from the kubeconfig context or the pod's service account
+	namespace string
+	server    *url.URL
+	// token is a bearer token. When it's empty and tokenFile isn't, Storage reads the token from
+	// tokenFile before each request because the kubelet rotates service account tokens.
+	token, tokenFile string
+}
+
+// bearer returns the bearer token, if there is one
+func (c *config) bearer() (string, error) {
+	if c.token != "" || c.tokenFile == "" {
+		return c.token, nil
+	}
+	b, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// inClusterConfig returns the configuration of a pod's service account
+func inClusterConfig() (*config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod")
+	}
+	pool, err := certPool(filepath.Join(serviceAccountDir, "ca.crt"), "")
+	if err != nil {
+		return nil, err
+	}
+	c := config{
+		client:    &http.Client{Transport: transport(&tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool})},
+		server:    &url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)},
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+	}
+	if ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		c.namespace = strings.TrimSpace(string(ns))
+	}
+	return &c, nil
+}
+
+// kubeconfig is the subset of a kubeconfig file's schema Storage supports
+type kubeconfig struct {
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			CA            string `yaml:"certificate-authority"`
+			CAData        string `yaml:"certificate-authority-data"`
+			Insecure      bool   `yaml:"insecure-skip-tls-verify"`
+			Server        string `yaml:"server"`
+			TLSServerName string `yaml:"tls-server-name"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			Namespace string `yaml:"namespace"`
+			User      string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	CurrentContext string `yaml:"current-context"`
+	Users          []struct {
+		Name string `yaml:"name"`
+		User struct {
+			AuthProvider   any    `yaml:"auth-provider"`
+			ClientCert     string `yaml:"client-certificate"`
+			ClientCertData string `yaml:"client-certificate-data"`
+			ClientKey      string `yaml:"client-key"`
+			ClientKeyData  string `yaml:"client-key-data"`
+			Exec           any    `yaml:"exec"`
+			Token          string `yaml:"token"`
+			TokenFile      string `yaml:"tokenFile"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// kubeconfigPath returns the path of the default kubeconfig file: the first path in $KUBECONFIG or,
+// when that's empty, ~/.kube/config
+func kubeconfigPath() (string, error) {
+	if p := filepath.SplitList(os.Getenv("KUBECONFIG")); len(p) > 0 && p[0] != "" {
+		return p[0], nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".kube", "config"), nil
+}
+
+// loadKubeconfig returns the configuration of a context in a kubeconfig file. When "name" is empty,
+// it returns the configuration of the file's current context.
+func loadKubeconfig(p, name string) (*config, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	if err = yaml.Unmarshal(b, &kc); err != nil {
+		return nil, fmt.Errorf("couldn't parse kubeconfig %q: %w", p, err)
+	}
+	if name == "" {
+		name = kc.CurrentContext
+	}
+	dir := filepath.Dir(p)
+	resolve := func(f string) string {
+		if f != "" && !filepath.IsAbs(f) {
+			f = filepath.Join(dir, f)
+		}
+		return f
+	}
+	for _, ctx := range kc.Contexts {
+		if ctx.Name != name {
+			continue
+		}
+		c := config{namespace: ctx.Context.Namespace}
+		tc := &tls.Config{MinVersion: tls.VersionTLS12}
+		found := false
+		for _, cl := range kc.Clusters {
+			if cl.Name != ctx.Context.Cluster {
+				continue
+			}
+			found = true
+			if c.server, err = url.Parse(cl.Cluster.Server); err != nil || c.server.Host == "" {
+				return nil, fmt.Errorf("cluster %q has invalid server %q", cl.Name, cl.Cluster.Server)
+			}
+			tc.InsecureSkipVerify = cl.Cluster.Insecure
+			tc.ServerName = cl.Cluster.TLSServerName
+			if cl.Cluster.CA != "" || cl.Cluster.CAData != "" {
+				if tc.RootCAs, err = certPool(resolve(cl.Cluster.CA), cl.Cluster.CAData); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("kubeconfig has no cluster %q", ctx.Context.Cluster)
+		}
+		for _, u := range kc.Users {
+			if u.Name != ctx.Context.User {
+				continue
+			}
+			if u.User.Exec != nil || u.User.AuthProvider != nil {
+				return nil, fmt.Errorf("user %q authenticates with a plugin, which Storage doesn't support", u.Name)
+			}
+			c.token, c.tokenFile = u.User.Token, resolve(u.User.TokenFile)
+			cert, key := []byte(nil), []byte(nil)
+			if cert, err = fileOrData(resolve(u.User.ClientCert), u.User.ClientCertData); err == nil {
+				key, err = fileOrData(resolve(u.User.ClientKey), u.User.ClientKeyData)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if cert != nil || key != nil {
+				pair, err := tls.X509KeyPair(cert, key)
+				if err != nil {
+					return nil, fmt.Errorf("invalid client certificate for user %q: %w", u.Name, err)
+				}
+				tc.Certificates = []tls.Certificate{pair}
+			}
+		}
+		c.client = &http.Client{Transport: transport(tc)}
+		return &c, nil
+	}
+	return nil, fmt.Errorf("kubeconfig %q has no context %q", p, name)
+}
+
+// certPool returns a pool of the certificates in a PEM file or base64 encoded PEM data
+func certPool(p, data string) (*x509.CertPool, error) {
+	b, err := fileOrData(p, data)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no valid certificate authority data")
+	}
+	return pool, nil
+}
+
+// fileOrData returns base64 encoded data when it isn't empty and otherwise the content of the file
+// at "p", if p isn't empty
+func fileOrData(p, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if p == "" {
+		return nil, nil
+	}
+	return os.ReadFile(p)
+}
+
+func transport(tc *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tc
+	return t
+}
@@ -0,0 +1,587 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package kubernetes stores data in a Kubernetes Secret, allowing pods to share a token cache across
+// restarts. Its Storage implements [accessor.Locker] with a coordination.k8s.io Lease, which Cache uses
+// instead of a file lock, and [accessor.Versioned] with the Secret's resourceVersion. Because the
+// timestamp file Cache uses to skip redundant reads records only local writes, pods sharing a Secret
+// should disable it:
+//
+//	s, err := kubernetes.New("msal-cache")
+//	// TODO: handle error
+//	c, err := cache.New(s, p, cache.WithTimestampMode(cache.TimestampDisabled))
+//
+// Storage connects to the API server with the pod's service account when it runs in a pod, and otherwise
+// with the current context of the default kubeconfig file. The service account requires permission to
+// get, create and patch the Secret and, to use the lock, to get, create and update the Lease.
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	defaultDataKey       = "msal-cache"
+	defaultLeaseDuration = 15 * time.Second
+	// microTime is the format of the Lease's timestamps, which Kubernetes expects in UTC
+	microTime = "2006-01-02T15:04:05.000000Z07:00"
+	// leaseRetryDelay and maxLeaseRetryDelay bound the delay between attempts to acquire the Lease
+	leaseRetryDelay, maxLeaseRetryDelay = 50 * time.Millisecond, time.Second
+)
+
+var (
+	dataKey = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+	// namespaceName matches a DNS label, as Kubernetes requires of namespace names
+	namespaceName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	// objectName matches a DNS subdomain, as Kubernetes requires of Secret and Lease names
+	objectName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// ErrLeaseExpired indicates Storage's Lease expired, or another holder took it, before Storage finished
+// using it.
+var ErrLeaseExpired = errors.New("the Kubernetes Lease expired")
+
+type option func(*Storage) error
+
+// WithDataKey sets the key of the Secret's data in which Storage stores data. The default is "msal-cache".
+// Storage doesn't modify the Secret's other keys.
+func WithDataKey(k string) option {
+	return func(s *Storage) error {
+		if !dataKey.MatchString(k) {
+			return fmt.Errorf("invalid data key %q", k)
+		}
+		s.dataKey = k
+		return nil
+	}
+}
+
+// WithHolderIdentity sets the identity Storage records in the Lease while holding it. It must be unique
+// among clients sharing the Lease. The default is the host name, which in a pod is the pod's name,
+// followed by a random suffix.
+func WithHolderIdentity(id string) option {
+	return func(s *Storage) error {
+		if id == "" {
+			return errors.New("holder identity can't be empty")
+		}
+		s.holder = id
+		return nil
+	}
+}
+
+// WithKubeconfig makes Storage connect to the API server as configured by a context of the kubeconfig file
+// at path "p". When "context" is empty, Storage uses the file's current context. Storage supports token
+// and client certificate authentication but not exec or auth provider plugins.
+func WithKubeconfig(p, context string) option {
+	return func(s *Storage) error {
+		if p == "" {
+			return errors.New("kubeconfig path can't be empty")
+		}
+		s.kubeconfig, s.kubeContext = p, context
+		return nil
+	}
+}
+
+// WithLease sets the name and duration of the Lease Storage holds while Cache writes. The default name is
+// the Secret's name with "-lock" appended, and the default duration is 15 seconds. The Lease expires when
+// its holder doesn't release it within its duration, so a pod that crashes while holding it can't block
+// others indefinitely. The duration should therefore be much longer than a write takes.
+func WithLease(name string, d time.Duration) option {
+	return func(s *Storage) error {
+		if !objectName.MatchString(name) || len(name) > 253 {
+			return fmt.Errorf("invalid Lease name %q", name)
+		}
+		if d < time.Second {
+			return errors.New("Lease duration must be at least 1 second")
+		}
+		s.leaseName, s.leaseDuration = name, d
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about Kubernetes API requests. These records never
+// include stored data or credentials. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithNamespace sets the namespace of the Secret and Lease. The default is the pod's namespace or, outside
+// a pod, the kubeconfig context's namespace. When neither is available, the default is "default".
+func WithNamespace(ns string) option {
+	return func(s *Storage) error {
+		if !namespaceName.MatchString(ns) || len(ns) > 63 {
+			return fmt.Errorf("invalid namespace %q", ns)
+		}
+		s.namespace = ns
+		return nil
+	}
+}
+
+// Storage stores data in a key of a Kubernetes Secret.
+type Storage struct {
+	cfg                     *config
+	dataKey                 string
+	holder                  string
+	kubeconfig, kubeContext string
+	leaseDuration           time.Duration
+	// leaseExpires is when Storage's Lease expires, estimated from the local clock. It's zero
+	// when Storage doesn't hold the Lease.
+	leaseExpires time.Time
+	leaseName    string
+	logger       *slog.Logger
+	m            *sync.Mutex
+	name         string
+	namespace    string
+}
+
+// New is the constructor for Storage. "name" is the name of the Secret, which Storage creates when
+// necessary.
+func New(name string, opts ...option) (*Storage, error) {
+	if !objectName.MatchString(name) || len(name) > 253 {
+		return nil, fmt.Errorf("invalid Secret name %q", name)
+	}
+	s := Storage{
+		dataKey:       defaultDataKey,
+		leaseDuration: defaultLeaseDuration,
+		leaseName:     name + "-lock",
+		m:             &sync.Mutex{},
+		name:          name,
+	}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	switch {
+	case s.kubeconfig != "":
+		s.cfg, err = loadKubeconfig(s.kubeconfig, s.kubeContext)
+	case os.Getenv("KUBERNETES_SERVICE_HOST") != "":
+		s.cfg, err = inClusterConfig()
+	default:
+		var p string
+		if p, err = kubeconfigPath(); err == nil {
+			s.cfg, err = loadKubeconfig(p, "")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure a Kubernetes client: %w", err)
+	}
+	if s.namespace == "" {
+		s.namespace = s.cfg.namespace
+		if s.namespace == "" {
+			s.namespace = "default"
+		}
+	}
+	if s.holder == "" {
+		host, _ := os.Hostname()
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s.holder = host + "_" + hex.EncodeToString(b)
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("namespace", s.namespace), slog.String("secret", name))
+	return &s, nil
+}
+
+// Delete deletes the Secret's data key, if it exists. It doesn't delete the Secret.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.checkLease(); err != nil {
+		return err
+	}
+	patch := map[string]any{"data": map[string]any{s.dataKey: nil}}
+	err := s.do(ctx, http.MethodPatch, s.secretPath(), patch, nil)
+	if isStatus(err, http.StatusNotFound) {
+		s.logger.DebugContext(ctx, "nothing to delete because the Secret doesn't exist")
+		return nil
+	}
+	return err
+}
+
+// Read returns the data in the Secret's data key or, if the Secret or key doesn't exist, a nil slice
+// and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	data, _, err := s.ReadVersion(ctx)
+	return data, err
+}
+
+// ReadVersion returns the data in the Secret's data key and the Secret's resourceVersion. When the Secret
+// doesn't exist, it returns a nil slice and an empty version.
+func (s *Storage) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var secret secret
+	err := s.do(ctx, http.MethodGet, s.secretPath(), nil, &secret)
+	if isStatus(err, http.StatusNotFound) {
+		s.logger.DebugContext(ctx, "returning no data because the Secret doesn't exist")
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	data, ok := secret.Data[s.dataKey]
+	if !ok {
+		s.logger.DebugContext(ctx, "returning no data because the Secret has no data key", slog.String("key", s.dataKey))
+		return nil, secret.Metadata.ResourceVersion, nil
+	}
+	return data, secret.Metadata.ResourceVersion, nil
+}
+
+// Write stores data in the Secret's data key, creating the Secret if necessary.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.checkLease(); err != nil {
+		return err
+	}
+	_, err := s.patch(ctx, data, "")
+	if isStatus(err, http.StatusNotFound) {
+		_, err = s.create(ctx, data)
+		if isStatus(err, http.StatusConflict) {
+			// another client created the Secret after the patch
+			_, err = s.patch(ctx, data, "")
+		}
+	}
+	return err
+}
+
+// WriteIf stores data in the Secret's data key when the Secret's resourceVersion is "version" or, when
+// version is empty, when the Secret doesn't exist. It returns the Secret's new resourceVersion.
+func (s *Storage) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.checkLease(); err != nil {
+		return "", err
+	}
+	var (
+		v   string
+		err error
+	)
+	if version == "" {
+		v, err = s.create(ctx, data)
+	} else {
+		v, err = s.patch(ctx, data, version)
+	}
+	if isStatus(err, http.StatusConflict) || isStatus(err, http.StatusNotFound) {
+		s.logger.DebugContext(ctx, "not writing because the Secret changed", slog.String("resourceVersion", version))
+		return "", fmt.Errorf("%w: %s", accessor.ErrVersionConflict, err)
+	}
+	return v, err
+}
+
+// Lock acquires the Lease, waiting until it succeeds or the context is done. Storage can acquire the Lease
+// when no client holds it or the holder's lease has expired according to the Lease's renewTime.
+func (s *Storage) Lock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.leaseExpires.IsZero() {
+		return errors.New("Storage already holds the Lease")
+	}
+	delay := leaseRetryDelay
+	for {
+		start := time.Now()
+		acquired, err := s.acquire(ctx, start)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			s.leaseExpires = start.Add(s.leaseDuration)
+			s.logger.DebugContext(ctx, "acquired Lease", slog.String("holder", s.holder))
+			return nil
+		}
+		s.logger.DebugContext(ctx, "retrying Lease acquisition because another client holds it", slog.Duration("delay", delay))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+			if delay *= 2; delay > maxLeaseRetryDelay {
+				delay = maxLeaseRetryDelay
+			}
+		}
+	}
+}
+
+// Unlock releases the Lease. It returns [ErrLeaseExpired] when another client holds the Lease, because
+// that client may have acquired it while Storage believed it held the Lease.
+func (s *Storage) Unlock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.leaseExpires.IsZero() {
+		return errors.New("Storage doesn't hold the Lease")
+	}
+	s.leaseExpires = time.Time{}
+	for {
+		var l lease
+		if err := s.do(ctx, http.MethodGet, s.leasePath(), nil, &l); err != nil {
+			return err
+		}
+		if l.Spec.HolderIdentity == nil || *l.Spec.HolderIdentity != s.holder {
+			s.logger.DebugContext(ctx, "Lease expired before release")
+			return ErrLeaseExpired
+		}
+		now := time.Now().UTC().Format(microTime)
+		l.Spec.HolderIdentity, l.Spec.RenewTime = nil, &now
+		err := s.do(ctx, http.MethodPut, s.leasePath(), l, nil)
+		if !isStatus(err, http.StatusConflict) {
+			if err == nil {
+				s.logger.DebugContext(ctx, "released Lease")
+			}
+			return err
+		}
+		// the Lease changed since the GET, perhaps because it expired and another client took it
+	}
+}
+
+// acquire tries once to acquire the Lease, returning false when another client holds it
+func (s *Storage) acquire(ctx context.Context, now time.Time) (bool, error) {
+	ts := now.UTC().Format(microTime)
+	seconds := int(s.leaseDuration.Round(time.Second) / time.Second)
+	var l lease
+	err := s.do(ctx, http.MethodGet, s.leasePath(), nil, &l)
+	if isStatus(err, http.StatusNotFound) {
+		l = lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   objectMeta{Name: s.leaseName, Namespace: s.namespace},
+			Spec:       leaseSpec{AcquireTime: &ts, HolderIdentity: &s.holder, LeaseDurationSeconds: &seconds, RenewTime: &ts},
+		}
+		err = s.do(ctx, http.MethodPost, s.leasesPath(), l, nil)
+		if isStatus(err, http.StatusConflict) {
+			// another client created the Lease first
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if l.Spec.HolderIdentity != nil && *l.Spec.HolderIdentity != "" && !l.expired(now) {
+		return false, nil
+	}
+	transitions := 1
+	if l.Spec.LeaseTransitions != nil {
+		transitions += *l.Spec.LeaseTransitions
+	}
+	l.Spec = leaseSpec{AcquireTime: &ts, HolderIdentity: &s.holder, LeaseDurationSeconds: &seconds, LeaseTransitions: &transitions, RenewTime: &ts}
+	err = s.do(ctx, http.MethodPut, s.leasePath(), l, nil)
+	if isStatus(err, http.StatusConflict) {
+		// another client updated the Lease first
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkLease returns ErrLeaseExpired when Storage holds the Lease but it may have expired
+func (s *Storage) checkLease() error {
+	if !s.leaseExpires.IsZero() && !time.Now().Before(s.leaseExpires) {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// create creates the Secret, returning its resourceVersion
+func (s *Storage) create(ctx context.Context, data []byte) (string, error) {
+	body := secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   objectMeta{Name: s.name, Namespace: s.namespace},
+		Data:       map[string][]byte{s.dataKey: data},
+		Type:       "Opaque",
+	}
+	var created secret
+	err := s.do(ctx, http.MethodPost, s.secretsPath(), body, &created)
+	if err == nil {
+		s.logger.DebugContext(ctx, "created Secret", slog.String("resourceVersion", created.Metadata.ResourceVersion))
+	}
+	return created.Metadata.ResourceVersion, err
+}
+
+// patch sets the Secret's data key with a JSON merge patch, returning the Secret's new resourceVersion.
+// When "version" isn't empty, the API server applies the patch only when the Secret's resourceVersion
+// matches it.
+func (s *Storage) patch(ctx context.Context, data []byte, version string) (string, error) {
+	if data == nil {
+		// a merge patch deletes keys whose value is null
+		data = []byte{}
+	}
+	patch := map[string]any{"data": map[string][]byte{s.dataKey: data}}
+	if version != "" {
+		patch["metadata"] = map[string]string{"resourceVersion": version}
+	}
+	var patched secret
+	err := s.do(ctx, http.MethodPatch, s.secretPath(), patch, &patched)
+	if err == nil {
+		s.logger.DebugContext(ctx, "wrote Secret", slog.String("resourceVersion", patched.Metadata.ResourceVersion))
+	}
+	return patched.Metadata.ResourceVersion, err
+}
+
+func (s *Storage) leasePath() string {
+	return s.leasesPath() + "/" + s.leaseName
+}
+
+func (s *Storage) leasesPath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + s.namespace + "/leases"
+}
+
+func (s *Storage) secretPath() string {
+	return s.secretsPath() + "/" + s.name
+}
+
+func (s *Storage) secretsPath() string {
+	return "/api/v1/namespaces/" + s.namespace + "/secrets"
+}
+
+// do sends a request to the API server and unmarshals the response body into "out". It sends PATCH
+// requests as JSON merge patches. It returns an *apiError when the API server responds with an error status.
+func (s *Storage) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.cfg.server.JoinPath(path).String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		ct := "application/json"
+		if method == http.MethodPatch {
+			ct = "application/merge-patch+json"
+		}
+		req.Header.Set("Content-Type", ct)
+	}
+	token, err := s.cfg.bearer()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := s.cfg.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		e := apiError{status: res.StatusCode}
+		var status struct {
+			Message string `json:"message"`
+			Reason  string `json:"reason"`
+		}
+		if json.Unmarshal(b, &status) == nil {
+			e.message, e.reason = status.Message, status.Reason
+		}
+		return &e
+	}
+	if out != nil && len(b) > 0 {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+// apiError is an error response from the API server
+type apiError struct {
+	message, reason string
+	status          int
+}
+
+func (e *apiError) Error() string {
+	msg := e.message
+	if msg == "" {
+		msg = http.StatusText(e.status)
+	}
+	if e.reason != "" {
+		msg = e.reason + ": " + msg
+	}
+	return fmt.Sprintf("Kubernetes API server responded %d: %s", e.status, msg)
+}
+
+// isStatus returns true when err is an *apiError having the given status
+func isStatus(err error, status int) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.status == status
+}
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type secret struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	// Data values are base64 encoded in JSON, as encoding/json encodes []byte
+	Data map[string][]byte `json:"data,omitempty"`
+	Type string            `json:"type,omitempty"`
+}
+
+type lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	Spec       leaseSpec  `json:"spec"`
+}
+
+type leaseSpec struct {
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+}
+
+// expired returns true when the Lease's holder hasn't renewed it within its duration. A Lease
+// lacking the times needed to determine this has expired.
+func (l *lease) expired(now time.Time) bool {
+	renewed := l.Spec.RenewTime
+	if renewed == nil {
+		renewed = l.Spec.AcquireTime
+	}
+	if renewed == nil || l.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(*renewed))
+	if err != nil {
+		return true
+	}
+	return !now.Before(t.Add(time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+var (
+	_ accessor.Accessor  = (*Storage)(nil)
+	_ accessor.Locker    = (*Storage)(nil)
+	_ accessor.Versioned = (*Storage)(nil)
+)
@@ -0,0 +1,524 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	msal "github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// fakeAPIServer implements the subset of the Kubernetes API Storage uses: Secrets and Leases
+type fakeAPIServer struct {
+	m sync.Mutex
+	// objects maps object paths, for example "/api/v1/namespaces/default/secrets/name", to objects
+	objects map[string]map[string]any
+	// resourceVersion is the latest resourceVersion, which increases with every change
+	resourceVersion int
+	// token is the bearer token clients must present
+	token string
+}
+
+func newFakeAPIServer() *fakeAPIServer {
+	return &fakeAPIServer{objects: map[string]map[string]any{}, token: "token"}
+}
+
+func (f *fakeAPIServer) locked(fn func()) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fn()
+}
+
+// object returns an object's field at a path of keys, or nil when the object or field doesn't exist
+func (f *fakeAPIServer) object(p string, keys ...string) any {
+	f.m.Lock()
+	defer f.m.Unlock()
+	var v any = f.objects[p]
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	respond := func(status int, body any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+	fail := func(status int, reason, msg string) {
+		respond(status, map[string]any{"kind": "Status", "apiVersion": "v1", "status": "Failure", "message": msg, "reason": reason, "code": status})
+	}
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		fail(http.StatusUnauthorized, "Unauthorized", "Unauthorized")
+		return
+	}
+	var collection bool
+	switch parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); {
+	case len(parts) == 5 && parts[0] == "api" && parts[4] == "secrets",
+		len(parts) == 6 && parts[0] == "apis" && parts[1] == "coordination.k8s.io" && parts[5] == "leases":
+		collection = true
+	case len(parts) == 6 && parts[0] == "api" && parts[4] == "secrets",
+		len(parts) == 7 && parts[0] == "apis" && parts[1] == "coordination.k8s.io" && parts[5] == "leases":
+	default:
+		fail(http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+		return
+	}
+	var body map[string]any
+	if r.Method != http.MethodGet {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			fail(http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+	}
+	// store records a changed object, returning it
+	store := func(p string, obj map[string]any) map[string]any {
+		f.resourceVersion++
+		obj["metadata"].(map[string]any)["resourceVersion"] = strconv.Itoa(f.resourceVersion)
+		f.objects[p] = obj
+		return obj
+	}
+	if collection {
+		if r.Method != http.MethodPost {
+			fail(http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported method")
+			return
+		}
+		meta, _ := body["metadata"].(map[string]any)
+		name, _ := meta["name"].(string)
+		if name == "" {
+			fail(http.StatusUnprocessableEntity, "Invalid", "name is required")
+			return
+		}
+		p := r.URL.Path + "/" + name
+		if f.objects[p] != nil {
+			fail(http.StatusConflict, "AlreadyExists", fmt.Sprintf("%q already exists", name))
+			return
+		}
+		respond(http.StatusCreated, store(p, body))
+		return
+	}
+	current := f.objects[r.URL.Path]
+	if current == nil {
+		fail(http.StatusNotFound, "NotFound", "not found")
+		return
+	}
+	// requireVersion fails the request when obj's resourceVersion is set and doesn't match the current object's
+	requireVersion := func(obj map[string]any) bool {
+		meta, _ := obj["metadata"].(map[string]any)
+		if v, ok := meta["resourceVersion"]; ok && v != current["metadata"].(map[string]any)["resourceVersion"] {
+			fail(http.StatusConflict, "Conflict", "the object has been modified; please apply your changes to the latest version and try again")
+			return false
+		}
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet:
+		respond(http.StatusOK, current)
+	case http.MethodPut:
+		if requireVersion(body) {
+			respond(http.StatusOK, store(r.URL.Path, body))
+		}
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			fail(http.StatusUnsupportedMediaType, "UnsupportedMediaType", "unsupported patch type")
+			return
+		}
+		if requireVersion(body) {
+			respond(http.StatusOK, store(r.URL.Path, mergePatch(current, body).(map[string]any)))
+		}
+	default:
+		fail(http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported method")
+	}
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386)
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	merged := map[string]any{}
+	for k, v := range t {
+		merged[k] = v
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = mergePatch(merged[k], v)
+		}
+	}
+	return merged
+}
+
+// writeKubeconfig writes a kubeconfig file for a server, returning its path
+func writeKubeconfig(t *testing.T, srv *httptest.Server, namespace, user string) string {
+	ca := ""
+	if srv.Certificate() != nil {
+		b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+		ca = "certificate-authority-data: " + base64.StdEncoding.EncodeToString(b)
+	}
+	kc := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+    %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    namespace: %s
+    user: user
+- name: other
+  context:
+    cluster: test
+    user: user
+current-context: test
+users:
+- name: user
+  user:
+%s
+`, srv.URL, ca, namespace, user)
+	p := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(p, []byte(kc), 0600))
+	return p
+}
+
+// newTestStorage returns a Storage connected to a fake API server through a kubeconfig file
+func newTestStorage(t *testing.T, f *fakeAPIServer, opts ...option) *Storage {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	p := writeKubeconfig(t, srv, "ns", "    token: token")
+	s, err := New("msal", append([]option{WithKubeconfig(p, "")}, opts...)...)
+	require.NoError(t, err)
+	return s
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	f := newFakeAPIServer()
+	s := newTestStorage(t, f)
+
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	require.NoError(t, s.Delete(ctx))
+
+	for _, expected := range [][]byte{[]byte(`{"expected":true}`), {0, 1, 2, 255}, {}} {
+		require.NoError(t, s.Write(ctx, expected))
+		actual, err = s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+	expected := []byte("expected")
+	require.NoError(t, s.Write(ctx, expected))
+	encoded := f.object("/api/v1/namespaces/ns/secrets/msal", "data", defaultDataKey)
+	require.Equal(t, base64.StdEncoding.EncodeToString(expected), encoded, "Secret data should be base64 encoded")
+
+	require.NoError(t, s.Delete(ctx))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+}
+
+func TestDataKey(t *testing.T) {
+	f := newFakeAPIServer()
+	f.locked(func() {
+		f.objects["/api/v1/namespaces/ns/secrets/msal"] = map[string]any{
+			"metadata": map[string]any{"name": "msal", "namespace": "ns", "resourceVersion": "1"},
+			"data":     map[string]any{"other": base64.StdEncoding.EncodeToString([]byte("other"))},
+		}
+	})
+	s := newTestStorage(t, f, WithDataKey("cache.json"))
+
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual, "the Secret exists but has no cache.json key")
+
+	expected := []byte("expected")
+	require.NoError(t, s.Write(ctx, expected))
+	require.Equal(t, base64.StdEncoding.EncodeToString(expected), f.object("/api/v1/namespaces/ns/secrets/msal", "data", "cache.json"))
+
+	// Storage shouldn't modify other keys
+	require.NoError(t, s.Delete(ctx))
+	require.Nil(t, f.object("/api/v1/namespaces/ns/secrets/msal", "data", "cache.json"))
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte("other")), f.object("/api/v1/namespaces/ns/secrets/msal", "data", "other"))
+}
+
+func TestWriteIf(t *testing.T) {
+	f := newFakeAPIServer()
+	a := newTestStorage(t, f)
+	b := newTestStorage(t, f)
+
+	data, v, err := a.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Empty(t, v)
+
+	va, err := a.WriteIf(ctx, []byte("a"), v)
+	require.NoError(t, err)
+	require.NotEmpty(t, va)
+	_, err = b.WriteIf(ctx, []byte("b"), v)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict, "b should have to read a's write before writing")
+
+	data, v, err = b.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+	require.Equal(t, va, v)
+	vb, err := b.WriteIf(ctx, []byte("b"), v)
+	require.NoError(t, err)
+	require.NotEqual(t, va, vb)
+	_, err = a.WriteIf(ctx, []byte("a"), va)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+
+	// after a Delete, the Secret exists without data and WriteIf requires its new version
+	require.NoError(t, a.Delete(ctx))
+	data, v, err = a.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.NotEqual(t, vb, v)
+	_, err = b.WriteIf(ctx, []byte("b"), vb)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+	_, err = b.WriteIf(ctx, []byte("b"), v)
+	require.NoError(t, err)
+}
+
+func TestLease(t *testing.T) {
+	f := newFakeAPIServer()
+	a := newTestStorage(t, f, WithHolderIdentity("a"))
+	b := newTestStorage(t, f, WithHolderIdentity("b"), WithLease("msal-lease", time.Minute))
+	holder := func(name string) any {
+		return f.object("/apis/coordination.k8s.io/v1/namespaces/ns/leases/"+name, "spec", "holderIdentity")
+	}
+
+	require.NoError(t, a.Lock(ctx))
+	require.Equal(t, "a", holder("msal-lock"))
+	for _, field := range []string{"acquireTime", "renewTime"} {
+		ts, ok := f.object("/apis/coordination.k8s.io/v1/namespaces/ns/leases/msal-lock", "spec", field).(string)
+		require.True(t, ok)
+		require.True(t, strings.HasSuffix(ts, "Z"), "%s should be in UTC: %s", field, ts)
+	}
+	require.Error(t, a.Lock(ctx), "Lock isn't reentrant")
+	require.NoError(t, b.Lock(ctx), "b uses a different Lease")
+	require.Equal(t, "b", holder("msal-lease"))
+	require.NoError(t, b.Unlock(ctx))
+	require.Nil(t, holder("msal-lease"))
+
+	c := newTestStorage(t, f, WithHolderIdentity("c"))
+	cx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, c.Lock(cx), context.DeadlineExceeded)
+
+	// c should acquire the Lease soon after a releases it
+	locked := make(chan error)
+	go func() { locked <- c.Lock(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	require.NoError(t, a.Unlock(ctx))
+	require.NoError(t, <-locked)
+	require.Equal(t, "c", holder("msal-lock"))
+	require.Equal(t, float64(1), f.object("/apis/coordination.k8s.io/v1/namespaces/ns/leases/msal-lock", "spec", "leaseTransitions"))
+	require.Error(t, a.Unlock(ctx), "Storage doesn't hold the Lease")
+
+	// a may acquire the Lease when c's expires, after which c's Unlock shouldn't release it
+	f.locked(func() {
+		spec := f.objects["/apis/coordination.k8s.io/v1/namespaces/ns/leases/msal-lock"]["spec"].(map[string]any)
+		spec["renewTime"] = time.Now().Add(-time.Hour).Format(microTime)
+	})
+	require.NoError(t, a.Lock(ctx))
+	require.ErrorIs(t, c.Unlock(ctx), ErrLeaseExpired)
+	require.Equal(t, "a", holder("msal-lock"))
+
+	// Storage shouldn't write after its Lease may have expired
+	a.leaseExpires = time.Now().Add(-time.Second)
+	require.ErrorIs(t, a.Write(ctx, []byte("a")), ErrLeaseExpired)
+	require.NoError(t, a.Unlock(ctx))
+	require.NoError(t, a.Write(ctx, []byte("a")))
+}
+
+func TestInCluster(t *testing.T) {
+	f := newFakeAPIServer()
+	srv := httptest.NewTLSServer(f)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(u.Host)
+	require.NoError(t, err)
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+
+	before := serviceAccountDir
+	serviceAccountDir = t.TempDir()
+	defer func() { serviceAccountDir = before }()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(serviceAccountDir, "ca.crt"), ca, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(serviceAccountDir, "namespace"), []byte("pod-ns\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(serviceAccountDir, "token"), []byte("token\n"), 0600))
+
+	s, err := New("msal")
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.NotNil(t, f.object("/api/v1/namespaces/pod-ns/secrets/msal"), "Storage should use the pod's namespace")
+
+	// Storage should read the token again when the kubelet rotates it
+	f.locked(func() { f.token = "rotated" })
+	require.NoError(t, os.WriteFile(filepath.Join(serviceAccountDir, "token"), []byte("rotated"), 0600))
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+}
+
+func TestKubeconfig(t *testing.T) {
+	f := newFakeAPIServer()
+	srv := httptest.NewTLSServer(f)
+	defer srv.Close()
+	p := writeKubeconfig(t, srv, "ns", "    token: token")
+
+	// the "other" context has no namespace
+	s, err := New("msal", WithKubeconfig(p, "other"))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.NotNil(t, f.object("/api/v1/namespaces/default/secrets/msal"))
+
+	s, err = New("msal", WithKubeconfig(p, ""), WithNamespace("explicit"))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.NotNil(t, f.object("/api/v1/namespaces/explicit/secrets/msal"))
+
+	// Storage should find the kubeconfig file through $KUBECONFIG
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBECONFIG", p+string(filepath.ListSeparator)+"ignored")
+	s, err = New("msal")
+	require.NoError(t, err)
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data, "Storage should use the current context's namespace")
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.NotNil(t, f.object("/api/v1/namespaces/ns/secrets/msal"))
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("token"), 0600))
+	s, err = New("msal", WithKubeconfig(writeKubeconfig(t, srv, "ns", "    tokenFile: "+tokenFile), ""))
+	require.NoError(t, err)
+	data, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+
+	s, err = New("msal", WithKubeconfig(writeKubeconfig(t, srv, "ns", "    token: wrong"), ""))
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorContains(t, err, "401")
+
+	for _, test := range []struct{ desc, user, context string }{
+		{desc: "exec plugin", user: "    exec:\n      command: kubelogin"},
+		{desc: "missing context", user: "    token: token", context: "missing"},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New("msal", WithKubeconfig(writeKubeconfig(t, srv, "ns", test.user), test.context))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	f := newFakeAPIServer()
+	p := filepath.Join(t.TempDir(), "ts")
+	var caches []*cache.Cache
+	for i := 0; i < 2; i++ {
+		s := newTestStorage(t, f)
+		c, err := cache.New(s, p, cache.WithTimestampMode(cache.TimestampDisabled))
+		require.NoError(t, err)
+		caches = append(caches, c)
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range caches {
+		wg.Add(1)
+		go func(i int, c *cache.Cache) {
+			defer wg.Done()
+			for j := 0; j < 5 && !t.Failed(); j++ {
+				if err := c.Export(ctx, &fakeMarshaler{data: []byte(strconv.Itoa(i))}, msal.ExportHints{}); err != nil {
+					t.Errorf("%d: %s", i, err)
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	require.NoFileExists(t, p+".lockfile", "Cache should use the Lease")
+	require.Nil(t, f.object("/apis/coordination.k8s.io/v1/namespaces/ns/leases/msal-lock", "spec", "holderIdentity"), "Cache should release the Lease")
+
+	m := fakeMarshaler{}
+	require.NoError(t, caches[0].Replace(ctx, &m, msal.ReplaceHints{}))
+	require.Contains(t, []string{"0", "1"}, string(m.data))
+}
+
+func TestOptions(t *testing.T) {
+	f := newFakeAPIServer()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	kc := WithKubeconfig(writeKubeconfig(t, srv, "ns", "    token: token"), "")
+	for _, test := range []struct {
+		desc, name string
+		opts       []option
+	}{
+		{desc: "invalid name", name: "MSAL"},
+		{desc: "invalid data key", name: "msal", opts: []option{WithDataKey("a/b")}},
+		{desc: "empty holder", name: "msal", opts: []option{WithHolderIdentity("")}},
+		{desc: "empty kubeconfig path", name: "msal", opts: []option{WithKubeconfig("", "")}},
+		{desc: "missing kubeconfig", name: "msal", opts: []option{WithKubeconfig(filepath.Join(t.TempDir(), "missing"), "")}},
+		{desc: "invalid Lease name", name: "msal", opts: []option{WithLease("-lock", time.Minute)}},
+		{desc: "short Lease", name: "msal", opts: []option{WithLease("lock", time.Millisecond)}},
+		{desc: "invalid namespace", name: "msal", opts: []option{WithNamespace("a.b")}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(test.name, append([]option{kc}, test.opts...)...)
+			require.Error(t, err)
+		})
+	}
+}
+
+// fakeMarshaler implements MSAL's cache.Marshaler and cache.Unmarshaler
+type fakeMarshaler struct {
+	data []byte
+}
+
+func (f *fakeMarshaler) Marshal() ([]byte, error) {
+	return f.data, nil
+}
+
+func (f *fakeMarshaler) Unmarshal(b []byte) error {
+	f.data = b
+	return nil
+}
@@ -0,0 +1,341 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package kwallet
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	defaultAppID  = "MSALCache"
+	defaultFolder = "MSALCache"
+	// iface is the D-Bus interface of KWallet daemons
+	iface = "org.kde.KWallet"
+	// mapKey is the key of the map entry value holding data, when Storage writes map entries
+	mapKey = "data"
+)
+
+// KWallet's entry types, as returned by its entryType method
+const (
+	kwalletPassword = 1
+	kwalletMap      = 3
+)
+
+// EntryType determines the kind of wallet entry in which [Storage] stores data
+type EntryType int
+
+const (
+	// EntryPassword stores base64 encoded data in a password entry. This is the default.
+	EntryPassword EntryType = iota
+	// EntryMap stores base64 encoded data in a map entry, under the key "data". Some tools
+	// display map entries as key/value pairs rather than an opaque password.
+	EntryMap
+)
+
+// service identifies a KWallet daemon on the session bus
+type service struct {
+	name string
+	path dbus.ObjectPath
+}
+
+// services are the KWallet daemons Storage can use, in order of preference
+var services = []service{
+	{name: "org.kde.kwalletd6", path: "/modules/kwalletd6"},
+	{name: "org.kde.kwalletd5", path: "/modules/kwalletd5"},
+}
+
+type option func(*Storage) error
+
+// WithAppID sets the application ID Storage presents to KWallet. KWallet shows this ID to users when
+// asking whether to allow access to a wallet, and remembers their decision per ID. The default is "MSALCache".
+func WithAppID(id string) option {
+	return func(s *Storage) error {
+		if id == "" {
+			return errors.New("application ID can't be empty")
+		}
+		s.appID = id
+		return nil
+	}
+}
+
+// WithEntryType sets the kind of entry in which Storage stores data. The default is [EntryPassword].
+// Storage reads both kinds of entry regardless of this option.
+func WithEntryType(t EntryType) option {
+	return func(s *Storage) error {
+		switch t {
+		case EntryMap, EntryPassword:
+			s.entryType = t
+			return nil
+		}
+		return fmt.Errorf("unknown entry type %d", t)
+	}
+}
+
+// WithFolder sets the wallet folder in which Storage stores data. The default is "MSALCache".
+func WithFolder(f string) option {
+	return func(s *Storage) error {
+		if f == "" {
+			return errors.New("folder can't be empty")
+		}
+		s.folder = f
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about KWallet operations. These records
+// never include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithWallet sets the wallet in which Storage stores data. By default, Storage uses the wallet
+// KWallet designates for network passwords, which is typically "kdewallet".
+func WithWallet(w string) option {
+	return func(s *Storage) error {
+		if w == "" {
+			return errors.New("wallet can't be empty")
+		}
+		s.wallet = w
+		return nil
+	}
+}
+
+// Storage stores data in a KDE Wallet via the KWallet daemon's D-Bus API. It works without the Secret
+// Service bridge required by the libsecret accessor. Storage uses kwalletd6 when it's available and
+// otherwise kwalletd5. Opening a wallet may require user interaction, for example to allow access or
+// enter the wallet's password.
+type Storage struct {
+	appID, folder, key, wallet string
+	// conn is a private connection to the session bus. Storage connects when it first needs to.
+	conn      *dbus.Conn
+	entryType EntryType
+	logger    *slog.Logger
+	m         *sync.Mutex
+	// svc is the KWallet daemon Storage uses. It's nil until Storage connects.
+	svc *service
+}
+
+// New is the constructor for Storage. "key" is the name of the wallet entry in which to store data.
+func New(key string, opts ...option) (*Storage, error) {
+	if key == "" {
+		return nil, errors.New("key can't be empty")
+	}
+	s := Storage{appID: defaultAppID, folder: defaultFolder, key: key, m: &sync.Mutex{}}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("folder", s.folder), slog.String("key", key))
+	return &s, nil
+}
+
+// Delete deletes the wallet entry, if it exists.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.withWallet(ctx, func(w *wallet) error {
+		if exists, err := w.hasEntry(ctx); err != nil || !exists {
+			if err == nil {
+				s.logger.DebugContext(ctx, "nothing to delete because the wallet has no matching entry")
+			}
+			return err
+		}
+		return w.check(ctx, "removeEntry", s.folder, s.key)
+	})
+}
+
+// Read returns the wallet entry's data or, if the entry doesn't exist, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var data []byte
+	err := s.withWallet(ctx, func(w *wallet) error {
+		exists, err := w.hasEntry(ctx)
+		if err != nil || !exists {
+			if err == nil {
+				s.logger.DebugContext(ctx, "returning no data because the wallet has no matching entry")
+			}
+			return err
+		}
+		var t int32
+		if err = w.call(ctx, "entryType", &t, s.folder, s.key); err != nil {
+			return err
+		}
+		var encoded string
+		switch t {
+		case kwalletPassword:
+			err = w.call(ctx, "readPassword", &encoded, s.folder, s.key)
+		case kwalletMap:
+			var b []byte
+			if err = w.call(ctx, "readMap", &b, s.folder, s.key); err == nil {
+				var m map[string]string
+				if m, err = decodeMap(b); err == nil {
+					v, ok := m[mapKey]
+					if !ok {
+						return fmt.Errorf("map entry %q has no %q key", s.key, mapKey)
+					}
+					encoded = v
+				}
+			}
+		default:
+			return fmt.Errorf("entry %q has unsupported type %d", s.key, t)
+		}
+		if err == nil {
+			data, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		return err
+	})
+	return data, err
+}
+
+// Write stores data in the wallet entry, creating the entry and its folder if necessary.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.withWallet(ctx, func(w *wallet) error {
+		var exists bool
+		if err := w.call(ctx, "hasFolder", &exists, s.folder); err != nil {
+			return err
+		}
+		if !exists {
+			s.logger.DebugContext(ctx, "creating wallet folder")
+			var ok bool
+			if err := w.call(ctx, "createFolder", &ok, s.folder); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("couldn't create folder %q", s.folder)
+			}
+		}
+		encoded := base64.StdEncoding.EncodeToString(data)
+		if s.entryType == EntryMap {
+			return w.check(ctx, "writeMap", s.folder, s.key, encodeMap(map[string]string{mapKey: encoded}))
+		}
+		return w.check(ctx, "writePassword", s.folder, s.key, encoded)
+	})
+}
+
+// wallet is an open wallet
+type wallet struct {
+	appID, folder, key string
+	handle             int32
+	obj                dbus.BusObject
+}
+
+// call calls a KWallet method taking a wallet handle and application ID, which call adds to
+// the given arguments, and stores the method's return value in "ret"
+func (w *wallet) call(ctx context.Context, method string, ret any, args ...any) error {
+	args = append(append([]any{w.handle}, args...), w.appID)
+	if err := w.obj.CallWithContext(ctx, iface+"."+method, 0, args...).Store(ret); err != nil {
+		return fmt.Errorf("KWallet method %s failed: %w", method, err)
+	}
+	return nil
+}
+
+// check calls a KWallet method which returns 0 on success
+func (w *wallet) check(ctx context.Context, method string, args ...any) error {
+	var rc int32
+	if err := w.call(ctx, method, &rc, args...); err != nil {
+		return err
+	}
+	if rc != 0 {
+		return fmt.Errorf("KWallet method %s failed with code %d", method, rc)
+	}
+	return nil
+}
+
+// hasEntry returns true when the wallet has the Storage's folder and entry
+func (w *wallet) hasEntry(ctx context.Context) (bool, error) {
+	var exists bool
+	err := w.call(ctx, "hasFolder", &exists, w.folder)
+	if err == nil && exists {
+		err = w.call(ctx, "hasEntry", &exists, w.folder, w.key)
+	}
+	return exists, err
+}
+
+// withWallet opens the wallet, calls "fn", then closes the wallet. Callers must hold s.m.
+func (s *Storage) withWallet(ctx context.Context, fn func(*wallet) error) error {
+	obj, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	name := s.wallet
+	if name == "" {
+		if err = obj.CallWithContext(ctx, iface+".networkWallet", 0).Store(&name); err != nil {
+			return fmt.Errorf("couldn't get the name of the network wallet: %w", err)
+		}
+	}
+	var handle int32
+	// 0 is the ID of the window KWallet should use as the parent of its prompts; there is none
+	if err = obj.CallWithContext(ctx, iface+".open", 0, name, int64(0), s.appID).Store(&handle); err != nil {
+		return fmt.Errorf("couldn't open wallet %q: %w", name, err)
+	}
+	if handle < 0 {
+		return fmt.Errorf("couldn't open wallet %q. The user may have denied access", name)
+	}
+	w := &wallet{appID: s.appID, folder: s.folder, handle: handle, key: s.key, obj: obj}
+	defer func() {
+		// closing the handle doesn't close the wallet for other applications
+		var rc int32
+		if err := obj.CallWithContext(ctx, iface+".close", 0, handle, false, s.appID).Store(&rc); err != nil {
+			s.logger.DebugContext(ctx, "couldn't close wallet", slog.Any("error", err))
+		}
+	}()
+	return fn(w)
+}
+
+// connect returns the KWallet daemon, connecting to the session bus if necessary. Callers must hold s.m.
+func (s *Storage) connect(ctx context.Context) (dbus.BusObject, error) {
+	if s.conn == nil || !s.conn.Connected() {
+		conn, err := dbus.ConnectSessionBus()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't connect to the session bus: %w", err)
+		}
+		s.conn, s.svc = conn, nil
+	}
+	if s.svc == nil {
+		bus := s.conn.BusObject()
+		var activatable []string
+		if err := bus.CallWithContext(ctx, "org.freedesktop.DBus.ListActivatableNames", 0).Store(&activatable); err != nil {
+			return nil, err
+		}
+		for i := range services {
+			var owned bool
+			if err := bus.CallWithContext(ctx, "org.freedesktop.DBus.NameHasOwner", 0, services[i].name).Store(&owned); err != nil {
+				return nil, err
+			}
+			if !owned {
+				for _, name := range activatable {
+					if owned = name == services[i].name; owned {
+						break
+					}
+				}
+			}
+			if owned {
+				s.svc = &services[i]
+				break
+			}
+		}
+		if s.svc == nil {
+			return nil, errors.New("KWallet isn't available on the session bus")
+		}
+		s.logger.DebugContext(ctx, "using KWallet daemon", slog.String("service", s.svc.name))
+	}
+	return s.conn.Object(s.svc.name, s.svc.path), nil
+}
+
+var _ accessor.Accessor = (*Storage)(nil)
@@ -0,0 +1,318 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package kwallet
+
+import (
+	"bufio"
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// fakeWallet is a stand-in for a KWallet daemon
+type fakeWallet struct {
+	// appIDs are the application IDs of method calls
+	appIDs map[string]bool
+	// denied makes open fail
+	denied bool
+	// entries maps folder names to entries, which map keys to values
+	entries map[string]map[string]fakeEntry
+	m       sync.Mutex
+	// open maps handles to wallet names
+	open map[int32]string
+	// opened are the names of wallets opened
+	opened []string
+}
+
+type fakeEntry struct {
+	t     int32
+	value any
+}
+
+func newFakeWallet() *fakeWallet {
+	return &fakeWallet{appIDs: map[string]bool{}, entries: map[string]map[string]fakeEntry{}, open: map[int32]string{}}
+}
+
+// locked calls "fn" while holding the fake's lock. The race detector can't see that D-Bus
+// replies order the fake's writes before the test's reads, so tests must access state this way.
+func (f *fakeWallet) locked(fn func()) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fn()
+}
+
+func (f *fakeWallet) methods() map[string]any {
+	check := func(handle int32, appID string) *dbus.Error {
+		f.appIDs[appID] = true
+		if _, ok := f.open[handle]; !ok {
+			return dbus.NewError("org.kde.KWallet.Error", []any{"invalid handle"})
+		}
+		return nil
+	}
+	write := func(handle int32, folder, key string, e fakeEntry, appID string) (int32, *dbus.Error) {
+		f.m.Lock()
+		defer f.m.Unlock()
+		if err := check(handle, appID); err != nil {
+			return -1, err
+		}
+		if _, ok := f.entries[folder]; !ok {
+			return -1, nil
+		}
+		f.entries[folder][key] = e
+		return 0, nil
+	}
+	read := func(handle int32, folder, key, appID string) (fakeEntry, *dbus.Error) {
+		f.m.Lock()
+		defer f.m.Unlock()
+		if err := check(handle, appID); err != nil {
+			return fakeEntry{}, err
+		}
+		return f.entries[folder][key], nil
+	}
+	return map[string]any{
+		"networkWallet": func() (string, *dbus.Error) { return "kdewallet", nil },
+		"open": func(wallet string, wID int64, appID string) (int32, *dbus.Error) {
+			f.m.Lock()
+			defer f.m.Unlock()
+			f.appIDs[appID] = true
+			if f.denied {
+				return -1, nil
+			}
+			handle := int32(len(f.opened) + 1)
+			f.open[handle] = wallet
+			f.opened = append(f.opened, wallet)
+			return handle, nil
+		},
+		"close": func(handle int32, force bool, appID string) (int32, *dbus.Error) {
+			f.m.Lock()
+			defer f.m.Unlock()
+			if err := check(handle, appID); err != nil {
+				return -1, err
+			}
+			delete(f.open, handle)
+			return 0, nil
+		},
+		"hasFolder": func(handle int32, folder, appID string) (bool, *dbus.Error) {
+			f.m.Lock()
+			defer f.m.Unlock()
+			_, ok := f.entries[folder]
+			return ok, check(handle, appID)
+		},
+		"createFolder": func(handle int32, folder, appID string) (bool, *dbus.Error) {
+			f.m.Lock()
+			defer f.m.Unlock()
+			f.entries[folder] = map[string]fakeEntry{}
+			return true, check(handle, appID)
+		},
+		"hasEntry": func(handle int32, folder, key, appID string) (bool, *dbus.Error) {
+			f.m.Lock()
+			defer f.m.Unlock()
+			_, ok := f.entries[folder][key]
+			return ok, check(handle, appID)
+		},
+		"entryType": func(handle int32, folder, key, appID string) (int32, *dbus.Error) {
+			e, err := read(handle, folder, key, appID)
+			return e.t, err
+		},
+		"readPassword": func(handle int32, folder, key, appID string) (string, *dbus.Error) {
+			e, err := read(handle, folder, key, appID)
+			s, _ := e.value.(string)
+			return s, err
+		},
+		"readMap": func(handle int32, folder, key, appID string) ([]byte, *dbus.Error) {
+			e, err := read(handle, folder, key, appID)
+			b, _ := e.value.([]byte)
+			return b, err
+		},
+		"writePassword": func(handle int32, folder, key, value, appID string) (int32, *dbus.Error) {
+			return write(handle, folder, key, fakeEntry{t: kwalletPassword, value: value}, appID)
+		},
+		"writeMap": func(handle int32, folder, key string, value []byte, appID string) (int32, *dbus.Error) {
+			return write(handle, folder, key, fakeEntry{t: kwalletMap, value: value}, appID)
+		},
+		"removeEntry": func(handle int32, folder, key, appID string) (int32, *dbus.Error) {
+			f.m.Lock()
+			defer f.m.Unlock()
+			if err := check(handle, appID); err != nil {
+				return -1, err
+			}
+			delete(f.entries[folder], key)
+			return 0, nil
+		},
+	}
+}
+
+// startBus starts a private session bus and returns a connection to it. It also points
+// DBUS_SESSION_BUS_ADDRESS at the bus, so Storage connects to it.
+func startBus(t *testing.T) *dbus.Conn {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip(err)
+	}
+	daemon := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address=1")
+	stdout, err := daemon.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, daemon.Start())
+	t.Cleanup(func() { _ = daemon.Process.Kill(); _ = daemon.Wait() })
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	addr = strings.TrimSpace(addr)
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", addr)
+	conn, err := dbus.Connect(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// serve exports a fake wallet as the given KWallet daemon
+func serve(t *testing.T, conn *dbus.Conn, svc service) *fakeWallet {
+	f := newFakeWallet()
+	require.NoError(t, conn.ExportMethodTable(f.methods(), svc.path, iface))
+	reply, err := conn.RequestName(svc.name, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+	return f
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	for _, svc := range services {
+		for _, et := range []EntryType{EntryPassword, EntryMap} {
+			name := svc.name + "/password"
+			if et == EntryMap {
+				name = svc.name + "/map"
+			}
+			t.Run(name, func(t *testing.T) {
+				f := serve(t, startBus(t), svc)
+				s, err := New(t.Name(), WithAppID("app"), WithEntryType(et), WithFolder("folder"))
+				require.NoError(t, err)
+
+				actual, err := s.Read(ctx)
+				require.NoError(t, err)
+				require.Nil(t, actual)
+				require.NoError(t, s.Delete(ctx))
+
+				for _, expected := range [][]byte{[]byte("expected"), {0, 1, 2, 255}, {}} {
+					require.NoError(t, s.Write(ctx, expected))
+					actual, err = s.Read(ctx)
+					require.NoError(t, err)
+					require.Equal(t, expected, actual)
+				}
+				expectedType := int32(kwalletPassword)
+				if et == EntryMap {
+					expectedType = kwalletMap
+				}
+				f.locked(func() { require.Equal(t, expectedType, f.entries["folder"][t.Name()].t) })
+
+				require.NoError(t, s.Delete(ctx))
+				actual, err = s.Read(ctx)
+				require.NoError(t, err)
+				require.Nil(t, actual)
+
+				f.locked(func() {
+					require.Equal(t, map[string]bool{"app": true}, f.appIDs)
+					require.Empty(t, f.open, "Storage should close the wallet after each operation")
+				})
+			})
+		}
+	}
+}
+
+func TestEntryTypes(t *testing.T) {
+	serve(t, startBus(t), services[0])
+	expected := []byte("expected")
+	m, err := New(t.Name(), WithEntryType(EntryMap))
+	require.NoError(t, err)
+	p, err := New(t.Name())
+	require.NoError(t, err)
+
+	// Storage should read either kind of entry regardless of its entry type option
+	require.NoError(t, m.Write(ctx, expected))
+	actual, err := p.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	require.NoError(t, p.Write(ctx, expected))
+	actual, err = m.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+}
+
+func TestErrors(t *testing.T) {
+	t.Run("access denied", func(t *testing.T) {
+		f := serve(t, startBus(t), services[0])
+		f.locked(func() { f.denied = true })
+		s, err := New(t.Name())
+		require.NoError(t, err)
+		_, err = s.Read(ctx)
+		require.Error(t, err)
+		require.Error(t, s.Write(ctx, []byte("data")))
+		require.Error(t, s.Delete(ctx))
+	})
+	t.Run("no KWallet", func(t *testing.T) {
+		startBus(t)
+		s, err := New(t.Name())
+		require.NoError(t, err)
+		_, err = s.Read(ctx)
+		require.Error(t, err)
+	})
+	t.Run("options", func(t *testing.T) {
+		for _, opts := range [][]option{
+			{WithAppID("")},
+			{WithEntryType(EntryType(42))},
+			{WithFolder("")},
+			{WithWallet("")},
+		} {
+			_, err := New(t.Name(), opts...)
+			require.Error(t, err)
+		}
+		_, err := New("")
+		require.Error(t, err)
+	})
+}
+
+func TestWithWallet(t *testing.T) {
+	f := serve(t, startBus(t), services[0])
+	s, err := New(t.Name(), WithWallet("other"))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	f.locked(func() { require.Equal(t, []string{"other"}, f.opened) })
+
+	s, err = New(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	f.locked(func() {
+		require.Equal(t, []string{"other", "kdewallet"}, f.opened, "Storage should default to the network wallet")
+	})
+}
+
+func TestMap(t *testing.T) {
+	for _, m := range []map[string]string{
+		{},
+		{"data": "value"},
+		{"a": "", "b": "ünïcødé 🔑", "c": strings.Repeat("x", 1<<16)},
+	} {
+		actual, err := decodeMap(encodeMap(m))
+		require.NoError(t, err)
+		require.Equal(t, m, actual)
+	}
+
+	// a QMap<QString, QString> {"k": "v"} serialized by QDataStream
+	b := []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 'k', 0, 0, 0, 2, 0, 'v'}
+	require.Equal(t, b, encodeMap(map[string]string{"k": "v"}))
+	// QDataStream serializes a null QString with length 0xFFFFFFFF
+	actual, err := decodeMap([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 'k', 0xFF, 0xFF, 0xFF, 0xFF})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"k": ""}, actual)
+
+	for _, b := range [][]byte{{}, {0, 0, 0, 1}, {0, 0, 0, 1, 0, 0, 0, 3, 0, 'k', 0}, {0, 0, 0, 1, 0, 0, 0, 4, 0, 'k'}} {
+		_, err := decodeMap(b)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package kwallet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf16"
+)
+
+// nullString is the length QDataStream writes for a null QString
+const nullString = 0xFFFFFFFF
+
+// encodeMap serializes a map as QDataStream serializes a QMap<QString, QString>, which is the
+// format of KWallet map entries
+func encodeMap(m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	// QMap is ordered by key
+	sort.Strings(keys)
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(m)))
+	for _, k := range keys {
+		b = appendString(b, k)
+		b = appendString(b, m[k])
+	}
+	return b
+}
+
+// decodeMap deserializes a QMap<QString, QString> serialized by QDataStream
+func decodeMap(b []byte) (map[string]string, error) {
+	if len(b) < 4 {
+		return nil, errors.New("map entry is truncated")
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	m := map[string]string{}
+	for i := uint32(0); i < n; i++ {
+		var (
+			k, v string
+			err  error
+		)
+		if k, b, err = readString(b); err != nil {
+			return nil, err
+		}
+		if v, b, err = readString(b); err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// appendString appends a QString serialized as UTF-16BE with a length prefix
+func appendString(b []byte, s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(u)*2))
+	for _, c := range u {
+		b = binary.BigEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+// readString reads a serialized QString, returning it and the remaining bytes
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("map entry is truncated")
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if n == nullString {
+		return "", b, nil
+	}
+	if n%2 != 0 || uint64(n) > uint64(len(b)) {
+		return "", nil, fmt.Errorf("map entry has invalid string length %d", n)
+	}
+	u := make([]uint16, n/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u)), b[n:], nil
+}
@@ -18,6 +18,13 @@ typedef struct
     char *message;
 } gError;
 
+typedef struct gList
+{
+    void *data;
+    struct gList *next;
+    struct gList *prev;
+} gList;
+
 typedef struct
 {
     const char *name;
@@ -41,25 +48,22 @@ typedef struct
     char *r8;
 } schema;
 
-schema *new_schema(char *name, const char *key1, const char *key2)
+// new_schema allocates a schema having no attributes. Add attributes with set_schema_attribute.
+schema *new_schema(char *name)
 {
-    int i = 0;
     schema *s;
-    s = malloc(sizeof(schema));
+    s = calloc(1, sizeof(schema));
     s->flags = 0; // SECRET_SCHEMA_NONE
     s->name = name;
-    if (key1 != NULL)
-    {
-        s->attributes[i++] = (schemaAttribute){key1, 0}; // 0 == SECRET_SCHEMA_ATTRIBUTE_STRING
-    }
-    if (key2 != NULL)
-    {
-        s->attributes[i++] = (schemaAttribute){key2, 0};
-    }
-    s->attributes[i] = (schemaAttribute){NULL, 0};
     return s;
 }
 
+// set_schema_attribute sets the name of the schema's ith attribute
+void set_schema_attribute(schema *s, int i, const char *key)
+{
+    s->attributes[i] = (schemaAttribute){key, 0}; // 0 == SECRET_SCHEMA_ATTRIBUTE_STRING
+}
+
 // free a gError. f must be a pointer to g_error_free
 void free_g_error(void *f, gError *err)
 {
@@ -68,47 +72,261 @@ void free_g_error(void *f, gError *err)
     fn(err);
 }
 
-// clear (delete) a secret. f must be a pointer to secret_password_clear_sync
-// https://gnome.pages.gitlab.gnome.org/libsecret/func.password_clear_sync.html
-int clear(void *f, schema *sch, void* cancellable, gError **err, char *key1, char *value1, char *key2, char *value2)
+// create a GHashTable having string keys. f must be a pointer to g_hash_table_new, hash a pointer
+// to g_str_hash and equal a pointer to g_str_equal
+void *new_hash_table(void *f, void *hash, void *equal)
+{
+    void *(*fn)(void *hash, void *equal);
+    fn = (void *(*)(void *hash, void *equal))f;
+    return fn(hash, equal);
+}
+
+// insert a key/value pair into a GHashTable. f must be a pointer to g_hash_table_insert
+void hash_table_insert(void *f, void *table, char *key, char *value)
+{
+    int (*fn)(void *table, char *key, char *value);
+    fn = (int (*)(void *table, char *key, char *value))f;
+    fn(table, key, value);
+}
+
+// decrement an object's reference count. f must be a pointer to an unref function such as g_hash_table_unref
+void unref(void *f, void *p)
+{
+    void (*fn)(void *p);
+    fn = (void (*)(void *p))f;
+    fn(p);
+}
+
+// store a password. f must be a pointer to secret_password_storev_sync
+// https://gnome.pages.gitlab.gnome.org/libsecret/func.password_storev_sync.html
+int storev(void *f, schema *sch, void *attributes, char *collection, char *label, char *password, void *cancellable, gError **err)
+{
+    int (*fn)(schema *sch, void *attributes, char *collection, char *label, char *password, void *cancellable, gError **err);
+    fn = (int (*)(schema *sch, void *attributes, char *collection, char *label, char *password, void *cancellable, gError **err))f;
+    return fn(sch, attributes, collection, label, password, cancellable, err);
+}
+
+// create a SecretValue. f must be a pointer to secret_value_new
+// https://gnome.pages.gitlab.gnome.org/libsecret/ctor.Value.new.html
+void *value_new(void *f, char *secret, long length, char *content_type)
 {
-    int (*fn)(schema *sch, void* cancellable, gError **err, char *key1, char *value1, char *key2, char *value2, ...);
-    fn = (int (*)(schema *sch, void* cancellable, gError **err, char *key1, char *value1, char *key2, char *value2, ...))f;
-    int r = fn(sch, cancellable, err, key1, value1, key2, value2, NULL);
-    return r;
+    void *(*fn)(char *secret, long length, char *content_type);
+    fn = (void *(*)(char *secret, long length, char *content_type))f;
+    return fn(secret, length, content_type);
 }
 
-// lookup a password. f must be a pointer to secret_password_lookup_sync
-// https://gnome.pages.gitlab.gnome.org/libsecret/func.password_lookup_sync.html
-char *lookup(void *f, schema *sch, void* cancellable, gError **err, char *key1, char *value1, char *key2, char *value2)
+// get a SecretValue's data. f must be a pointer to secret_value_get
+// https://gnome.pages.gitlab.gnome.org/libsecret/method.Value.get.html
+const char *value_get(void *f, void *value, unsigned long *length)
 {
-    char *(*fn)(schema *s, void *cancellable, gError **err, char *attrKey1, char *attrValue1, char *attrKey2, char* attrValue2, ...);
-    fn = (char *(*)(schema *s, void *cancellable, gError **err, char *attrKey1, char *attrValue1, char *attrKey2, char* attrValue2, ...))f;
-    char *r = fn(sch, cancellable, err, key1, value1, key2, value2, NULL);
-    return r;
+    const char *(*fn)(void *value, unsigned long *length);
+    fn = (const char *(*)(void *value, unsigned long *length))f;
+    return fn(value, length);
 }
 
-// store a password. f must be a pointer to secret_password_store_sync
-// https://gnome.pages.gitlab.gnome.org/libsecret/func.password_store_sync.html
-int store(void *f, schema *sch, char* collection, char *label, char *password, void* cancellable, gError **err, char *key1, char *value1, char *key2, char *value2)
+// get a SecretValue's content type. f must be a pointer to secret_value_get_content_type
+// https://gnome.pages.gitlab.gnome.org/libsecret/method.Value.get_content_type.html
+const char *value_get_content_type(void *f, void *value)
 {
-    int (*fn)(schema *s, char *collection, char *label, char *data, void *cancellable, gError **err, ...);
-    fn = (int (*)(schema *s, char *collection, char *label, char *data, void *cancellable, gError **err, ...))f;
-    int r = fn(sch, collection, label, password, cancellable, err, key1, value1, key2, value2, NULL);
-    return r;
+    const char *(*fn)(void *value);
+    fn = (const char *(*)(void *value))f;
+    return fn(value);
+}
+
+// store a secret value. f must be a pointer to secret_password_storev_binary_sync
+// https://gnome.pages.gitlab.gnome.org/libsecret/func.password_storev_binary_sync.html
+int storev_binary(void *f, schema *sch, void *attributes, char *collection, char *label, void *value, void *cancellable, gError **err)
+{
+    int (*fn)(schema *sch, void *attributes, char *collection, char *label, void *value, void *cancellable, gError **err);
+    fn = (int (*)(schema *sch, void *attributes, char *collection, char *label, void *value, void *cancellable, gError **err))f;
+    return fn(sch, attributes, collection, label, value, cancellable, err);
+}
+
+// get the Secret Service proxy. f must be a pointer to secret_service_get_sync
+// https://gnome.pages.gitlab.gnome.org/libsecret/type_func.Service.get_sync.html
+void *service_get(void *f, int flags, void *cancellable, gError **err)
+{
+    void *(*fn)(int flags, void *cancellable, gError **err);
+    fn = (void *(*)(int flags, void *cancellable, gError **err))f;
+    return fn(flags, cancellable, err);
+}
+
+// get a collection by alias or D-Bus path. f must be a pointer to secret_collection_for_alias_sync
+// or secret_collection_new_for_dbus_path_sync, which have compatible signatures
+// https://gnome.pages.gitlab.gnome.org/libsecret/type_func.Collection.for_alias_sync.html
+// https://gnome.pages.gitlab.gnome.org/libsecret/type_func.Collection.new_for_dbus_path_sync.html
+void *collection_get(void *f, void *service, char *name, int flags, void *cancellable, gError **err)
+{
+    void *(*fn)(void *service, char *name, int flags, void *cancellable, gError **err);
+    fn = (void *(*)(void *service, char *name, int flags, void *cancellable, gError **err))f;
+    return fn(service, name, flags, cancellable, err);
+}
+
+// get whether a collection is locked. f must be a pointer to secret_collection_get_locked
+// https://gnome.pages.gitlab.gnome.org/libsecret/method.Collection.get_locked.html
+int collection_get_locked(void *f, void *collection)
+{
+    int (*fn)(void *collection);
+    fn = (int (*)(void *collection))f;
+    return fn(collection);
+}
+
+// append to a GList. f must be a pointer to g_list_append
+void *list_append(void *f, void *list, void *data)
+{
+    void *(*fn)(void *list, void *data);
+    fn = (void *(*)(void *list, void *data))f;
+    return fn(list, data);
+}
+
+// unlock objects, prompting the user if necessary. f must be a pointer to secret_service_unlock_sync
+// https://gnome.pages.gitlab.gnome.org/libsecret/method.Service.unlock_sync.html
+int service_unlock(void *f, void *service, void *objects, void *cancellable, void **unlocked, gError **err)
+{
+    int (*fn)(void *service, void *objects, void *cancellable, void **unlocked, gError **err);
+    fn = (int (*)(void *service, void *objects, void *cancellable, void **unlocked, gError **err))f;
+    return fn(service, objects, cancellable, unlocked, err);
+}
+
+// search for items. f must be a pointer to secret_service_search_sync
+// https://gnome.pages.gitlab.gnome.org/libsecret/method.Service.search_sync.html
+gList *service_search(void *f, void *service, schema *sch, void *attributes, int flags, void *cancellable, gError **err)
+{
+    gList *(*fn)(void *service, schema *sch, void *attributes, int flags, void *cancellable, gError **err);
+    fn = (gList *(*)(void *service, schema *sch, void *attributes, int flags, void *cancellable, gError **err))f;
+    return fn(service, sch, attributes, flags, cancellable, err);
+}
+
+// search a collection for items. f must be a pointer to secret_collection_search_sync
+// https://gnome.pages.gitlab.gnome.org/libsecret/method.Collection.search_sync.html
+gList *collection_search(void *f, void *collection, schema *sch, void *attributes, int flags, void *cancellable, gError **err)
+{
+    gList *(*fn)(void *collection, schema *sch, void *attributes, int flags, void *cancellable, gError **err);
+    fn = (gList *(*)(void *collection, schema *sch, void *attributes, int flags, void *cancellable, gError **err))f;
+    return fn(collection, sch, attributes, flags, cancellable, err);
+}
+
+// delete an item. f must be a pointer to secret_item_delete_sync
+// https://gnome.pages.gitlab.gnome.org/libsecret/method.Item.delete_sync.html
+int item_delete(void *f, void *item, void *cancellable, gError **err)
+{
+    int (*fn)(void *item, void *cancellable, gError **err);
+    fn = (int (*)(void *item, void *cancellable, gError **err))f;
+    return fn(item, cancellable, err);
+}
+
+// get a pointer property of an object. f must be a pointer to a getter such as secret_item_get_attributes
+void *get_pointer(void *f, void *p)
+{
+    void *(*fn)(void *p);
+    fn = (void *(*)(void *p))f;
+    return fn(p);
+}
+
+// get an integer property of an object. f must be a pointer to a getter such as secret_item_get_created
+unsigned long long get_uint64(void *f, void *p)
+{
+    unsigned long long (*fn)(void *p);
+    fn = (unsigned long long (*)(void *p))f;
+    return fn(p);
+}
+
+// get a boolean property of an object. f must be a pointer to a getter such as secret_item_get_locked
+int get_bool(void *f, void *p)
+{
+    int (*fn)(void *p);
+    fn = (int (*)(void *p))f;
+    return fn(p);
+}
+
+// look up a value in a GHashTable. f must be a pointer to g_hash_table_lookup
+void *hash_table_lookup(void *f, void *table, void *key)
+{
+    void *(*fn)(void *table, void *key);
+    fn = (void *(*)(void *table, void *key))f;
+    return fn(table, key);
+}
+
+// get the quark identifying libsecret errors. f must be a pointer to secret_error_get_quark
+unsigned int error_quark(void *f)
+{
+    unsigned int (*fn)(void);
+    fn = (unsigned int (*)(void))f;
+    return fn();
+}
+
+// create a GCancellable. f must be a pointer to g_cancellable_new
+void *cancellable_new(void *f)
+{
+    void *(*fn)(void);
+    fn = (void *(*)(void))f;
+    return fn();
+}
+
+// cancel a GCancellable. f must be a pointer to g_cancellable_cancel
+void cancellable_cancel(void *f, void *cancellable)
+{
+    void (*fn)(void *cancellable);
+    fn = (void (*)(void *cancellable))f;
+    fn(cancellable);
 }
 */
 import "C"
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"log/slog"
 	"runtime"
+	"strings"
+	"time"
+	"unicode/utf8"
 	"unsafe"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/compat"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	// collectionDefault is the alias of the default collection
+	collectionDefault = "default"
+	// contentTypeText is the content type of secrets stored via libsecret's password API.
+	// Storage encodes data as base64 when storing it with this content type.
+	contentTypeText = "text/plain"
+	// maxAttributes is the number of attributes a libsecret schema can have
+	maxAttributes = 32
+	// schemaAttribute is the attribute in which libsecret stores an item's schema name
+	schemaAttribute = "xdg:schema"
+	// searchAll, searchUnlock and searchLoadSecrets are SECRET_SEARCH_ALL, SECRET_SEARCH_UNLOCK and SECRET_SEARCH_LOAD_SECRETS
+	searchAll, searchUnlock, searchLoadSecrets = 1 << 1, 1 << 2, 1 << 3
+	so                                         = "libsecret-1.so"
+	// secretErrorIsLocked is SECRET_ERROR_IS_LOCKED, the code of libsecret errors due to a locked collection or item
+	secretErrorIsLocked = 2
 )
 
-const so = "libsecret-1.so"
+// ErrLocked indicates Storage couldn't access the secret service because a collection is locked.
+// A user can unlock the collection with a tool such as Seahorse, or an application can prompt the
+// user to unlock it by calling [Storage.UnlockCollection].
+var ErrLocked = errors.New("secret service collection is locked")
+
+// Item describes an item in the secret service. It never includes the item's secret.
+type Item struct {
+	// Attributes are the item's attributes, excluding its schema name
+	Attributes map[string]string
+	// Created and Modified are when the item was created and last modified
+	Created, Modified time.Time
+	// Label is the item's label, which tools such as Seahorse display
+	Label string
+	// Locked indicates whether the item is locked. The secret service reveals a locked item's
+	// attributes, label and timestamps, but not its secret.
+	Locked bool
+	// Path is the item's D-Bus object path. It identifies the item within the secret service.
+	Path string
+	// Schema is the name of the item's schema. It's empty when the item has no schema.
+	Schema string
+}
 
 type attribute struct {
 	name, value string
@@ -116,18 +334,98 @@ type attribute struct {
 
 type option func(*Storage) error
 
-// WithAttribute adds an attribute to the schema representing the cache.
-// [Storage] supports up to 2 attributes.
+// WithAttribute adds an attribute to the schema representing the cache. Attributes identify
+// the cache's secret, so tools such as secret-tool and Seahorse can find it. For example,
+// attributes can distinguish caches belonging to different applications, tenants or users.
+// [Storage] supports up to 32 attributes.
 func WithAttribute(name, value string) option {
 	return func(s *Storage) error {
-		if len(s.attributes) == 2 {
-			return errors.New("Storage supports up to 2 attributes")
+		if name == "" {
+			return errors.New("attribute name can't be empty")
+		}
+		if len(s.attributes) == maxAttributes {
+			return fmt.Errorf("Storage supports up to %d attributes", maxAttributes)
+		}
+		for _, attr := range s.attributes {
+			if attr.name == name {
+				return fmt.Errorf("duplicate attribute %q", name)
+			}
 		}
 		s.attributes = append(s.attributes, attribute{name: name, value: value})
 		return nil
 	}
 }
 
+// WithCollection sets the collection in which Storage stores data. Storage reads and deletes data only in
+// this collection, ignoring matching items in other collections. "c" is either a collection alias
+// such as "default" or "session", or the D-Bus object path of a collection such as
+// "/org/freedesktop/secrets/collection/login". The default is the "default" collection, which is
+// typically the user's login keyring. The "session" collection is held in memory and disappears
+// when the user logs out.
+func WithCollection(c string) option {
+	return func(s *Storage) error {
+		if c == "" {
+			return errors.New("collection can't be empty")
+		}
+		s.collection = c
+		return nil
+	}
+}
+
+// WithInteractive sets whether Storage may prompt the user to unlock a locked collection. By default,
+// the secret service prompts the user when Storage tries to access a locked collection. When interaction
+// isn't allowed, Storage returns [ErrLocked] immediately instead. This is useful in headless environments,
+// in which a prompt may block indefinitely.
+func WithInteractive(allowed bool) option {
+	return func(s *Storage) error {
+		s.interactive = allowed
+		return nil
+	}
+}
+
+// WithCompatibility makes Storage encode data as the MSAL extension library "p" identifies does, so
+// that it can share a cache with applications using that library. With a profile other than [compat.Go],
+// Storage stores data as a text secret, which the other libraries can read: base64 encoded for [compat.DotNet],
+// and as is for [compat.Python], which stores the cache's JSON. Storage then ignores [WithContentType]. Storage
+// reads text secrets in the same encoding, so Storage using the Go profile can't read data written with the
+// Python profile. Pass the other application's schema name, attributes and collection to New, [WithAttribute]
+// and [WithCollection].
+func WithCompatibility(p compat.Profile) option {
+	return func(s *Storage) error {
+		switch p {
+		case compat.Go, compat.DotNet, compat.Python:
+			s.compat = p
+			return nil
+		default:
+			return fmt.Errorf("unknown compatibility profile %d", p)
+		}
+	}
+}
+
+// WithContentType sets the content type of the secret holding cached data, for example "application/json".
+// The default is "application/octet-stream". Storage stores data in its binary form regardless of content type.
+func WithContentType(ct string) option {
+	return func(s *Storage) error {
+		if ct == "" {
+			return errors.New("content type can't be empty")
+		}
+		if ct == contentTypeText {
+			return fmt.Errorf("content type %q is reserved for base64 encoded data", ct)
+		}
+		s.contentType = ct
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about secret service operations. These records
+// never include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
 // WithLabel sets a label on the schema representing the cache. The default label is "MSALCache".
 func WithLabel(label string) option {
 	return func(s *Storage) error {
@@ -138,43 +436,67 @@ func WithLabel(label string) option {
 
 // Storage uses libsecret to store data with a DBus Secret Service such as GNOME Keyring or KDE Wallet. The Service
 // must be unlocked before Storage can access it. Unlocking typically requires user interaction, and some systems may
-// be unable to unlock the Service in a headless environment such as an SSH session.
+// be unable to unlock the Service in a headless environment such as an SSH session. Storage's methods return
+// ctx.Err() as soon as their context is done, even when the Service doesn't respond.
 type Storage struct {
 	// attributes are key/value pairs on the secret schema
 	attributes []attribute
+	// collection is the alias or D-Bus path of the collection in which Storage stores data
+	collection string
+	// binary indicates whether Storage stores data in binary form. It's false only when
+	// libsecret is too old to support binary secrets (versions before 0.19).
+	binary bool
+	// compat determines how Storage encodes text secrets and whether it stores binary secrets
+	compat compat.Profile
+	// contentType is the content type of binary secrets
+	contentType string
 	// handle is an opaque handle for libsecret returned by dlopen(). It should be
 	// released via dlclose() when no longer needed so the loader knows when it's
 	// safe to unload libsecret.
 	handle unsafe.Pointer
+	// interactive determines whether Storage may prompt the user to unlock a collection
+	interactive bool
 	// label of the secret schema
 	label string
-	// clear, freeError, lookup and store are the addresses of libsecret functions
-	clear, freeError, lookup, store unsafe.Pointer
+	// logger receives debug records. It must never receive stored data.
+	logger *slog.Logger
+	// freeError and store are the addresses of libsecret functions
+	freeError, store unsafe.Pointer
+	// hashTableNew, hashTableInsert, hashTableUnref, strEqual and strHash are the addresses of glib functions
+	hashTableNew, hashTableInsert, hashTableUnref, strEqual, strHash unsafe.Pointer
+	// storeBinary and valueNew are the addresses of libsecret functions for binary secrets
+	storeBinary, valueNew unsafe.Pointer
+	// itemGetSecret, valueGet, valueGetContentType and valueUnref are the addresses of libsecret functions for
+	// reading secrets
+	itemGetSecret, valueGet, valueGetContentType, valueUnref unsafe.Pointer
+	// cancellableCancel and cancellableNew are the addresses of gio functions for cancelling operations
+	cancellableCancel, cancellableNew unsafe.Pointer
+	// collectionForAlias, collectionForPath, collectionGetLocked, collectionSearch, errorQuark, listAppend, listFree,
+	// objectUnref, serviceGet and serviceUnlock are the addresses of libsecret and glib functions for managing collections
+	collectionForAlias, collectionForPath, collectionGetLocked, collectionSearch, errorQuark, listAppend, listFree, objectUnref, serviceGet, serviceUnlock unsafe.Pointer
+	// gFree, hashTableGetKeys, hashTableLookup, itemDelete, itemGetAttributes, itemGetCreated, itemGetLabel, itemGetLocked,
+	// itemGetModified, proxyGetObjectPath and serviceSearch are the addresses of libsecret and glib functions for searching
+	gFree, hashTableGetKeys, hashTableLookup, itemDelete, itemGetAttributes, itemGetCreated, itemGetLabel, itemGetLocked, itemGetModified, proxyGetObjectPath, serviceSearch unsafe.Pointer
 	// schema identifies the cached data in the secret service
 	schema *C.schema
 }
 
 // New is the constructor for Storage. "name" is the name of the secret schema.
 func New(name string, opts ...option) (*Storage, error) {
-	s := Storage{label: "MSALCache"}
+	s := Storage{collection: collectionDefault, contentType: "application/octet-stream", interactive: true, label: "MSALCache"}
 	for _, o := range opts {
 		if err := o(&s); err != nil {
 			return nil, err
 		}
 	}
-	n := C.CString(so)
-	defer C.free(unsafe.Pointer(n))
-
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("schema", name))
 	// set the handle and finalizer first so any handle will be
 	// released even when this constructor goes on to return an error
-	s.handle = C.dlopen(n, C.RTLD_LAZY)
-	if s.handle == nil {
-		msg := fmt.Sprintf("encrypted storage isn't possible because the dynamic linker couldn't open %s", so)
-		if e := C.dlerror(); e != nil {
-			msg += fmt.Sprintf(". The underlying error is %q", C.GoString(e))
-		}
-		return nil, errors.New(msg)
+	handle, err := dlopen(so)
+	if err != nil {
+		return nil, err
 	}
+	s.handle = handle
 	runtime.SetFinalizer(&s, func(s *Storage) {
 		if s.handle != nil {
 			C.dlclose(s.handle)
@@ -190,115 +512,565 @@ func New(name string, opts ...option) (*Storage, error) {
 		}
 	})
 
-	clear, err := s.symbol("secret_password_clear_sync")
-	if err != nil {
-		return nil, err
+	for _, sym := range []struct {
+		name string
+		p    *unsafe.Pointer
+	}{
+		{"g_error_free", &s.freeError},
+		{"secret_password_storev_sync", &s.store},
+		{"g_hash_table_new", &s.hashTableNew},
+		{"g_hash_table_insert", &s.hashTableInsert},
+		{"g_hash_table_unref", &s.hashTableUnref},
+		{"g_str_equal", &s.strEqual},
+		{"g_str_hash", &s.strHash},
+		{"g_cancellable_cancel", &s.cancellableCancel},
+		{"g_cancellable_new", &s.cancellableNew},
+		{"secret_collection_for_alias_sync", &s.collectionForAlias},
+		{"secret_collection_new_for_dbus_path_sync", &s.collectionForPath},
+		{"secret_collection_get_locked", &s.collectionGetLocked},
+		{"secret_collection_search_sync", &s.collectionSearch},
+		{"secret_error_get_quark", &s.errorQuark},
+		{"g_list_append", &s.listAppend},
+		{"g_list_free", &s.listFree},
+		{"g_object_unref", &s.objectUnref},
+		{"secret_service_get_sync", &s.serviceGet},
+		{"secret_service_unlock_sync", &s.serviceUnlock},
+		{"g_free", &s.gFree},
+		{"g_hash_table_get_keys", &s.hashTableGetKeys},
+		{"g_hash_table_lookup", &s.hashTableLookup},
+		{"secret_item_delete_sync", &s.itemDelete},
+		{"secret_item_get_attributes", &s.itemGetAttributes},
+		{"secret_item_get_created", &s.itemGetCreated},
+		{"secret_item_get_label", &s.itemGetLabel},
+		{"secret_item_get_locked", &s.itemGetLocked},
+		{"secret_item_get_modified", &s.itemGetModified},
+		{"secret_item_get_secret", &s.itemGetSecret},
+		{"secret_value_get", &s.valueGet},
+		{"secret_value_get_content_type", &s.valueGetContentType},
+		{"secret_value_unref", &s.valueUnref},
+		{"g_dbus_proxy_get_object_path", &s.proxyGetObjectPath},
+		{"secret_service_search_sync", &s.serviceSearch},
+	} {
+		fp, err := s.symbol(sym.name)
+		if err != nil {
+			return nil, err
+		}
+		*sym.p = fp
+	}
+	s.binary = true
+	for _, sym := range []struct {
+		name string
+		p    *unsafe.Pointer
+	}{
+		{"secret_password_storev_binary_sync", &s.storeBinary},
+		{"secret_value_new", &s.valueNew},
+	} {
+		fp, err := s.symbol(sym.name)
+		if err != nil {
+			s.logger.Debug("storing data as base64 text because libsecret doesn't support binary secrets", slog.Any("error", err))
+			s.binary = false
+			break
+		}
+		*sym.p = fp
+	}
+
+	// libsecret hangs on to these pointers; the finalizer frees them
+	s.schema = C.new_schema(C.CString(name))
+	for i, attr := range s.attributes {
+		C.set_schema_attribute(s.schema, C.int(i), C.CString(attr.name))
 	}
-	freeError, err := s.symbol("g_error_free")
+	return &s, nil
+}
+
+// Delete deletes the stored data in the configured collection, if any exists. Like [Storage.Write],
+// it waits for a cancelled operation to stop before returning.
+func (s *Storage) Delete(ctx context.Context) error {
+	_, err := call(ctx, s, true, func(cancellable unsafe.Pointer) (struct{}, error) {
+		return struct{}{}, s.delete(ctx, cancellable)
+	})
+	return err
+}
+
+func (s *Storage) delete(ctx context.Context, cancellable unsafe.Pointer) error {
+	if err := s.checkLocked(ctx, cancellable); err != nil {
+		return err
+	}
+	n := 0
+	err := s.searchCollection(ctx, cancellable, true, func(item unsafe.Pointer) error {
+		if err := s.deleteItem(item, cancellable); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
 	if err != nil {
+		return err
+	}
+	if n == 0 {
+		s.logger.DebugContext(ctx, "nothing to delete because the secret service has no matching secret")
+	}
+	return nil
+}
+
+// Read returns data stored according to the secret schema in the configured collection or, if no such data
+// exists, a nil slice and nil error. It can read binary secrets and base64 encoded text secrets written by
+// previous versions of Storage.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	return call(ctx, s, false, func(cancellable unsafe.Pointer) ([]byte, error) {
+		return s.read(ctx, cancellable)
+	})
+}
+
+func (s *Storage) read(ctx context.Context, cancellable unsafe.Pointer) ([]byte, error) {
+	if err := s.checkLocked(ctx, cancellable); err != nil {
 		return nil, err
 	}
-	lookup, err := s.symbol("secret_password_lookup_sync")
+	var data []byte
+	found := false
+	err := s.searchCollection(ctx, cancellable, false, func(item unsafe.Pointer) error {
+		found = true
+		value := C.get_pointer(s.itemGetSecret, item)
+		if value == nil {
+			// the secret service doesn't reveal a locked item's secret
+			return fmt.Errorf("%w: item %q", ErrLocked, C.GoString((*C.char)(C.get_pointer(s.proxyGetObjectPath, item))))
+		}
+		defer C.unref(s.valueUnref, value)
+		var length C.ulong
+		p := C.value_get(s.valueGet, value, &length)
+		data = C.GoBytes(unsafe.Pointer(p), C.int(length))
+		if ct := C.value_get_content_type(s.valueGetContentType, value); ct == nil || C.GoString(ct) == contentTypeText {
+			s.logger.DebugContext(ctx, "decoding text secret", slog.String("profile", s.compat.String()))
+			var err error
+			data, err = decodeText(s.compat, string(data))
+			return err
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	store, err := s.symbol("secret_password_store_sync")
+	if !found {
+		s.logger.DebugContext(ctx, "returning no data because the secret service has no matching secret")
+	}
+	return data, nil
+}
+
+// UnlockCollection prompts the user to unlock the collection in which Storage stores data, if that
+// collection is locked. It returns [ErrLocked] when the user dismisses the prompt. It ignores the
+// option [WithInteractive] because it exists to prompt the user.
+func (s *Storage) UnlockCollection(ctx context.Context) error {
+	_, err := call(ctx, s, false, func(cancellable unsafe.Pointer) (struct{}, error) {
+		return struct{}{}, s.unlock(ctx, cancellable, true)
+	})
+	return err
+}
+
+// Write stores cache data in the configured collection. Previous versions of this package can't
+// read the binary secrets Write stores; they read no data instead. When ctx is done, Write cancels
+// the operation and waits for it to stop, so that it can't complete after Write returns.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	_, err := call(ctx, s, true, func(cancellable unsafe.Pointer) (struct{}, error) {
+		return struct{}{}, s.write(ctx, cancellable, data)
+	})
+	return err
+}
+
+func (s *Storage) write(ctx context.Context, cancellable unsafe.Pointer, data []byte) error {
+	if err := s.checkLocked(ctx, cancellable); err != nil {
+		return err
+	}
+	attrs, free := s.attributeTable()
+	defer free()
+	collection := C.CString(s.collection)
+	defer C.free(unsafe.Pointer(collection))
+	var label *C.char
+	if s.label != "" {
+		label = C.CString(s.label)
+		defer C.free(unsafe.Pointer(label))
+	}
+	var (
+		e *C.gError
+		r C.int
+	)
+	if s.binary && s.compat == compat.Go {
+		ct := C.CString(s.contentType)
+		defer C.free(unsafe.Pointer(ct))
+		var p *C.char
+		if len(data) > 0 {
+			// secret_value_new copies the data, so there's no need to copy it to C memory first
+			p = (*C.char)(unsafe.Pointer(&data[0]))
+		}
+		value := C.value_new(s.valueNew, p, C.long(len(data)), ct)
+		defer C.unref(s.valueUnref, value)
+		r = C.storev_binary(s.storeBinary, s.schema, attrs, collection, label, value, cancellable, &e)
+	} else {
+		text, err := encodeText(s.compat, data)
+		if err != nil {
+			return err
+		}
+		pw := C.CString(text)
+		defer C.free(unsafe.Pointer(pw))
+		r = C.storev(s.store, s.schema, attrs, collection, label, pw, cancellable, &e)
+	}
+	if r == 0 {
+		if e != nil {
+			return s.gError(e, "couldn't write data to secret service")
+		}
+		return errors.New("couldn't write data to secret service")
+	}
+	return nil
+}
+
+// encodeText encodes data for a text secret in the format of the library "p" identifies
+func encodeText(p compat.Profile, data []byte) (string, error) {
+	if p == compat.Python {
+		// libsecret passwords are C strings, so they can't contain NUL
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			return "", errors.New("the Python compatibility profile requires data to be text without NUL characters")
+		}
+		return string(data), nil
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decodeText decodes a text secret in the format of the library "p" identifies
+func decodeText(p compat.Profile, text string) ([]byte, error) {
+	if p == compat.Python {
+		return []byte(text), nil
+	}
+	return base64.StdEncoding.DecodeString(text)
+}
+
+// Search returns the secret service items having the schema "schema" and the attributes specified by [WithAttribute].
+// Items may have attributes in addition to those specified, so for example Search(ctx, "name") returns every item
+// having the schema "name", and an empty schema matches items having any schema or none. Given the same schema
+// and options, Search returns the item a [Storage] stores data in, if that item exists. Search searches all
+// collections; it ignores options other than [WithAttribute], [WithInteractive] and [WithLogger]. When interaction
+// is allowed, the secret service may prompt the user to unlock collections containing matching items.
+func Search(ctx context.Context, schema string, opts ...option) ([]Item, error) {
+	s, err := New(schema, opts...)
 	if err != nil {
 		return nil, err
 	}
-	s.clear = clear
-	s.freeError = freeError
-	s.lookup = lookup
-	s.store = store
+	return call(ctx, s, false, func(cancellable unsafe.Pointer) ([]Item, error) {
+		items := []Item{}
+		err := s.search(ctx, cancellable, schema, func(item unsafe.Pointer) error {
+			items = append(items, s.item(item))
+			return nil
+		})
+		return items, err
+	})
+}
 
-	// the first nil terminates the list and libsecret ignores any extras
-	attrs := []*C.char{nil, nil}
-	for i, attr := range s.attributes {
-		// libsecret hangs on to these pointers; the finalizer frees them
-		attrs[i] = C.CString(attr.name)
+// DeleteMatching deletes the secret service items [Search] returns given the same arguments, and returns the
+// number of items it deleted, which may be nonzero when it also returns an error. Because DeleteMatching can
+// delete items written by any application, it requires a schema name or at least one attribute. Deleting a
+// locked item fails with [ErrLocked] when interaction isn't allowed (see [WithInteractive]).
+func DeleteMatching(ctx context.Context, schema string, opts ...option) (int, error) {
+	s, err := New(schema, opts...)
+	if err != nil {
+		return 0, err
 	}
-	s.schema = C.new_schema(C.CString(name), attrs[0], attrs[1])
-	return &s, nil
+	if schema == "" && len(s.attributes) == 0 {
+		return 0, errors.New("DeleteMatching requires a schema name or attribute")
+	}
+	return call(ctx, s, true, func(cancellable unsafe.Pointer) (int, error) {
+		n := 0
+		err := s.search(ctx, cancellable, schema, func(item unsafe.Pointer) error {
+			if err := s.deleteItem(item, cancellable); err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+		s.logger.DebugContext(ctx, "deleted matching items", slog.Int("count", n))
+		return n, err
+	})
 }
 
-// Delete deletes the stored data, if any exists.
-func (s *Storage) Delete(context.Context) error {
-	// the first nil terminates the list and libsecret ignores any extras
-	attrs := []*C.char{nil, nil, nil, nil}
-	for i, attr := range s.attributes {
-		name := C.CString(attr.name)
-		defer C.free(unsafe.Pointer(name))
-		value := C.CString(attr.value)
-		defer C.free(unsafe.Pointer(value))
-		attrs[i*2] = name
-		attrs[(i*2)+1] = value
-	}
+// search calls "fn" for each item having the schema "schema", when it isn't empty, and the Storage's attributes
+func (s *Storage) search(ctx context.Context, cancellable unsafe.Pointer, schema string, fn func(item unsafe.Pointer) error) error {
 	var e *C.gError
-	_ = C.clear(s.clear, s.schema, nil, &e, attrs[0], attrs[1], attrs[2], attrs[3])
+	service := C.service_get(s.serviceGet, 0, cancellable, &e) // 0 == SECRET_SERVICE_NONE
 	if e != nil {
-		defer C.free_g_error(s.freeError, e)
-		return fmt.Errorf("couldn't delete cache data: %q", C.GoString(e.message))
+		return s.gError(e, "couldn't connect to secret service")
+	}
+	defer C.unref(s.objectUnref, service)
+
+	// Searching without a libsecret schema allows matching any subset of an item's attributes.
+	// libsecret records the schema name in an attribute, so matching it is equivalent.
+	attrs := s.attributes
+	if schema != "" {
+		attrs = append(attrs[:len(attrs):len(attrs)], attribute{name: schemaAttribute, value: schema})
+	}
+	table, free := s.newAttributeTable(attrs)
+	defer free()
+	flags := C.int(searchAll)
+	if s.interactive {
+		flags |= searchUnlock
+	}
+	items := C.service_search(s.serviceSearch, service, nil, table, flags, cancellable, &e)
+	if e != nil {
+		return s.gError(e, "couldn't search secret service")
+	}
+	defer s.freeItems(items)
+	n := 0
+	for l := items; l != nil; l = l.next {
+		n++
+	}
+	s.logger.DebugContext(ctx, "found matching items", slog.Int("count", n))
+	for l := items; l != nil; l = l.next {
+		if err := fn(l.data); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// Read returns data stored according to the secret schema or, if no such data exists, a nil slice and nil error.
-func (s *Storage) Read(context.Context) ([]byte, error) {
-	// the first nil terminates the list and libsecret ignores any extras
-	attrs := []*C.char{nil, nil, nil, nil}
-	for i, attr := range s.attributes {
-		name := C.CString(attr.name)
-		defer C.free(unsafe.Pointer(name))
-		value := C.CString(attr.value)
-		defer C.free(unsafe.Pointer(value))
-		attrs[i*2] = name
-		attrs[(i*2)+1] = value
+// searchCollection calls "fn" for each item in the Storage's collection having its schema and attributes. When
+// "all" is false, searchCollection finds at most one item and loads its secret (see secret_item_get_secret).
+// It finds no items when the collection doesn't exist.
+func (s *Storage) searchCollection(ctx context.Context, cancellable unsafe.Pointer, all bool, fn func(item unsafe.Pointer) error) error {
+	return s.withCollection(ctx, cancellable, func(_, collection unsafe.Pointer) error {
+		if collection == nil {
+			return nil
+		}
+		attrs, free := s.attributeTable()
+		defer free()
+		flags := C.int(searchLoadSecrets)
+		if all {
+			flags = searchAll
+		}
+		if s.interactive {
+			flags |= searchUnlock
+		}
+		var e *C.gError
+		items := C.collection_search(s.collectionSearch, collection, s.schema, attrs, flags, cancellable, &e)
+		if e != nil {
+			return s.gError(e, fmt.Sprintf("couldn't search collection %q", s.collection))
+		}
+		defer s.freeItems(items)
+		for l := items; l != nil; l = l.next {
+			if err := fn(l.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteItem deletes a SecretItem
+func (s *Storage) deleteItem(item, cancellable unsafe.Pointer) error {
+	var e *C.gError
+	if C.item_delete(s.itemDelete, item, cancellable, &e) == 0 {
+		msg := fmt.Sprintf("couldn't delete item %q", C.GoString((*C.char)(C.get_pointer(s.proxyGetObjectPath, item))))
+		if e != nil {
+			return s.gError(e, msg)
+		}
+		return errors.New(msg)
 	}
+	return nil
+}
+
+// freeItems frees a list of SecretItems
+func (s *Storage) freeItems(items *C.gList) {
+	for l := items; l != nil; l = l.next {
+		C.unref(s.objectUnref, l.data)
+	}
+	C.unref(s.listFree, unsafe.Pointer(items))
+}
+
+// item returns a description of a SecretItem
+func (s *Storage) item(p unsafe.Pointer) Item {
+	item := Item{
+		Attributes: map[string]string{},
+		Created:    time.Unix(int64(C.get_uint64(s.itemGetCreated, p)), 0),
+		Locked:     C.get_bool(s.itemGetLocked, p) != 0,
+		Modified:   time.Unix(int64(C.get_uint64(s.itemGetModified, p)), 0),
+		// the proxy owns the path
+		Path: C.GoString((*C.char)(C.get_pointer(s.proxyGetObjectPath, p))),
+	}
+	if label := C.get_pointer(s.itemGetLabel, p); label != nil {
+		item.Label = C.GoString((*C.char)(label))
+		C.unref(s.gFree, label)
+	}
+	if attrs := C.get_pointer(s.itemGetAttributes, p); attrs != nil {
+		// the table owns its keys and values
+		keys := (*C.gList)(C.get_pointer(s.hashTableGetKeys, attrs))
+		for l := keys; l != nil; l = l.next {
+			v := C.hash_table_lookup(s.hashTableLookup, attrs, l.data)
+			item.Attributes[C.GoString((*C.char)(l.data))] = C.GoString((*C.char)(v))
+		}
+		C.unref(s.listFree, unsafe.Pointer(keys))
+		C.unref(s.hashTableUnref, attrs)
+	}
+	item.Schema = item.Attributes[schemaAttribute]
+	delete(item.Attributes, schemaAttribute)
+	return item
+}
+
+// checkLocked returns ErrLocked when the user may not be prompted and the collection is locked
+func (s *Storage) checkLocked(ctx context.Context, cancellable unsafe.Pointer) error {
+	if s.interactive {
+		// the secret service will prompt the user if necessary
+		return nil
+	}
+	return s.unlock(ctx, cancellable, false)
+}
+
+// unlock returns nil when the collection is unlocked. When it's locked, unlock prompts the user
+// to unlock it if "prompt" is true and otherwise returns ErrLocked.
+func (s *Storage) unlock(ctx context.Context, cancellable unsafe.Pointer, prompt bool) error {
+	return s.withCollection(ctx, cancellable, func(service, collection unsafe.Pointer) error {
+		if collection == nil {
+			// the secret service will create the collection, if possible, when Storage writes to it
+			return nil
+		}
+		if C.collection_get_locked(s.collectionGetLocked, collection) == 0 {
+			return nil
+		}
+		if !prompt {
+			s.logger.DebugContext(ctx, "not prompting the user to unlock the collection", slog.String("collection", s.collection))
+			return fmt.Errorf("%w: %q", ErrLocked, s.collection)
+		}
+		s.logger.DebugContext(ctx, "prompting the user to unlock the collection", slog.String("collection", s.collection))
+		objects := C.list_append(s.listAppend, nil, collection)
+		defer C.unref(s.listFree, objects)
+		var e *C.gError
+		if n := C.service_unlock(s.serviceUnlock, service, objects, cancellable, nil, &e); e != nil {
+			return s.gError(e, fmt.Sprintf("couldn't unlock collection %q", s.collection))
+		} else if n == 0 {
+			return fmt.Errorf("%w: %q", ErrLocked, s.collection)
+		}
+		return nil
+	})
+}
+
+// withCollection calls "fn" with the secret service and the collection in which Storage stores data.
+// The collection is nil when it doesn't exist.
+func (s *Storage) withCollection(ctx context.Context, cancellable unsafe.Pointer, fn func(service, collection unsafe.Pointer) error) error {
 	var e *C.gError
-	data := C.lookup(s.lookup, s.schema, nil, &e, attrs[0], attrs[1], attrs[2], attrs[3])
+	service := C.service_get(s.serviceGet, 0, cancellable, &e) // 0 == SECRET_SERVICE_NONE
+	if e != nil {
+		return s.gError(e, "couldn't connect to secret service")
+	}
+	defer C.unref(s.objectUnref, service)
+
+	name := C.CString(s.collection)
+	defer C.free(unsafe.Pointer(name))
+	get := s.collectionForAlias
+	if strings.HasPrefix(s.collection, "/") {
+		get = s.collectionForPath
+	}
+	collection := C.collection_get(get, service, name, 0, cancellable, &e) // 0 == SECRET_COLLECTION_NONE
 	if e != nil {
-		defer C.free_g_error(s.freeError, e)
-		return nil, fmt.Errorf("couldn't read data from secret service: %q", C.GoString(e.message))
+		return s.gError(e, fmt.Sprintf("couldn't get collection %q", s.collection))
 	}
-	if data == nil {
-		return nil, nil
+	if collection == nil {
+		s.logger.DebugContext(ctx, "collection doesn't exist", slog.String("collection", s.collection))
+		return fn(service, nil)
 	}
-	defer C.free(unsafe.Pointer(data))
-	result, err := base64.StdEncoding.DecodeString(C.GoString(data))
-	return result, err
+	defer C.unref(s.objectUnref, collection)
+	return fn(service, collection)
 }
 
-// Write stores cache data.
-func (s *Storage) Write(_ context.Context, data []byte) error {
-	// the first nil terminates the list and libsecret ignores any extras
-	attrs := []*C.char{nil, nil, nil, nil}
-	for i, attr := range s.attributes {
+// call calls "fn" on a new goroutine, passing it a GCancellable. When ctx is done before fn returns,
+// call cancels the GCancellable and returns ctx.Err(). Unless "wait" is true, call returns immediately,
+// without waiting for fn to return, because a libsecret function may block for a long time despite
+// cancellation, for example while waiting for a D-Bus service to start. In this case, the operation
+// may complete after call returns, so operations which modify stored data must wait: otherwise the
+// caller could release its lock while a write is pending, and the write could then overwrite newer
+// data. When waiting, call returns fn's result if fn succeeds despite cancellation. "fn" must free
+// any resources it allocates because it may outlive its caller.
+func call[T any](ctx context.Context, s *Storage, wait bool, fn func(cancellable unsafe.Pointer) (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	cancellable := C.cancellable_new(s.cancellableNew)
+	ch := make(chan result, 1)
+	go func() {
+		v, err := fn(cancellable)
+		ch <- result{v, err}
+	}()
+	select {
+	case r := <-ch:
+		C.unref(s.objectUnref, cancellable)
+		return r.v, r.err
+	case <-ctx.Done():
+		s.logger.DebugContext(ctx, "cancelling secret service operation", slog.Any("error", ctx.Err()))
+		C.cancellable_cancel(s.cancellableCancel, cancellable)
+		if wait {
+			r := <-ch
+			C.unref(s.objectUnref, cancellable)
+			if r.err != nil {
+				// fn probably failed because call cancelled it
+				return r.v, ctx.Err()
+			}
+			return r.v, nil
+		}
+		go func() {
+			// fn may still be using the GCancellable
+			<-ch
+			C.unref(s.objectUnref, cancellable)
+		}()
+		return zero, ctx.Err()
+	}
+}
+
+// gError converts a GError to a Go error, prefixing "msg" to its message, and frees it
+func (s *Storage) gError(e *C.gError, msg string) error {
+	defer C.free_g_error(s.freeError, e)
+	err := fmt.Errorf("%s: %q", msg, C.GoString(e.message))
+	if C.uint(e.domain) == C.error_quark(s.errorQuark) && e.code == secretErrorIsLocked {
+		err = fmt.Errorf("%w: %s", ErrLocked, err)
+	}
+	return err
+}
+
+// attributeTable returns a GHashTable of the Storage's attribute names and values, and a
+// function the caller must call to free the table when it's no longer needed.
+func (s *Storage) attributeTable() (unsafe.Pointer, func()) {
+	return s.newAttributeTable(s.attributes)
+}
+
+// newAttributeTable returns a GHashTable of the given attributes' names and values, and a
+// function the caller must call to free the table when it's no longer needed.
+func (s *Storage) newAttributeTable(attributes []attribute) (unsafe.Pointer, func()) {
+	table := C.new_hash_table(s.hashTableNew, s.strHash, s.strEqual)
+	strs := make([]*C.char, 0, len(attributes)*2)
+	for _, attr := range attributes {
 		name := C.CString(attr.name)
-		defer C.free(unsafe.Pointer(name))
 		value := C.CString(attr.value)
-		defer C.free(unsafe.Pointer(value))
-		attrs[i*2] = name
-		attrs[(i*2)+1] = value
+		strs = append(strs, name, value)
+		C.hash_table_insert(s.hashTableInsert, table, name, value)
 	}
-	pw := C.CString(base64.StdEncoding.EncodeToString(data))
-	defer C.free(unsafe.Pointer(pw))
-	var label *C.char
-	if s.label != "" {
-		label = C.CString(s.label)
-		defer C.free(unsafe.Pointer(label))
+	return table, func() {
+		// the table doesn't own its keys and values, so we free them after unref
+		C.unref(s.hashTableUnref, table)
+		for _, str := range strs {
+			C.free(unsafe.Pointer(str))
+		}
 	}
-	var e *C.gError
-	if r := C.store(s.store, s.schema, nil, label, pw, nil, &e, attrs[0], attrs[1], attrs[2], attrs[3]); r == 0 {
-		msg := "couldn't write data to secret service"
-		if e != nil {
-			defer C.free_g_error(s.freeError, e)
-			if e.message != nil {
-				msg += ": " + C.GoString(e.message)
-			}
+}
+
+// dlopen opens a shared library. Callers must eventually dlclose the returned handle.
+func dlopen(name string) (unsafe.Pointer, error) {
+	n := C.CString(name)
+	defer C.free(unsafe.Pointer(n))
+	handle := C.dlopen(n, C.RTLD_LAZY)
+	if handle == nil {
+		msg := fmt.Sprintf("encrypted storage isn't possible because the dynamic linker couldn't open %s", name)
+		if e := C.dlerror(); e != nil {
+			msg += fmt.Sprintf(". The underlying error is %q", C.GoString(e))
 		}
-		return errors.New(msg)
+		return nil, errors.New(msg)
 	}
-	return nil
+	return handle, nil
 }
 
 func (s *Storage) symbol(name string) (unsafe.Pointer, error) {
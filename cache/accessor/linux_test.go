@@ -7,16 +7,56 @@
 package accessor
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/compat"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
 	"github.com/stretchr/testify/require"
 )
 
+// blackHoleBus is set when a test process should use a private session bus on which the secret
+// service never responds. Its value is the bus address.
+const blackHoleBus = "MSALEXT_TEST_BLACK_HOLE_BUS"
+
 func TestTooManyAttributes(t *testing.T) {
-	_, err := New(t.Name(), WithAttribute("", ""), WithAttribute("", ""), WithAttribute("", ""))
+	opts := []option{}
+	for i := 0; i <= maxAttributes; i++ {
+		opts = append(opts, WithAttribute(fmt.Sprint(i), ""))
+	}
+	_, err := New(t.Name(), opts...)
 	require.Error(t, err)
 }
 
+func TestInvalidOption(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		opts []option
+	}{
+		{"empty name", []option{WithAttribute("", "value")}},
+		{"duplicate name", []option{WithAttribute("name", "a"), WithAttribute("name", "b")}},
+		{"empty collection", []option{WithCollection("")}},
+		{"empty content type", []option{WithContentType("")}},
+		{"text content type", []option{WithContentType(contentTypeText)}},
+		{"unknown compatibility profile", []option{WithCompatibility(compat.Profile(42))}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(t.Name(), test.opts...)
+			require.Error(t, err)
+		})
+	}
+}
+
 func TestWithAttribute(t *testing.T) {
 	if !manualTests {
 		t.Skipf("set %s to run this test", msalextManualTest)
@@ -46,6 +86,28 @@ func TestWithAttribute(t *testing.T) {
 	actual, err = c.Read(ctx)
 	require.NoError(t, err)
 	require.Empty(t, actual)
+
+	// Storage should support many attributes and match all of them
+	names := []string{"application", "tenant", "environment", "user", "version"}
+	opts := []option{}
+	for _, name := range names {
+		opts = append(opts, WithAttribute(name, name))
+	}
+	d, err := New(t.Name(), opts...)
+	require.NoError(t, err)
+	require.NoError(t, d.Write(ctx, expected))
+	actual, err = d.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	e, err := New(t.Name(), append(opts[:len(opts)-1], WithAttribute("version", "other"))...)
+	require.NoError(t, err)
+	actual, err = e.Read(ctx)
+	require.NoError(t, err)
+	require.Empty(t, actual)
+
+	require.NoError(t, a.Delete(ctx))
+	require.NoError(t, d.Delete(ctx))
 }
 
 func TestWithLabel(t *testing.T) {
@@ -65,3 +127,342 @@ func TestWithLabel(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expected, actual)
 }
+
+func TestBinary(t *testing.T) {
+	if !manualTests {
+		t.Skipf("set %s to run this test", msalextManualTest)
+	}
+	a, err := New(t.Name(), WithContentType("application/json"))
+	require.NoError(t, err)
+	require.True(t, a.binary, "libsecret doesn't support binary secrets")
+	t.Cleanup(func() { require.NoError(t, a.Delete(ctx)) })
+
+	// Storage should read base64 text secrets written by previous versions
+	for _, binary := range []bool{false, true} {
+		expected := []byte{0, 1, 2, 3, 255}
+		a.binary = binary
+		require.NoError(t, a.Write(ctx, expected))
+		a.binary = true
+		actual, err := a.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+}
+
+// TestCompatibilityEncoding verifies Storage encodes and decodes secrets as the other extension libraries do.
+// The golden files in testdata/compat are caches and the secrets those libraries store for them.
+func TestCompatibilityEncoding(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		p    compat.Profile
+	}{
+		{"dotnet", compat.DotNet},
+		{"python", compat.Python},
+	} {
+		t.Run(test.p.String(), func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "compat", test.name+".json"))
+			require.NoError(t, err)
+			secret, err := os.ReadFile(filepath.Join("testdata", "compat", test.name+".secret"))
+			require.NoError(t, err)
+
+			actual, err := encodeText(test.p, data)
+			require.NoError(t, err)
+			require.Equal(t, string(secret), actual)
+
+			decoded, err := decodeText(test.p, string(secret))
+			require.NoError(t, err)
+			require.Equal(t, data, decoded)
+		})
+	}
+	for _, data := range [][]byte{{0xff}, []byte("a\x00b")} {
+		_, err := encodeText(compat.Python, data)
+		require.Error(t, err, "Python secrets must be text")
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	if !manualTests {
+		t.Skipf("set %s to run this test", msalextManualTest)
+	}
+	expected := []byte(`{"key":"value"}`)
+	for _, p := range []compat.Profile{compat.DotNet, compat.Python} {
+		t.Run(p.String(), func(t *testing.T) {
+			a, err := New(t.Name(), WithCompatibility(p), WithContentType("application/json"))
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, a.Delete(ctx)) })
+			require.NoError(t, a.Write(ctx, expected))
+
+			actual, err := a.Read(ctx)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+
+			// the other libraries read secrets with libsecret's text API, as Storage does when
+			// libsecret doesn't support binary secrets
+			text := *a
+			text.binary = false
+			actual, err = text.Read(ctx)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func BenchmarkReadWrite(b *testing.B) {
+	if !manualTests {
+		b.Skipf("set %s to run this benchmark", msalextManualTest)
+	}
+	data := bytes.Repeat([]byte(`{"secret":"0123456789abcdef"},`), 1<<15)
+	for _, binary := range []bool{true, false} {
+		name := "binary"
+		if !binary {
+			name = "base64"
+		}
+		b.Run(name, func(b *testing.B) {
+			a, err := New(b.Name())
+			require.NoError(b, err)
+			if binary {
+				require.True(b, a.binary, "libsecret doesn't support binary secrets")
+			}
+			a.binary = binary
+			b.Cleanup(func() { require.NoError(b, a.Delete(ctx)) })
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, a.Write(ctx, data))
+				actual, err := a.Read(ctx)
+				require.NoError(b, err)
+				require.Equal(b, len(data), len(actual))
+			}
+		})
+	}
+}
+
+func TestWithCollection(t *testing.T) {
+	if !manualTests {
+		t.Skipf("set %s to run this test", msalextManualTest)
+	}
+	// the session collection is unlocked and held in memory, so this test shouldn't prompt
+	a, err := New(t.Name(), WithCollection("session"), WithInteractive(false))
+	require.NoError(t, err)
+	require.NoError(t, a.UnlockCollection(ctx))
+
+	expected := []byte("expected")
+	require.NoError(t, a.Write(ctx, expected))
+	actual, err := a.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+	require.NoError(t, a.Delete(ctx))
+}
+
+func TestCollectionScope(t *testing.T) {
+	if !manualTests {
+		t.Skipf("set %s to run this test", msalextManualTest)
+	}
+	// these Storages have the same schema and attributes, so only their collections distinguish their data
+	def, err := New(t.Name(), WithAttribute("app", "test"))
+	require.NoError(t, err)
+	session, err := New(t.Name(), WithAttribute("app", "test"), WithCollection("session"), WithInteractive(false))
+	require.NoError(t, err)
+	require.NoError(t, session.UnlockCollection(ctx))
+	require.NoError(t, def.Write(ctx, []byte("default")))
+	t.Cleanup(func() { require.NoError(t, def.Delete(ctx)) })
+
+	actual, err := session.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual, "Read shouldn't return data from another collection")
+	require.NoError(t, session.Write(ctx, []byte("session")))
+	for _, test := range []struct {
+		s        *Storage
+		expected string
+	}{{def, "default"}, {session, "session"}} {
+		actual, err = test.s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, string(actual))
+	}
+
+	require.NoError(t, session.Delete(ctx))
+	actual, err = session.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	actual, err = def.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "default", string(actual), "Delete shouldn't delete data from another collection")
+}
+
+func TestSearch(t *testing.T) {
+	if !manualTests {
+		t.Skipf("set %s to run this test", msalextManualTest)
+	}
+	schema := t.Name()
+	_, err := DeleteMatching(ctx, "")
+	require.Error(t, err, "DeleteMatching should require a schema or attribute")
+	_, err = DeleteMatching(ctx, schema)
+	require.NoError(t, err)
+
+	start := time.Now().Truncate(time.Second)
+	for _, user := range []string{"a", "b"} {
+		s, err := New(schema, WithAttribute("app", "test"), WithAttribute("user", user), WithLabel("label "+user))
+		require.NoError(t, err)
+		require.NoError(t, s.Write(ctx, []byte("secret")))
+	}
+	t.Cleanup(func() {
+		_, err := DeleteMatching(ctx, schema)
+		require.NoError(t, err)
+	})
+
+	items, err := Search(ctx, schema)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	for _, item := range items {
+		require.Equal(t, schema, item.Schema)
+		require.Equal(t, "test", item.Attributes["app"])
+		require.Equal(t, "label "+item.Attributes["user"], item.Label)
+		require.NotContains(t, item.Attributes, schemaAttribute)
+		require.NotEmpty(t, item.Path)
+		require.False(t, item.Created.Before(start))
+		require.False(t, item.Modified.Before(item.Created))
+	}
+
+	items, err = Search(ctx, "", WithAttribute("user", "a"), WithAttribute("app", "test"))
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, "a", items[0].Attributes["user"])
+
+	items, err = Search(ctx, schema, WithAttribute("user", "c"))
+	require.NoError(t, err)
+	require.Empty(t, items)
+
+	n, err := DeleteMatching(ctx, schema, WithAttribute("user", "a"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	items, err = Search(ctx, schema)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, "b", items[0].Attributes["user"])
+
+	n, err = DeleteMatching(ctx, schema)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	items, err = Search(ctx, schema)
+	require.NoError(t, err)
+	require.Empty(t, items)
+}
+
+func TestCall(t *testing.T) {
+	// call requires only gio, which is more commonly installed than libsecret
+	handle, err := dlopen("libgio-2.0.so.0")
+	if err != nil {
+		t.Skip(err)
+	}
+	s := &Storage{handle: handle, logger: logging.Discard()}
+	for name, p := range map[string]*unsafe.Pointer{
+		"g_cancellable_cancel": &s.cancellableCancel,
+		"g_cancellable_new":    &s.cancellableNew,
+		"g_object_unref":       &s.objectUnref,
+	} {
+		*p, err = s.symbol(name)
+		require.NoError(t, err)
+	}
+
+	expected := []byte("expected")
+	actual, err := call(ctx, s, false, func(cancellable unsafe.Pointer) ([]byte, error) {
+		require.NotNil(t, cancellable)
+		return expected, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// call should return as soon as the context is done, even when fn doesn't return
+	block, done := make(chan struct{}), make(chan struct{})
+	cx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = call(cx, s, false, func(unsafe.Pointer) ([]byte, error) {
+		defer close(done)
+		<-block
+		return expected, nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	close(block)
+	<-done
+
+	// when told to wait, call should return only after fn returns
+	returned := false
+	cx2, cancel2 := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel2()
+	_, err = call(cx2, s, true, func(unsafe.Pointer) ([]byte, error) {
+		<-cx2.Done()
+		time.Sleep(10 * time.Millisecond)
+		returned = true
+		return nil, errors.New("cancelled")
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.True(t, returned, "call returned before fn")
+
+	// call shouldn't call fn when the context is already done
+	_, err = call(cx, s, false, func(unsafe.Pointer) ([]byte, error) {
+		t.Fatal("call shouldn't have called fn")
+		return nil, nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCancellation(t *testing.T) {
+	if addr := os.Getenv(blackHoleBus); addr != "" {
+		// this is the child process started below. Its session bus is private and the
+		// secret service on that bus never responds, so every call should time out
+		a, err := New(t.Name())
+		require.NoError(t, err)
+		for _, op := range []func(context.Context) error{
+			a.Delete,
+			func(ctx context.Context) error { _, err := a.Read(ctx); return err },
+			func(ctx context.Context) error { return a.Write(ctx, []byte("data")) },
+		} {
+			cx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			start := time.Now()
+			err = op(cx)
+			cancel()
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+			require.Less(t, time.Since(start), time.Second, "operation didn't return promptly after its context expired")
+		}
+		return
+	}
+	if _, err := New(t.Name()); err != nil {
+		t.Skip(err)
+	}
+	for _, cmd := range []string{"dbus-daemon", "dbus-send", "dbus-test-tool"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	// start a private session bus and a stand-in secret service, which never replies to method calls
+	daemon := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address=1")
+	stdout, err := daemon.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, daemon.Start())
+	t.Cleanup(func() { _ = daemon.Process.Kill(); _ = daemon.Wait() })
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	env := append(os.Environ(), "DBUS_SESSION_BUS_ADDRESS="+strings.TrimSpace(addr))
+
+	blackHole := exec.Command("dbus-test-tool", "black-hole", "--name=org.freedesktop.secrets")
+	blackHole.Env = env
+	require.NoError(t, blackHole.Start())
+	t.Cleanup(func() { _ = blackHole.Process.Kill(); _ = blackHole.Wait() })
+	require.Eventually(t, func() bool {
+		cmd := exec.Command(
+			"dbus-send", "--session", "--print-reply", "--dest=org.freedesktop.DBus", "/org/freedesktop/DBus",
+			"org.freedesktop.DBus.NameHasOwner", "string:org.freedesktop.secrets",
+		)
+		cmd.Env = env
+		out, err := cmd.Output()
+		return err == nil && strings.Contains(string(out), "true")
+	}, 5*time.Second, 10*time.Millisecond, "stand-in secret service didn't start")
+
+	// libsecret connects to the session bus only once per process, so the test continues in a child
+	// process to ensure libsecret connects to the private bus
+	test := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	test.Env = append(env, blackHoleBus+"="+strings.TrimSpace(addr))
+	out, err := test.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
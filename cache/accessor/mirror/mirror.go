@@ -0,0 +1,166 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package mirror helps applications migrate cached data from one storage backend to another. Its
+// Storage reads data from a primary accessor or, when the primary has no data, from legacy accessors.
+// It writes only to the primary unless configured to mirror writes to legacy accessors, and it deletes
+// the legacy data it read once it has successfully written to the primary. For example, this migrates data from a
+// plaintext file to libsecret:
+//
+//	legacy, err := file.New(p)
+//	// TODO: handle error
+//	primary, err := accessor.New(name)
+//	// TODO: handle error
+//	a, err := mirror.New(primary, mirror.WithLegacy(legacy))
+//	// TODO: handle error
+//	c, err := cache.New(a, p+".timestamp")
+//
+// Storage doesn't synchronize access to its accessors. When it's used with a Cache from the cache
+// package, the Cache's lock serializes writes, including migration, across processes.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+type option func(*Storage) error
+
+// WithLegacy adds accessors from which Storage reads when the primary has no data. Storage reads
+// them in the order given and returns the first data it finds.
+func WithLegacy(a ...accessor.Accessor) option {
+	return func(s *Storage) error {
+		for _, l := range a {
+			if l == nil {
+				return errors.New("legacy accessor can't be nil")
+			}
+		}
+		s.legacy = append(s.legacy, a...)
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about reads, writes and migration. These
+// records never include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithMirroring makes Storage write to legacy accessors as well as the primary. This is useful
+// during a transition period in which applications using only a legacy accessor share the cache.
+// Storage doesn't delete legacy data while mirroring.
+func WithMirroring() option {
+	return func(s *Storage) error {
+		s.mirror = true
+		return nil
+	}
+}
+
+// Storage reads and writes data through a primary accessor, migrating data from legacy accessors.
+type Storage struct {
+	legacy []accessor.Accessor
+	// legacyErr indicates whether Read failed to read a legacy accessor while looking for data to migrate
+	legacyErr bool
+	logger    *slog.Logger
+	mirror    bool
+	primary   accessor.Accessor
+	// source is the index of the legacy accessor from which Read last returned data, or -1 when
+	// there's no legacy data to delete
+	source int
+}
+
+// New is the constructor for Storage. "primary" is the accessor to which Storage writes data.
+func New(primary accessor.Accessor, opts ...option) (*Storage, error) {
+	if primary == nil {
+		return nil, errors.New("primary accessor can't be nil")
+	}
+	s := Storage{primary: primary, source: -1}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger)
+	return &s, nil
+}
+
+// Delete deletes data from the primary and all legacy accessors. It returns the first error
+// it encounters, after attempting all deletions.
+func (s *Storage) Delete(ctx context.Context) error {
+	err := s.primary.Delete(ctx)
+	for i, l := range s.legacy {
+		if e := l.Delete(ctx); e != nil {
+			s.logger.DebugContext(ctx, "couldn't delete legacy data", slog.Int("legacy", i), slog.Any("error", e))
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// Read returns data from the primary accessor or, when the primary has no data, from the first
+// legacy accessor having data. Read ignores errors from legacy accessors because they shouldn't
+// prevent an application working once it has migrated data to the primary. However, Write won't
+// delete legacy data after such an error, because Read may have missed data that hasn't been migrated.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	data, err := s.primary.Read(ctx)
+	if err != nil || len(data) > 0 {
+		return data, err
+	}
+	s.legacyErr = false
+	s.source = -1
+	for i, l := range s.legacy {
+		data, err := l.Read(ctx)
+		if err != nil {
+			s.legacyErr = true
+			s.logger.DebugContext(ctx, "couldn't read legacy data", slog.Int("legacy", i), slog.Any("error", err))
+			continue
+		}
+		if len(data) > 0 {
+			s.source = i
+			s.logger.DebugContext(ctx, "read legacy data because the primary has none", slog.Int("legacy", i), logging.Size(data))
+			return data, nil
+		}
+	}
+	return nil, nil
+}
+
+// Write writes data to the primary accessor. When mirroring, it then writes data to each legacy
+// accessor. Otherwise, after a successful write to the primary, it deletes data from the legacy
+// accessor from which Read returned data, unless Read failed to read another legacy accessor. Write
+// returns only errors from the primary because the primary's data is authoritative.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	if err := s.primary.Write(ctx, data); err != nil {
+		return err
+	}
+	switch {
+	case s.mirror:
+		for i, l := range s.legacy {
+			if err := l.Write(ctx, data); err != nil {
+				s.logger.DebugContext(ctx, "couldn't mirror data to legacy accessor", slog.Int("legacy", i), slog.Any("error", err))
+			}
+		}
+	case s.source < 0:
+	case s.legacyErr:
+		s.logger.DebugContext(ctx, "not deleting legacy data because Read couldn't read all legacy accessors", slog.Int("legacy", s.source))
+	default:
+		if err := s.legacy[s.source].Delete(ctx); err != nil {
+			// try again after the next write
+			s.logger.DebugContext(ctx, "couldn't delete legacy data after migration", slog.Int("legacy", s.source), slog.Any("error", err))
+			break
+		}
+		s.logger.DebugContext(ctx, "deleted legacy data after migration", slog.Int("legacy", s.source))
+		s.source = -1
+	}
+	return nil
+}
+
+var _ accessor.Accessor = (*Storage)(nil)
@@ -0,0 +1,164 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// fakeAccessor stores data in memory
+type fakeAccessor struct {
+	data                   []byte
+	deleteErr, readErr     error
+	deletes, reads, writes int
+}
+
+func (f *fakeAccessor) Delete(context.Context) error {
+	f.deletes++
+	if f.deleteErr != nil {
+		return f.deleteErr
+	}
+	f.data = nil
+	return nil
+}
+
+func (f *fakeAccessor) Read(context.Context) ([]byte, error) {
+	f.reads++
+	return f.data, f.readErr
+}
+
+func (f *fakeAccessor) Write(_ context.Context, b []byte) error {
+	f.writes++
+	f.data = append([]byte{}, b...)
+	return nil
+}
+
+func TestMigration(t *testing.T) {
+	primary := &fakeAccessor{}
+	empty := &fakeAccessor{}
+	legacy := &fakeAccessor{data: []byte("legacy")}
+	other := &fakeAccessor{data: []byte("other")}
+	s, err := New(primary, WithLegacy(empty, legacy, other))
+	require.NoError(t, err)
+
+	// Read should return legacy data because the primary has none
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("legacy"), actual)
+
+	// Write should write to the primary and delete only the legacy data Read returned
+	expected := []byte("expected")
+	require.NoError(t, s.Write(ctx, expected))
+	require.Equal(t, expected, primary.data)
+	require.Equal(t, 1, legacy.deletes)
+	require.Empty(t, legacy.data)
+	for _, l := range []*fakeAccessor{empty, legacy, other} {
+		require.Equal(t, 0, l.writes)
+	}
+	for _, l := range []*fakeAccessor{empty, other} {
+		require.Equal(t, 0, l.deletes)
+	}
+	require.Equal(t, []byte("other"), other.data)
+
+	// Storage should no longer read or delete legacy data
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+	require.NoError(t, s.Write(ctx, expected))
+	require.Equal(t, 1, legacy.reads)
+	require.Equal(t, 1, legacy.deletes)
+}
+
+func TestMigrationRetry(t *testing.T) {
+	primary := &fakeAccessor{}
+	legacy := &fakeAccessor{data: []byte("legacy"), deleteErr: errors.New("it didn't work")}
+	s, err := New(primary, WithLegacy(legacy))
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.NoError(t, err)
+
+	// Write should succeed despite failing to delete legacy data...
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.Equal(t, 1, legacy.deletes)
+
+	// ...and try again next time
+	legacy.deleteErr = nil
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.Equal(t, 2, legacy.deletes)
+	require.Empty(t, legacy.data)
+}
+
+func TestLegacyReadError(t *testing.T) {
+	primary := &fakeAccessor{}
+	broken := &fakeAccessor{data: []byte("broken"), readErr: errors.New("it didn't work")}
+	legacy := &fakeAccessor{data: []byte("legacy")}
+	s, err := New(primary, WithLegacy(broken, legacy))
+	require.NoError(t, err)
+
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("legacy"), actual)
+
+	// Write shouldn't delete any legacy data because Read may have missed some
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	for _, l := range []*fakeAccessor{broken, legacy} {
+		require.Equal(t, 0, l.deletes)
+		require.NotEmpty(t, l.data)
+	}
+
+	// likewise when Read found no data, as when MSAL then acquires new tokens
+	legacy.data = nil
+	primary.data = nil
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Empty(t, actual)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.Equal(t, 0, broken.deletes)
+	require.Equal(t, []byte("broken"), broken.data)
+}
+
+func TestWriteWithoutLegacyData(t *testing.T) {
+	legacy := &fakeAccessor{}
+	s, err := New(&fakeAccessor{}, WithLegacy(legacy))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.Equal(t, 0, legacy.deletes, "Write should delete only legacy data Read returned")
+}
+
+func TestMirroring(t *testing.T) {
+	primary := &fakeAccessor{}
+	legacy := []*fakeAccessor{{data: []byte("legacy")}, {}}
+	s, err := New(primary, WithLegacy(legacy[0], legacy[1]), WithMirroring())
+	require.NoError(t, err)
+
+	expected := []byte("expected")
+	require.NoError(t, s.Write(ctx, expected))
+	for _, a := range append(legacy, primary) {
+		require.Equal(t, expected, a.data)
+		require.Equal(t, 0, a.deletes)
+	}
+
+	require.NoError(t, s.Delete(ctx))
+	for _, a := range append(legacy, primary) {
+		require.Empty(t, a.data)
+	}
+}
+
+func TestPrimaryReadError(t *testing.T) {
+	expected := errors.New("expected")
+	legacy := &fakeAccessor{data: []byte("legacy")}
+	s, err := New(&fakeAccessor{readErr: expected}, WithLegacy(legacy))
+	require.NoError(t, err)
+
+	// Storage shouldn't fall back to legacy data when it can't determine whether the primary has data
+	_, err = s.Read(ctx)
+	require.ErrorIs(t, err, expected)
+	require.Equal(t, 0, legacy.reads)
+}
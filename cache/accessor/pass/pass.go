@@ -0,0 +1,279 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package pass
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	// ext is the extension of files in a password store
+	ext = ".gpg"
+	// gpgID is the name of files listing the keys to which pass encrypts files in their directory
+	gpgID = ".gpg-id"
+)
+
+type option func(*Storage) error
+
+// WithGitCommit makes Storage commit its changes when the password store is a git repository, as pass
+// does. By default, Storage doesn't commit, leaving changes for the user or a sync tool to commit.
+func WithGitCommit() option {
+	return func(s *Storage) error {
+		s.commit = true
+		return nil
+	}
+}
+
+// WithGPG sets the gpg executable Storage invokes. The default is "gpg".
+func WithGPG(path string) option {
+	return func(s *Storage) error {
+		if path == "" {
+			return errors.New("gpg path can't be empty")
+		}
+		s.gpg = path
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about password store operations. These records
+// never include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithRecipients sets the keys to which Storage encrypts data. Any value gpg accepts for its --recipient
+// flag identifies a key, though fingerprints are the least ambiguous. By default, Storage encrypts data
+// to the keys listed in the .gpg-id file nearest the entry, as pass does.
+func WithRecipients(ids ...string) option {
+	return func(s *Storage) error {
+		if len(ids) == 0 {
+			return errors.New("at least one recipient is required")
+		}
+		for _, id := range ids {
+			if strings.TrimSpace(id) == "" {
+				return errors.New("recipient can't be empty")
+			}
+		}
+		s.recipients = ids
+		return nil
+	}
+}
+
+// WithStoreDir sets the password store's directory. The default is $PASSWORD_STORE_DIR, if it's set,
+// and otherwise ~/.password-store.
+func WithStoreDir(dir string) option {
+	return func(s *Storage) error {
+		if dir == "" {
+			return errors.New("store directory can't be empty")
+		}
+		s.dir = dir
+		return nil
+	}
+}
+
+// Storage stores data in a password store managed by pass (https://www.passwordstore.org), as an OpenPGP
+// encrypted file. It invokes gpg to encrypt and decrypt data, so decrypting may require user interaction
+// via gpg-agent, for example to enter a key's passphrase or insert a smartcard. The store needn't exist
+// until Storage writes data; pass can read this data with "pass show".
+type Storage struct {
+	commit bool
+	// dir is the password store's directory
+	dir string
+	gpg string
+	// name is the entry's name, relative to dir and without the .gpg extension
+	name       string
+	logger     *slog.Logger
+	m          *sync.Mutex
+	recipients []string
+}
+
+// New is the constructor for Storage. "name" is the name of the password store entry in which to store
+// data, for example "msal/cache". Storage stores the entry's data in the file "name".gpg within the store.
+func New(name string, opts ...option) (*Storage, error) {
+	if name == "" || !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid entry name %q", name)
+	}
+	s := Storage{dir: os.Getenv("PASSWORD_STORE_DIR"), gpg: "gpg", m: &sync.Mutex{}, name: filepath.Clean(name)}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	if s.dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find the default password store: %w", err)
+		}
+		s.dir = filepath.Join(home, ".password-store")
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("path", s.path()))
+	return &s, nil
+}
+
+// Delete deletes the entry, if it exists, and any of its parent directories left empty.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	err := os.Remove(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "nothing to delete because the entry doesn't exist")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// remove empty directories, as "pass rm" does, but never the store itself
+	for dir := filepath.Dir(s.path()); dir != filepath.Clean(s.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return s.gitCommit(ctx, "Remove "+s.name+" from store.")
+}
+
+// Read decrypts and returns the entry's data or, if the entry doesn't exist, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, err := os.Stat(s.path()); errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "returning no data because the entry doesn't exist")
+		return nil, nil
+	}
+	data, err := s.run(ctx, nil, "--decrypt", s.path())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt %s: %w", s.path(), err)
+	}
+	return data, nil
+}
+
+// Write encrypts data to the recipients and stores it in the entry, creating the entry and its
+// parent directories if necessary.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	recipients := s.recipients
+	if len(recipients) == 0 {
+		var err error
+		if recipients, err = s.readGPGID(); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path()), 0700); err != nil {
+		return err
+	}
+	// gpg writes to a temporary file which replaces the entry only after encryption
+	// succeeds, so readers never see a partially written file
+	f, err := os.CreateTemp(filepath.Dir(s.path()), "."+filepath.Base(s.name)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// these are the flags pass uses
+	args := []string{"--yes", "--compress-algo=none", "--no-encrypt-to", "--output", tmp, "--encrypt"}
+	for _, r := range recipients {
+		args = append(args, "--recipient", r)
+	}
+	if _, err = s.run(ctx, data, args...); err != nil {
+		return fmt.Errorf("couldn't encrypt data: %w", err)
+	}
+	if err = os.Rename(tmp, s.path()); err != nil {
+		return err
+	}
+	return s.gitCommit(ctx, "Add given password for "+s.name+" to store.")
+}
+
+// path returns the path of the entry's file
+func (s *Storage) path() string {
+	return filepath.Join(s.dir, s.name+ext)
+}
+
+// readGPGID returns the key IDs listed in the .gpg-id file nearest the entry, searching
+// from the entry's directory up to the store's root
+func (s *Storage) readGPGID() ([]string, error) {
+	root := filepath.Clean(s.dir)
+	for dir := filepath.Dir(s.path()); ; dir = filepath.Dir(dir) {
+		f, err := os.Open(filepath.Join(dir, gpgID))
+		if err == nil {
+			defer f.Close()
+			ids := []string{}
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				// pass ignores comments and blank lines
+				line, _, _ := strings.Cut(scanner.Text(), "#")
+				if line = strings.TrimSpace(line); line != "" {
+					ids = append(ids, line)
+				}
+			}
+			if err = scanner.Err(); err == nil && len(ids) == 0 {
+				err = fmt.Errorf("%s lists no keys", f.Name())
+			}
+			return ids, err
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return nil, fmt.Errorf(`%s has no %s file. Initialize the password store with "pass init" or specify recipients with WithRecipients`, s.dir, gpgID)
+}
+
+// run runs gpg in batch mode with the given arguments and input, returning its output
+func (s *Storage) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, s.gpg, append([]string{"--batch", "--quiet"}, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// gpg's diagnostics never include plaintext
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// gitCommit commits changes to the entry when WithGitCommit is set and the store is a git repository
+func (s *Storage) gitCommit(ctx context.Context, msg string) error {
+	if !s.commit {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, ".git")); err != nil {
+		s.logger.DebugContext(ctx, "not committing because the password store isn't a git repository")
+		return nil
+	}
+	file := s.name + ext
+	for _, args := range [][]string{{"add", "--all", "--", file}, {"commit", "--quiet", "-m", msg, "--", file}} {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", s.dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+var _ accessor.Accessor = (*Storage)(nil)
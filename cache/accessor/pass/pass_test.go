@@ -0,0 +1,237 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package pass
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// newKeyring creates a GnuPG home directory containing a passphraseless key for each of the given
+// user IDs and returns the fingerprints of the keys' encryption subkeys, by user ID
+func newKeyring(t *testing.T, uids ...string) map[string]string {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip(err)
+	}
+	// gpg-agent's socket path must be short, so this can't be in t.TempDir()
+	home, err := os.MkdirTemp("", "gnupg")
+	require.NoError(t, err)
+	t.Setenv("GNUPGHOME", home)
+	t.Cleanup(func() {
+		_ = exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+		_ = os.RemoveAll(home)
+	})
+	subkeys := map[string]string{}
+	for _, uid := range uids {
+		out, err := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", uid, "future-default", "default", "never").CombinedOutput()
+		require.NoError(t, err, string(out))
+		out, err = exec.Command("gpg", "--batch", "--with-colons", "--with-subkey-fingerprint", "--list-keys", uid).Output()
+		require.NoError(t, err)
+		sub := false
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Split(line, ":")
+			if fields[0] == "sub" {
+				sub = true
+			} else if sub && fields[0] == "fpr" {
+				subkeys[uid] = fields[9]
+				break
+			}
+		}
+		require.NotEmpty(t, subkeys[uid])
+	}
+	return subkeys
+}
+
+// recipients returns the fingerprints of the keys to which a file is encrypted
+func recipients(t *testing.T, p string) []string {
+	out, err := exec.Command("gpg", "--batch", "--list-packets", p).CombinedOutput()
+	require.NoError(t, err, string(out))
+	ids := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if _, after, found := strings.Cut(line, ":pubkey enc packet:"); found {
+			_, id, _ := strings.Cut(after, "keyid ")
+			ids = append(ids, strings.Fields(id)[0])
+		}
+	}
+	return ids
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	keys := newKeyring(t, "a@example.com")
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, gpgID), []byte("a@example.com\n"), 0600))
+	s, err := New("msal/cache", WithStoreDir(dir))
+	require.NoError(t, err)
+	p := filepath.Join(dir, "msal", "cache.gpg")
+	require.Equal(t, p, s.path())
+
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	require.NoError(t, s.Delete(ctx))
+
+	for _, expected := range [][]byte{[]byte(`{"expected":true}`), {0, 1, 2, 255}} {
+		require.NoError(t, s.Write(ctx, expected))
+		actual, err = s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+
+		// "pass show" decrypts the file with gpg
+		out, err := exec.Command("gpg", "--batch", "--quiet", "--decrypt", p).Output()
+		require.NoError(t, err)
+		require.Equal(t, expected, out)
+	}
+	require.Equal(t, []string{keys["a@example.com"][24:]}, recipients(t, p))
+	entries, err := os.ReadDir(filepath.Dir(p))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "Storage shouldn't leave temporary files")
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	require.NoError(t, s.Delete(ctx))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	require.NoDirExists(t, filepath.Dir(p), "Delete should remove empty directories")
+	require.DirExists(t, dir, "Delete shouldn't remove the store")
+}
+
+func TestRecipients(t *testing.T) {
+	keys := newKeyring(t, "a@example.com", "b@example.com", "c@example.com")
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, gpgID), []byte("a@example.com\n"), 0600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "work", "msal"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "work", gpgID), []byte("# comment\nb@example.com\n\nc@example.com # comment\n"), 0600))
+
+	for _, test := range []struct {
+		desc, name string
+		opts       []option
+		expected   []string
+	}{
+		{desc: "root .gpg-id", name: "cache", expected: []string{"a@example.com"}},
+		{desc: "nearest .gpg-id", name: "work/msal/cache", expected: []string{"b@example.com", "c@example.com"}},
+		{desc: "WithRecipients", name: "work/cache", opts: []option{WithRecipients("a@example.com")}, expected: []string{"a@example.com"}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			s, err := New(test.name, append(test.opts, WithStoreDir(dir))...)
+			require.NoError(t, err)
+			require.NoError(t, s.Write(ctx, []byte("data")))
+			expected := []string{}
+			for _, uid := range test.expected {
+				expected = append(expected, keys[uid][24:])
+			}
+			require.ElementsMatch(t, expected, recipients(t, s.path()))
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	newKeyring(t, "a@example.com")
+	t.Run("no .gpg-id", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New("cache", WithStoreDir(dir))
+		require.NoError(t, err)
+		require.Error(t, s.Write(ctx, []byte("data")))
+		require.NoFileExists(t, s.path())
+	})
+	t.Run("empty .gpg-id", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, gpgID), []byte("# no keys\n"), 0600))
+		s, err := New("cache", WithStoreDir(dir))
+		require.NoError(t, err)
+		require.Error(t, s.Write(ctx, []byte("data")))
+	})
+	t.Run("unknown recipient", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New("cache", WithStoreDir(dir), WithRecipients("unknown@example.com"))
+		require.NoError(t, err)
+		require.Error(t, s.Write(ctx, []byte("data")))
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries, "Storage shouldn't leave temporary files")
+	})
+	t.Run("corrupt entry", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New("cache", WithStoreDir(dir))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(s.path(), []byte("not encrypted"), 0600))
+		_, err = s.Read(ctx)
+		require.Error(t, err)
+	})
+	t.Run("options", func(t *testing.T) {
+		for _, name := range []string{"", "/abs", "../escape", "a/../../escape"} {
+			_, err := New(name)
+			require.Error(t, err, name)
+		}
+		for _, opts := range [][]option{
+			{WithGPG("")},
+			{WithRecipients()},
+			{WithRecipients("a@example.com", " ")},
+			{WithStoreDir("")},
+		} {
+			_, err := New("cache", opts...)
+			require.Error(t, err)
+		}
+	})
+}
+
+func TestPasswordStoreDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PASSWORD_STORE_DIR", dir)
+	s, err := New("cache")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "cache.gpg"), s.path())
+
+	t.Setenv("PASSWORD_STORE_DIR", "")
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	s, err = New("cache")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, ".password-store", "cache.gpg"), s.path())
+}
+
+func TestWithGitCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip(err)
+	}
+	newKeyring(t, "a@example.com")
+	for _, k := range []string{"GIT_AUTHOR", "GIT_COMMITTER"} {
+		t.Setenv(k+"_NAME", "test")
+		t.Setenv(k+"_EMAIL", "test@example.com")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+		return string(out)
+	}
+	git("init", "--quiet")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, gpgID), []byte("a@example.com\n"), 0600))
+	git("add", gpgID)
+	git("commit", "--quiet", "-m", "init")
+
+	s, err := New("msal/cache", WithStoreDir(dir))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.Contains(t, git("status", "--porcelain"), "msal/", "Storage shouldn't commit by default")
+
+	s, err = New("msal/cache", WithStoreDir(dir), WithGitCommit())
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	require.Empty(t, git("status", "--porcelain"))
+	require.Contains(t, git("log", "--oneline"), "msal/cache")
+
+	require.NoError(t, s.Delete(ctx))
+	require.Empty(t, git("status", "--porcelain"))
+	require.Equal(t, 3, strings.Count(git("log", "--oneline"), "\n"))
+}
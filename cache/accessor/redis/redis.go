@@ -0,0 +1,371 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package redis stores data in Redis, allowing a fleet of confidential client applications to share
+// a token cache. Its Storage implements [accessor.Locker] with a lease lock, which Cache uses instead
+// of a file lock. Because the timestamp file Cache uses to skip redundant reads records only local
+// writes, hosts sharing data in Redis should disable it:
+//
+//	s, err := redis.New("redis.contoso.com:6380", "msal", redis.WithKeyPrefix(tenantID+":"), redis.WithTLS(&tls.Config{}))
+//	// TODO: handle error
+//	c, err := cache.New(s, p, cache.WithTimestampMode(cache.TimestampDisabled))
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	defaultLockTTL = 10 * time.Second
+	// lockKeySuffix is appended to the data's key to form the key of the lock
+	lockKeySuffix = ":lock"
+	// lockRetryDelay and maxLockRetryDelay bound the random delay between attempts to acquire the lock
+	lockRetryDelay, maxLockRetryDelay = 10 * time.Millisecond, 200 * time.Millisecond
+	// unlockScript deletes the lock only when it holds the given token, so a client whose lease
+	// expired can't release a lock another client has since acquired
+	unlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+// ErrLockExpired indicates Storage's lease on the lock expired before Storage finished using it,
+// so another client may have acquired the lock.
+var ErrLockExpired = errors.New("the Redis lock's lease expired")
+
+type option func(*Storage) error
+
+// WithAuth sets credentials with which Storage authenticates to Redis. When "user" is empty,
+// Storage authenticates with only the password, as the default user.
+func WithAuth(user, password string) option {
+	return func(s *Storage) error {
+		if password == "" {
+			return errors.New("password can't be empty")
+		}
+		s.user, s.password = user, password
+		return nil
+	}
+}
+
+// WithDB sets the number of the Redis database in which Storage stores data. The default is 0.
+func WithDB(n int) option {
+	return func(s *Storage) error {
+		if n < 0 {
+			return errors.New("database number can't be negative")
+		}
+		s.db = n
+		return nil
+	}
+}
+
+// WithKeyPrefix sets a prefix for the keys of the data and lock, for example to partition data by
+// tenant. By default, keys have no prefix.
+func WithKeyPrefix(prefix string) option {
+	return func(s *Storage) error {
+		s.prefix = prefix
+		return nil
+	}
+}
+
+// WithLockTTL sets the duration of Storage's lease on the lock. Redis deletes the lock when the lease
+// expires, so a client that crashes while holding the lock can't block others indefinitely. The lease
+// should therefore be much longer than a write takes. The default is 10 seconds.
+func WithLockTTL(d time.Duration) option {
+	return func(s *Storage) error {
+		if d < time.Millisecond {
+			return errors.New("lock TTL must be at least 1 millisecond")
+		}
+		s.lockTTL = d
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about Redis operations. These records never
+// include stored data or credentials. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithTLS makes Storage connect to Redis with TLS configured by "c".
+func WithTLS(c *tls.Config) option {
+	return func(s *Storage) error {
+		if c == nil {
+			return errors.New("TLS config can't be nil")
+		}
+		s.tls = c
+		return nil
+	}
+}
+
+// WithTTL makes stored data expire "d" after it's written. By default, data doesn't expire. A TTL
+// suits caches of app tokens, which the application can acquire again.
+func WithTTL(d time.Duration) option {
+	return func(s *Storage) error {
+		if d < time.Millisecond {
+			return errors.New("TTL must be at least 1 millisecond")
+		}
+		s.ttl = d
+		return nil
+	}
+}
+
+// Storage stores data under a key in Redis. It holds one connection to Redis, which it opens when
+// first needed and reopens after a communication failure.
+type Storage struct {
+	addr   string
+	conn   *conn
+	db     int
+	key    string
+	logger *slog.Logger
+	// lockExpires is when Storage's lease on the lock expires, conservatively estimated from the
+	// local clock. It's zero when Storage doesn't hold the lock.
+	lockExpires time.Time
+	// lockToken identifies Storage as the lock holder. It's empty when Storage doesn't hold the lock.
+	lockToken string
+	lockTTL   time.Duration
+	m         *sync.Mutex
+	password  string
+	prefix    string
+	tls       *tls.Config
+	ttl       time.Duration
+	user      string
+}
+
+// New is the constructor for Storage. "addr" is the Redis server's address as host:port and "key"
+// is the key under which Storage stores data.
+func New(addr, key string, opts ...option) (*Storage, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid Redis address %q: %w", addr, err)
+	}
+	if key == "" {
+		return nil, errors.New("key can't be empty")
+	}
+	s := Storage{addr: addr, key: key, lockTTL: defaultLockTTL, m: &sync.Mutex{}}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.key = s.prefix + key
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("key", s.key))
+	return &s, nil
+}
+
+// Close closes Storage's connection to Redis. Storage opens a new connection when next used.
+func (s *Storage) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Delete deletes the key, if it exists.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	n, err := s.do(ctx, "DEL", s.key)
+	if err == nil && n == int64(0) {
+		s.logger.DebugContext(ctx, "nothing to delete because the key doesn't exist")
+	}
+	return err
+}
+
+// Read returns the key's value or, if the key doesn't exist, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	reply, err := s.do(ctx, "GET", s.key)
+	if err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case nil:
+		s.logger.DebugContext(ctx, "returning no data because the key doesn't exist")
+		return nil, nil
+	case []byte:
+		return v, nil
+	}
+	return nil, fmt.Errorf("unexpected reply to GET: %T", reply)
+}
+
+// Write sets the key's value to data. When Storage holds the lock, Write returns [ErrLockExpired]
+// instead of writing if the lease may have expired.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.lockToken != "" && !time.Now().Before(s.lockExpires) {
+		return ErrLockExpired
+	}
+	args := []any{"SET", s.key, data}
+	if s.ttl > 0 {
+		args = append(args, "PX", s.ttl.Milliseconds())
+	}
+	reply, err := s.do(ctx, args...)
+	if err == nil && reply != "OK" {
+		err = fmt.Errorf("unexpected reply to SET: %v", reply)
+	}
+	return err
+}
+
+// Lock acquires the lock, waiting until it succeeds or the context is done. Following the single
+// instance Redlock algorithm, the lock is a key set only if it doesn't exist, whose value is a random
+// token and which expires when Storage's lease does (see [WithLockTTL]). Storage waits a random delay
+// between attempts so that contending clients don't retry in lockstep.
+func (s *Storage) Lock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.lockToken != "" {
+		return errors.New("Storage already holds the lock")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	delay := lockRetryDelay
+	for {
+		start := time.Now()
+		reply, err := s.do(ctx, "SET", s.key+lockKeySuffix, token, "NX", "PX", s.lockTTL.Milliseconds())
+		if err != nil {
+			return err
+		}
+		if reply == "OK" {
+			// allow for the time the request took and for clock drift, as Redlock does
+			drift := s.lockTTL/100 + 2*time.Millisecond
+			s.lockExpires, s.lockToken = start.Add(s.lockTTL-drift), token
+			s.logger.DebugContext(ctx, "acquired lock")
+			return nil
+		}
+		d := delay/2 + time.Duration(mrand.Int63n(int64(delay)))
+		s.logger.DebugContext(ctx, "retrying lock acquisition because another client holds the lock", slog.Duration("delay", d))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+			if delay *= 2; delay > maxLockRetryDelay {
+				delay = maxLockRetryDelay
+			}
+		}
+	}
+}
+
+// Unlock releases the lock. It returns [ErrLockExpired] when the lease expired before Unlock,
+// because another client may have acquired the lock while Storage believed it held the lock.
+func (s *Storage) Unlock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.lockToken == "" {
+		return errors.New("Storage doesn't hold the lock")
+	}
+	token := s.lockToken
+	s.lockExpires, s.lockToken = time.Time{}, ""
+	n, err := s.do(ctx, "EVAL", unlockScript, 1, s.key+lockKeySuffix, token)
+	if err != nil {
+		return err
+	}
+	if n != int64(1) {
+		s.logger.DebugContext(ctx, "lock expired before release")
+		return ErrLockExpired
+	}
+	s.logger.DebugContext(ctx, "released lock")
+	return nil
+}
+
+// do sends a command to Redis, connecting first if necessary, and returns the reply. It returns an
+// error reply as a redisError. Callers must hold s.m.
+func (s *Storage) do(ctx context.Context, args ...any) (any, error) {
+	if s.conn == nil {
+		c, err := s.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+	}
+	reply, err := s.send(ctx, s.conn, args...)
+	var re redisError
+	if err != nil && !errors.As(err, &re) {
+		// the connection's state is unknown, so the next command should use a new one
+		s.logger.DebugContext(ctx, "closing connection after an error", slog.Any("error", err))
+		s.conn.Close()
+		s.conn = nil
+	}
+	return reply, err
+}
+
+// connect opens a connection to Redis, authenticates and selects the configured database
+func (s *Storage) connect(ctx context.Context) (*conn, error) {
+	var (
+		nc  net.Conn
+		err error
+	)
+	if s.tls != nil {
+		d := tls.Dialer{Config: s.tls}
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(nc)
+	var setup [][]any
+	if s.password != "" {
+		auth := []any{"AUTH", s.password}
+		if s.user != "" {
+			auth = []any{"AUTH", s.user, s.password}
+		}
+		setup = append(setup, auth)
+	}
+	if s.db != 0 {
+		setup = append(setup, []any{"SELECT", s.db})
+	}
+	for _, args := range setup {
+		if _, err = s.send(ctx, c, args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("couldn't set up connection: %s failed: %w", args[0], err)
+		}
+	}
+	s.logger.DebugContext(ctx, "connected to Redis", slog.String("addr", s.addr))
+	return c, nil
+}
+
+// send sends a command on "c", abandoning it when the context is done
+func (s *Storage) send(ctx context.Context, c *conn, args ...any) (any, error) {
+	deadline, _ := ctx.Deadline()
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// interrupt blocked I/O when the context is done
+	stop := context.AfterFunc(ctx, func() { _ = c.SetDeadline(time.Unix(1, 0)) })
+	reply, err := c.do(args...)
+	if !stop() && err != nil {
+		err = ctx.Err()
+	}
+	if e, ok := reply.(redisError); ok && err == nil {
+		return nil, e
+	}
+	return reply, err
+}
+
+var (
+	_ accessor.Accessor = (*Storage)(nil)
+	_ accessor.Locker   = (*Storage)(nil)
+)
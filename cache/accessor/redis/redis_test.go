@@ -0,0 +1,463 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache"
+	msal "github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// fakeRedis is an in-process stand-in for a Redis server. It implements the commands Storage sends.
+type fakeRedis struct {
+	addr  string
+	conns map[net.Conn]bool
+	// dbs maps database numbers to keys to entries
+	dbs      map[int]map[string]fakeEntry
+	m        sync.Mutex
+	password string
+}
+
+type fakeEntry struct {
+	expires time.Time
+	value   []byte
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{addr: l.Addr().String(), conns: map[net.Conn]bool{}, dbs: map[int]map[string]fakeEntry{}}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.locked(func() { f.conns[c] = true })
+			go f.serve(c)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		f.closeConns()
+	})
+	return f
+}
+
+func (f *fakeRedis) locked(fn func()) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fn()
+}
+
+// closeConns closes all client connections, as a restarting server would
+func (f *fakeRedis) closeConns() {
+	f.locked(func() {
+		for c := range f.conns {
+			c.Close()
+		}
+		f.conns = map[net.Conn]bool{}
+	})
+}
+
+// get returns the value of a key in a database, if it exists
+func (f *fakeRedis) get(db int, key string) ([]byte, bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	e, ok := f.dbs[db][key]
+	if ok && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		return nil, false
+	}
+	return e.value, ok
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+	authenticated, db := false, 0
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		f.locked(func() {
+			if f.password != "" && !authenticated && !strings.EqualFold(args[0], "AUTH") {
+				reply = "-NOAUTH Authentication required.\r\n"
+				return
+			}
+			reply = f.exec(args, &authenticated, &db)
+		})
+		if _, err = w.WriteString(reply); err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// exec executes a command and returns its encoded reply. Callers must hold f.m.
+func (f *fakeRedis) exec(args []string, authenticated *bool, db *int) string {
+	bulk := func(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+	if f.dbs[*db] == nil {
+		f.dbs[*db] = map[string]fakeEntry{}
+	}
+	keys := f.dbs[*db]
+	live := func(k string) (fakeEntry, bool) {
+		e, ok := keys[k]
+		if ok && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+			delete(keys, k)
+			return e, false
+		}
+		return e, ok
+	}
+	switch cmd := strings.ToUpper(args[0]); {
+	case cmd == "AUTH" && (len(args) == 2 || len(args) == 3):
+		if args[len(args)-1] != f.password || (len(args) == 3 && args[1] != "default") {
+			return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		}
+		*authenticated = true
+		return "+OK\r\n"
+	case cmd == "SELECT" && len(args) == 2:
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "-ERR invalid DB index\r\n"
+		}
+		*db = n
+		return "+OK\r\n"
+	case cmd == "GET" && len(args) == 2:
+		if e, ok := live(args[1]); ok {
+			return bulk(string(e.value))
+		}
+		return "$-1\r\n"
+	case cmd == "SET" && len(args) >= 3:
+		e := fakeEntry{value: []byte(args[2])}
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				if i++; i == len(args) {
+					return "-ERR syntax error\r\n"
+				}
+				ms, err := strconv.Atoi(args[i])
+				if err != nil || ms <= 0 {
+					return "-ERR invalid expire time in 'set' command\r\n"
+				}
+				e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			default:
+				return "-ERR syntax error\r\n"
+			}
+		}
+		if _, ok := live(args[1]); ok && nx {
+			return "$-1\r\n"
+		}
+		keys[args[1]] = e
+		return "+OK\r\n"
+	case cmd == "DEL" && len(args) >= 2:
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := live(k); ok {
+				delete(keys, k)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case cmd == "EVAL" && len(args) == 5 && args[1] == unlockScript && args[2] == "1":
+		if e, ok := live(args[3]); ok && string(e.value) == args[4] {
+			delete(keys, args[3])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command or wrong number of arguments for '%s'\r\n", args[0])
+}
+
+// readCommand reads a command encoded as a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if line[0] != '*' || err != nil || n < 1 {
+		return nil, fmt.Errorf("malformed command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if line[0] != '$' || err != nil {
+			return nil, fmt.Errorf("malformed bulk string header %q", line)
+		}
+		b := make([]byte, size+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	f := newFakeRedis(t)
+	s, err := New(f.addr, "msal")
+	require.NoError(t, err)
+	defer s.Close()
+
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	require.NoError(t, s.Delete(ctx))
+
+	for _, expected := range [][]byte{[]byte(`{"expected":true}`), {0, 1, '\r', '\n', 255}, {}} {
+		require.NoError(t, s.Write(ctx, expected))
+		actual, err = s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+
+	require.NoError(t, s.Delete(ctx))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+}
+
+func TestKeyPrefixAndTTL(t *testing.T) {
+	f := newFakeRedis(t)
+	a, err := New(f.addr, "msal", WithKeyPrefix("tenant-a:"), WithTTL(50*time.Millisecond))
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := New(f.addr, "msal", WithKeyPrefix("tenant-b:"))
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	require.NoError(t, b.Write(ctx, []byte("b")))
+	v, ok := f.get(0, "tenant-a:msal")
+	require.True(t, ok)
+	require.Equal(t, []byte("a"), v)
+	v, ok = f.get(0, "tenant-b:msal")
+	require.True(t, ok)
+	require.Equal(t, []byte("b"), v)
+
+	require.Eventually(t, func() bool {
+		data, err := a.Read(ctx)
+		return err == nil && data == nil
+	}, time.Second, 10*time.Millisecond, "a's data should expire")
+	data, err := b.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), data, "b's data shouldn't expire")
+}
+
+func TestAuthAndDB(t *testing.T) {
+	f := newFakeRedis(t)
+	f.locked(func() { f.password = "password" })
+
+	s, err := New(f.addr, "msal")
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorContains(t, err, "NOAUTH")
+
+	s, err = New(f.addr, "msal", WithAuth("", "wrong"))
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorContains(t, err, "WRONGPASS")
+
+	for _, user := range []string{"", "default"} {
+		s, err = New(f.addr, "msal", WithAuth(user, "password"), WithDB(3))
+		require.NoError(t, err)
+		require.NoError(t, s.Write(ctx, []byte(user)))
+		require.NoError(t, s.Close())
+		v, ok := f.get(3, "msal")
+		require.True(t, ok)
+		require.Equal(t, []byte(user), v)
+	}
+	_, ok := f.get(0, "msal")
+	require.False(t, ok)
+}
+
+func TestLock(t *testing.T) {
+	f := newFakeRedis(t)
+	a, err := New(f.addr, "msal")
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := New(f.addr, "msal")
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.NoError(t, a.Lock(ctx))
+	require.Error(t, a.Lock(ctx), "Lock isn't reentrant")
+	cx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, b.Lock(cx), context.DeadlineExceeded)
+
+	// b should acquire the lock soon after a releases it
+	locked := make(chan error)
+	go func() { locked <- b.Lock(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	require.NoError(t, a.Unlock(ctx))
+	require.NoError(t, <-locked)
+	require.NoError(t, b.Unlock(ctx))
+	require.Error(t, b.Unlock(ctx), "Storage doesn't hold the lock")
+}
+
+func TestLockExpiration(t *testing.T) {
+	f := newFakeRedis(t)
+	a, err := New(f.addr, "msal", WithLockTTL(30*time.Millisecond))
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := New(f.addr, "msal")
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.NoError(t, a.Lock(ctx))
+	time.Sleep(50 * time.Millisecond)
+	require.ErrorIs(t, a.Write(ctx, []byte("a")), ErrLockExpired, "Write should refuse when the lease may have expired")
+
+	// b may acquire the expired lock, and a's Unlock shouldn't release it
+	require.NoError(t, b.Lock(ctx))
+	require.ErrorIs(t, a.Unlock(ctx), ErrLockExpired)
+	_, ok := f.get(0, "msal"+lockKeySuffix)
+	require.True(t, ok, "a released b's lock")
+	require.NoError(t, b.Write(ctx, []byte("b")))
+	require.NoError(t, b.Unlock(ctx))
+
+	// a should be able to lock again
+	require.NoError(t, a.Lock(ctx))
+	require.NoError(t, a.Unlock(ctx))
+}
+
+func TestReconnect(t *testing.T) {
+	f := newFakeRedis(t)
+	s, err := New(f.addr, "msal")
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Write(ctx, []byte("data")))
+
+	f.closeConns()
+	// the first command after the server closes the connection may fail
+	// but Storage should then reconnect
+	if _, err := s.Read(ctx); err != nil {
+		require.False(t, errors.As(err, new(redisError)), "unexpected error reply")
+	}
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+}
+
+func TestCache(t *testing.T) {
+	f := newFakeRedis(t)
+	p := filepath.Join(t.TempDir(), "ts")
+	var caches []*cache.Cache
+	for i := 0; i < 2; i++ {
+		s, err := New(f.addr, "msal")
+		require.NoError(t, err)
+		defer s.Close()
+		c, err := cache.New(s, p, cache.WithTimestampMode(cache.TimestampDisabled))
+		require.NoError(t, err)
+		caches = append(caches, c)
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range caches {
+		wg.Add(1)
+		go func(i int, c *cache.Cache) {
+			defer wg.Done()
+			for j := 0; j < 10 && !t.Failed(); j++ {
+				if err := c.Export(ctx, &fakeMarshaler{data: []byte(strconv.Itoa(i))}, msal.ExportHints{}); err != nil {
+					t.Errorf("%d: %s", i, err)
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	require.NoFileExists(t, p+".lockfile", "Cache should use the Redis lock")
+	_, ok := f.get(0, "msal"+lockKeySuffix)
+	require.False(t, ok, "Cache should release the lock")
+
+	u := fakeMarshaler{}
+	require.NoError(t, caches[0].Replace(ctx, &u, msal.ReplaceHints{}))
+	require.Contains(t, []string{"0", "1"}, string(u.data))
+}
+
+func TestConnectionErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	s, err := New(addr, "msal")
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.Error(t, err)
+
+	// a server that never responds
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	s, err = New(l.Addr().String(), "msal")
+	require.NoError(t, err)
+	defer s.Close()
+	cx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err = s.Read(cx)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestOptions(t *testing.T) {
+	for _, test := range []struct {
+		desc, addr, key string
+		opts            []option
+	}{
+		{desc: "invalid address", addr: "redis", key: "msal"},
+		{desc: "empty key", addr: "localhost:6379"},
+		{desc: "empty password", addr: "localhost:6379", key: "msal", opts: []option{WithAuth("user", "")}},
+		{desc: "negative DB", addr: "localhost:6379", key: "msal", opts: []option{WithDB(-1)}},
+		{desc: "zero lock TTL", addr: "localhost:6379", key: "msal", opts: []option{WithLockTTL(0)}},
+		{desc: "zero TTL", addr: "localhost:6379", key: "msal", opts: []option{WithTTL(0)}},
+		{desc: "nil TLS config", addr: "localhost:6379", key: "msal", opts: []option{WithTLS(nil)}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(test.addr, test.key, test.opts...)
+			require.Error(t, err)
+		})
+	}
+}
+
+// fakeMarshaler implements MSAL's cache.Marshaler and cache.Unmarshaler
+type fakeMarshaler struct {
+	data []byte
+}
+
+func (f *fakeMarshaler) Marshal() ([]byte, error) {
+	return f.data, nil
+}
+
+func (f *fakeMarshaler) Unmarshal(b []byte) error {
+	f.data = b
+	return nil
+}
@@ -0,0 +1,318 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package s3 stores data in an object in Amazon S3 or another storage service having an S3-compatible
+// API, such as MinIO. Its Storage implements [accessor.Versioned] with the object's ETag and conditional
+// writes, so several clients can share the object with Cache's optimistic concurrency mode. S3 has no
+// locks, so clients sharing the object should use that mode, and should disable the timestamp file,
+// which records only local writes:
+//
+//	s, err := s3.New("https://s3.us-west-2.amazonaws.com", "bucket", "msal/cache.json", s3.WithRegion("us-west-2"))
+//	// TODO: handle error
+//	c, err := cache.New(s, p, cache.WithOptimisticConcurrency(), cache.WithTimestampMode(cache.TimestampDisabled))
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/seal"
+)
+
+const defaultRegion = "us-east-1"
+
+type credentials struct {
+	accessKeyID, secretAccessKey, sessionToken string
+}
+
+type option func(*Storage) error
+
+// WithCredentials sets the credentials with which Storage signs requests. "sessionToken" is required
+// only for temporary credentials. The defaults are $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
+// $AWS_SESSION_TOKEN.
+func WithCredentials(accessKeyID, secretAccessKey, sessionToken string) option {
+	return func(s *Storage) error {
+		if accessKeyID == "" || secretAccessKey == "" {
+			return errors.New("access key ID and secret access key can't be empty")
+		}
+		s.creds = credentials{accessKeyID: accessKeyID, secretAccessKey: secretAccessKey, sessionToken: sessionToken}
+		return nil
+	}
+}
+
+// WithEncryptionKey makes Storage encrypt data with AES-256-GCM before storing it, so the storage
+// service's operators can't read cached tokens. The key must be 32 bytes. Ciphertext is bound to the
+// bucket and key, so it doesn't decrypt when copied to another object.
+func WithEncryptionKey(key []byte) option {
+	return func(s *Storage) error {
+		if err := seal.CheckKey(key); err != nil {
+			return err
+		}
+		s.encryptionKey = append([]byte{}, key...)
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client Storage uses to send requests, for example to configure TLS. The
+// default is [http.DefaultClient].
+func WithHTTPClient(c *http.Client) option {
+	return func(s *Storage) error {
+		if c == nil {
+			return errors.New("HTTP client can't be nil")
+		}
+		s.client = c
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about storage operations. These records never
+// include stored data or credentials. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithRegion sets the region with which Storage signs requests. The default is $AWS_REGION or, when
+// that's empty, $AWS_DEFAULT_REGION or "us-east-1".
+func WithRegion(region string) option {
+	return func(s *Storage) error {
+		if region == "" {
+			return errors.New("region can't be empty")
+		}
+		s.region = region
+		return nil
+	}
+}
+
+// Storage stores data in an S3 object.
+type Storage struct {
+	bucket, key   string
+	client        *http.Client
+	creds         credentials
+	encryptionKey []byte
+	logger        *slog.Logger
+	m             *sync.Mutex
+	region        string
+	u             *url.URL
+}
+
+// New is the constructor for Storage. "endpoint" is the URL of the storage service, for example
+// "https://s3.us-west-2.amazonaws.com" or "http://localhost:9000". Storage addresses the object by
+// path, as in "{endpoint}/{bucket}/{key}".
+func New(endpoint, bucket, key string, opts ...option) (*Storage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("invalid bucket %q", bucket)
+	}
+	if key == "" {
+		return nil, errors.New("key can't be empty")
+	}
+	s := Storage{
+		bucket: bucket,
+		client: http.DefaultClient,
+		creds: credentials{
+			accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		key: key,
+		m:   &sync.Mutex{},
+		u:   u.JoinPath(bucket, key),
+	}
+	for _, r := range []string{os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), defaultRegion} {
+		if r != "" {
+			s.region = r
+			break
+		}
+	}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	if s.creds.accessKeyID == "" || s.creds.secretAccessKey == "" {
+		return nil, errors.New("no credentials. Specify them with WithCredentials or set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("bucket", bucket), slog.String("key", key))
+	return &s, nil
+}
+
+// Delete deletes the object, if it exists.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, _, err := s.do(ctx, http.MethodDelete, nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		s.logger.DebugContext(ctx, "nothing to delete because the object doesn't exist")
+		return nil
+	}
+	return err
+}
+
+// Read returns the object's data or, if the object doesn't exist, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	data, _, err := s.ReadVersion(ctx)
+	return data, err
+}
+
+// ReadVersion returns the object's data and ETag or, if the object doesn't exist, a nil slice and
+// an empty version.
+func (s *Storage) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	body, etag, err := s.do(ctx, http.MethodGet, nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		s.logger.DebugContext(ctx, "returning no data because the object doesn't exist")
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if s.encryptionKey != nil {
+		if body, err = seal.Open(s.encryptionKey, body, s.ad()); err != nil {
+			return nil, "", err
+		}
+	}
+	return body, etag, nil
+}
+
+// Write stores data in the object, creating it if necessary.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err := s.put(ctx, data, nil)
+	return err
+}
+
+// WriteIf stores data in the object when the object's ETag is "version" or, when version is empty,
+// when the object doesn't exist. It returns the object's new ETag. The storage service must support
+// conditional writes, as S3 has since 2024.
+func (s *Storage) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	h := http.Header{}
+	if version == "" {
+		h.Set("If-None-Match", "*")
+	} else {
+		h.Set("If-Match", version)
+	}
+	etag, err := s.put(ctx, data, h)
+	var e *s3Error
+	if errors.As(err, &e) && (e.status == http.StatusPreconditionFailed || e.code == "ConditionalRequestConflict") {
+		s.logger.DebugContext(ctx, "not writing because the object changed", slog.String("etag", version))
+		return "", fmt.Errorf("%w: %s", accessor.ErrVersionConflict, err)
+	}
+	return etag, err
+}
+
+// ad returns the associated data binding ciphertext to the object
+func (s *Storage) ad() []byte {
+	return []byte(s.bucket + "/" + s.key)
+}
+
+// put uploads data, encrypting it first if Storage has an encryption key, and returns the object's ETag
+func (s *Storage) put(ctx context.Context, data []byte, h http.Header) (string, error) {
+	if s.encryptionKey != nil {
+		var err error
+		if data, err = seal.Seal(s.encryptionKey, data, s.ad()); err != nil {
+			return "", err
+		}
+	}
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Content-Type", "application/octet-stream")
+	_, etag, err := s.do(ctx, http.MethodPut, data, h)
+	if err == nil {
+		s.logger.DebugContext(ctx, "wrote object", logging.Size(data))
+	}
+	return etag, err
+}
+
+// do sends a signed request for the object, returning the response body and ETag. It returns an
+// *s3Error when the storage service responds with an error status.
+func (s *Storage) do(ctx context.Context, method string, body []byte, h http.Header) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	if body == nil {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	payloadHash := emptyHash
+	if len(body) > 0 {
+		payloadHash = hash(body)
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	sign(req, s.creds, s.region, time.Now())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		e := s3Error{status: res.StatusCode}
+		var x struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(b, &x) == nil {
+			e.code, e.message = x.Code, x.Message
+		}
+		return nil, "", &e
+	}
+	return b, res.Header.Get("ETag"), nil
+}
+
+// s3Error is an error response from the storage service
+type s3Error struct {
+	code, message string
+	status        int
+}
+
+func (e *s3Error) Error() string {
+	msg := e.message
+	if msg == "" {
+		msg = http.StatusText(e.status)
+	}
+	if e.code != "" {
+		msg = e.code + ": " + msg
+	}
+	return fmt.Sprintf("storage service responded %d: %s", e.status, msg)
+}
+
+// isStatus returns true when err is an *s3Error having the given status
+func isStatus(err error, status int) bool {
+	var e *s3Error
+	return errors.As(err, &e) && e.status == status
+}
+
+var (
+	_ accessor.Accessor  = (*Storage)(nil)
+	_ accessor.Versioned = (*Storage)(nil)
+)
@@ -0,0 +1,260 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package seed provides an accessor for processes that receive a pre-populated cache from their
+// environment, such as CI jobs given a cache in a secret variable. Storage reads the cache once, from
+// an environment variable, a file descriptor inherited from the parent process, or a systemd credential,
+// and thereafter keeps data only in memory. It never writes to disk unless configured to flush data
+// to another accessor:
+//
+//	s, err := seed.New(seed.WithEnv("MSAL_CACHE"), seed.WithFlush(a))
+//	// TODO: handle error
+//	defer s.Flush(context.Background())
+//	c, err := cache.New(s, p)
+//
+// Cache still creates lock and timestamp files at p, but these contain no cached data. Data written to
+// Storage lasts only as long as the process, so Storage suits processes which don't share the cache
+// with others running concurrently.
+package seed
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	// credentialsDirectory is the environment variable in which systemd provides the path of
+	// a service's decrypted credentials
+	credentialsDirectory = "CREDENTIALS_DIRECTORY"
+	// maxSize is the maximum size of seed data
+	maxSize = 64 << 20
+)
+
+// source reads seed data. It returns a nil slice and error when it has no data.
+type source struct {
+	name string
+	read func() ([]byte, error)
+}
+
+type option func(*Storage) error
+
+// WithCredential adds a systemd credential as a source of seed data. "name" is the credential's name in
+// the unit's LoadCredential= or LoadCredentialEncrypted= setting. The source has no data when the
+// process has no credential having that name.
+func WithCredential(name string) option {
+	return func(s *Storage) error {
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+			return fmt.Errorf("invalid credential name %q", name)
+		}
+		s.sources = append(s.sources, source{
+			name: "credential " + name,
+			read: func() ([]byte, error) {
+				dir := os.Getenv(credentialsDirectory)
+				if dir == "" {
+					return nil, nil
+				}
+				f, err := os.Open(filepath.Join(dir, name))
+				if errors.Is(err, os.ErrNotExist) {
+					return nil, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				defer f.Close()
+				return readAll(f)
+			},
+		})
+		return nil
+	}
+}
+
+// WithEnv adds an environment variable having a base64 encoded value as a source of seed data. The
+// source has no data when the variable is unset or empty. New unsets the variable after reading it, so
+// the process's children don't inherit the cache.
+func WithEnv(name string) option {
+	return func(s *Storage) error {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+		s.sources = append(s.sources, source{
+			name: "$" + name,
+			read: func() ([]byte, error) {
+				v := strings.TrimSpace(os.Getenv(name))
+				if err := os.Unsetenv(name); err != nil {
+					return nil, err
+				}
+				if v == "" {
+					return nil, nil
+				}
+				data, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					return nil, fmt.Errorf("$%s isn't valid base64: %w", name, err)
+				}
+				return data, nil
+			},
+		})
+		return nil
+	}
+}
+
+// WithFD adds a file descriptor inherited from the parent process, such as one end of a pipe, as a source
+// of seed data. On Windows, "fd" is a handle. New reads the file to its end and then closes it, whether
+// or not it has data.
+func WithFD(fd uintptr) option {
+	return func(s *Storage) error {
+		f := os.NewFile(fd, fmt.Sprintf("fd %d", fd))
+		if f == nil {
+			return fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		s.sources = append(s.sources, source{
+			name: f.Name(),
+			read: func() ([]byte, error) {
+				defer f.Close()
+				return readAll(f)
+			},
+		})
+		return nil
+	}
+}
+
+// WithFlush sets an accessor to which Flush writes data. By default, Flush does nothing.
+func WithFlush(a accessor.Accessor) option {
+	return func(s *Storage) error {
+		if a == nil {
+			return errors.New("flush accessor can't be nil")
+		}
+		s.flush = a
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about seeding and flushing. These records never
+// include cached data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// Storage keeps data in memory, having initially the seed data New read from its sources.
+type Storage struct {
+	data []byte
+	// dirty indicates whether data changed after New read it
+	dirty   bool
+	flush   accessor.Accessor
+	logger  *slog.Logger
+	m       *sync.Mutex
+	sources []source
+}
+
+// New is the constructor for Storage. It requires at least one source of seed data. New reads every
+// source, so that it unsets all the environment variables and closes all the file descriptors, and seeds
+// Storage with data from the first source in the order given having data. When no source has data,
+// Storage starts empty. New returns an error when it can't read a source, because silently starting
+// with no data could hide a misconfigured pipeline.
+func New(opts ...option) (*Storage, error) {
+	s := Storage{m: &sync.Mutex{}}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger)
+	if len(s.sources) == 0 {
+		return nil, errors.New("no source of seed data. Specify one with WithCredential, WithEnv or WithFD")
+	}
+	var err error
+	for _, src := range s.sources {
+		data, e := src.read()
+		switch {
+		case e != nil:
+			if err == nil {
+				err = fmt.Errorf("couldn't read %s: %w", src.name, e)
+			}
+		case len(data) == 0:
+			s.logger.Debug("source has no data", slog.String("source", src.name))
+		case s.data == nil:
+			s.logger.Debug("seeded data", slog.String("source", src.name), logging.Size(data))
+			s.data = data
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Delete deletes data from memory. It doesn't affect the sources of seed data.
+func (s *Storage) Delete(context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.data = nil
+	s.dirty = true
+	return nil
+}
+
+// Flush writes data to the accessor set by [WithFlush], or deletes that accessor's data when Storage has
+// none. It does nothing when Storage has no flush accessor or its data hasn't changed since New read it
+// (or since the last successful Flush). Applications should call Flush before exiting.
+func (s *Storage) Flush(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.flush == nil || !s.dirty {
+		return nil
+	}
+	var err error
+	if len(s.data) == 0 {
+		s.logger.DebugContext(ctx, "flushing deletion")
+		err = s.flush.Delete(ctx)
+	} else {
+		s.logger.DebugContext(ctx, "flushing data", logging.Size(s.data))
+		err = s.flush.Write(ctx, s.data)
+	}
+	if err == nil {
+		s.dirty = false
+	}
+	return err
+}
+
+// Read returns data from memory or, if there is none, a nil slice and error.
+func (s *Storage) Read(context.Context) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.data) == 0 {
+		return nil, nil
+	}
+	return bytes.Clone(s.data), nil
+}
+
+// Write stores data in memory. It doesn't affect the sources of seed data.
+func (s *Storage) Write(_ context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.data = bytes.Clone(data)
+	s.dirty = true
+	return nil
+}
+
+// readAll reads r to its end, returning an error if it has more than maxSize bytes
+func readAll(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err == nil && len(data) > maxSize {
+		err = fmt.Errorf("data exceeds %d bytes", maxSize)
+	}
+	return data, err
+}
+
+var _ accessor.Accessor = (*Storage)(nil)
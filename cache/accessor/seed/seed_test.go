@@ -0,0 +1,244 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package seed
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache"
+	msal "github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+const envName = "MSALCACHE_SEED_TEST"
+
+// fakeAccessor stores data in memory
+type fakeAccessor struct {
+	data            []byte
+	err             error
+	deletes, writes int
+}
+
+func (f *fakeAccessor) Delete(context.Context) error {
+	f.deletes++
+	if f.err != nil {
+		return f.err
+	}
+	f.data = nil
+	return nil
+}
+
+func (f *fakeAccessor) Read(context.Context) ([]byte, error) {
+	return f.data, f.err
+}
+
+func (f *fakeAccessor) Write(_ context.Context, b []byte) error {
+	f.writes++
+	if f.err != nil {
+		return f.err
+	}
+	f.data = append([]byte{}, b...)
+	return nil
+}
+
+// pipe returns the read end of a pipe from which data can be read
+func pipe(t *testing.T, data []byte) *os.File {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Close() })
+	go func() {
+		_, _ = w.Write(data)
+		w.Close()
+	}()
+	return r
+}
+
+// credential creates a systemd credential for the test
+func credential(t *testing.T, name string, data []byte) {
+	dir := t.TempDir()
+	t.Setenv(credentialsDirectory, dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0400))
+}
+
+func TestSources(t *testing.T) {
+	expected := []byte(`{"key":"value"}`)
+
+	t.Run("credential", func(t *testing.T) {
+		credential(t, "msal", expected)
+		s, err := New(WithCredential("msal"))
+		require.NoError(t, err)
+		actual, err := s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv(envName, base64.StdEncoding.EncodeToString(expected)+"\n")
+		s, err := New(WithEnv(envName))
+		require.NoError(t, err)
+		actual, err := s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+		_, ok := os.LookupEnv(envName)
+		require.False(t, ok, "New should unset the variable")
+	})
+
+	t.Run("fd", func(t *testing.T) {
+		r := pipe(t, expected)
+		s, err := New(WithFD(r.Fd()))
+		require.NoError(t, err)
+		actual, err := s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("order", func(t *testing.T) {
+		t.Setenv(credentialsDirectory, t.TempDir())
+		t.Setenv(envName, base64.StdEncoding.EncodeToString([]byte("env")))
+		r := pipe(t, []byte("fd"))
+		s, err := New(WithCredential("missing"), WithEnv(envName), WithFD(r.Fd()))
+		require.NoError(t, err)
+		actual, err := s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "env", string(actual), "New should use the first source having data")
+		_, err = r.Stat()
+		require.Error(t, err, "New should close the file descriptor")
+	})
+
+	t.Run("no data", func(t *testing.T) {
+		t.Setenv(credentialsDirectory, "")
+		t.Setenv(envName, "")
+		s, err := New(WithCredential("msal"), WithEnv(envName), WithFD(pipe(t, nil).Fd()))
+		require.NoError(t, err)
+		actual, err := s.Read(ctx)
+		require.NoError(t, err)
+		require.Nil(t, actual)
+	})
+
+	t.Run("invalid base64", func(t *testing.T) {
+		t.Setenv(envName, "not base64")
+		_, err := New(WithEnv(envName))
+		require.ErrorContains(t, err, envName)
+	})
+
+	t.Run("unreadable credential", func(t *testing.T) {
+		// a directory can be opened but not read
+		dir := t.TempDir()
+		t.Setenv(credentialsDirectory, dir)
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "msal"), 0700))
+		_, err := New(WithCredential("msal"))
+		require.Error(t, err)
+	})
+}
+
+func TestOverlay(t *testing.T) {
+	seed := []byte("seed")
+	credential(t, "msal", seed)
+	s, err := New(WithCredential("msal"))
+	require.NoError(t, err)
+	require.NoError(t, s.Flush(ctx), "Flush should do nothing when Storage has no flush accessor")
+
+	expected := []byte("expected")
+	require.NoError(t, s.Write(ctx, expected))
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+	actual[0] = 'x'
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual, "Read shouldn't return Storage's buffer")
+
+	require.NoError(t, s.Delete(ctx))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+
+	b, err := os.ReadFile(filepath.Join(os.Getenv(credentialsDirectory), "msal"))
+	require.NoError(t, err)
+	require.Equal(t, seed, b, "Storage shouldn't modify its sources")
+}
+
+func TestFlush(t *testing.T) {
+	t.Setenv(envName, base64.StdEncoding.EncodeToString([]byte("seed")))
+	f := &fakeAccessor{}
+	s, err := New(WithEnv(envName), WithFlush(f))
+	require.NoError(t, err)
+
+	require.NoError(t, s.Flush(ctx))
+	require.Equal(t, 0, f.writes, "Flush shouldn't write unchanged seed data")
+
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	f.err = errors.New("it didn't work")
+	require.ErrorIs(t, s.Flush(ctx), f.err)
+	f.err = nil
+	require.NoError(t, s.Flush(ctx), "Flush should try again after failing")
+	require.Equal(t, "data", string(f.data))
+	require.NoError(t, s.Flush(ctx))
+	require.Equal(t, 2, f.writes, "Flush shouldn't write data it already flushed")
+
+	require.NoError(t, s.Delete(ctx))
+	require.NoError(t, s.Flush(ctx))
+	require.Equal(t, 1, f.deletes)
+	require.Nil(t, f.data)
+}
+
+func TestCache(t *testing.T) {
+	t.Setenv(envName, base64.StdEncoding.EncodeToString([]byte("seed")))
+	f := &fakeAccessor{}
+	s, err := New(WithEnv(envName), WithFlush(f))
+	require.NoError(t, err)
+	c, err := cache.New(s, filepath.Join(t.TempDir(), "cache"))
+	require.NoError(t, err)
+
+	m := fakeMarshaler{}
+	require.NoError(t, c.Replace(ctx, &m, msal.ReplaceHints{}))
+	require.Equal(t, "seed", string(m.data))
+	require.NoError(t, c.Export(ctx, &fakeMarshaler{data: []byte("exported")}, msal.ExportHints{}))
+	require.NoError(t, c.Replace(ctx, &m, msal.ReplaceHints{}))
+	require.Equal(t, "exported", string(m.data))
+	require.Nil(t, f.data, "Storage should write to the flush accessor only when flushed")
+
+	require.NoError(t, s.Flush(ctx))
+	require.Equal(t, "exported", string(f.data))
+}
+
+func TestOptions(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		opts []option
+	}{
+		{desc: "no source"},
+		{desc: "empty credential name", opts: []option{WithCredential("")}},
+		{desc: "credential path", opts: []option{WithCredential("../msal")}},
+		{desc: "empty variable name", opts: []option{WithEnv("")}},
+		{desc: "invalid variable name", opts: []option{WithEnv("A=B")}},
+		{desc: "nil flush accessor", opts: []option{WithEnv(envName), WithFlush(nil)}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(test.opts...)
+			require.Error(t, err)
+		})
+	}
+}
+
+// fakeMarshaler implements MSAL's cache.Marshaler and cache.Unmarshaler
+type fakeMarshaler struct {
+	data []byte
+}
+
+func (f *fakeMarshaler) Marshal() ([]byte, error) {
+	return f.data, nil
+}
+
+func (f *fakeMarshaler) Unmarshal(b []byte) error {
+	f.data = b
+	return nil
+}
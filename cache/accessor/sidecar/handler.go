@@ -0,0 +1,307 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package sidecar
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	defaultLockTTL = 15 * time.Second
+	// defaultPollInterval is how often a watch request reads the accessor to detect changes made by
+	// other writers. Changes made through the Handler are reported immediately.
+	defaultPollInterval = 5 * time.Second
+	// defaultWatchTimeout is how long a watch request waits for a change before responding 204
+	defaultWatchTimeout = 25 * time.Second
+	// maxBodySize is the maximum size of a request body
+	maxBodySize = 64 << 20
+)
+
+type handlerOption func(*Handler) error
+
+// WithHandlerLogger sets a Logger to receive debug records about requests. These records never include
+// cached data. By default, Handler doesn't log.
+func WithHandlerLogger(l *slog.Logger) handlerOption {
+	return func(h *Handler) error {
+		h.logger = l
+		return nil
+	}
+}
+
+// WithLockTTL sets how long a client may hold the lock. Handler releases the lock after this time, so
+// a client that crashes while holding the lock can't block others indefinitely. The default is 15 seconds.
+func WithLockTTL(d time.Duration) handlerOption {
+	return func(h *Handler) error {
+		if d < time.Second {
+			return errors.New("lock TTL must be at least 1 second")
+		}
+		h.lockTTL = d
+		return nil
+	}
+}
+
+// Handler serves an accessor to clients speaking the sidecar protocol. It doesn't authenticate clients,
+// so it should be served only on a Unix domain socket or with mutual TLS. When the accessor implements
+// [accessor.Versioned], Handler uses its versions. Otherwise, a version is a hash of the accessor's
+// data, and conditional writes are atomic only when all writers use the Handler.
+type Handler struct {
+	a accessor.Accessor
+	// changed is closed, and replaced, when data changes through the Handler
+	changed chan struct{}
+	// lock is the cache lock. A client holds the lock after the Handler sends a value to it.
+	lock   chan struct{}
+	logger *slog.Logger
+	// lockToken identifies the client holding the lock. It's empty when no client holds the lock.
+	lockToken string
+	lockTimer *time.Timer
+	lockTTL   time.Duration
+	// m guards changed, lockToken and lockTimer
+	m            *sync.Mutex
+	pollInterval time.Duration
+	va           accessor.Versioned
+	watchTimeout time.Duration
+	// wm serializes writes when the accessor isn't versioned
+	wm *sync.Mutex
+}
+
+// NewHandler is the constructor for Handler.
+func NewHandler(a accessor.Accessor, opts ...handlerOption) (*Handler, error) {
+	if a == nil {
+		return nil, errors.New("accessor can't be nil")
+	}
+	h := Handler{
+		a:            a,
+		changed:      make(chan struct{}),
+		lock:         make(chan struct{}, 1),
+		lockTTL:      defaultLockTTL,
+		m:            &sync.Mutex{},
+		pollInterval: defaultPollInterval,
+		watchTimeout: defaultWatchTimeout,
+		wm:           &sync.Mutex{},
+	}
+	h.va, _ = a.(accessor.Versioned)
+	for _, o := range opts {
+		if err := o(&h); err != nil {
+			return nil, err
+		}
+	}
+	h.logger = logging.OrDiscard(h.logger)
+	return &h, nil
+}
+
+// ServeHTTP serves a protocol request. Handler expects paths relative to its base URL, so an application
+// serving it under a prefix should remove the prefix with [http.StripPrefix].
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case p == pathData && r.Method == http.MethodGet:
+		data, version, err := h.read(r.Context())
+		if err != nil {
+			h.fail(w, r, http.StatusInternalServerError, "", err)
+			return
+		}
+		h.respond(w, http.StatusOK, dataResponse{Data: data, Version: version})
+	case p == pathData && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		var req writeRequest
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&req); err != nil {
+				h.fail(w, r, http.StatusBadRequest, "", fmt.Errorf("invalid request body: %w", err))
+				return
+			}
+		}
+		if t := r.Header.Get(headerLockToken); t != "" && !h.holds(t) {
+			h.fail(w, r, http.StatusConflict, codeLockExpired, errors.New("the lock expired"))
+			return
+		}
+		version, err := h.write(r.Context(), r.Method == http.MethodDelete, req)
+		if errors.Is(err, accessor.ErrVersionConflict) {
+			h.fail(w, r, http.StatusPreconditionFailed, codeVersionConflict, err)
+			return
+		}
+		if err != nil {
+			h.fail(w, r, http.StatusInternalServerError, "", err)
+			return
+		}
+		h.notify()
+		h.respond(w, http.StatusOK, versionResponse{Version: version})
+	case p == pathLock && r.Method == http.MethodPost:
+		token, err := h.acquire(r.Context())
+		if err != nil {
+			if r.Context().Err() == nil {
+				h.fail(w, r, http.StatusInternalServerError, "", err)
+			}
+			return
+		}
+		h.logger.DebugContext(r.Context(), "client acquired the lock")
+		h.respond(w, http.StatusOK, lockResponse{TTLMilliseconds: h.lockTTL.Milliseconds(), Token: token})
+	case strings.HasPrefix(p, pathLock+"/") && r.Method == http.MethodDelete:
+		if !h.release(strings.TrimPrefix(p, pathLock+"/")) {
+			h.fail(w, r, http.StatusConflict, codeLockExpired, errors.New("the lock expired"))
+			return
+		}
+		h.logger.DebugContext(r.Context(), "client released the lock")
+		w.WriteHeader(http.StatusNoContent)
+	case p == pathWatch && r.Method == http.MethodGet:
+		h.watch(w, r)
+	default:
+		h.fail(w, r, http.StatusNotFound, "", fmt.Errorf("no operation %s %s", r.Method, p))
+	}
+}
+
+// acquire waits for the lock, returning a token identifying its holder, until the context is done
+func (h *Handler) acquire(ctx context.Context) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	select {
+	case h.lock <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.lockToken = token
+	h.lockTimer = time.AfterFunc(h.lockTTL, func() {
+		if h.release(token) {
+			h.logger.Debug("released the lock because its TTL elapsed")
+		}
+	})
+	return token, nil
+}
+
+// holds returns true when the given token identifies the lock's holder
+func (h *Handler) holds(token string) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return token == h.lockToken
+}
+
+// release releases the lock if the given token identifies its holder. It returns false otherwise.
+func (h *Handler) release(token string) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if token == "" || token != h.lockToken {
+		return false
+	}
+	h.lockTimer.Stop()
+	h.lockTimer, h.lockToken = nil, ""
+	<-h.lock
+	return true
+}
+
+// read returns the accessor's data and version
+func (h *Handler) read(ctx context.Context) ([]byte, string, error) {
+	if h.va != nil {
+		return h.va.ReadVersion(ctx)
+	}
+	data, err := h.a.Read(ctx)
+	return data, hash(data), err
+}
+
+// write writes or deletes data, subject to the request's version condition, and returns the new version.
+// Delete requests have no condition.
+func (h *Handler) write(ctx context.Context, del bool, req writeRequest) (string, error) {
+	if h.va != nil && req.IfVersion != nil {
+		return h.va.WriteIf(ctx, req.Data, *req.IfVersion)
+	}
+	h.wm.Lock()
+	defer h.wm.Unlock()
+	if req.IfVersion != nil {
+		_, v, err := h.read(ctx)
+		if err != nil {
+			return "", err
+		}
+		if v != *req.IfVersion {
+			return "", accessor.ErrVersionConflict
+		}
+	}
+	if del {
+		return "", h.a.Delete(ctx)
+	}
+	if err := h.a.Write(ctx, req.Data); err != nil {
+		return "", err
+	}
+	if h.va != nil {
+		_, v, err := h.va.ReadVersion(ctx)
+		return v, err
+	}
+	return hash(req.Data), nil
+}
+
+// notify wakes watch requests
+func (h *Handler) notify() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// watch responds when the accessor's version differs from the version in the request's query, or with
+// 204 when it doesn't change before h.watchTimeout
+func (h *Handler) watch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	known := r.URL.Query().Get("version")
+	timeout := time.NewTimer(h.watchTimeout)
+	defer timeout.Stop()
+	for {
+		h.m.Lock()
+		changed := h.changed
+		h.m.Unlock()
+		_, v, err := h.read(ctx)
+		if err != nil {
+			h.fail(w, r, http.StatusInternalServerError, "", err)
+			return
+		}
+		if v != known {
+			h.respond(w, http.StatusOK, versionResponse{Version: v})
+			return
+		}
+		select {
+		case <-changed:
+		case <-time.After(h.pollInterval):
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Handler) fail(w http.ResponseWriter, r *http.Request, status int, code string, err error) {
+	h.logger.DebugContext(r.Context(), "request failed", slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.Any("error", err))
+	h.respond(w, status, errorResponse{Code: code, Error: err.Error()})
+}
+
+func (h *Handler) respond(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// hash returns the version of data from an accessor that isn't versioned
+func hash(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,369 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package sidecar accesses a token cache held by another process, such as a service mesh sidecar, over
+// HTTP. Storage is the client. It implements [accessor.Locker], which Cache uses instead of a file lock,
+// and [accessor.Versioned]. Handler is the server, an [http.Handler] serving any accessor:
+//
+//	// in the sidecar
+//	h, err := sidecar.NewHandler(a)
+//	// TODO: handle error
+//	srv := http.Server{Handler: h, TLSConfig: &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}}
+//
+//	// in the application
+//	s, err := sidecar.New("https://localhost:8443", sidecar.WithTLS(tc))
+//	// TODO: handle error
+//	c, err := cache.New(s, p, cache.WithTimestampMode(cache.TimestampDisabled))
+//
+// Handler doesn't authenticate clients, so it should be served on a Unix domain socket whose permissions
+// restrict access, or with mutual TLS as above. Storage connects to a Unix domain socket when configured
+// with [WithUnixSocket].
+//
+// # Protocol
+//
+// The protocol is JSON over HTTP. Paths are relative to the server's base URL and begin with the
+// protocol version, "/v1". Error responses have a body like {"error": "message", "code": "Code"}.
+//
+//   - GET /v1/data responds {"data": base64, "version": string}. An empty version means there's no data.
+//   - PUT /v1/data with body {"data": base64} writes data and responds {"version": string}. When the body
+//     has "ifVersion", the server writes only when the current version is ifVersion, otherwise
+//     responding 412 with code "VersionConflict". An empty ifVersion matches no data.
+//   - DELETE /v1/data deletes data.
+//   - POST /v1/lock waits for the lock, then responds {"token": string, "ttlMs": number}. The server
+//     releases the lock after ttlMs milliseconds unless the client releases it first.
+//   - DELETE /v1/lock/{token} releases the lock. The server responds 409 with code "LockExpired" when
+//     the token doesn't identify the lock's current holder.
+//   - GET /v1/watch?version={version} responds {"version": string} when the current version differs
+//     from the given one, or 204 after a timeout.
+//
+// PUT and DELETE requests for /v1/data from the lock's holder should have the header Msal-Cache-Lock-Token
+// set to the lock's token. The server rejects such requests with 409 and code "LockExpired" after the lock expires.
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	codeLockExpired     = "LockExpired"
+	codeVersionConflict = "VersionConflict"
+	headerLockToken     = "Msal-Cache-Lock-Token"
+	pathData            = "/v1/data"
+	pathLock            = "/v1/lock"
+	pathWatch           = "/v1/watch"
+)
+
+type dataResponse struct {
+	Data    []byte `json:"data,omitempty"`
+	Version string `json:"version"`
+}
+
+type errorResponse struct {
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error"`
+}
+
+type lockResponse struct {
+	TTLMilliseconds int64  `json:"ttlMs"`
+	Token           string `json:"token"`
+}
+
+type versionResponse struct {
+	Version string `json:"version"`
+}
+
+type writeRequest struct {
+	Data      []byte  `json:"data,omitempty"`
+	IfVersion *string `json:"ifVersion,omitempty"`
+}
+
+// ErrLockExpired indicates the server released Storage's lock, because the lock's TTL elapsed, before
+// Storage finished using it.
+var ErrLockExpired = errors.New("the sidecar lock expired")
+
+type option func(*Storage) error
+
+// WithHTTPClient sets the client Storage uses to send requests. It can't be combined with [WithTLS] or
+// [WithUnixSocket]. The default is [http.DefaultClient].
+func WithHTTPClient(c *http.Client) option {
+	return func(s *Storage) error {
+		if c == nil {
+			return errors.New("HTTP client can't be nil")
+		}
+		s.client = c
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about requests. These records never include cached
+// data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithTLS sets the TLS configuration with which Storage connects to the server. For mutual TLS, the
+// configuration should include a client certificate.
+func WithTLS(c *tls.Config) option {
+	return func(s *Storage) error {
+		if c == nil {
+			return errors.New("TLS config can't be nil")
+		}
+		s.tls = c.Clone()
+		return nil
+	}
+}
+
+// WithUnixSocket makes Storage connect to the server through a Unix domain socket. The host in the
+// server's URL is then irrelevant, so "http://localhost" is a conventional choice.
+func WithUnixSocket(p string) option {
+	return func(s *Storage) error {
+		if p == "" {
+			return errors.New("socket path can't be empty")
+		}
+		s.socket = p
+		return nil
+	}
+}
+
+// Storage accesses a cache served by a Handler.
+type Storage struct {
+	client *http.Client
+	// lockExpires is when the server will release Storage's lock, conservatively estimated from the
+	// local clock. It's zero when Storage doesn't hold the lock.
+	lockExpires time.Time
+	lockToken   string
+	logger      *slog.Logger
+	m           *sync.Mutex
+	socket      string
+	tls         *tls.Config
+	u           *url.URL
+}
+
+// New is the constructor for Storage. "serverURL" is the server's base URL.
+func New(serverURL string, opts ...option) (*Storage, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q", serverURL)
+	}
+	s := Storage{m: &sync.Mutex{}, u: u}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	if s.tls != nil || s.socket != "" {
+		if s.client != nil {
+			return nil, errors.New("WithHTTPClient can't be combined with WithTLS or WithUnixSocket")
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = s.tls
+		if s.socket != "" {
+			t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", s.socket)
+			}
+		}
+		s.client = &http.Client{Transport: t}
+	}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("server", u.Redacted()))
+	return &s, nil
+}
+
+// Delete deletes the cached data. When Storage holds the lock, Delete returns [ErrLockExpired] instead
+// of deleting if the lock may have expired.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.write(ctx, http.MethodDelete, nil, nil)
+}
+
+// Read returns the cached data or, if there is none, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	data, _, err := s.ReadVersion(ctx)
+	return data, err
+}
+
+// ReadVersion returns the cached data, or a nil slice when there's none, and the data's version.
+func (s *Storage) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var res dataResponse
+	if err := s.do(ctx, http.MethodGet, pathData, nil, nil, &res); err != nil {
+		return nil, "", err
+	}
+	if len(res.Data) == 0 {
+		s.logger.DebugContext(ctx, "returning no data because the server has none")
+		return nil, res.Version, nil
+	}
+	return res.Data, res.Version, nil
+}
+
+// Write stores data. When Storage holds the lock, Write returns [ErrLockExpired] instead of writing if
+// the lock may have expired.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.write(ctx, http.MethodPut, &writeRequest{Data: data}, nil)
+}
+
+// WriteIf stores data when the current version is "version" or, when version is empty, when there's
+// no data. It returns the new version.
+func (s *Storage) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var res versionResponse
+	err := s.write(ctx, http.MethodPut, &writeRequest{Data: data, IfVersion: &version}, &res)
+	return res.Version, err
+}
+
+// Lock acquires the server's lock, waiting until it succeeds or the context is done.
+func (s *Storage) Lock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.lockToken != "" {
+		return errors.New("Storage already holds the lock")
+	}
+	start := time.Now()
+	var res lockResponse
+	if err := s.do(ctx, http.MethodPost, pathLock, nil, nil, &res); err != nil {
+		return err
+	}
+	if res.Token == "" {
+		return errors.New("server didn't return a lock token")
+	}
+	s.lockExpires, s.lockToken = start.Add(time.Duration(res.TTLMilliseconds)*time.Millisecond), res.Token
+	s.logger.DebugContext(ctx, "acquired lock")
+	return nil
+}
+
+// Unlock releases the server's lock. It returns [ErrLockExpired] when the lock expired before Unlock,
+// because another client may have acquired the lock while Storage believed it held the lock.
+func (s *Storage) Unlock(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.lockToken == "" {
+		return errors.New("Storage doesn't hold the lock")
+	}
+	token := s.lockToken
+	s.lockExpires, s.lockToken = time.Time{}, ""
+	err := s.do(ctx, http.MethodDelete, pathLock+"/"+url.PathEscape(token), nil, nil, nil)
+	if err == nil {
+		s.logger.DebugContext(ctx, "released lock")
+	}
+	return err
+}
+
+// Watch waits until the cached data's version differs from "version", then returns the new version.
+// It returns an error when the context is done first.
+func (s *Storage) Watch(ctx context.Context, version string) (string, error) {
+	// Watch doesn't lock s.m because it may wait indefinitely and uses no mutable state
+	for {
+		// res remains nil when the server times out without a change
+		var res *versionResponse
+		err := s.do(ctx, http.MethodGet, pathWatch+"?version="+url.QueryEscape(version), nil, nil, &res)
+		if err != nil {
+			return "", err
+		}
+		if res != nil && res.Version != version {
+			return res.Version, nil
+		}
+	}
+}
+
+// write sends a PUT or DELETE request for the data, with the lock token if Storage holds the lock.
+// Callers must hold s.m.
+func (s *Storage) write(ctx context.Context, method string, body *writeRequest, out any) error {
+	h := http.Header{}
+	if s.lockToken != "" {
+		if !time.Now().Before(s.lockExpires) {
+			return ErrLockExpired
+		}
+		h.Set(headerLockToken, s.lockToken)
+	}
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	err := s.do(ctx, method, pathData, h, b, out)
+	if err == nil && method == http.MethodPut {
+		s.logger.DebugContext(ctx, "wrote data", logging.Size(body.Data))
+	}
+	return err
+}
+
+// do sends a request and decodes the response body into out, if it isn't nil. It returns errors for
+// the protocol's error codes that wrap ErrLockExpired or accessor.ErrVersionConflict.
+func (s *Storage) do(ctx context.Context, method, p string, h http.Header, body []byte, out any) error {
+	u, err := s.u.Parse(strings.TrimSuffix(s.u.Path, "/") + p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var e errorResponse
+		if json.Unmarshal(b, &e) != nil || e.Error == "" {
+			e.Error = http.StatusText(res.StatusCode)
+		}
+		err = fmt.Errorf("sidecar responded %d: %s", res.StatusCode, e.Error)
+		switch e.Code {
+		case codeLockExpired:
+			err = fmt.Errorf("%w: %s", ErrLockExpired, err)
+		case codeVersionConflict:
+			err = fmt.Errorf("%w: %s", accessor.ErrVersionConflict, err)
+		}
+		return err
+	}
+	if out != nil && res.StatusCode != http.StatusNoContent {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+var (
+	_ accessor.Accessor  = (*Storage)(nil)
+	_ accessor.Locker    = (*Storage)(nil)
+	_ accessor.Versioned = (*Storage)(nil)
+)
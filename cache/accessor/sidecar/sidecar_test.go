@@ -0,0 +1,415 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package sidecar
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor/file"
+	msal "github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// memory is an accessor that isn't versioned
+type memory struct {
+	data []byte
+	m    sync.Mutex
+}
+
+func (m *memory) Delete(context.Context) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.data = nil
+	return nil
+}
+
+func (m *memory) Read(context.Context) ([]byte, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.data, nil
+}
+
+func (m *memory) Write(_ context.Context, data []byte) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.data = data
+	return nil
+}
+
+// accessors returns accessors for tests to serve: one versioned, one not
+func accessors(t *testing.T) map[string]accessor.Accessor {
+	f, err := file.New(filepath.Join(t.TempDir(), "cache"))
+	require.NoError(t, err)
+	return map[string]accessor.Accessor{"versioned": f, "unversioned": &memory{}}
+}
+
+// serve serves an accessor with a Handler and returns a client for it
+func serve(t *testing.T, a accessor.Accessor, opts ...handlerOption) (*Handler, *Storage) {
+	h, err := NewHandler(a, opts...)
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.StripPrefix("/sidecar", h))
+	t.Cleanup(srv.Close)
+	s, err := New(srv.URL + "/sidecar/")
+	require.NoError(t, err)
+	return h, s
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	for name, a := range accessors(t) {
+		t.Run(name, func(t *testing.T) {
+			_, s := serve(t, a)
+
+			data, version, err := s.ReadVersion(ctx)
+			require.NoError(t, err)
+			require.Nil(t, data)
+			require.Empty(t, version)
+			require.NoError(t, s.Delete(ctx))
+
+			expected := []byte(`{"key":"value"}`)
+			require.NoError(t, s.Write(ctx, expected))
+			actual, err := a.Read(ctx)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+			data, err = s.Read(ctx)
+			require.NoError(t, err)
+			require.Equal(t, expected, data)
+
+			require.NoError(t, s.Delete(ctx))
+			data, err = s.Read(ctx)
+			require.NoError(t, err)
+			require.Nil(t, data)
+		})
+	}
+}
+
+func TestWriteIf(t *testing.T) {
+	for name, a := range accessors(t) {
+		t.Run(name, func(t *testing.T) {
+			_, s := serve(t, a)
+
+			v1, err := s.WriteIf(ctx, []byte("1"), "")
+			require.NoError(t, err)
+			require.NotEmpty(t, v1)
+			_, err = s.WriteIf(ctx, []byte("x"), "")
+			require.ErrorIs(t, err, accessor.ErrVersionConflict, "data exists")
+
+			v2, err := s.WriteIf(ctx, []byte("2"), v1)
+			require.NoError(t, err)
+			require.NotEqual(t, v1, v2)
+			_, err = s.WriteIf(ctx, []byte("x"), v1)
+			require.ErrorIs(t, err, accessor.ErrVersionConflict, "stale version")
+
+			data, version, err := s.ReadVersion(ctx)
+			require.NoError(t, err)
+			require.Equal(t, "2", string(data))
+			require.Equal(t, v2, version)
+
+			// another writer changes the data
+			require.NoError(t, a.Write(ctx, []byte("3")))
+			_, err = s.WriteIf(ctx, []byte("x"), v2)
+			require.ErrorIs(t, err, accessor.ErrVersionConflict)
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	h, a := serve(t, &memory{})
+	b, err := New(a.u.String())
+	require.NoError(t, err)
+
+	require.NoError(t, a.Lock(ctx))
+	require.Error(t, a.Lock(ctx), "Storage already holds the lock")
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, b.Lock(short), context.DeadlineExceeded)
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	require.NoError(t, a.Unlock(ctx))
+	require.Error(t, a.Unlock(ctx), "Storage doesn't hold the lock")
+
+	// the server releases the lock, as it would when the lock's TTL elapses
+	require.NoError(t, b.Lock(ctx))
+	require.True(t, h.release(b.lockToken))
+	require.NoError(t, a.Lock(ctx))
+	require.ErrorIs(t, b.Write(ctx, []byte("b")), ErrLockExpired)
+	require.ErrorIs(t, b.Delete(ctx), ErrLockExpired)
+	require.ErrorIs(t, b.Unlock(ctx), ErrLockExpired)
+	data, err := a.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(data))
+
+	// Storage shouldn't write after the lock may have expired
+	a.lockExpires = time.Now()
+	require.ErrorIs(t, a.Write(ctx, []byte("x")), ErrLockExpired)
+	require.NoError(t, a.Unlock(ctx))
+}
+
+func TestLockTTL(t *testing.T) {
+	h, a := serve(t, &memory{})
+	h.lockTTL = 50 * time.Millisecond
+	b, err := New(a.u.String())
+	require.NoError(t, err)
+
+	require.NoError(t, a.Lock(ctx))
+	require.NoError(t, b.Lock(ctx), "the server should release the lock when its TTL elapses")
+	require.ErrorIs(t, a.Unlock(ctx), ErrLockExpired)
+	require.NoError(t, b.Unlock(ctx))
+}
+
+func TestWatch(t *testing.T) {
+	a := &memory{}
+	h, s := serve(t, a)
+	h.pollInterval = 10 * time.Millisecond
+	watch := func(version string) chan string {
+		ch := make(chan string, 1)
+		go func() {
+			v, err := s.Watch(ctx, version)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- v
+		}()
+		return ch
+	}
+	receive := func(ch chan string) string {
+		select {
+		case v := <-ch:
+			return v
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a change")
+		}
+		return ""
+	}
+
+	v, err := s.WriteIf(ctx, []byte("1"), "")
+	require.NoError(t, err)
+	require.Equal(t, v, receive(watch("")), "Watch should return immediately when the version differs")
+
+	ch := watch(v)
+	select {
+	case v := <-ch:
+		t.Fatalf("Watch returned %q before any change", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+	v2, err := s.WriteIf(ctx, []byte("2"), v)
+	require.NoError(t, err)
+	require.Equal(t, v2, receive(ch))
+
+	// the server should notice changes made by other writers
+	ch = watch(v2)
+	require.NoError(t, a.Write(ctx, []byte("3")))
+	require.Equal(t, hash([]byte("3")), receive(ch))
+
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = s.Watch(short, hash([]byte("3")))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestWatchTimeout(t *testing.T) {
+	h, err := NewHandler(&memory{})
+	require.NoError(t, err)
+	h.watchTimeout = 10 * time.Millisecond
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	res, err := http.Get(srv.URL + pathWatch)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestUnixSocket(t *testing.T) {
+	// t.TempDir() may return a path too long for a socket
+	dir, err := os.MkdirTemp("", "sidecar")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", p)
+	if err != nil {
+		t.Skip("Unix domain sockets aren't supported: ", err)
+	}
+	h, err := NewHandler(&memory{})
+	require.NoError(t, err)
+	srv := http.Server{Handler: h}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	s, err := New("http://localhost", WithUnixSocket(p))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+}
+
+func TestMutualTLS(t *testing.T) {
+	// the client's certificate is self-signed
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	h, err := NewHandler(&memory{})
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs, MinVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+
+	s, err := New(srv.URL, WithTLS(&tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}))
+	require.NoError(t, err)
+	require.Error(t, s.Write(ctx, []byte("data")), "server should require a client certificate")
+
+	tc := tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+		RootCAs:      rootCAs,
+	}
+	s, err = New(srv.URL, WithTLS(&tc))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+}
+
+func TestCache(t *testing.T) {
+	for _, optimistic := range []bool{false, true} {
+		name := "lock"
+		if optimistic {
+			name = "optimistic"
+		}
+		t.Run(name, func(t *testing.T) {
+			f, err := file.New(filepath.Join(t.TempDir(), "cache"))
+			require.NoError(t, err)
+			_, first := serve(t, f)
+			dir := t.TempDir()
+			var caches []*cache.Cache
+			for i := 0; i < 3; i++ {
+				s, err := New(first.u.String())
+				require.NoError(t, err)
+				mode := cache.WithLockTimeout(time.Minute)
+				if optimistic {
+					mode = cache.WithOptimisticConcurrency()
+				}
+				c, err := cache.New(s, filepath.Join(dir, strconv.Itoa(i)), cache.WithTimestampMode(cache.TimestampDisabled), mode)
+				require.NoError(t, err)
+				caches = append(caches, c)
+			}
+
+			var wg sync.WaitGroup
+			for i, c := range caches {
+				wg.Add(1)
+				go func(i int, c *cache.Cache) {
+					defer wg.Done()
+					for j := 0; j < 5 && !t.Failed(); j++ {
+						m := fakeMarshaler{}
+						err := c.Replace(ctx, &m, msal.ReplaceHints{})
+						if err == nil {
+							// add an entry, as MSAL would after acquiring a token
+							at := map[string]map[string]any{"AccessToken": {}}
+							if len(m.data) > 0 {
+								err = json.Unmarshal(m.data, &at)
+							}
+							if err == nil {
+								at["AccessToken"][fmt.Sprintf("%d-%d", i, j)] = map[string]any{}
+								m.data, _ = json.Marshal(at)
+								err = c.Export(ctx, &m, msal.ExportHints{})
+							}
+						}
+						if err != nil {
+							t.Errorf("%d: %s", i, err)
+						}
+					}
+				}(i, c)
+			}
+			wg.Wait()
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, entries, "Cache shouldn't create a lock file")
+			m := fakeMarshaler{}
+			require.NoError(t, caches[0].Replace(ctx, &m, msal.ReplaceHints{}))
+			var actual map[string]map[string]any
+			require.NoError(t, json.Unmarshal(m.data, &actual))
+			require.NotEmpty(t, actual["AccessToken"])
+			if optimistic {
+				require.Len(t, actual["AccessToken"], 15, "Export should have merged concurrent writes")
+			}
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, test := range []struct {
+		desc, url string
+		opts      []option
+	}{
+		{desc: "invalid URL", url: "localhost:8080"},
+		{desc: "unsupported scheme", url: "unix:///run/sidecar.sock"},
+		{desc: "nil client", url: "http://localhost", opts: []option{WithHTTPClient(nil)}},
+		{desc: "nil TLS config", url: "https://localhost", opts: []option{WithTLS(nil)}},
+		{desc: "empty socket", url: "http://localhost", opts: []option{WithUnixSocket("")}},
+		{desc: "client and socket", url: "http://localhost", opts: []option{WithHTTPClient(&http.Client{}), WithUnixSocket("s")}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(test.url, test.opts...)
+			require.Error(t, err)
+		})
+	}
+
+	_, err := NewHandler(nil)
+	require.Error(t, err)
+	_, err = NewHandler(&memory{}, WithLockTTL(time.Millisecond))
+	require.Error(t, err)
+}
+
+// fakeMarshaler implements MSAL's cache.Marshaler and cache.Unmarshaler
+type fakeMarshaler struct {
+	data []byte
+}
+
+func (f *fakeMarshaler) Marshal() ([]byte, error) {
+	return f.data, nil
+}
+
+func (f *fakeMarshaler) Unmarshal(b []byte) error {
+	f.data = b
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package systemdcreds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+// credentialsDirectory is the environment variable in which systemd provides the path of
+// a service's decrypted credentials
+const credentialsDirectory = "CREDENTIALS_DIRECTORY"
+
+// Key identifies the key with which systemd-creds encrypts credentials
+type Key string
+
+const (
+	// KeyAuto encrypts with the host key and, when the system has one, a TPM2 chip. This is the default.
+	KeyAuto Key = "auto"
+	// KeyHost encrypts with only the host key in /var/lib/systemd/credential.secret. Credentials
+	// encrypted this way don't require a TPM2 chip to decrypt.
+	KeyHost Key = "host"
+	// KeyHostTPM2 encrypts with the host key and a TPM2 chip. Encryption fails when the system has no TPM2 chip.
+	KeyHostTPM2 Key = "host+tpm2"
+	// KeyTPM2 encrypts with only a TPM2 chip. Encryption fails when the system has no TPM2 chip.
+	KeyTPM2 Key = "tpm2"
+)
+
+type option func(*Storage) error
+
+// WithKey sets the key with which Storage encrypts data. The default is [KeyAuto], which falls back to
+// [KeyHost] on systems having no TPM2 chip. Storage can decrypt data encrypted with any key.
+func WithKey(k Key) option {
+	return func(s *Storage) error {
+		switch k {
+		case KeyAuto, KeyHost, KeyHostTPM2, KeyTPM2:
+			s.key = k
+			return nil
+		}
+		return fmt.Errorf("unknown key %q", k)
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about credential operations. These records never
+// include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// Storage stores data as a systemd encrypted credential. It's intended for services managed by systemd,
+// which typically have no keyring. Storage writes data to a file encrypted by systemd-creds, which the
+// service's unit can load with LoadCredentialEncrypted= on its next start. Storage reads that file when
+// it exists and otherwise reads the credential systemd decrypted into $CREDENTIALS_DIRECTORY, if any.
+//
+// Encrypting and decrypting data with the host key requires read access to the host's credential secret,
+// which typically requires root privileges. Services lacking that access can only read credentials
+// systemd decrypted for them.
+type Storage struct {
+	key    Key
+	logger *slog.Logger
+	m      *sync.Mutex
+	// name is the credential's name, to which its encryption is bound
+	name string
+	// p is the path of the encrypted credential file
+	p string
+}
+
+// New is the constructor for Storage. "name" is the credential's name, which must match the name in
+// the unit's LoadCredentialEncrypted= setting. "p" is the path of the encrypted credential file.
+func New(name, p string, opts ...option) (*Storage, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return nil, fmt.Errorf("invalid credential name %q", name)
+	}
+	if p == "" {
+		return nil, errors.New("credential path can't be empty")
+	}
+	s := Storage{key: KeyAuto, m: &sync.Mutex{}, name: name, p: p}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("name", name), slog.String("path", p))
+	return &s, nil
+}
+
+// Delete deletes the encrypted credential file. systemd's decrypted copy in $CREDENTIALS_DIRECTORY is
+// read-only, so when that copy exists, Delete instead writes an empty credential, which Read returns as no data.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.loaded(); ok {
+		s.logger.DebugContext(ctx, "writing an empty credential because $"+credentialsDirectory+" has a copy")
+		return s.write(ctx, nil)
+	}
+	err := os.Remove(s.p)
+	if errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "nothing to delete because the credential file doesn't exist")
+		return nil
+	}
+	return err
+}
+
+// Read returns the credential's data or, if there is no credential, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var data []byte
+	cred, err := os.ReadFile(s.p)
+	switch {
+	case err == nil:
+		if data, err = s.run(ctx, cred, "decrypt"); err != nil {
+			return nil, fmt.Errorf("couldn't decrypt %s: %w", s.p, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		p, ok := s.loaded()
+		if !ok {
+			s.logger.DebugContext(ctx, "returning no data because the credential doesn't exist")
+			return nil, nil
+		}
+		s.logger.DebugContext(ctx, "reading the credential from $"+credentialsDirectory)
+		if data, err = os.ReadFile(p); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// Write encrypts data and stores it in the credential file, creating the file and its parent
+// directories if necessary.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.write(ctx, data)
+}
+
+func (s *Storage) write(ctx context.Context, data []byte) error {
+	cred, err := s.run(ctx, data, "encrypt", "--with-key="+string(s.key))
+	if err != nil {
+		return fmt.Errorf("couldn't encrypt data: %w", err)
+	}
+	dir := filepath.Dir(s.p)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// write a temporary file and rename it, so that a service starting concurrently
+	// never loads a partially written credential
+	f, err := os.CreateTemp(dir, "."+filepath.Base(s.p)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(cred)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.p)
+	}
+	return err
+}
+
+// loaded returns the path of the credential systemd decrypted for this process, if it exists
+func (s *Storage) loaded() (string, bool) {
+	dir := os.Getenv(credentialsDirectory)
+	if dir == "" {
+		return "", false
+	}
+	p := filepath.Join(dir, s.name)
+	_, err := os.Stat(p)
+	return p, err == nil
+}
+
+// run runs a systemd-creds command which reads from stdin and writes to stdout, and returns its output
+func (s *Storage) run(ctx context.Context, stdin []byte, command string, args ...string) ([]byte, error) {
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	args = append(append([]string{command, "--name=" + s.name}, args...), "-", "-")
+	cmd := exec.CommandContext(ctx, "systemd-creds", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+var _ accessor.Accessor = (*Storage)(nil)
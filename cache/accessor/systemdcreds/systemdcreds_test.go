@@ -0,0 +1,121 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package systemdcreds
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// requireHostKey skips the test unless systemd-creds can encrypt with the host key, which
+// typically requires root privileges
+func requireHostKey(t *testing.T) {
+	cmd := exec.Command("systemd-creds", "encrypt", "--name=test", "--with-key=host", "-", "-")
+	cmd.Stdin = strings.NewReader("test")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("systemd-creds can't encrypt with the host key: %v: %s", err, out)
+	}
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	requireHostKey(t)
+	t.Setenv(credentialsDirectory, "")
+	for _, key := range []Key{KeyAuto, KeyHost} {
+		t.Run(string(key), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "dir", "msal.cred")
+			s, err := New("msal", p, WithKey(key))
+			require.NoError(t, err)
+
+			actual, err := s.Read(ctx)
+			require.NoError(t, err)
+			require.Nil(t, actual)
+			require.NoError(t, s.Delete(ctx))
+
+			for _, expected := range [][]byte{[]byte(`{"expected":true}`), {0, 1, 2, 255}} {
+				require.NoError(t, s.Write(ctx, expected))
+				actual, err = s.Read(ctx)
+				require.NoError(t, err)
+				require.Equal(t, expected, actual)
+
+				cred, err := os.ReadFile(p)
+				require.NoError(t, err)
+				require.NotContains(t, string(cred), string(expected), "credential isn't encrypted")
+			}
+			entries, err := os.ReadDir(filepath.Dir(p))
+			require.NoError(t, err)
+			require.Len(t, entries, 1, "Storage shouldn't leave temporary files")
+
+			require.NoError(t, s.Delete(ctx))
+			require.NoFileExists(t, p)
+			actual, err = s.Read(ctx)
+			require.NoError(t, err)
+			require.Nil(t, actual)
+		})
+	}
+}
+
+func TestCredentialsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(credentialsDirectory, dir)
+	loaded := []byte("loaded")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "msal"), loaded, 0400))
+	p := filepath.Join(t.TempDir(), "msal.cred")
+	s, err := New("msal", p)
+	require.NoError(t, err)
+
+	// reading the loaded credential doesn't require systemd-creds
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, loaded, actual)
+
+	requireHostKey(t)
+	s, err = New("msal", p, WithKey(KeyHost))
+	require.NoError(t, err)
+	expected := []byte("expected")
+	require.NoError(t, s.Write(ctx, expected))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual, "Storage should prefer the credential file to the loaded credential")
+
+	// the loaded credential is read-only, so Delete should hide it
+	require.NoError(t, s.Delete(ctx))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	require.FileExists(t, filepath.Join(dir, "msal"))
+}
+
+func TestName(t *testing.T) {
+	requireHostKey(t)
+	t.Setenv(credentialsDirectory, "")
+	p := filepath.Join(t.TempDir(), "msal.cred")
+	a, err := New("a", p, WithKey(KeyHost))
+	require.NoError(t, err)
+	require.NoError(t, a.Write(ctx, []byte("data")))
+
+	// systemd-creds binds a credential's encryption to its name
+	b, err := New("b", p)
+	require.NoError(t, err)
+	_, err = b.Read(ctx)
+	require.Error(t, err)
+}
+
+func TestOptions(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		_, err := New(name, "p")
+		require.Error(t, err, name)
+	}
+	_, err := New("name", "")
+	require.Error(t, err)
+	_, err = New("name", "p", WithKey("key"))
+	require.Error(t, err)
+}
@@ -0,0 +1,408 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+const (
+	// dataKey is the key of the secret's data in which Storage stores base64 encoded data
+	dataKey = "data"
+	// tokenRefreshMargin is how long before an AppRole token expires that Storage logs in again
+	tokenRefreshMargin = 30 * time.Second
+)
+
+// ErrConflict indicates Storage didn't write data because the secret changed after Storage last read
+// or wrote it. It wraps [accessor.ErrVersionConflict]. See [WithCheckAndSet].
+var ErrConflict = fmt.Errorf("the Vault secret changed since Storage last read or wrote it: %w", accessor.ErrVersionConflict)
+
+type option func(*Storage) error
+
+// WithAppRole makes Storage authenticate with Vault's AppRole method, logging in with the given role ID
+// and secret ID. Storage logs in again shortly before its token expires. "mount" is the path at which
+// the AppRole method is mounted; when it's empty, Storage uses the default path "approle".
+func WithAppRole(roleID, secretID, mount string) option {
+	return func(s *Storage) error {
+		if roleID == "" || secretID == "" {
+			return errors.New("AppRole authentication requires a role ID and secret ID")
+		}
+		if mount == "" {
+			mount = "approle"
+		}
+		s.appRole = &appRole{mount: strings.Trim(mount, "/"), roleID: roleID, secretID: secretID}
+		return nil
+	}
+}
+
+// WithCheckAndSet makes Storage write only when the secret's version is the version Storage last read or
+// wrote. When the secret has changed, Write returns [ErrConflict] and the caller should read the secret
+// again before retrying. This prevents clients sharing a secret from overwriting each other's changes.
+// By default, the last write wins. Vault requires this option when the KV mount sets cas_required.
+func WithCheckAndSet() option {
+	return func(s *Storage) error {
+		s.cas = true
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client Storage uses to send requests to Vault, for example to configure
+// TLS. The default is [http.DefaultClient].
+func WithHTTPClient(c *http.Client) option {
+	return func(s *Storage) error {
+		if c == nil {
+			return errors.New("HTTP client can't be nil")
+		}
+		s.client = c
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about Vault operations. These records never
+// include stored data or credentials. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithNamespace sets the Vault Enterprise namespace of the secret. The default is $VAULT_NAMESPACE.
+func WithNamespace(ns string) option {
+	return func(s *Storage) error {
+		s.namespace = strings.Trim(ns, "/")
+		return nil
+	}
+}
+
+// WithToken sets the token with which Storage authenticates to Vault. The default is $VAULT_TOKEN.
+func WithToken(token string) option {
+	return func(s *Storage) error {
+		if token == "" {
+			return errors.New("token can't be empty")
+		}
+		s.token = token
+		return nil
+	}
+}
+
+type appRole struct {
+	mount, roleID, secretID string
+	// expires is when the current token expires. It's zero when Storage hasn't logged in
+	// or the token doesn't expire.
+	expires time.Time
+}
+
+// Storage stores data in a secret in a HashiCorp Vault KV version 2 secrets engine. The secret's
+// data has one key, "data", whose value is the stored data encoded as base64.
+type Storage struct {
+	addr      *url.URL
+	appRole   *appRole
+	cas       bool
+	client    *http.Client
+	logger    *slog.Logger
+	m         *sync.Mutex
+	mount     string
+	namespace string
+	path      string
+	token     string
+	// version is the secret's version as of Storage's last read or write. It's zero
+	// when the secret didn't exist.
+	version int
+}
+
+// New is the constructor for Storage. "addr" is Vault's address, for example "https://vault.contoso.com:8200".
+// "mount" is the path at which the KV secrets engine is mounted, for example "secret", and "path" is the
+// secret's path within that engine.
+func New(addr, mount, path string, opts ...option) (*Storage, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Vault address %q", addr)
+	}
+	mount, path = strings.Trim(mount, "/"), strings.Trim(path, "/")
+	if mount == "" || path == "" {
+		return nil, errors.New("mount and path can't be empty")
+	}
+	s := Storage{
+		addr:      u,
+		client:    http.DefaultClient,
+		m:         &sync.Mutex{},
+		mount:     mount,
+		namespace: strings.Trim(os.Getenv("VAULT_NAMESPACE"), "/"),
+		path:      path,
+		token:     os.Getenv("VAULT_TOKEN"),
+	}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	if s.appRole != nil {
+		// the AppRole token replaces any token from the environment
+		s.token = ""
+	} else if s.token == "" {
+		return nil, errors.New("no Vault credential. Specify one with WithToken or WithAppRole, or set VAULT_TOKEN")
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("mount", mount), slog.String("path", path))
+	return &s, nil
+}
+
+// Delete deletes the secret's latest version. Vault retains the secret's metadata and earlier
+// versions, according to the engine's configuration.
+func (s *Storage) Delete(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	err := s.do(ctx, http.MethodDelete, s.url("data"), nil, nil)
+	var e *vaultError
+	if errors.As(err, &e) && e.status == http.StatusNotFound {
+		s.logger.DebugContext(ctx, "nothing to delete because the secret doesn't exist")
+		return nil
+	}
+	return err
+}
+
+// Read returns the secret's data or, if the secret doesn't exist, a nil slice and error.
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.read(ctx)
+}
+
+// ReadVersion returns the secret's data and version. When the secret doesn't exist, it returns a
+// nil slice and an empty version. When the secret's latest version is deleted, it returns a nil
+// slice and that version, which WriteIf requires to write a new version.
+func (s *Storage) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	data, err := s.read(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, formatVersion(s.version), nil
+}
+
+// Write stores data in a new version of the secret, creating the secret if necessary.
+func (s *Storage) Write(ctx context.Context, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	cas := -1
+	if s.cas {
+		cas = s.version
+	}
+	return s.write(ctx, data, cas)
+}
+
+// WriteIf stores data in a new version of the secret when the secret's current version is "version",
+// regardless of [WithCheckAndSet]. It returns the new version.
+func (s *Storage) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	cas := 0
+	if version != "" {
+		var err error
+		if cas, err = strconv.Atoi(version); err != nil || cas < 1 {
+			return "", fmt.Errorf("invalid secret version %q", version)
+		}
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.write(ctx, data, cas); err != nil {
+		return "", err
+	}
+	return formatVersion(s.version), nil
+}
+
+// read gets the secret's data, updating s.version. Callers must hold s.m.
+func (s *Storage) read(ctx context.Context) ([]byte, error) {
+	var body struct {
+		Data struct {
+			Data     map[string]any `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	err := s.do(ctx, http.MethodGet, s.url("data"), nil, &body)
+	var e *vaultError
+	if errors.As(err, &e) && e.status == http.StatusNotFound {
+		// Vault returns metadata with a 404 when the latest version is deleted. Remember its version
+		// so a check-and-set write can replace it. Otherwise, the secret doesn't exist and the version is 0.
+		_ = json.Unmarshal(e.body, &body)
+		s.version = body.Data.Metadata.Version
+		s.logger.DebugContext(ctx, "returning no data because the secret doesn't exist", slog.Int("version", s.version))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.version = body.Data.Metadata.Version
+	s.logger.DebugContext(ctx, "read secret", slog.Int("version", s.version))
+	encoded, ok := body.Data.Data[dataKey].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret has no string value for key %q", dataKey)
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// write stores data in a new version of the secret, updating s.version. When "cas" isn't negative, Vault
+// writes only if the secret's current version is "cas". Callers must hold s.m.
+func (s *Storage) write(ctx context.Context, data []byte, cas int) error {
+	req := map[string]any{"data": map[string]string{dataKey: base64.StdEncoding.EncodeToString(data)}}
+	if cas >= 0 {
+		req["options"] = map[string]int{"cas": cas}
+	}
+	var body struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+	err := s.do(ctx, http.MethodPost, s.url("data"), req, &body)
+	var e *vaultError
+	if cas >= 0 && errors.As(err, &e) && e.status == http.StatusBadRequest && strings.Contains(e.Error(), "check-and-set") {
+		s.logger.DebugContext(ctx, "secret changed since the last read or write", slog.Int("version", cas))
+		return fmt.Errorf("%w: %s", ErrConflict, err)
+	}
+	if err == nil {
+		s.version = body.Data.Version
+		s.logger.DebugContext(ctx, "wrote secret", slog.Int("version", s.version))
+	}
+	return err
+}
+
+// formatVersion returns the string form of a secret version. Version 0 means the secret doesn't exist.
+func formatVersion(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+// url returns the URL of the secret's data or metadata endpoint
+func (s *Storage) url(endpoint string) string {
+	return s.addr.JoinPath("v1", s.mount, endpoint, s.path).String()
+}
+
+// vaultError is an error response from Vault
+type vaultError struct {
+	body   []byte
+	status int
+}
+
+func (e *vaultError) Error() string {
+	var body struct {
+		Errors []string `json:"errors"`
+	}
+	msg := http.StatusText(e.status)
+	if json.Unmarshal(e.body, &body) == nil && len(body.Errors) > 0 {
+		msg = strings.Join(body.Errors, "; ")
+	}
+	return fmt.Sprintf("Vault responded %d: %s", e.status, msg)
+}
+
+// do sends a request to Vault, authenticating if necessary, and unmarshals the response body into "out".
+// It returns a *vaultError when Vault responds with an error status.
+func (s *Storage) do(ctx context.Context, method, u string, in, out any) error {
+	err := s.login(ctx, false)
+	if err == nil {
+		err = s.send(ctx, method, u, s.token, in, out)
+		var e *vaultError
+		if s.appRole != nil && errors.As(err, &e) && e.status == http.StatusForbidden {
+			// the token may have been revoked; log in again and retry once
+			s.logger.DebugContext(ctx, "logging in again because Vault rejected the token")
+			if err = s.login(ctx, true); err == nil {
+				err = s.send(ctx, method, u, s.token, in, out)
+			}
+		}
+	}
+	return err
+}
+
+// login gets a token from the AppRole method when Storage uses it and the current token is missing,
+// about to expire or, when "force" is true, rejected
+func (s *Storage) login(ctx context.Context, force bool) error {
+	r := s.appRole
+	if r == nil || (!force && s.token != "" && (r.expires.IsZero() || time.Until(r.expires) > tokenRefreshMargin)) {
+		return nil
+	}
+	var body struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	u := s.addr.JoinPath("v1", "auth", r.mount, "login").String()
+	if err := s.send(ctx, http.MethodPost, u, "", map[string]string{"role_id": r.roleID, "secret_id": r.secretID}, &body); err != nil {
+		return fmt.Errorf("AppRole login failed: %w", err)
+	}
+	if body.Auth.ClientToken == "" {
+		return errors.New("AppRole login response has no token")
+	}
+	s.token, r.expires = body.Auth.ClientToken, time.Time{}
+	if body.Auth.LeaseDuration > 0 {
+		r.expires = time.Now().Add(time.Duration(body.Auth.LeaseDuration) * time.Second)
+	}
+	s.logger.DebugContext(ctx, "logged in with AppRole", slog.Int("leaseDuration", body.Auth.LeaseDuration))
+	return nil
+}
+
+// send sends a request to Vault and unmarshals the response body into "out"
+func (s *Storage) send(ctx context.Context, method, u, token string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if s.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.namespace)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &vaultError{body: b, status: res.StatusCode}
+	}
+	if out != nil && len(b) > 0 {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+var (
+	_ accessor.Accessor  = (*Storage)(nil)
+	_ accessor.Versioned = (*Storage)(nil)
+)
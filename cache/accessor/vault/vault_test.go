@@ -0,0 +1,324 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+const (
+	roleID   = "role"
+	secretID = "secret"
+)
+
+// fakeVault implements a subset of Vault's HTTP API: AppRole login and the data endpoint of a KV v2 engine
+type fakeVault struct {
+	// leaseDuration is the lifetime in seconds of tokens from AppRole login
+	leaseDuration int
+	// logins counts AppRole logins
+	logins    int
+	m         sync.Mutex
+	namespace string
+	// secrets maps paths of secrets to their versions
+	secrets map[string][]fakeVersion
+	// tokens are the valid tokens
+	tokens map[string]bool
+}
+
+type fakeVersion struct {
+	data    map[string]any
+	deleted bool
+}
+
+func newFakeVault(t *testing.T, tokens ...string) (*fakeVault, *httptest.Server) {
+	f := &fakeVault{secrets: map[string][]fakeVersion{}, tokens: map[string]bool{}}
+	for _, token := range tokens {
+		f.tokens[token] = true
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeVault) locked(fn func()) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fn()
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	respond := func(status int, body any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if body != nil {
+			_ = json.NewEncoder(w).Encode(body)
+		}
+	}
+	fail := func(status int, msg string) {
+		respond(status, map[string]any{"errors": []string{msg}})
+	}
+	if ns := r.Header.Get("X-Vault-Namespace"); ns != f.namespace {
+		fail(http.StatusNotFound, fmt.Sprintf("unexpected namespace %q", ns))
+		return
+	}
+	if r.URL.Path == "/v1/auth/approle/login" && r.Method == http.MethodPost {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["role_id"] != roleID || body["secret_id"] != secretID {
+			fail(http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		f.logins++
+		token := fmt.Sprint("token", f.logins)
+		f.tokens[token] = true
+		respond(http.StatusOK, map[string]any{"auth": map[string]any{"client_token": token, "lease_duration": f.leaseDuration}})
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+	path, found := strings.CutPrefix(r.URL.Path, "/v1/secret/data/")
+	if !found {
+		fail(http.StatusNotFound, "no handler for route "+r.URL.Path)
+		return
+	}
+	versions := f.secrets[path]
+	switch r.Method {
+	case http.MethodGet:
+		if len(versions) == 0 {
+			respond(http.StatusNotFound, map[string]any{"errors": []string{}})
+			return
+		}
+		latest := versions[len(versions)-1]
+		body := map[string]any{"data": map[string]any{"data": latest.data, "metadata": map[string]any{"version": len(versions)}}}
+		if latest.deleted {
+			body["data"].(map[string]any)["data"] = nil
+			respond(http.StatusNotFound, body)
+			return
+		}
+		respond(http.StatusOK, body)
+	case http.MethodPost:
+		var body struct {
+			Data    map[string]any `json:"data"`
+			Options struct {
+				CAS *int `json:"cas"`
+			} `json:"options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		if body.Options.CAS != nil && *body.Options.CAS != len(versions) {
+			fail(http.StatusBadRequest, "check-and-set parameter did not match the current version")
+			return
+		}
+		f.secrets[path] = append(versions, fakeVersion{data: body.Data})
+		respond(http.StatusOK, map[string]any{"data": map[string]any{"version": len(f.secrets[path])}})
+	case http.MethodDelete:
+		if len(versions) > 0 {
+			versions[len(versions)-1].deleted = true
+		}
+		respond(http.StatusNoContent, nil)
+	default:
+		fail(http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
+
+func TestReadWriteDelete(t *testing.T) {
+	f, srv := newFakeVault(t, "token")
+	s, err := New(srv.URL, "/secret/", "msal/cache", WithToken("token"))
+	require.NoError(t, err)
+
+	actual, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	require.NoError(t, s.Delete(ctx))
+
+	for _, expected := range [][]byte{[]byte(`{"expected":true}`), {0, 1, 2, 255}} {
+		require.NoError(t, s.Write(ctx, expected))
+		actual, err = s.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+	f.locked(func() { require.Len(t, f.secrets["msal/cache"], 2) })
+
+	require.NoError(t, s.Delete(ctx))
+	actual, err = s.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+}
+
+func TestCheckAndSet(t *testing.T) {
+	_, srv := newFakeVault(t, "token")
+	t.Setenv("VAULT_TOKEN", "token")
+	a, err := New(srv.URL, "secret", "cache", WithCheckAndSet())
+	require.NoError(t, err)
+	b, err := New(srv.URL, "secret", "cache", WithCheckAndSet())
+	require.NoError(t, err)
+	for _, s := range []*Storage{a, b} {
+		data, err := s.Read(ctx)
+		require.NoError(t, err)
+		require.Nil(t, data)
+	}
+
+	require.NoError(t, a.Write(ctx, []byte("a")))
+	require.ErrorIs(t, b.Write(ctx, []byte("b")), ErrConflict, "b should have to read a's write before writing")
+	data, err := b.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+	require.NoError(t, b.Write(ctx, []byte("b")))
+	require.ErrorIs(t, a.Write(ctx, []byte("a")), ErrConflict)
+
+	// after a deletion, the secret's version is unchanged and a reader should be able to write
+	require.NoError(t, b.Delete(ctx))
+	data, err = a.Read(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.NoError(t, a.Write(ctx, []byte("a")))
+
+	// without check-and-set, the last write wins
+	c, err := New(srv.URL, "secret", "cache")
+	require.NoError(t, err)
+	require.NoError(t, c.Write(ctx, []byte("c")))
+	data, err = a.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), data)
+}
+
+func TestAppRole(t *testing.T) {
+	f, srv := newFakeVault(t)
+	t.Setenv("VAULT_TOKEN", "ignored")
+	f.locked(func() { f.leaseDuration = 3600 })
+	s, err := New(srv.URL, "secret", "cache", WithAppRole(roleID, secretID, ""))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Write(ctx, []byte("data")))
+	}
+	f.locked(func() { require.Equal(t, 1, f.logins, "Storage should reuse its token until it expires") })
+
+	// Storage should log in again when Vault rejects its token
+	f.locked(func() { f.tokens = map[string]bool{} })
+	_, err = s.Read(ctx)
+	require.NoError(t, err)
+	f.locked(func() { require.Equal(t, 2, f.logins) })
+
+	// Storage should log in again when its token is about to expire
+	f.locked(func() { f.leaseDuration = 1 })
+	s, err = New(srv.URL, "secret", "cache", WithAppRole(roleID, secretID, "/approle/"))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = s.Read(ctx)
+		require.NoError(t, err)
+	}
+	f.locked(func() { require.Equal(t, 4, f.logins) })
+
+	s, err = New(srv.URL, "secret", "cache", WithAppRole(roleID, "wrong", ""))
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorContains(t, err, "invalid role or secret ID")
+}
+
+func TestNamespace(t *testing.T) {
+	f, srv := newFakeVault(t, "token")
+	f.locked(func() { f.namespace = "team/ns" })
+	s, err := New(srv.URL, "secret", "cache", WithToken("token"))
+	require.NoError(t, err)
+	require.Error(t, s.Write(ctx, []byte("data")))
+
+	s, err = New(srv.URL, "secret", "cache", WithToken("token"), WithNamespace("/team/ns/"))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(ctx, []byte("data")))
+
+	t.Setenv("VAULT_NAMESPACE", "team/ns")
+	s, err = New(srv.URL, "secret", "cache", WithToken("token"))
+	require.NoError(t, err)
+	data, err := s.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+}
+
+func TestErrors(t *testing.T) {
+	_, srv := newFakeVault(t, "token")
+	s, err := New(srv.URL, "secret", "cache", WithToken("wrong"))
+	require.NoError(t, err)
+	_, err = s.Read(ctx)
+	require.ErrorContains(t, err, "permission denied")
+	require.ErrorContains(t, s.Write(ctx, []byte("data")), "permission denied")
+	require.ErrorContains(t, s.Delete(ctx), "permission denied")
+
+	t.Setenv("VAULT_TOKEN", "")
+	for _, test := range []struct {
+		desc, addr, mount, path string
+		opts                    []option
+	}{
+		{desc: "no credential", addr: srv.URL, mount: "secret", path: "cache"},
+		{desc: "invalid address", addr: "vault", mount: "secret", path: "cache", opts: []option{WithToken("token")}},
+		{desc: "empty mount", addr: srv.URL, mount: "/", path: "cache", opts: []option{WithToken("token")}},
+		{desc: "empty path", addr: srv.URL, mount: "secret", opts: []option{WithToken("token")}},
+		{desc: "empty token", addr: srv.URL, mount: "secret", path: "cache", opts: []option{WithToken("")}},
+		{desc: "empty role ID", addr: srv.URL, mount: "secret", path: "cache", opts: []option{WithAppRole("", secretID, "")}},
+		{desc: "nil client", addr: srv.URL, mount: "secret", path: "cache", opts: []option{WithToken("token"), WithHTTPClient(nil)}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(test.addr, test.mount, test.path, test.opts...)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestWriteIf(t *testing.T) {
+	_, srv := newFakeVault(t, "token")
+	a, err := New(srv.URL, "secret", "cache", WithToken("token"))
+	require.NoError(t, err)
+	b, err := New(srv.URL, "secret", "cache", WithToken("token"))
+	require.NoError(t, err)
+
+	data, v, err := a.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Empty(t, v)
+
+	va, err := a.WriteIf(ctx, []byte("a"), v)
+	require.NoError(t, err)
+	require.Equal(t, "1", va)
+	_, err = b.WriteIf(ctx, []byte("b"), v)
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+	require.ErrorIs(t, err, ErrConflict)
+
+	data, v, err = b.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+	require.Equal(t, va, v)
+	vb, err := b.WriteIf(ctx, []byte("b"), v)
+	require.NoError(t, err)
+	require.Equal(t, "2", vb)
+
+	// after a deletion, the deleted version should match
+	require.NoError(t, a.Delete(ctx))
+	data, v, err = a.ReadVersion(ctx)
+	require.NoError(t, err)
+	require.Nil(t, data)
+	require.Equal(t, vb, v)
+	_, err = a.WriteIf(ctx, []byte("a"), "")
+	require.ErrorIs(t, err, accessor.ErrVersionConflict)
+	_, err = a.WriteIf(ctx, []byte("a"), v)
+	require.NoError(t, err)
+
+	_, err = a.WriteIf(ctx, []byte("a"), "version")
+	require.Error(t, err)
+}
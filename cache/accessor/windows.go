@@ -9,43 +9,84 @@ package accessor
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
 	"unsafe"
 
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/compat"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
 	"golang.org/x/sys/windows"
 )
 
 // Storage stores data in a file encrypted by the Windows data protection API.
 type Storage struct {
-	m *sync.RWMutex
-	p string
+	// logger receives debug records. It must never receive stored data.
+	logger *slog.Logger
+	m      *sync.RWMutex
+	p      string
+}
+
+type option func(*Storage) error
+
+// WithCompatibility declares that Storage shares a cache with applications using the MSAL extension library
+// "p" identifies. All the libraries store the cache in a file encrypted by DPAPI for the current user without
+// additional entropy, so Storage's behavior doesn't depend on the profile. Pass the other application's cache
+// file path to New, and the same path to cache.New.
+func WithCompatibility(p compat.Profile) option {
+	return func(s *Storage) error {
+		switch p {
+		case compat.Go, compat.DotNet, compat.Python:
+			return nil
+		default:
+			return fmt.Errorf("unknown compatibility profile %d", p)
+		}
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about file operations. These records never
+// include stored data. By default, Storage doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Storage) error {
+		s.logger = l
+		return nil
+	}
 }
 
 // New is the constructor for Storage. "p" is the path to the file in which to store data.
-func New(p string) (*Storage, error) {
-	return &Storage{m: &sync.RWMutex{}, p: p}, nil
+func New(p string, opts ...option) (*Storage, error) {
+	s := Storage{m: &sync.RWMutex{}, p: p}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger).With(slog.String("path", p))
+	return &s, nil
 }
 
 // Delete deletes the file, if it exists.
-func (s *Storage) Delete(context.Context) error {
+func (s *Storage) Delete(ctx context.Context) error {
 	s.m.Lock()
 	defer s.m.Unlock()
 	err := os.Remove(s.p)
 	if errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "nothing to delete because the file doesn't exist")
 		return nil
 	}
 	return err
 }
 
 // Read returns data from the file. If the file doesn't exist, Read returns a nil slice and error.
-func (s *Storage) Read(context.Context) ([]byte, error) {
+func (s *Storage) Read(ctx context.Context) ([]byte, error) {
 	s.m.RLock()
 	defer s.m.RUnlock()
 
 	data, err := os.ReadFile(s.p)
 	if errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "returning no data because the file doesn't exist")
 		return nil, nil
 	}
 	if err != nil {
@@ -58,7 +99,7 @@ func (s *Storage) Read(context.Context) ([]byte, error) {
 }
 
 // Write stores data in the file, creating the file if it doesn't exist.
-func (s *Storage) Write(_ context.Context, data []byte) error {
+func (s *Storage) Write(ctx context.Context, data []byte) error {
 	s.m.Lock()
 	defer s.m.Unlock()
 
@@ -68,6 +109,7 @@ func (s *Storage) Write(_ context.Context, data []byte) error {
 	}
 	err = os.WriteFile(s.p, data, 0600)
 	if errors.Is(err, os.ErrNotExist) {
+		s.logger.DebugContext(ctx, "creating the file's parent directory")
 		dir := filepath.Dir(s.p)
 		if err = os.MkdirAll(dir, 0700); err == nil {
 			err = os.WriteFile(s.p, data, 0600)
@@ -7,11 +7,13 @@
 package accessor
 
 import (
+	"bytes"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/compat"
 	"github.com/stretchr/testify/require"
 )
 
@@ -31,3 +33,29 @@ func TestWriteEncryption(t *testing.T) {
 	err = json.Unmarshal(actual, &struct{}{})
 	require.Error(t, err, "Unmarshal should fail because the file's content, being encrypted, isn't JSON")
 }
+
+func TestCompatibility(t *testing.T) {
+	// dpapiHeader begins every DPAPI blob: version 1 followed by the GUID of the default
+	// provider, df9d8cd0-1501-11d1-8c7a-00c04fc297eb. The other extension libraries' files
+	// are DPAPI blobs too; they differ only in content, which only the user can decrypt.
+	dpapiHeader := []byte{1, 0, 0, 0, 0xd0, 0x8c, 0x9d, 0xdf, 0x01, 0x15, 0xd1, 0x11, 0x8c, 0x7a, 0x00, 0xc0, 0x4f, 0xc2, 0x97, 0xeb}
+	for _, p := range []compat.Profile{compat.Go, compat.DotNet, compat.Python} {
+		t.Run(p.String(), func(t *testing.T) {
+			f := filepath.Join(t.TempDir(), "msal.cache")
+			a, err := New(f, WithCompatibility(p))
+			require.NoError(t, err)
+			expected := []byte(`{"key":"value"}`)
+			require.NoError(t, a.Write(ctx, expected))
+
+			b, err := os.ReadFile(f)
+			require.NoError(t, err)
+			require.True(t, bytes.HasPrefix(b, dpapiHeader), "file should contain only a DPAPI blob")
+
+			actual, err := a.Read(ctx)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+	_, err := New(filepath.Join(t.TempDir(), "msal.cache"), WithCompatibility(compat.Profile(42)))
+	require.Error(t, err)
+}
@@ -6,27 +6,63 @@ package cache
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/compat"
 	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/lock"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
 )
 
-var (
-	// retryDelay lets tests prevent delays when faking errors in Replace
-	retryDelay = 10 * time.Millisecond
-	// timeout lets tests set the default amount of time allowed to read from the accessor
-	timeout = time.Second
+const (
+	defaultLockTimeout = 5 * time.Second
+	defaultReadTimeout = time.Second
+	defaultRetryDelay  = 10 * time.Millisecond
 )
 
 // locker helps tests fake Lock
 type locker interface {
 	Lock(context.Context) error
-	Unlock() error
+	Unlock(context.Context) error
+}
+
+// accessorLock adapts an accessor.Locker, applying Cache's lock timeout
+type accessorLock struct {
+	l       accessor.Locker
+	timeout time.Duration
+}
+
+func (a accessorLock) Lock(ctx context.Context) error {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	return a.l.Lock(ctx)
+}
+
+func (a accessorLock) Unlock(ctx context.Context) error {
+	return a.l.Unlock(ctx)
+}
+
+// fileLock adapts a file lock to the locker interface
+type fileLock struct {
+	l *lock.Lock
+}
+
+func (f fileLock) Lock(ctx context.Context) error {
+	return f.l.Lock(ctx)
+}
+
+func (f fileLock) Unlock(context.Context) error {
+	return f.l.Unlock()
 }
 
 // Cache caches authentication data in external storage, using a file lock to coordinate
@@ -34,27 +70,140 @@ type locker interface {
 type Cache struct {
 	// a provides read/write access to storage
 	a accessor.Accessor
+	// accessorVersion is the version of a's data as of the last sync, when Cache uses optimistic concurrency
+	accessorVersion string
+	// compat identifies the extension library whose lock protocol Cache follows
+	compat compat.Profile
 	// data is accessor's data as of the last sync
 	data []byte
-	// l coordinates with other processes
+	// dirPerm and filePerm are the permissions of directories and files Cache creates
+	dirPerm, filePerm os.FileMode
+	// l coordinates with other processes. It's the accessor's lock when the accessor implements
+	// accessor.Locker and otherwise a file lock. It's nil when Cache doesn't lock reads or writes.
 	l locker
+	// lockPath is the path to the lock file
+	lockPath string
+	// lockTimeout is how long Export tries to acquire the lock when its context has no deadline
+	lockTimeout time.Duration
+	// logger receives debug records about Cache's decisions. It must never receive cached data.
+	logger *slog.Logger
 	// m coordinates this process's goroutines
 	m *sync.Mutex
+	// optimistic Caches write conditionally instead of locking, merging concurrent changes
+	optimistic bool
+	// readOnly Caches never write. readOnlyPolicy determines what Export does instead.
+	readOnly       bool
+	readOnlyPolicy ReadOnlyPolicy
+	// readTimeout is how long Replace tries to read from the accessor when its context has no deadline
+	readTimeout time.Duration
+	// retryDelay is how long Cache waits before its first retry of a failed operation. Each
+	// subsequent delay doubles the previous one, up to maxRetryDelay.
+	retryDelay, maxRetryDelay time.Duration
 	// sync is when this Cache last read from or wrote to a
 	sync time.Time
 	// ts is the path to a file used to timestamp Export and Replace operations
 	ts string
+	// tsMode determines how Cache uses the timestamp file
+	tsMode TimestampMode
+	// va is a's versioned interface, when Cache uses optimistic concurrency
+	va accessor.Versioned
+	// version is the version of a's data as of the last sync, when Cache uses a version file
+	version version
+	// versionPath is the path to the version file. When empty, Cache doesn't use a version file.
+	versionPath string
 }
 
 // New is the constructor for Cache. "p" is the path to a file used to track when stored
-// data changes. [Cache.Export] will create this file and any directories in its path which don't
-// already exist.
-func New(a accessor.Accessor, p string) (*Cache, error) {
-	lock, err := lock.New(p+".lockfile", retryDelay)
+// data changes. By default, [Cache.Export] will create this file and any directories in its
+// path which don't already exist (see [WithTimestampMode]). When "a" implements [accessor.Locker],
+// Cache uses its lock instead of a lock file. A read-only Cache doesn't lock the accessor, nor does
+// a Cache using optimistic concurrency (see [WithOptimisticConcurrency]).
+func New(a accessor.Accessor, p string, opts ...option) (*Cache, error) {
+	c := Cache{
+		a:             a,
+		dirPerm:       0700,
+		filePerm:      0600,
+		lockPath:      p + ".lockfile",
+		lockTimeout:   defaultLockTimeout,
+		m:             &sync.Mutex{},
+		maxRetryDelay: defaultRetryDelay,
+		readTimeout:   defaultReadTimeout,
+		retryDelay:    defaultRetryDelay,
+		ts:            p,
+	}
+	for _, o := range opts {
+		if err := o(&c); err != nil {
+			return nil, err
+		}
+	}
+	if c.lockPath == c.ts {
+		return nil, errors.New("the lock file and timestamp file must have different paths")
+	}
+	if c.versionPath != "" && (c.versionPath == c.ts || c.versionPath == c.lockPath) {
+		return nil, errors.New("the version file must have a different path than the lock and timestamp files")
+	}
+	c.logger = logging.OrDiscard(c.logger)
+	if c.compat != compat.Go {
+		if c.optimistic {
+			return nil, fmt.Errorf("optimistic concurrency is incompatible with the %s compatibility profile", c.compat)
+		}
+		if _, ok := a.(accessor.Locker); ok {
+			return nil, fmt.Errorf("the %s compatibility profile requires a lock file, so the accessor can't implement accessor.Locker", c.compat)
+		}
+	}
+	if c.optimistic {
+		va, ok := a.(accessor.Versioned)
+		if !ok {
+			return nil, errors.New("optimistic concurrency requires an accessor implementing accessor.Versioned")
+		}
+		if c.versionPath != "" {
+			return nil, errors.New("optimistic concurrency is incompatible with a version file")
+		}
+		c.va = va
+		return &c, nil
+	}
+	if l, ok := a.(accessor.Locker); ok {
+		if !c.readOnly {
+			c.logger.Debug("using the accessor's lock instead of a lock file")
+			c.l = accessorLock{l: l, timeout: c.lockTimeout}
+		}
+		return &c, nil
+	}
+	lockOpts := []lock.Option{
+		lock.WithLogger(c.logger),
+		lock.WithPerm(c.dirPerm, c.filePerm),
+		lock.WithRetryDelay(c.retryDelay, c.maxRetryDelay),
+		lock.WithTimeout(c.lockTimeout),
+	}
+	if c.readOnly {
+		lockOpts = append(lockOpts, lock.WithReadOnly())
+	}
+	switch c.compat {
+	case compat.DotNet:
+		// .NET locks the file by opening it with FileShare.None, which on Linux and macOS takes the same
+		// flock this package does and on Windows excludes other handles, including this package's. It
+		// writes the process ID and name, which is the executable's name without its extension.
+		name := strings.TrimSuffix(filepath.Base(os.Args[0]), filepath.Ext(os.Args[0]))
+		lockOpts = append(lockOpts, lock.WithDebugInfo(fmt.Sprintf("{%d} {%s}", os.Getpid(), name)))
+	case compat.Python:
+		// Python acquires the lock by creating the file and then locking it
+		lockOpts = append(lockOpts, lock.WithExclusiveCreate(), lock.WithDebugInfo(fmt.Sprintf("%d %s", os.Getpid(), os.Args[0])))
+	}
+	lock, err := lock.New(c.lockPath, lockOpts...)
 	if err != nil {
 		return nil, err
 	}
-	return &Cache{a: a, l: lock, m: &sync.Mutex{}, ts: p}, err
+	c.l = fileLock{lock}
+	return &c, err
+}
+
+// unlock releases the lock even when ctx is done, because a remote lock may otherwise block other
+// clients. It bounds the release by the lock timeout so that an unresponsive remote lock can't block
+// the caller indefinitely.
+func (c *Cache) unlock(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.lockTimeout)
+	defer cancel()
+	return c.l.Unlock(ctx)
 }
 
 // Export writes the bytes marshaled by "m" to the accessor.
@@ -63,31 +212,52 @@ func (c *Cache) Export(ctx context.Context, m cache.Marshaler, h cache.ExportHin
 	c.m.Lock()
 	defer c.m.Unlock()
 
+	if c.readOnly {
+		c.logger.DebugContext(ctx, "not exporting because the cache is read-only")
+		if c.readOnlyPolicy == ExportError {
+			return ErrReadOnly
+		}
+		return nil
+	}
 	data, err := m.Marshal()
 	if err != nil {
 		return err
 	}
+	if c.optimistic {
+		return c.exportOptimistic(ctx, data)
+	}
 	err = c.l.Lock(ctx)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		e := c.l.Unlock()
+		e := c.unlock(ctx)
 		if err == nil {
 			err = e
 		}
 	}()
+	var v version
+	if c.versionPath != "" {
+		// the lock prevents other processes changing the version file until this Export is finished
+		if v, err = readVersion(c.versionPath); err != nil {
+			c.logger.DebugContext(ctx, "restarting the generation count because the version file is unreadable", slog.Any("error", err))
+		}
+	}
 	if err = c.a.Write(ctx, data); err == nil {
-		// touch the timestamp file to record the time of this write; discard any
-		// error because this is just an optimization to avoid redundant reads
-		c.sync = time.Now()
-		if er := os.Chtimes(c.ts, c.sync, c.sync); errors.Is(er, os.ErrNotExist) {
-			if er = os.MkdirAll(filepath.Dir(c.ts), 0700); er == nil {
-				f, _ := os.OpenFile(c.ts, os.O_CREATE, 0600)
-				_ = f.Close()
+		c.logger.DebugContext(ctx, "wrote data to accessor", logging.Size(data))
+		c.touch(ctx)
+		if c.versionPath != "" {
+			v = newVersion(v.gen+1, data)
+			if er := writeVersion(c.versionPath, v, c.dirPerm, c.filePerm); er != nil {
+				// other processes will rely on the timestamp file, so there's no need to fail the Export
+				c.logger.DebugContext(ctx, "couldn't write version file", slog.Any("error", er))
+				v = version{}
 			}
+			c.version = v
 		}
 		c.data = data
+	} else {
+		c.logger.DebugContext(ctx, "couldn't write data to accessor", slog.Any("error", err))
 	}
 	return err
 }
@@ -98,45 +268,53 @@ func (c *Cache) Replace(ctx context.Context, u cache.Unmarshaler, h cache.Replac
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	// If the timestamp file indicates cached data hasn't changed since we last read or wrote it,
-	// return c.data, which is the data as of that time. Discard any error from reading the timestamp
-	// because this is just an optimization to prevent unnecessary reads. If we don't know whether
+	// If the version and timestamp files indicate cached data hasn't changed since we last read or
+	// wrote it, return c.data, which is the data as of that time. Discard any error from reading these
+	// files because they're just an optimization to prevent unnecessary reads. If we don't know whether
 	// cached data has changed, we assume it has.
-	read := true
-	data := c.data
-	f, err := os.Stat(c.ts)
-	if err == nil {
-		mt := f.ModTime()
-		read = !mt.Equal(c.sync)
-	}
 	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, timeout)
+		ctx, cancel = context.WithTimeout(ctx, c.readTimeout)
 		defer cancel()
 	}
+	data := c.data
+	read, v, hasVersion := c.changed(ctx)
 	// Unmarshal the accessor's data, reading it first if needed. We don't acquire the file lock before
 	// reading from the accessor because it isn't strictly necessary and is relatively expensive. In the
 	// unlikely event that a read overlaps with a write and returns malformed data, Unmarshal will return
 	// an error and we'll try another read.
+	var (
+		av  string
+		err error
+	)
+	delay := c.retryDelay
 	for {
 		if read {
-			data, err = c.a.Read(ctx)
+			data, av, err = c.read(ctx)
 			if err != nil {
+				c.logger.DebugContext(ctx, "couldn't read from accessor", slog.Any("error", err))
 				break
 			}
+			c.logger.DebugContext(ctx, "read data from accessor", logging.Size(data))
 		}
 		err = u.Unmarshal(data)
 		if err == nil {
 			break
-		} else if !read {
+		}
+		// Unmarshal errors may quote the data, so we log only the error's type
+		c.logger.DebugContext(ctx, "retrying because unmarshaling failed", slog.String("errorType", fmt.Sprintf("%T", err)))
+		if !read {
 			// c.data is apparently corrupt; Read from the accessor before trying again
 			read = true
 		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(retryDelay):
+		case <-time.After(delay):
 			// Unmarshal error; try again
+			if delay *= 2; delay > c.maxRetryDelay {
+				delay = c.maxRetryDelay
+			}
 		}
 	}
 	// Update the sync time only if we read from the accessor and unmarshaled its data. Otherwise
@@ -144,11 +322,182 @@ func (c *Cache) Replace(ctx context.Context, u cache.Unmarshaler, h cache.Replac
 	// the next call.
 	if err == nil && read {
 		c.data = data
-		if f, err := os.Stat(c.ts); err == nil {
-			c.sync = f.ModTime()
+		c.accessorVersion = av
+		if c.tsMode != TimestampDisabled {
+			if f, err := os.Stat(c.ts); err == nil {
+				c.sync = f.ModTime()
+			}
+		}
+		if c.versionPath != "" {
+			// A mismatch means the data changed after we read the version file, or was written by a
+			// process that doesn't maintain the version file. Either way, the version we read doesn't
+			// describe this data, so we forget it to ensure the next Replace reads from the accessor.
+			c.version = version{}
+			if hasVersion && v.matches(data) {
+				c.version = v
+			} else {
+				c.logger.DebugContext(ctx, "stored data doesn't match its version")
+			}
 		}
 	}
 	return err
 }
 
+// exportOptimistic writes data when stored data hasn't changed since the last sync. Otherwise, it merges
+// data with the stored data and tries again, until it succeeds or the context is done.
+func (c *Cache) exportOptimistic(ctx context.Context, data []byte) error {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.lockTimeout)
+		defer cancel()
+	}
+	base, version := c.data, c.accessorVersion
+	delay := c.retryDelay
+	merged := false
+	for {
+		v, err := c.va.WriteIf(ctx, data, version)
+		if err == nil {
+			c.logger.DebugContext(ctx, "wrote data to accessor", logging.Size(data))
+			c.touch(ctx)
+			c.data, c.accessorVersion = data, v
+			if merged {
+				// the written data includes changes the MSAL client hasn't seen, so the next Replace must read
+				c.sync = time.Time{}
+			}
+			return nil
+		}
+		if !errors.Is(err, accessor.ErrVersionConflict) {
+			c.logger.DebugContext(ctx, "couldn't write data to accessor", slog.Any("error", err))
+			return err
+		}
+		c.logger.DebugContext(ctx, "merging concurrent changes because stored data changed since the last sync", slog.Duration("delay", delay))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+			if delay *= 2; delay > c.maxRetryDelay {
+				delay = c.maxRetryDelay
+			}
+		}
+		theirs, v, err := c.va.ReadVersion(ctx)
+		if err != nil {
+			c.logger.DebugContext(ctx, "couldn't read from accessor", slog.Any("error", err))
+			return err
+		}
+		if data, err = merge(base, data, theirs); err != nil {
+			return fmt.Errorf("couldn't merge concurrent changes: %w", err)
+		}
+		// the merged data is based on theirs, so any further conflict is with a change made after it
+		base, version, merged = theirs, v, true
+	}
+}
+
+// read reads from the accessor, returning the data's version when Cache uses optimistic concurrency.
+// When the Cache is read-only and uses a file lock, it reads while holding a shared lock.
+func (c *Cache) read(ctx context.Context) (data []byte, version string, err error) {
+	if c.va != nil {
+		return c.va.ReadVersion(ctx)
+	}
+	if c.readOnly && c.l != nil {
+		if err = c.l.Lock(ctx); err != nil {
+			return nil, "", err
+		}
+		defer func() {
+			if e := c.unlock(ctx); err == nil {
+				err = e
+			}
+		}()
+	}
+	data, err = c.a.Read(ctx)
+	return data, "", err
+}
+
+// changed returns true when stored data may have changed since this Cache last read or wrote it,
+// along with the content of the version file, if Cache has one and could read it.
+func (c *Cache) changed(ctx context.Context) (bool, version, bool) {
+	var (
+		hasVersion bool
+		v          version
+	)
+	if c.versionPath != "" {
+		var err error
+		if v, err = readVersion(c.versionPath); err == nil {
+			hasVersion = true
+		} else {
+			c.logger.DebugContext(ctx, "relying on the timestamp because the version file is unavailable", slog.Any("error", err))
+		}
+	}
+	// c.version is zero until Cache syncs with the version file
+	if hasVersion && (c.version.gen == 0 || v != c.version) {
+		c.logger.DebugContext(ctx, "reading from accessor because the version changed", slog.Uint64("generation", v.gen))
+		return true, v, hasVersion
+	}
+	// At this point, either there's no version file or the version is unchanged. In the latter case,
+	// the timestamp can still reveal a write by a process that doesn't maintain the version file.
+	if c.tsMode == TimestampDisabled {
+		if hasVersion {
+			c.logger.DebugContext(ctx, "skipping read from accessor because the version is unchanged")
+			return false, v, hasVersion
+		}
+		// c.accessorVersion is empty until Cache syncs with a versioned accessor
+		if vr, ok := c.a.(accessor.VersionReader); ok && c.va != nil && c.accessorVersion != "" {
+			av, err := vr.Version(ctx)
+			switch {
+			case err != nil:
+				c.logger.DebugContext(ctx, "reading from accessor because its version is unavailable", slog.Any("error", err))
+			case av == c.accessorVersion:
+				c.logger.DebugContext(ctx, "skipping read from accessor because its version is unchanged")
+				return false, v, hasVersion
+			default:
+				c.logger.DebugContext(ctx, "reading from accessor because its version changed")
+			}
+			return true, v, hasVersion
+		}
+		c.logger.DebugContext(ctx, "reading from accessor because the timestamp file is disabled")
+		return true, v, hasVersion
+	}
+	f, err := os.Stat(c.ts)
+	switch {
+	case err != nil && hasVersion:
+		c.logger.DebugContext(ctx, "skipping read from accessor because the version is unchanged and the timestamp is unavailable", slog.Any("error", err))
+		return false, v, hasVersion
+	case err != nil:
+		c.logger.DebugContext(ctx, "reading from accessor because the timestamp is unavailable", slog.Any("error", err))
+		return true, v, hasVersion
+	case !f.ModTime().Equal(c.sync):
+		c.logger.DebugContext(ctx, "reading from accessor because the timestamp changed")
+		return true, v, hasVersion
+	}
+	c.logger.DebugContext(ctx, "skipping read from accessor because the timestamp is unchanged")
+	return false, v, hasVersion
+}
+
+// touch updates the timestamp file to record the time of a write. It doesn't return an error
+// because the timestamp is just an optimization to avoid redundant reads.
+func (c *Cache) touch(ctx context.Context) {
+	if c.tsMode == TimestampDisabled {
+		return
+	}
+	c.sync = time.Now()
+	er := os.Chtimes(c.ts, c.sync, c.sync)
+	if errors.Is(er, os.ErrNotExist) {
+		if c.tsMode == TimestampExisting {
+			c.logger.DebugContext(ctx, "not creating the missing timestamp file because of the timestamp mode")
+			return
+		}
+		c.logger.DebugContext(ctx, "creating timestamp file", slog.String("path", c.ts))
+		if er = os.MkdirAll(filepath.Dir(c.ts), c.dirPerm); er == nil {
+			var f *os.File
+			if f, er = os.OpenFile(c.ts, os.O_CREATE, c.filePerm); er == nil {
+				if er = f.Close(); er == nil {
+					er = os.Chtimes(c.ts, c.sync, c.sync)
+				}
+			}
+		}
+	}
+	if er != nil {
+		c.logger.DebugContext(ctx, "couldn't update timestamp file; the next Replace will read from the accessor", slog.Any("error", er))
+	}
+}
+
 var _ cache.ExportReplace = (*Cache)(nil)
@@ -4,16 +4,23 @@
 package cache
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/compat"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/lock"
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
 	"github.com/stretchr/testify/require"
 )
@@ -86,10 +93,93 @@ func (l fakeLock) Lock(context.Context) error {
 	return l.lockErr
 }
 
-func (l fakeLock) Unlock() error {
+func (l fakeLock) Unlock(context.Context) error {
 	return l.unlockErr
 }
 
+// fakeLockingCache is a fakeExternalCache implementing accessor.Locker
+type fakeLockingCache struct {
+	fakeExternalCache
+	// locked indicates whether the lock is held
+	locked             bool
+	lockErr, unlockErr error
+	// lockCtx and unlockCtx are the contexts of the last calls to Lock and Unlock
+	lockCtx, unlockCtx context.Context
+}
+
+func (f *fakeLockingCache) Lock(ctx context.Context) error {
+	f.lockCtx = ctx
+	if f.lockErr != nil {
+		return f.lockErr
+	}
+	if f.locked {
+		return errors.New("already locked")
+	}
+	f.locked = true
+	return nil
+}
+
+func (f *fakeLockingCache) Unlock(ctx context.Context) error {
+	f.unlockCtx = ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !f.locked {
+		return errors.New("not locked")
+	}
+	f.locked = false
+	return f.unlockErr
+}
+
+// fakeVersionedCache is a fakeExternalCache implementing accessor.Versioned. Its version counts writes.
+type fakeVersionedCache struct {
+	fakeExternalCache
+	// conflicts counts failed conditional writes
+	conflicts, version int
+}
+
+func (f *fakeVersionedCache) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	v := f.versionString()
+	data, err := f.Read(ctx)
+	return data, v, err
+}
+
+func (f *fakeVersionedCache) WriteIf(ctx context.Context, data []byte, version string) (string, error) {
+	if version != f.versionString() {
+		f.conflicts++
+		return "", fmt.Errorf("%w: version is %q", accessor.ErrVersionConflict, f.versionString())
+	}
+	if err := f.Write(ctx, data); err != nil {
+		return "", err
+	}
+	f.version++
+	return f.versionString(), nil
+}
+
+// fakeVersionReaderCache is a fakeVersionedCache implementing accessor.VersionReader
+type fakeVersionReaderCache struct {
+	fakeVersionedCache
+	// reads counts calls to ReadVersion
+	reads      int
+	versionErr error
+}
+
+func (f *fakeVersionReaderCache) ReadVersion(ctx context.Context) ([]byte, string, error) {
+	f.reads++
+	return f.fakeVersionedCache.ReadVersion(ctx)
+}
+
+func (f *fakeVersionReaderCache) Version(context.Context) (string, error) {
+	return f.versionString(), f.versionErr
+}
+
+func (f *fakeVersionedCache) versionString() string {
+	if f.version == 0 {
+		return ""
+	}
+	return strconv.Itoa(f.version)
+}
+
 func TestExport(t *testing.T) {
 	ec := &fakeExternalCache{}
 	ic := &fakeInternalCache{}
@@ -142,6 +232,89 @@ func TestFilenameCompat(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// TestCompatibility verifies Cache follows the lock protocol of other extension libraries. The golden
+// files in testdata/compat are caches and abandoned lock files those libraries write.
+func TestCompatibility(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		p    compat.Profile
+		// debugInfo matches the content each library writes to the lock file
+		debugInfo *regexp.Regexp
+		// exclusive indicates whether the library acquires the lock by creating the lock file
+		exclusive bool
+	}{
+		{"dotnet", compat.DotNet, regexp.MustCompile(`^\{\d+\} \{[^{}]+\}$`), false},
+		{"python", compat.Python, regexp.MustCompile(`^\d+ \S.*$`), true},
+	} {
+		t.Run(test.p.String(), func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "compat", test.name+".json"))
+			require.NoError(t, err)
+			abandoned, err := os.ReadFile(filepath.Join("testdata", "compat", test.name+".lockfile"))
+			require.NoError(t, err)
+			require.Regexp(t, test.debugInfo, string(abandoned), "test bug: debugInfo doesn't match the golden file")
+
+			p := filepath.Join(t.TempDir(), "msal.cache")
+			lp := p + ".lockfile"
+			ec := fakeExternalCache{data: data}
+			c, err := New(&ec, p, WithCompatibility(test.p), WithLockTimeout(100*time.Millisecond))
+			require.NoError(t, err)
+
+			// Cache should store the other library's data unmodified
+			ic := fakeInternalCache{}
+			require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+			require.Equal(t, data, ic.data)
+			ec.writeCallback = func() error {
+				// Windows prevents other handles reading the locked file
+				if runtime.GOOS != "windows" {
+					b, err := os.ReadFile(lp)
+					require.NoError(t, err)
+					require.Regexp(t, test.debugInfo, string(b))
+					require.Contains(t, string(b), strconv.Itoa(os.Getpid()))
+				}
+				return nil
+			}
+			require.NoError(t, c.Export(ctx, &ic, cache.ExportHints{}))
+			require.Equal(t, data, ec.data)
+			require.NoFileExists(t, lp, "Export should delete the lock file")
+
+			// a process holding the lock excludes Cache, however old its lock file
+			holder, err := lock.New(lp)
+			require.NoError(t, err)
+			require.NoError(t, holder.Lock(ctx))
+			old := time.Now().Add(-time.Hour)
+			require.NoError(t, os.Chtimes(lp, old, old))
+			require.ErrorIs(t, c.Export(ctx, &ic, cache.ExportHints{}), context.DeadlineExceeded)
+			require.NoError(t, holder.Unlock())
+
+			require.NoError(t, os.WriteFile(lp, abandoned, 0600))
+			if test.exclusive {
+				// the other library's lock file excludes Cache even when no process has locked it,
+				// until it's old enough to have been abandoned
+				require.ErrorIs(t, c.Export(ctx, &ic, cache.ExportHints{}), context.DeadlineExceeded)
+				require.NoError(t, os.Chtimes(lp, old, old))
+			}
+			require.NoError(t, c.Export(ctx, &ic, cache.ExportHints{}))
+			require.NoFileExists(t, lp)
+		})
+	}
+}
+
+func TestLockPath(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "ts")
+	lp := filepath.Join(dir, "lock", "file")
+	ec := fakeExternalCache{
+		writeCallback: func() error {
+			require.FileExists(t, lp, "missing expected lock file")
+			require.NoFileExists(t, p+".lockfile", "unexpected lock file")
+			return nil
+		},
+	}
+	c, err := New(&ec, p, WithLockPath(lp))
+	require.NoError(t, err)
+	require.NoError(t, c.Export(ctx, &fakeInternalCache{}, cache.ExportHints{}))
+}
+
 func TestLockError(t *testing.T) {
 	c, err := New(&fakeExternalCache{}, filepath.Join(t.TempDir(), t.Name()))
 	require.NoError(t, err)
@@ -151,6 +324,68 @@ func TestLockError(t *testing.T) {
 	require.EqualError(t, err, expected.Error())
 }
 
+func TestLogger(t *testing.T) {
+	secret := []byte("secret")
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ec := fakeExternalCache{}
+	c, err := New(&ec, filepath.Join(t.TempDir(), t.Name()), WithLogger(logger))
+	require.NoError(t, err)
+
+	ic := fakeInternalCache{data: secret}
+	require.NoError(t, c.Export(ctx, &ic, cache.ExportHints{}))
+	require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+
+	// corrupt data should provoke a retry whose log record doesn't reveal the data
+	tries := 0
+	ic.unmarshalCallback = func() error {
+		if tries++; tries > 1 {
+			return nil
+		}
+		return fmt.Errorf("%s is malformed", secret)
+	}
+	require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+
+	require.NotEmpty(t, buf.String(), "Cache didn't log")
+	require.NotContains(t, buf.String(), string(secret), "Cache logged cached data")
+}
+
+func TestOptionValidation(t *testing.T) {
+	p := filepath.Join(t.TempDir(), t.Name())
+	for _, test := range []struct {
+		desc string
+		opt  option
+	}{
+		{"empty lock path", WithLockPath("")},
+		{"lock path equals timestamp path", WithLockPath(p)},
+		{"zero lock timeout", WithLockTimeout(0)},
+		{"zero read timeout", WithReadTimeout(0)},
+		{"negative retry delay", WithRetryDelay(-1, 0)},
+		{"max retry delay less than initial", WithRetryDelay(2, 1)},
+		{"zero initial retry delay with positive max", WithRetryDelay(0, time.Second)},
+		{"directory permissions exclude owner", WithPermissions(0070, 0600)},
+		{"file permissions exclude owner", WithPermissions(0700, 0060)},
+		{"non-permission mode bits", WithPermissions(os.ModeDir|0700, 0600)},
+		{"unknown timestamp mode", WithTimestampMode(TimestampMode(42))},
+		{"unknown read-only policy", WithReadOnly(ReadOnlyPolicy(42))},
+		{"empty version file path", WithVersionFile("")},
+		{"version file path equals timestamp path", WithVersionFile(p)},
+		{"optimistic concurrency with unversioned accessor", WithOptimisticConcurrency()},
+		{"unknown compatibility profile", WithCompatibility(compat.Profile(42))},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(&fakeExternalCache{}, p, test.opt)
+			require.Error(t, err)
+		})
+	}
+	_, err := New(&fakeVersionedCache{}, p, WithOptimisticConcurrency(), WithVersionFile(p+".version"))
+	require.Error(t, err, "optimistic concurrency should be incompatible with a version file")
+	_, err = New(&fakeVersionedCache{}, p, WithOptimisticConcurrency(), WithCompatibility(compat.Python))
+	require.Error(t, err, "optimistic concurrency should be incompatible with another library's profile")
+	_, err = New(&fakeLockingCache{}, p, WithCompatibility(compat.DotNet))
+	require.Error(t, err, "another library's profile should require a lock file")
+}
+
 func TestPreservesTimestampFileContent(t *testing.T) {
 	p := filepath.Join(t.TempDir(), t.Name())
 	expected := []byte("expected")
@@ -196,6 +431,36 @@ func TestRace(t *testing.T) {
 	wg.Wait()
 }
 
+func TestReadOnly(t *testing.T) {
+	for _, policy := range []ReadOnlyPolicy{ExportIgnore, ExportError} {
+		t.Run(fmt.Sprint(policy), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "nonexistent")
+			p := filepath.Join(dir, "ts")
+			ec := fakeExternalCache{
+				data: []byte("data"),
+				writeCallback: func() error {
+					t.Fatal("read-only Cache wrote to the accessor")
+					return nil
+				},
+			}
+			c, err := New(&ec, p, WithReadOnly(policy), WithVersionFile(filepath.Join(dir, "version")))
+			require.NoError(t, err)
+
+			err = c.Export(ctx, &fakeInternalCache{data: []byte("new data")}, cache.ExportHints{})
+			if policy == ExportError {
+				require.ErrorIs(t, err, ErrReadOnly)
+			} else {
+				require.NoError(t, err)
+			}
+
+			ic := fakeInternalCache{}
+			require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+			require.Equal(t, ec.data, ic.data)
+			require.NoDirExists(t, dir, "read-only Cache created a directory")
+		})
+	}
+}
+
 func TestReplace(t *testing.T) {
 	ic := fakeInternalCache{}
 	ec := fakeExternalCache{}
@@ -230,9 +495,6 @@ func TestReplace(t *testing.T) {
 }
 
 func TestReplaceErrors(t *testing.T) {
-	realDelay := retryDelay
-	retryDelay = 0
-	t.Cleanup(func() { retryDelay = realDelay })
 	expected := errors.New("expected")
 
 	t.Run("read", func(t *testing.T) {
@@ -240,7 +502,7 @@ func TestReplaceErrors(t *testing.T) {
 			return expected
 		}}
 		p := filepath.Join(t.TempDir(), t.Name())
-		c, err := New(ec, p)
+		c, err := New(ec, p, WithRetryDelay(0, 0))
 		require.NoError(t, err)
 
 		err = c.Replace(ctx, &fakeInternalCache{}, cache.ReplaceHints{})
@@ -264,7 +526,7 @@ func TestReplaceErrors(t *testing.T) {
 			ec := &fakeExternalCache{}
 
 			p := filepath.Join(t.TempDir(), t.Name())
-			c, err := New(ec, p)
+			c, err := New(ec, p, WithRetryDelay(0, 0))
 			require.NoError(t, err)
 
 			cx, cancel := context.WithTimeout(ctx, time.Millisecond)
@@ -276,6 +538,173 @@ func TestReplaceErrors(t *testing.T) {
 	}
 }
 
+func TestTimestampMode(t *testing.T) {
+	for _, mode := range []TimestampMode{TimestampCreate, TimestampExisting, TimestampDisabled} {
+		t.Run(fmt.Sprint(mode), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "dir", "ts")
+			reads := 0
+			ec := fakeExternalCache{readCallback: func() error {
+				reads++
+				return nil
+			}}
+			c, err := New(&ec, p, WithTimestampMode(mode))
+			require.NoError(t, err)
+
+			ic := fakeInternalCache{data: []byte("data")}
+			require.NoError(t, c.Export(ctx, &ic, cache.ExportHints{}))
+			if mode == TimestampCreate {
+				require.FileExists(t, p)
+			} else {
+				require.NoFileExists(t, p, "Export created the timestamp file")
+			}
+
+			if mode == TimestampExisting {
+				// when the file exists, Cache should use it as in the default mode
+				f, err := os.Create(p)
+				require.NoError(t, err)
+				require.NoError(t, f.Close())
+				require.NoError(t, c.Export(ctx, &ic, cache.ExportHints{}))
+			}
+			for i := 0; i < 2; i++ {
+				require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+			}
+			if mode == TimestampDisabled {
+				require.Equal(t, 2, reads, "Replace should read every time when the timestamp is disabled")
+			} else {
+				require.Equal(t, 0, reads, "Replace shouldn't read when the timestamp indicates no change")
+			}
+		})
+	}
+}
+
+func TestVersionFile(t *testing.T) {
+	for _, versioned := range []bool{false, true} {
+		name := "timestamp only"
+		if versioned {
+			name = "with version file"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := filepath.Join(dir, "ts")
+			opts := []option{}
+			if versioned {
+				opts = append(opts, WithVersionFile(filepath.Join(dir, "version")))
+			}
+			ec := fakeExternalCache{}
+			writer, err := New(&ec, p, opts...)
+			require.NoError(t, err)
+			reader, err := New(&ec, p, opts...)
+			require.NoError(t, err)
+
+			ic := fakeInternalCache{data: []byte("a")}
+			require.NoError(t, writer.Export(ctx, &ic, cache.ExportHints{}))
+			actual := fakeInternalCache{}
+			require.NoError(t, reader.Replace(ctx, &actual, cache.ReplaceHints{}))
+			require.Equal(t, ic.data, actual.data)
+
+			// simulate a second write within the file system's time resolution by restoring the
+			// timestamp's modification time after the write
+			f, err := os.Stat(p)
+			require.NoError(t, err)
+			ic.data = []byte("b")
+			require.NoError(t, writer.Export(ctx, &ic, cache.ExportHints{}))
+			require.NoError(t, os.Chtimes(p, f.ModTime(), f.ModTime()))
+
+			require.NoError(t, reader.Replace(ctx, &actual, cache.ReplaceHints{}))
+			if versioned {
+				require.Equal(t, ic.data, actual.data, "Replace should have detected the new generation")
+			} else {
+				// this is the stale read the version file prevents
+				require.Equal(t, []byte("a"), actual.data)
+			}
+		})
+	}
+
+	t.Run("fallback", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "ts")
+		vp := filepath.Join(dir, "version")
+		ec := fakeExternalCache{}
+		c, err := New(&ec, p, WithVersionFile(vp))
+		require.NoError(t, err)
+		ic := fakeInternalCache{data: []byte("a")}
+		require.NoError(t, c.Export(ctx, &ic, cache.ExportHints{}))
+
+		// a process that doesn't maintain the version file writes new data and touches the timestamp
+		ec.data = []byte("b")
+		tm := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(p, tm, tm))
+		require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+		require.Equal(t, ec.data, ic.data)
+
+		// the data doesn't match the version, so Cache should keep reading until a versioned write
+		ec.data = []byte("c")
+		require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+		require.Equal(t, ec.data, ic.data)
+
+		// when the version file is malformed, Cache should rely on the timestamp
+		require.NoError(t, os.WriteFile(vp, []byte("malformed"), 0600))
+		ec.data = []byte("d")
+		tm = tm.Add(time.Minute)
+		require.NoError(t, os.Chtimes(p, tm, tm))
+		require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+		require.Equal(t, ec.data, ic.data)
+		ec.data = []byte("e")
+		require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+		require.Equal(t, []byte("d"), ic.data, "Replace should have skipped the read because the timestamp didn't change")
+	})
+}
+
+func TestAccessorLock(t *testing.T) {
+	p := filepath.Join(t.TempDir(), t.Name())
+	a := &fakeLockingCache{}
+	a.writeCallback = func() error {
+		require.True(t, a.locked, "Cache should hold the accessor's lock while writing")
+		return nil
+	}
+	c, err := New(a, p, WithLockTimeout(time.Hour))
+	require.NoError(t, err)
+
+	expected := []byte("expected")
+	require.NoError(t, c.Export(ctx, &fakeInternalCache{data: expected}, cache.ExportHints{}))
+	require.Equal(t, expected, a.data)
+	require.False(t, a.locked, "Export should release the lock")
+	require.NoFileExists(t, p+".lockfile", "Cache shouldn't use a lock file when the accessor provides a lock")
+	deadline, ok := a.lockCtx.Deadline()
+	require.True(t, ok, "Cache should apply its lock timeout")
+	require.WithinDuration(t, time.Now().Add(time.Hour), deadline, time.Minute)
+
+	// Export should return errors from Lock and Unlock
+	lockErr := errors.New("lock error")
+	a.lockErr = lockErr
+	require.ErrorIs(t, c.Export(ctx, &fakeInternalCache{data: expected}, cache.ExportHints{}), lockErr)
+	a.lockErr = nil
+	unlockErr := errors.New("unlock error")
+	a.unlockErr = unlockErr
+	require.ErrorIs(t, c.Export(ctx, &fakeInternalCache{data: expected}, cache.ExportHints{}), unlockErr)
+	a.unlockErr = nil
+
+	// Export should release the lock even when its context is cancelled during the write
+	cx, cancel := context.WithCancel(ctx)
+	a.writeCallback = func() error {
+		cancel()
+		return nil
+	}
+	require.NoError(t, c.Export(cx, &fakeInternalCache{data: expected}, cache.ExportHints{}))
+	require.False(t, a.locked)
+	deadline, ok = a.unlockCtx.Deadline()
+	require.True(t, ok, "Cache should apply its lock timeout to Unlock")
+	require.WithinDuration(t, time.Now().Add(time.Hour), deadline, time.Minute)
+
+	// a read-only Cache shouldn't lock the accessor
+	a.lockErr = lockErr
+	ro, err := New(a, p, WithReadOnly(ExportIgnore))
+	require.NoError(t, err)
+	ic := fakeInternalCache{}
+	require.NoError(t, ro.Replace(ctx, &ic, cache.ReplaceHints{}))
+	require.Equal(t, expected, ic.data)
+}
+
 func TestUnlockError(t *testing.T) {
 	p := filepath.Join(t.TempDir(), t.Name())
 	a := fakeExternalCache{}
@@ -294,3 +723,174 @@ func TestUnlockError(t *testing.T) {
 	err = c.Export(ctx, &fakeInternalCache{}, cache.ExportHints{})
 	require.Equal(t, writeErr, err)
 }
+
+func TestMerge(t *testing.T) {
+	for _, test := range []struct {
+		desc, base, ours, theirs, expected string
+	}{
+		{
+			desc:     "no base",
+			ours:     `{"AccessToken":{"a":{"v":1}}}`,
+			theirs:   `{"AccessToken":{"b":{"v":1}},"Account":{"b":{}}}`,
+			expected: `{"AccessToken":{"a":{"v":1},"b":{"v":1}},"Account":{"b":{}}}`,
+		},
+		{
+			desc:     "no theirs",
+			base:     `{"AccessToken":{"a":{"v":1}}}`,
+			ours:     `{"AccessToken":{"a":{"v":2}}}`,
+			expected: `{"AccessToken":{"a":{"v":2}}}`,
+		},
+		{
+			desc:     "concurrent additions",
+			base:     `{"AccessToken":{"a":{"v":1}}}`,
+			ours:     `{"AccessToken":{"a":{"v":1},"b":{"v":1}}}`,
+			theirs:   `{"AccessToken":{"a":{"v":1},"c":{"v":1}}}`,
+			expected: `{"AccessToken":{"a":{"v":1},"b":{"v":1},"c":{"v":1}}}`,
+		},
+		{
+			desc:     "ours deleted an entry",
+			base:     `{"AccessToken":{"a":{"v":1},"b":{"v":1}}}`,
+			ours:     `{"AccessToken":{"b":{"v":1}}}`,
+			theirs:   `{"AccessToken":{"a":{"v":1},"b":{"v":1},"c":{"v":1}}}`,
+			expected: `{"AccessToken":{"b":{"v":1},"c":{"v":1}}}`,
+		},
+		{
+			desc:     "theirs deleted an entry",
+			base:     `{"AccessToken":{"a":{"v":1},"b":{"v":1}}}`,
+			ours:     `{"AccessToken":{"a":{"v":1},"b":{"v":1},"c":{"v":1}}}`,
+			theirs:   `{"AccessToken":{"b":{"v":1}}}`,
+			expected: `{"AccessToken":{"b":{"v":1},"c":{"v":1}}}`,
+		},
+		{
+			desc:     "both changed an entry",
+			base:     `{"RefreshToken":{"a":{"secret":"0","x":1}}}`,
+			ours:     `{"RefreshToken":{"a":{"secret":"1","x":1}}}`,
+			theirs:   `{"RefreshToken":{"a":{"secret":"2","y":1}}}`,
+			expected: `{"RefreshToken":{"a":{"secret":"1","x":1}}}`,
+		},
+		{
+			desc:     "only theirs changed an entry",
+			base:     `{"RefreshToken":{"a":{"secret":"0"}}}`,
+			ours:     `{"RefreshToken":{"a":{ "secret": "0" }}}`,
+			theirs:   `{"RefreshToken":{"a":{"secret":"2"}}}`,
+			expected: `{"RefreshToken":{"a":{"secret":"2"}}}`,
+		},
+		{
+			desc:     "new section",
+			base:     `{}`,
+			ours:     `{"IdToken":{"a":{}}}`,
+			theirs:   `{"AppMetadata":{"b":{}}}`,
+			expected: `{"AppMetadata":{"b":{}},"IdToken":{"a":{}}}`,
+		},
+		{
+			desc:     "malformed theirs",
+			base:     `{"AccessToken":{"a":{"v":1}}}`,
+			ours:     `{"AccessToken":{"a":{"v":2}}}`,
+			theirs:   `{"AccessToken":`,
+			expected: `{"AccessToken":{"a":{"v":2}}}`,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			actual, err := merge([]byte(test.base), []byte(test.ours), []byte(test.theirs))
+			require.NoError(t, err)
+			require.JSONEq(t, test.expected, string(actual))
+		})
+	}
+	_, err := merge(nil, []byte("malformed"), nil)
+	require.Error(t, err)
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	p := filepath.Join(t.TempDir(), t.Name())
+	a := &fakeVersionedCache{}
+	c1, err := New(a, p, WithOptimisticConcurrency())
+	require.NoError(t, err)
+	c2, err := New(a, p, WithOptimisticConcurrency())
+	require.NoError(t, err)
+
+	require.NoError(t, c1.Export(ctx, &fakeInternalCache{data: []byte(`{"AccessToken":{"1":{}}}`)}, cache.ExportHints{}))
+	require.Equal(t, 0, a.conflicts)
+
+	// c2 hasn't read c1's write, so its write should conflict and Export should merge the changes
+	require.NoError(t, c2.Export(ctx, &fakeInternalCache{data: []byte(`{"AccessToken":{"2":{}}}`)}, cache.ExportHints{}))
+	require.Equal(t, 1, a.conflicts)
+	require.JSONEq(t, `{"AccessToken":{"1":{},"2":{}}}`, string(a.data))
+	require.NoFileExists(t, p+".lockfile", "Cache shouldn't lock in optimistic mode")
+
+	// c2's next Replace should read the merged data even though c2 wrote it
+	ic := fakeInternalCache{}
+	require.NoError(t, c2.Replace(ctx, &ic, cache.ReplaceHints{}))
+	require.JSONEq(t, `{"AccessToken":{"1":{},"2":{}}}`, string(ic.data))
+
+	// c1 deletes its entry without having read c2's. The merge should preserve c2's entry.
+	require.NoError(t, c1.Export(ctx, &fakeInternalCache{data: []byte(`{"AccessToken":{"3":{}}}`)}, cache.ExportHints{}))
+	require.Equal(t, 2, a.conflicts)
+	require.JSONEq(t, `{"AccessToken":{"2":{},"3":{}}}`, string(a.data))
+
+	// after a Replace, c2's write shouldn't conflict
+	require.NoError(t, c2.Replace(ctx, &ic, cache.ReplaceHints{}))
+	require.NoError(t, c2.Export(ctx, &fakeInternalCache{data: []byte(`{"AccessToken":{"3":{}}}`)}, cache.ExportHints{}))
+	require.Equal(t, 2, a.conflicts)
+	require.JSONEq(t, `{"AccessToken":{"3":{}}}`, string(a.data))
+
+	// Export should return other errors immediately
+	writeErr := errors.New("write error")
+	a.writeCallback = func() error { return writeErr }
+	require.ErrorIs(t, c2.Export(ctx, &fakeInternalCache{data: []byte(`{}`)}, cache.ExportHints{}), writeErr)
+
+	// Export should stop retrying when its context is done
+	a.writeCallback = nil
+	a.readCallback = func() error {
+		// another client writes after every read
+		a.version++
+		return nil
+	}
+	a.version++
+	cx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = c2.Export(cx, &fakeInternalCache{data: []byte(`{}`)}, cache.ExportHints{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestVersionReader(t *testing.T) {
+	p := filepath.Join(t.TempDir(), t.Name())
+	a := &fakeVersionReaderCache{}
+	c, err := New(a, p, WithOptimisticConcurrency(), WithTimestampMode(TimestampDisabled))
+	require.NoError(t, err)
+	other, err := New(a, p, WithOptimisticConcurrency(), WithTimestampMode(TimestampDisabled))
+	require.NoError(t, err)
+
+	expected := []byte(`{"AccessToken":{"1":{}}}`)
+	require.NoError(t, other.Export(ctx, &fakeInternalCache{data: expected}, cache.ExportHints{}))
+	ic := fakeInternalCache{}
+	require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+	require.Equal(t, expected, ic.data)
+	require.Equal(t, 1, a.reads)
+
+	// Replace shouldn't read again until the version changes
+	ic = fakeInternalCache{}
+	require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+	require.Equal(t, expected, ic.data, "Replace should unmarshal the data it last read")
+	require.Equal(t, 1, a.reads)
+
+	expected = []byte(`{"AccessToken":{"2":{}}}`)
+	require.NoError(t, other.Replace(ctx, &fakeInternalCache{}, cache.ReplaceHints{}))
+	require.NoError(t, other.Export(ctx, &fakeInternalCache{data: expected}, cache.ExportHints{}))
+	require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+	require.Equal(t, expected, ic.data)
+	require.Equal(t, 2, a.reads)
+
+	// Replace should read when it can't get the version
+	a.versionErr = errors.New("it didn't work")
+	require.NoError(t, c.Replace(ctx, &ic, cache.ReplaceHints{}))
+	require.Equal(t, 3, a.reads)
+	a.versionErr = nil
+
+	// Cache should use the timestamp file instead when that's enabled
+	ts, err := New(a, p, WithOptimisticConcurrency())
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, ts.Replace(ctx, &ic, cache.ReplaceHints{}))
+	}
+	require.Equal(t, 5, a.reads, "the timestamp file doesn't exist, so every Replace should read")
+}
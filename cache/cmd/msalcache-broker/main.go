@@ -0,0 +1,182 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Command msalcache-broker holds an MSAL token cache in memory and serves it to processes of the same
+// user over a Unix domain socket, so those processes can share tokens without writing them to disk.
+// Applications access the cache with package accessor/broker, which finds the socket through
+// $MSALCACHE_BROKER_SOCK. msalcache-broker runs in the foreground, for example as a systemd user
+// service, and like ssh-agent prints a shell command setting that variable:
+//
+//	$ msalcache-broker -persist systemd-creds:msal:$HOME/.msal.cred &
+//	MSALCACHE_BROKER_SOCK=/run/user/1000/msalcache-broker.sock; export MSALCACHE_BROKER_SOCK;
+//
+// The broker accepts connections only from processes running as its own user and any users allowed with
+// -allow-uid. By default it holds the cache only in memory, so the cache is lost when the broker exits.
+// The -persist flag makes it also store the cache with an accessor:
+//
+//	file:PATH                 an unencrypted file
+//	platform:NAME             the platform's secret storage (libsecret, keychain or DPAPI), as accessor.New.
+//	                          On Linux and macOS, this requires building msalcache-broker with cgo.
+//	systemd-creds:NAME:PATH   a systemd encrypted credential, as package accessor/systemdcreds
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor/broker"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor/file"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor/systemdcreds"
+	internal "github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/broker"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "msalcache-broker:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the broker until the context is done
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("msalcache-broker", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		allow   = fs.String("allow-uid", "", "comma separated IDs of other users allowed to connect")
+		persist = fs.String("persist", "", "store the cache with an accessor: file:PATH, platform:NAME or systemd-creds:NAME:PATH")
+		socket  = fs.String("socket", defaultSocket(), "path of the socket, in a directory only the user can access")
+		verbose = fs.Bool("v", false, "log connections and operations to stderr")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level}))
+
+	var uids []int
+	if *allow != "" {
+		for _, s := range strings.Split(*allow, ",") {
+			uid, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("invalid -allow-uid %q", *allow)
+			}
+			uids = append(uids, uid)
+		}
+	}
+	var a accessor.Accessor
+	if *persist != "" {
+		var err error
+		if a, err = persistence(*persist); err != nil {
+			return err
+		}
+	}
+	srv, err := internal.NewServer(ctx, internal.WithAllowedUIDs(uids...), internal.WithLogger(logger), internal.WithPersistence(a))
+	if err != nil {
+		return err
+	}
+
+	ln, err := listen(*socket)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s=%s; export %s;\n", broker.SocketEnv, *socket, broker.SocketEnv)
+	logger.Debug("listening", slog.String("socket", *socket))
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(ln) }()
+	select {
+	case <-ctx.Done():
+		err = nil
+	case err = <-errs:
+	}
+	// closing the listener also removes the socket file
+	ln.Close()
+	srv.Close()
+	return err
+}
+
+// defaultSocket returns the default path of the socket: a file in $XDG_RUNTIME_DIR when that's set
+// and otherwise in a directory named for the user in the temporary directory
+func defaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "msalcache-broker.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("msalcache-broker-%d", os.Getuid()), "broker.sock")
+}
+
+// listen creates the socket, readable and writable only by the broker's user. It removes an existing
+// socket file when no broker is listening on it. The socket's directory must be a directory, not a
+// symlink, belonging to the broker's user and having mode 0700.
+func listen(p string) (net.Listener, error) {
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// MkdirAll succeeds when the path exists, so another user could have created it to replace the
+	// socket and receive clients' caches
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("socket directory %s isn't a directory", dir)
+	}
+	if err := checkSocketDir(fi); err != nil {
+		return nil, fmt.Errorf("unsafe socket directory %s: %w", dir, err)
+	}
+	if _, err := os.Lstat(p); err == nil {
+		if c, err := net.DialTimeout("unix", p, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("another broker is listening on %s", p)
+		}
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(p, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// persistence returns the accessor described by the -persist flag
+func persistence(spec string) (accessor.Accessor, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "file":
+		if arg != "" {
+			return file.New(arg)
+		}
+	case "platform":
+		if arg != "" {
+			return platform(arg)
+		}
+	case "systemd-creds":
+		if name, p, ok := strings.Cut(arg, ":"); ok {
+			return systemdcreds.New(name, p)
+		}
+	}
+	return nil, errors.New("invalid -persist. Specify file:PATH, platform:NAME or systemd-creds:NAME:PATH")
+}
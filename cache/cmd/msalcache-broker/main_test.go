@@ -0,0 +1,41 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "broker", "broker.sock")
+	ln, err := listen(p)
+	require.NoError(t, err, "listen should create the directory")
+	require.NoError(t, ln.Close())
+
+	require.NoError(t, os.Chmod(filepath.Dir(p), 0755))
+	_, err = listen(p)
+	require.Error(t, err, "listen should reject a directory other users can access")
+
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink(filepath.Dir(p), link))
+	require.NoError(t, os.Chmod(filepath.Dir(p), 0700))
+	_, err = listen(filepath.Join(link, "broker.sock"))
+	require.Error(t, err, "listen should reject a symlink")
+
+	if os.Getuid() == 0 {
+		other := filepath.Join(dir, "other")
+		require.NoError(t, os.Mkdir(other, 0700))
+		require.NoError(t, os.Chown(other, 1, 1))
+		_, err = listen(filepath.Join(other, "broker.sock"))
+		require.Error(t, err, "listen should reject another user's directory")
+	}
+}
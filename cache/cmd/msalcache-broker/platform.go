@@ -0,0 +1,14 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+//go:build (darwin && cgo) || (linux && cgo) || windows
+// +build darwin,cgo linux,cgo windows
+
+package main
+
+import "github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+
+// platform returns the platform's secret storage accessor
+func platform(name string) (accessor.Accessor, error) {
+	return accessor.New(name)
+}
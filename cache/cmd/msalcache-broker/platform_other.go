@@ -0,0 +1,20 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+//go:build !((darwin && cgo) || (linux && cgo) || windows)
+// +build !darwin !cgo
+// +build !linux !cgo
+// +build !windows
+
+package main
+
+import (
+	"errors"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+)
+
+// platform returns an error because the platform's secret storage accessor requires cgo on this platform
+func platform(string) (accessor.Accessor, error) {
+	return nil, errors.New("platform persistence isn't available because msalcache-broker was built without cgo")
+}
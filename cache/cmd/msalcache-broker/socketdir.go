@@ -0,0 +1,29 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkSocketDir returns an error unless the socket's directory belongs to the broker's user and
+// only that user can access it. "fi" must describe the directory itself, not a symlink's target.
+func checkSocketDir(fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("couldn't determine the owner of %s", fi.Name())
+	}
+	if uid := os.Getuid(); int(st.Uid) != uid {
+		return fmt.Errorf("%s belongs to user %d, not %d", fi.Name(), st.Uid, uid)
+	}
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		return fmt.Errorf("%s has mode %#o, not 0700", fi.Name(), perm)
+	}
+	return nil
+}
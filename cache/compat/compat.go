@@ -0,0 +1,60 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package compat identifies the conventions of MSAL's extension libraries for other languages, so
+// that applications written in Go can share a persistent cache with applications using those libraries.
+// A [Profile] names a library. Setting the same profile on a Cache, with cache.WithCompatibility, and
+// on the platform accessor, with accessor.WithCompatibility, makes Go use that library's lock protocol
+// and storage formats:
+//
+//	a, err := accessor.New(name, accessor.WithCompatibility(compat.Python))
+//	// TODO: handle error
+//	c, err := cache.New(a, p, cache.WithCompatibility(compat.Python))
+//
+// Beyond the profile, both applications must configure the same storage location. The other libraries
+// identify a cache with a file path, which they use to detect changes and from which they derive the lock
+// file's path by appending ".lockfile". The Cache's timestamp file path ("p" above) must be that path.
+// On each platform, the accessor's configuration corresponds to the other libraries' as follows:
+//
+//   - Windows: all the libraries store data in a file encrypted by DPAPI for the current user, without
+//     additional entropy. The file is the one identifying the cache, so pass the same path to
+//     accessor.New and cache.New.
+//   - macOS: all the libraries store data as a generic password in the login keychain. Pass the service
+//     and account names the other application uses to accessor.New and accessor.WithAccount.
+//   - Linux: all the libraries store data as a libsecret password. Pass the schema name the other
+//     application uses to accessor.New, its attributes to accessor.WithAttribute and, when it isn't the
+//     default collection, its collection to accessor.WithCollection. The libraries differ in how they
+//     encode data in the password, which is why the accessor requires a profile.
+//
+// MSAL's Java extension library isn't supported because it locks the lock file with Java's FileChannel,
+// which on Linux and macOS doesn't exclude the locks the other libraries take.
+package compat
+
+import "fmt"
+
+// Profile identifies an MSAL extension library whose conventions a Cache or accessor follows.
+type Profile int
+
+const (
+	// Go is this module's own conventions. It's the default. Applications using this profile share a
+	// cache only with other applications using this module.
+	Go Profile = iota
+	// DotNet is the conventions of Microsoft.Identity.Client.Extensions.Msal, the extension library
+	// for MSAL.NET.
+	DotNet
+	// Python is the conventions of msal-extensions, the extension library for MSAL Python.
+	Python
+)
+
+func (p Profile) String() string {
+	switch p {
+	case Go:
+		return "Go"
+	case DotNet:
+		return ".NET"
+	case Python:
+		return "Python"
+	default:
+		return fmt.Sprintf("Profile(%d)", int(p))
+	}
+}
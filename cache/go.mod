@@ -1,13 +1,16 @@
 module github.com/AzureAD/microsoft-authentication-extensions-for-go/cache
 
-go 1.18
+go 1.21
 
 require (
 	github.com/AzureAD/microsoft-authentication-library-for-go v1.0.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/keybase/go-keychain v0.0.0-20230523030712-b5615109f100
 	github.com/stretchr/testify v1.8.2
+	go.etcd.io/bbolt v1.3.10
 	golang.org/x/sys v0.8.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -19,5 +22,4 @@ require (
 	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/pkg/browser v0.0.0-20210911075715-681adbf594b8 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
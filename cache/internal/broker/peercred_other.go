@@ -0,0 +1,17 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package broker
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID returns an error because this platform doesn't report the credentials of a socket's peer
+func peerUID(net.Conn) (int, error) {
+	return -1, errors.New("the broker can't authenticate clients on this platform")
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package broker implements the cache broker: a process that holds a cache in memory and serves it to
+// other processes of the same user over a Unix domain socket, as ssh-agent serves keys. The msalcache-broker
+// command runs a [Server], and package accessor/broker implements the client.
+//
+// The protocol is a sequence of JSON messages, one per line. A client sends a [Request] and the server
+// responds with a [Response] before reading the next request. The lock belongs to the connection, so the
+// server releases it when the client holding it disconnects.
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+)
+
+// Version is the protocol version. Servers reject requests having another version.
+const Version = 1
+
+// MaxMessageSize is the maximum size in bytes of a message, including its base64 encoded data.
+const MaxMessageSize = 64 << 20
+
+// Op is an operation a client requests
+type Op string
+
+const (
+	OpDelete Op = "delete"
+	OpLock   Op = "lock"
+	OpRead   Op = "read"
+	OpUnlock Op = "unlock"
+	OpWrite  Op = "write"
+)
+
+// Request is a message from a client
+type Request struct {
+	Data []byte `json:"data,omitempty"`
+	Op   Op     `json:"op"`
+	V    int    `json:"v"`
+}
+
+// Response is the server's reply to a Request. Error is empty when the operation succeeded.
+type Response struct {
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Conn sends and receives messages
+type Conn struct {
+	net.Conn
+	s *bufio.Scanner
+}
+
+// NewConn is the constructor for Conn
+func NewConn(c net.Conn) *Conn {
+	s := bufio.NewScanner(c)
+	s.Buffer(make([]byte, 0, 4096), MaxMessageSize)
+	return &Conn{Conn: c, s: s}
+}
+
+// Receive reads the next message into v. It returns io.EOF when the peer closed the connection.
+func (c *Conn) Receive(v any) error {
+	if !c.s.Scan() {
+		if err := c.s.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	return json.Unmarshal(c.s.Bytes(), v)
+}
+
+// Send writes v as a message
+func (c *Conn) Send(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) >= MaxMessageSize {
+		return errors.New("message exceeds the broker's maximum size")
+	}
+	_, err = c.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,264 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/accessor"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
+)
+
+// persistTimeout is how long Server waits for the persistence accessor to write or delete data
+const persistTimeout = 10 * time.Second
+
+type option func(*Server) error
+
+// WithAllowedUIDs allows clients running as the given users to connect. By default, only clients
+// running as the server's user can connect.
+func WithAllowedUIDs(uids ...int) option {
+	return func(s *Server) error {
+		for _, uid := range uids {
+			if uid < 0 {
+				return fmt.Errorf("invalid UID %d", uid)
+			}
+			s.allowed[uid] = true
+		}
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive records about connections and operations. These records never
+// include cached data. By default, Server doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(s *Server) error {
+		s.logger = l
+		return nil
+	}
+}
+
+// WithPersistence makes Server load data from an accessor when it starts and write data to the
+// accessor whenever a client writes, so the cache survives restarts. When the accessor is nil, as it
+// is by default, Server holds data only in memory.
+func WithPersistence(a accessor.Accessor) option {
+	return func(s *Server) error {
+		s.persist = a
+		return nil
+	}
+}
+
+// Server serves a cache to clients connected to a Unix domain socket. It authenticates clients by the
+// user ID the kernel reports for the socket's peer.
+type Server struct {
+	allowed map[int]bool
+	conns   map[net.Conn]bool
+	data    []byte
+	// lock is the cache lock. A connection holds the lock after sending a value to it.
+	lock   chan struct{}
+	logger *slog.Logger
+	// m guards data and conns, and serializes use of persist
+	m       *sync.Mutex
+	persist accessor.Accessor
+	// persistTimeout bounds each operation on persist, because operations hold m and therefore
+	// block every client until they return
+	persistTimeout time.Duration
+	wg             sync.WaitGroup
+}
+
+// NewServer is the constructor for Server. When it has a persistence accessor, it reads that
+// accessor's data.
+func NewServer(ctx context.Context, opts ...option) (*Server, error) {
+	s := Server{
+		allowed:        map[int]bool{},
+		conns:          map[net.Conn]bool{},
+		lock:           make(chan struct{}, 1),
+		m:              &sync.Mutex{},
+		persistTimeout: persistTimeout,
+	}
+	if uid := os.Getuid(); uid >= 0 {
+		s.allowed[uid] = true
+	}
+	for _, o := range opts {
+		if err := o(&s); err != nil {
+			return nil, err
+		}
+	}
+	s.logger = logging.OrDiscard(s.logger)
+	if s.persist != nil {
+		data, err := s.persist.Read(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read persisted data: %w", err)
+		}
+		s.data = data
+		s.logger.DebugContext(ctx, "loaded persisted data", logging.Size(data))
+	}
+	return &s, nil
+}
+
+// Close closes all client connections, releasing the lock, and waits for their handlers to return.
+// Callers should close the listener passed to Serve first.
+func (s *Server) Close() error {
+	s.m.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.m.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// Serve accepts connections from the listener until it's closed, then returns nil.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.m.Lock()
+		s.conns[c] = true
+		s.m.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+			s.m.Lock()
+			delete(s.conns, c)
+			s.m.Unlock()
+		}()
+	}
+}
+
+// handle serves a client connection until the client disconnects
+func (s *Server) handle(nc net.Conn) {
+	defer nc.Close()
+	c := NewConn(nc)
+	logger := s.logger
+	uid, err := peerUID(nc)
+	if err == nil {
+		logger = logger.With(slog.Int("uid", uid))
+		if !s.allowed[uid] {
+			err = fmt.Errorf("user %d isn't allowed to connect", uid)
+		}
+	}
+	if err != nil {
+		logger.Warn("rejected connection", slog.Any("error", err))
+		_ = c.Send(Response{Error: "permission denied"})
+		return
+	}
+	logger.Debug("accepted connection")
+
+	// a goroutine reads requests so that handle can notice a disconnection while waiting for the lock
+	requests, done, quit := make(chan Request), make(chan struct{}), make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(done)
+		for {
+			var req Request
+			if err := c.Receive(&req); err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					logger.Debug("closing connection after an error", slog.Any("error", err))
+				}
+				return
+			}
+			select {
+			case requests <- req:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	locked := false
+	defer func() {
+		if locked {
+			logger.Debug("releasing the lock because its holder disconnected")
+			<-s.lock
+		}
+	}()
+	for {
+		var req Request
+		select {
+		case req = <-requests:
+		case <-done:
+			return
+		}
+		res := Response{}
+		switch {
+		case req.V != Version:
+			res.Error = fmt.Sprintf("unsupported protocol version %d", req.V)
+		case req.Op == OpLock:
+			if locked {
+				res.Error = "client already holds the lock"
+				break
+			}
+			select {
+			case s.lock <- struct{}{}:
+				locked = true
+				logger.Debug("client acquired the lock")
+			case <-done:
+				return
+			}
+		case req.Op == OpUnlock:
+			if !locked {
+				res.Error = "client doesn't hold the lock"
+				break
+			}
+			<-s.lock
+			locked = false
+			logger.Debug("client released the lock")
+		default:
+			if res.Data, err = s.do(req); err != nil {
+				res.Error = err.Error()
+			}
+		}
+		if err := c.Send(res); err != nil {
+			logger.Debug("closing connection after an error", slog.Any("error", err))
+			return
+		}
+	}
+}
+
+// do performs a data operation, writing through to the persistence accessor if there is one, and
+// returns the cached data
+func (s *Server) do(req Request) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), s.persistTimeout)
+	defer cancel()
+	switch req.Op {
+	case OpRead:
+		return s.data, nil
+	case OpDelete:
+		if s.persist != nil {
+			if err := s.persist.Delete(ctx); err != nil {
+				s.logger.Warn("couldn't delete persisted data", slog.Any("error", err))
+				return nil, err
+			}
+		}
+		s.data = nil
+	case OpWrite:
+		if s.persist != nil {
+			if err := s.persist.Write(ctx, req.Data); err != nil {
+				s.logger.Warn("couldn't persist data", slog.Any("error", err))
+				return nil, err
+			}
+		}
+		s.data = req.Data
+		s.logger.Debug("client wrote data", logging.Size(req.Data))
+	default:
+		return nil, fmt.Errorf("unknown operation %q", req.Op)
+	}
+	return nil, nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+//go:build darwin || linux
+// +build darwin linux
+
+package broker
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+func listen(t *testing.T) (net.Listener, string) {
+	// t.TempDir() may return a path too long for a socket
+	dir, err := os.MkdirTemp("", "broker")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	p := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", p)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	return ln, p
+}
+
+func dial(t *testing.T, p string) *Conn {
+	nc, err := net.Dial("unix", p)
+	require.NoError(t, err)
+	t.Cleanup(func() { nc.Close() })
+	return NewConn(nc)
+}
+
+func roundTrip(t *testing.T, c *Conn, req Request) Response {
+	require.NoError(t, c.Send(req))
+	res := Response{}
+	require.NoError(t, c.Receive(&res))
+	return res
+}
+
+func TestPeerUID(t *testing.T) {
+	ln, p := listen(t)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	dial(t, p)
+	c := <-accepted
+	require.NotNil(t, c)
+	defer c.Close()
+	uid, err := peerUID(c)
+	require.NoError(t, err)
+	require.Equal(t, os.Getuid(), uid)
+}
+
+func TestServer(t *testing.T) {
+	srv, err := NewServer(ctx)
+	require.NoError(t, err)
+	ln, p := listen(t)
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	a, b := dial(t, p), dial(t, p)
+	require.Equal(t, "unsupported protocol version 0", roundTrip(t, a, Request{Op: OpRead}).Error)
+	require.Contains(t, roundTrip(t, a, Request{Op: "sing", V: Version}).Error, "unknown operation")
+	require.Empty(t, roundTrip(t, a, Request{Data: []byte("a"), Op: OpWrite, V: Version}).Error)
+	require.Equal(t, "a", string(roundTrip(t, b, Request{Op: OpRead, V: Version}).Data))
+	require.NotEmpty(t, roundTrip(t, a, Request{Op: OpUnlock, V: Version}).Error, "client doesn't hold the lock")
+
+	require.Empty(t, roundTrip(t, a, Request{Op: OpLock, V: Version}).Error)
+	require.NotEmpty(t, roundTrip(t, a, Request{Op: OpLock, V: Version}).Error, "client already holds the lock")
+
+	// a client that disconnects while waiting for the lock shouldn't acquire it
+	require.NoError(t, b.Send(Request{Op: OpLock, V: Version}))
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	require.Empty(t, roundTrip(t, a, Request{Op: OpUnlock, V: Version}).Error)
+	c := dial(t, p)
+	require.NoError(t, c.Send(Request{Op: OpLock, V: Version}))
+	require.NoError(t, c.SetDeadline(time.Now().Add(time.Second)))
+	res := Response{}
+	require.NoError(t, c.Receive(&res), "lock should be available")
+	require.Empty(t, res.Error)
+}
+
+func TestServerRejectsUser(t *testing.T) {
+	srv, err := NewServer(ctx, WithAllowedUIDs(os.Getuid()+1))
+	require.NoError(t, err)
+	delete(srv.allowed, os.Getuid())
+	ln, p := listen(t)
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	c := dial(t, p)
+	require.Equal(t, "permission denied", roundTrip(t, c, Request{Op: OpRead, V: Version}).Error)
+	require.Error(t, c.Receive(&Response{}), "server should close the connection")
+
+	_, err = NewServer(ctx, WithAllowedUIDs(-1))
+	require.Error(t, err)
+}
+
+// hangingAccessor's Write and Delete block until their context is done
+type hangingAccessor struct{}
+
+func (hangingAccessor) Delete(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (hangingAccessor) Read(context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+func (hangingAccessor) Write(ctx context.Context, _ []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPersistTimeout(t *testing.T) {
+	srv, err := NewServer(ctx, WithPersistence(hangingAccessor{}))
+	require.NoError(t, err)
+	srv.persistTimeout = 10 * time.Millisecond
+	ln, p := listen(t)
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	// an unresponsive persistence accessor shouldn't block clients indefinitely
+	a, b := dial(t, p), dial(t, p)
+	require.NoError(t, b.SetDeadline(time.Now().Add(time.Second)))
+	for _, op := range []Op{OpWrite, OpDelete} {
+		require.Contains(t, roundTrip(t, a, Request{Data: []byte("data"), Op: op, V: Version}).Error, context.DeadlineExceeded.Error())
+		require.Empty(t, roundTrip(t, b, Request{Op: OpRead, V: Version}).Error)
+	}
+}
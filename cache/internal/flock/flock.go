@@ -27,6 +27,8 @@ import (
 // with access to some of the fields provided by getter methods (Path() and Locked()).
 type Flock struct {
 	path string
+	flag int
+	perm os.FileMode
 	m    sync.RWMutex
 	fh   *os.File
 	l    bool
@@ -36,7 +38,19 @@ type Flock struct {
 // New returns a new instance of *Flock. The only parameter
 // it takes is the path to the desired lockfile.
 func New(path string) *Flock {
-	return &Flock{path: path}
+	return NewWithPerm(path, 0600)
+}
+
+// NewWithPerm returns a new instance of *Flock which creates the
+// lockfile, when it doesn't exist, with the given permissions.
+func NewWithPerm(path string, perm os.FileMode) *Flock {
+	return &Flock{path: path, flag: os.O_CREATE | os.O_RDWR, perm: perm}
+}
+
+// NewReadOnly returns a new instance of *Flock which opens the lockfile
+// read-only and never creates it. It can take only shared locks.
+func NewReadOnly(path string) *Flock {
+	return &Flock{path: path, flag: os.O_RDONLY}
 }
 
 // NewFlock returns a new instance of *Flock. The only parameter
@@ -119,7 +133,7 @@ func tryCtx(ctx context.Context, fn func() (bool, error), retryDelay time.Durati
 }
 
 func (f *Flock) setFh() error {
-	fh, err := os.OpenFile(f.path, os.O_CREATE|os.O_RDWR, os.FileMode(0600))
+	fh, err := os.OpenFile(f.path, f.flag, f.perm)
 	if err == nil {
 		f.fh = fh
 	}
@@ -7,10 +7,7 @@
 
 package flock
 
-import (
-	"os"
-	"syscall"
-)
+import "syscall"
 
 // Lock is a blocking call to try and take an exclusive file lock. It will wait
 // until it is able to obtain the exclusive file lock. It's recommended that
@@ -171,7 +168,7 @@ retry:
 }
 
 // reopenFDOnError determines whether we should reopen the file handle
-// in readwrite mode and try again. This comes from util-linux/sys-utils/flock.c:
+// and try again. This comes from util-linux/sys-utils/flock.c:
 //
 //	Since Linux 3.4 (commit 55725513)
 //	Probably NFSv4 where flock() is emulated by fcntl().
@@ -185,12 +182,11 @@ func (f *Flock) reopenFDOnError(err error) (bool, error) {
 			f.fh.Close()
 			f.fh = nil
 
-			// reopen in read-write mode and set the filehandle
-			fh, err := os.OpenFile(f.path, os.O_CREATE|os.O_RDWR, os.FileMode(0600))
-			if err != nil {
+			// reopen with the original flags and set the filehandle. A read-only
+			// Flock must not create the file or open it for writing.
+			if err := f.setFh(); err != nil {
 				return false, err
 			}
-			f.fh = fh
 			return true, nil
 		}
 	}
@@ -0,0 +1,42 @@
+//go:build !aix && !windows
+// +build !aix,!windows
+
+package flock
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestReopenReadOnly(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "lockfile")
+	if err := os.WriteFile(p, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	lock := NewReadOnly(p)
+	if err := lock.setFh(); err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	reopened, err := lock.reopenFDOnError(syscall.EIO)
+	if !reopened || err != nil {
+		t.Fatalf("failed to reopen: reopened: %t, err: %v", reopened, err)
+	}
+	if _, err := lock.fh.Write([]byte("x")); err == nil {
+		t.Fatal("read-only lock should reopen the file read-only")
+	}
+
+	// a read-only lock shouldn't recreate a file deleted before it reopens
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err = lock.reopenFDOnError(syscall.EBADF); reopened || err == nil {
+		t.Fatalf("reopen should fail: reopened: %t, err: %v", reopened, err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("read-only lock shouldn't create the file: %v", err)
+	}
+}
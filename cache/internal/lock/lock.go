@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -14,16 +15,23 @@ import (
 	"time"
 
 	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/flock"
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/internal/logging"
 )
 
-// timeout lets tests set the default amount of time allowed to acquire the lock
-var timeout = 5 * time.Second
+const (
+	defaultRetryDelay = 10 * time.Millisecond
+	defaultTimeout    = 5 * time.Second
+	// staleAge is how old a lock file no process has locked must be before an exclusive-create Lock
+	// considers it abandoned. Younger files may belong to a process between creating and locking the file.
+	staleAge = time.Second
+)
 
 // flocker helps tests fake flock
 type flocker interface {
 	Fh() *os.File
 	Path() string
-	TryLockContext(context.Context, time.Duration) (bool, error)
+	TryLock() (bool, error)
+	TryRLock() (bool, error)
 	Unlock() error
 }
 
@@ -32,18 +40,107 @@ type flocker interface {
 // locks on Linux and macOS and is therefore unreliable on these platforms when several
 // processes concurrently try to acquire the lock.
 type Lock struct {
-	f          flocker
-	retryDelay time.Duration
+	// debugInfo is written to the lock file to help humans identify the lock holder
+	debugInfo         string
+	dirPerm, filePerm os.FileMode
+	// exclusive Locks acquire the lock only by creating the lock file, in addition to locking it
+	exclusive                 bool
+	f                         flocker
+	logger                    *slog.Logger
+	maxRetryDelay, retryDelay time.Duration
+	// readOnly Locks take shared locks and never create, write or remove the lock file
+	readOnly bool
+	staleAge time.Duration
+	timeout  time.Duration
+}
+
+// Option configures a Lock.
+type Option func(*Lock)
+
+// WithDebugInfo sets the text Lock writes to the lock file after acquiring the lock. The default
+// is the process ID and executable path, in the format "{pid} {path}".
+func WithDebugInfo(s string) Option {
+	return func(l *Lock) {
+		l.debugInfo = s
+	}
+}
+
+// WithExclusiveCreate makes Lock acquire the lock only by creating the lock file, as MSAL's Python
+// extension library does, before locking it. Another process's lock file therefore excludes the Lock
+// even when that process hasn't locked it. Lock takes over a lock file no process has locked once the
+// file is old enough that its creator must have abandoned it, for example by crashing.
+func WithExclusiveCreate() Option {
+	return func(l *Lock) {
+		l.exclusive = true
+	}
+}
+
+// WithLogger sets a Logger to receive debug records about acquiring and releasing the lock.
+func WithLogger(l *slog.Logger) Option {
+	return func(lk *Lock) {
+		lk.logger = l
+	}
+}
+
+// WithPerm sets the permissions of the lock file and any directories New creates in its path.
+func WithPerm(dir, file os.FileMode) Option {
+	return func(l *Lock) {
+		l.dirPerm = dir
+		l.filePerm = file
+	}
+}
+
+// WithReadOnly makes the Lock take a shared lock on an existing lock file. A read-only Lock
+// never creates, writes or removes the lock file or directories in its path. When the lock file
+// doesn't exist, Lock returns immediately because no other process holds the lock.
+func WithReadOnly() Option {
+	return func(l *Lock) {
+		l.readOnly = true
+	}
+}
+
+// WithRetryDelay sets how long Lock waits between attempts to acquire the lock. The first
+// delay is "initial"; each subsequent delay doubles the previous one, up to "max".
+func WithRetryDelay(initial, max time.Duration) Option {
+	return func(l *Lock) {
+		l.retryDelay = initial
+		l.maxRetryDelay = max
+	}
+}
+
+// WithTimeout sets the amount of time Lock tries to acquire the lock when its context has no deadline.
+func WithTimeout(d time.Duration) Option {
+	return func(l *Lock) {
+		l.timeout = d
+	}
 }
 
 // New is the constructor for Lock. "p" is the path to the lock file.
-func New(p string, retryDelay time.Duration) (*Lock, error) {
+func New(p string, opts ...Option) (*Lock, error) {
+	l := Lock{
+		debugInfo:     fmt.Sprintf("{%d} {%s}", os.Getpid(), os.Args[0]),
+		dirPerm:       os.ModePerm,
+		filePerm:      0600,
+		maxRetryDelay: defaultRetryDelay,
+		retryDelay:    defaultRetryDelay,
+		staleAge:      staleAge,
+		timeout:       defaultTimeout,
+	}
+	for _, o := range opts {
+		o(&l)
+	}
+	l.logger = logging.OrDiscard(l.logger).With(slog.String("lockfile", p))
+	if l.readOnly {
+		l.f = flock.NewReadOnly(p)
+		return &l, nil
+	}
 	// ensure all dirs in the path exist before flock tries to create the file
-	err := os.MkdirAll(filepath.Dir(p), os.ModePerm)
+	err := os.MkdirAll(filepath.Dir(p), l.dirPerm)
 	if err != nil {
 		return nil, err
 	}
-	return &Lock{f: flock.New(p), retryDelay: retryDelay}, nil
+	l.f = flock.NewWithPerm(p, l.filePerm)
+	return &l, nil
 }
 
 // Lock acquires the file lock on behalf of the process. The behavior of concurrent
@@ -52,39 +149,112 @@ func New(p string, retryDelay time.Duration) (*Lock, error) {
 func (l *Lock) Lock(ctx context.Context) error {
 	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, timeout)
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
 		defer cancel()
 	}
+	delay := l.retryDelay
 	for {
 		// flock opens the file before locking it and returns errors due to an existing
 		// lock or one acquired by another process after this process has opened the
 		// file. We ignore some errors here because in such cases we want to retry until
 		// the deadline.
-		locked, err := l.f.TryLockContext(ctx, l.retryDelay)
-		if err != nil {
+		try := l.f.TryLock
+		if l.readOnly {
+			try = l.f.TryRLock
+		}
+		var (
+			created = true
+			err     error
+			locked  bool
+		)
+		if l.exclusive && !l.readOnly {
+			created, err = l.create(ctx)
+		}
+		if created && err == nil {
+			locked, err = try()
+		}
+		switch {
+		case err != nil:
+			if l.readOnly && errors.Is(err, os.ErrNotExist) {
+				l.logger.DebugContext(ctx, "not locking because the lock file doesn't exist")
+				return nil
+			}
 			if !(errors.Is(err, os.ErrPermission) || isWindowsSharingViolation(err)) {
+				l.logger.DebugContext(ctx, "couldn't acquire lock", slog.Any("error", err))
 				return err
 			}
-		} else if locked {
-			if fh := l.f.Fh(); fh != nil {
-				s := fmt.Sprintf("{%d} {%s}", os.Getpid(), os.Args[0])
-				_, _ = fh.WriteString(s)
+			l.logger.DebugContext(ctx, "retrying lock acquisition because another process holds or is deleting the lock file", slog.Any("error", err))
+		case !created:
+			l.logger.DebugContext(ctx, "retrying lock acquisition because another process's lock file exists", slog.Duration("delay", delay))
+		case locked:
+			if fh := l.f.Fh(); fh != nil && !l.readOnly {
+				// this debug info helps humans identify the lock holder. Failing to write
+				// it doesn't affect the lock, so we only log the error. The file may have
+				// content from an abandoned lock, which isn't interesting.
+				err := fh.Truncate(0)
+				if err == nil {
+					_, err = fh.WriteString(l.debugInfo)
+				}
+				if err != nil {
+					l.logger.DebugContext(ctx, "couldn't write debug info to lock file", slog.Any("error", err))
+				}
 			}
+			l.logger.DebugContext(ctx, "acquired lock")
 			return nil
+		default:
+			l.logger.DebugContext(ctx, "retrying lock acquisition because another process holds the lock", slog.Duration("delay", delay))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+			if delay *= 2; delay > l.maxRetryDelay {
+				delay = l.maxRetryDelay
+			}
 		}
 	}
 }
 
-// Unlock releases the lock and deletes the lock file.
+// create creates the lock file, returning true when it succeeds or the existing file is abandoned.
+// In the latter case, the file is abandoned only if Lock can lock it.
+func (l *Lock) create(ctx context.Context) (bool, error) {
+	p := l.f.Path()
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, l.filePerm)
+	if err == nil {
+		return true, f.Close()
+	}
+	if errors.Is(err, os.ErrExist) {
+		fi, err := os.Stat(p)
+		if err == nil && time.Since(fi.ModTime()) >= l.staleAge {
+			l.logger.DebugContext(ctx, "trying to take over a lock file which may be abandoned", slog.Time("modified", fi.ModTime()))
+			return true, nil
+		}
+		return false, nil
+	}
+	if errors.Is(err, os.ErrPermission) || isWindowsSharingViolation(err) {
+		// Windows denies access to a file another process is deleting
+		return false, nil
+	}
+	return false, err
+}
+
+// Unlock releases the lock and, unless the Lock is read-only, deletes the lock file.
 func (l *Lock) Unlock() error {
 	err := l.f.Unlock()
+	if l.readOnly {
+		return err
+	}
 	if err == nil {
 		err = os.Remove(l.f.Path())
 	}
 	// ignore errors caused by another process deleting the file or locking between the above Unlock and Remove
 	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) || isWindowsSharingViolation(err) {
+		l.logger.Debug("released lock; ignored an error removing the lock file", slog.Any("error", err))
 		return nil
 	}
+	if err == nil {
+		l.logger.Debug("released lock")
+	}
 	return err
 }
 
@@ -33,17 +33,21 @@ func (f fakeFlock) Path() string {
 	return f.p
 }
 
-func (f fakeFlock) TryLockContext(context.Context, time.Duration) (bool, error) {
+func (f fakeFlock) TryLock() (bool, error) {
 	return f.err == nil, f.err
 }
 
+func (f fakeFlock) TryRLock() (bool, error) {
+	return f.TryLock()
+}
+
 func (f fakeFlock) Unlock() error {
 	return f.err
 }
 
 func TestCreatesAndRemovesFile(t *testing.T) {
 	p := filepath.Join(t.TempDir(), "nonexistent", t.Name())
-	lock, err := New(p, 0)
+	lock, err := New(p, WithRetryDelay(0, 0))
 	require.NoError(t, err)
 	require.NoFileExists(t, p)
 
@@ -71,7 +75,7 @@ func TestFileExists(t *testing.T) {
 	require.NoError(t, f.Close())
 
 	// Lock should succeed when the file exists but isn't locked
-	lock, err := New(p, 0)
+	lock, err := New(p, WithRetryDelay(0, 0))
 	require.NoError(t, err)
 	err = lock.Lock(ctx)
 	require.NoError(t, err)
@@ -85,9 +89,73 @@ func TestFileExists(t *testing.T) {
 	require.NoFileExists(t, p, "Unlock didn't remove the file")
 }
 
+// content returns the content of a Lock's file, read through the Lock's handle because Windows
+// prevents other handles reading a locked file
+func content(t *testing.T, l *Lock) string {
+	fh := l.f.Fh()
+	require.NotNil(t, fh)
+	fi, err := fh.Stat()
+	require.NoError(t, err)
+	b := make([]byte, fi.Size())
+	_, err = fh.ReadAt(b, 0)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestDebugInfo(t *testing.T) {
+	p := filepath.Join(t.TempDir(), t.Name())
+	// Lock should replace content left by an abandoned lock
+	require.NoError(t, os.WriteFile(p, []byte("content left by an abandoned lock"), 0600))
+	lock, err := New(p, WithDebugInfo("debug info"), WithRetryDelay(0, 0))
+	require.NoError(t, err)
+	require.NoError(t, lock.Lock(ctx))
+	require.Equal(t, "debug info", content(t, lock))
+	require.NoError(t, lock.Unlock())
+}
+
+func TestExclusiveCreate(t *testing.T) {
+	p := filepath.Join(t.TempDir(), t.Name())
+	a, err := New(p, WithExclusiveCreate(), WithRetryDelay(0, 0))
+	require.NoError(t, err)
+	b, err := New(p, WithExclusiveCreate(), WithRetryDelay(0, 0), WithTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+
+	require.NoError(t, a.Lock(ctx))
+	require.FileExists(t, p)
+	require.ErrorIs(t, b.Lock(ctx), context.DeadlineExceeded)
+	require.NoError(t, a.Unlock())
+	require.NoFileExists(t, p, "Unlock didn't remove the file")
+
+	// another process's lock file should exclude Lock even though that process hasn't locked it
+	require.NoError(t, os.WriteFile(p, nil, 0600))
+	require.ErrorIs(t, b.Lock(ctx), context.DeadlineExceeded)
+
+	// Lock should take over the file once it's old enough to have been abandoned...
+	old := time.Now().Add(-2 * staleAge)
+	require.NoError(t, os.Chtimes(p, old, old))
+	require.NoError(t, b.Lock(ctx))
+	require.NoError(t, b.Unlock())
+	require.NoFileExists(t, p)
+
+	// ...unless another process holds a lock on it
+	other, err := New(p, WithRetryDelay(0, 0))
+	require.NoError(t, err)
+	require.NoError(t, other.Lock(ctx))
+	require.NoError(t, os.Chtimes(p, old, old))
+	require.ErrorIs(t, b.Lock(ctx), context.DeadlineExceeded)
+	require.NoError(t, other.Unlock())
+
+	// a read-only Lock shouldn't create the file
+	r, err := New(p, WithExclusiveCreate(), WithReadOnly())
+	require.NoError(t, err)
+	require.NoError(t, r.Lock(ctx))
+	require.NoError(t, r.Unlock())
+	require.NoFileExists(t, p)
+}
+
 func TestLockError(t *testing.T) {
 	p := filepath.Join(t.TempDir(), t.Name())
-	lock, err := New(p, 0)
+	lock, err := New(p, WithRetryDelay(0, 0))
 	require.NoError(t, err)
 	expected := errors.New("expected")
 	lock.f = fakeFlock{err: expected}
@@ -96,14 +164,12 @@ func TestLockError(t *testing.T) {
 
 func TestLockTimeout(t *testing.T) {
 	p := filepath.Join(t.TempDir(), t.Name())
-	a, err := New(p, 0)
+	a, err := New(p, WithRetryDelay(0, 0))
 	require.NoError(t, err)
 	err = a.Lock(ctx)
 	require.NoError(t, err)
 
-	defer func(d time.Duration) { timeout = d }(timeout)
-	timeout = 0
-	b, err := New(p, 0)
+	b, err := New(p, WithRetryDelay(0, 0), WithTimeout(0))
 	require.NoError(t, err)
 
 	err = b.Lock(ctx)
@@ -112,9 +178,55 @@ func TestLockTimeout(t *testing.T) {
 	require.NoError(t, a.Unlock())
 }
 
+func TestWithPerm(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't support Unix permissions")
+	}
+	p := filepath.Join(t.TempDir(), "dir", t.Name())
+	lock, err := New(p, WithPerm(0750, 0640))
+	require.NoError(t, err)
+	fi, err := os.Stat(filepath.Dir(p))
+	require.NoError(t, err)
+	// the process umask may clear bits but can't set them
+	require.Zero(t, fi.Mode().Perm()&^0750, "unexpected directory permissions")
+
+	require.NoError(t, lock.Lock(ctx))
+	fi, err = os.Stat(p)
+	require.NoError(t, err)
+	require.Zero(t, fi.Mode().Perm()&^0640, "unexpected file permissions")
+	require.NoError(t, lock.Unlock())
+}
+
+func TestReadOnly(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "nonexistent", t.Name())
+	r, err := New(p, WithReadOnly(), WithRetryDelay(0, 0))
+	require.NoError(t, err)
+	require.NoDirExists(t, filepath.Dir(p), "read-only Lock created a directory")
+
+	// Lock should succeed without creating the file when the file doesn't exist
+	require.NoError(t, r.Lock(ctx))
+	require.NoFileExists(t, p)
+	require.NoError(t, r.Unlock())
+
+	w, err := New(p, WithRetryDelay(0, 0))
+	require.NoError(t, err)
+	require.NoError(t, w.Lock(ctx))
+	// read-only Lock shouldn't acquire the lock while another Lock holds it exclusively
+	cx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, r.Lock(cx), context.DeadlineExceeded)
+	require.NoError(t, w.Unlock())
+
+	// when the lock file exists but no one holds it, read-only Lock should acquire it and leave the file in place
+	require.NoError(t, os.WriteFile(p, nil, 0600))
+	require.NoError(t, r.Lock(ctx))
+	require.NoError(t, r.Unlock())
+	require.FileExists(t, p, "read-only Lock removed the lock file")
+}
+
 func TestUnlockErrors(t *testing.T) {
 	p := filepath.Join(t.TempDir(), t.Name())
-	lock, err := New(p, 0)
+	lock, err := New(p, WithRetryDelay(0, 0))
 	require.NoError(t, err)
 
 	err = lock.Lock(ctx)
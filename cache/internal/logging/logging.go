@@ -0,0 +1,38 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package logging helps packages in this module write structured logs without
+// exposing cached data. Code which logs anything about cached data should describe
+// it with [Size] rather than including the data itself, because that data contains
+// bearer tokens.
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Discard returns a Logger that discards all records. Loggers in this module default to it.
+func Discard() *slog.Logger {
+	return slog.New(discardHandler{})
+}
+
+// OrDiscard returns "l" when it isn't nil and otherwise a Logger that discards all records.
+func OrDiscard(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return Discard()
+	}
+	return l
+}
+
+// Size describes data by its length only, never its content.
+func Size(data []byte) slog.Attr {
+	return slog.Int("bytes", len(data))
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
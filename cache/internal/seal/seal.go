@@ -0,0 +1,80 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+// Package seal encrypts data before accessors store it in remote storage, so the storage's operators
+// can't read cached tokens. Sealed data is a format version byte followed by a random nonce and the
+// AES-256-GCM ciphertext. The associated data binds ciphertext to its location, for example an object
+// name, so ciphertext copied to another location doesn't decrypt.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the size of a key in bytes.
+const KeySize = 32
+
+// version identifies the format of sealed data
+const version byte = 1
+
+// ErrOpen indicates sealed data is malformed, was sealed with a different key or associated data, or
+// was modified.
+var ErrOpen = errors.New("couldn't decrypt data")
+
+// CheckKey returns an error when key isn't a valid key.
+func CheckKey(key []byte) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("encryption key must be %d bytes, not %d", KeySize, len(key))
+	}
+	return nil
+}
+
+// Seal encrypts and authenticates plaintext and authenticates "ad".
+func Seal(key, plaintext, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = version
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[1:], plaintext, ad), nil
+}
+
+// Open authenticates and decrypts data sealed with the same key and associated data. It returns
+// an error wrapping [ErrOpen] when it can't.
+func Open(key, sealed, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 1+aead.NonceSize()+aead.Overhead() || sealed[0] != version {
+		return nil, fmt.Errorf("%w: unknown format", ErrOpen)
+	}
+	nonce, ciphertext := sealed[1:1+aead.NonceSize()], sealed[1+aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrOpen, err)
+	}
+	if plaintext == nil {
+		plaintext = []byte{}
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if err := CheckKey(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package seal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	ad := []byte("bucket/key")
+	for _, plaintext := range [][]byte{[]byte(`{"AccessToken":{}}`), {0, 1, 2, 255}, {}} {
+		sealed, err := Seal(key, plaintext, ad)
+		require.NoError(t, err)
+		if len(plaintext) > 0 {
+			require.NotContains(t, string(sealed), string(plaintext))
+		}
+		again, err := Seal(key, plaintext, ad)
+		require.NoError(t, err)
+		require.NotEqual(t, sealed, again, "Seal should use a random nonce")
+
+		actual, err := Open(key, sealed, ad)
+		require.NoError(t, err)
+		require.Equal(t, plaintext, actual)
+
+		_, err = Open(key, sealed, []byte("bucket/other"))
+		require.ErrorIs(t, err, ErrOpen, "ciphertext shouldn't decrypt at another location")
+		_, err = Open(bytes.Repeat([]byte{2}, KeySize), sealed, ad)
+		require.ErrorIs(t, err, ErrOpen, "ciphertext shouldn't decrypt with another key")
+		sealed[len(sealed)-1] ^= 1
+		_, err = Open(key, sealed, ad)
+		require.ErrorIs(t, err, ErrOpen, "modified ciphertext shouldn't decrypt")
+	}
+
+	for _, sealed := range [][]byte{nil, {version}, append([]byte{2}, make([]byte, 40)...)} {
+		_, err := Open(key, sealed, ad)
+		require.ErrorIs(t, err, ErrOpen)
+	}
+	_, err := Seal(key[1:], []byte("data"), ad)
+	require.Error(t, err)
+	require.Error(t, CheckKey(nil))
+}
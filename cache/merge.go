@@ -0,0 +1,79 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// mergeDepth is how many levels of JSON objects merge combines key by key. MSAL's cache is an object
+// of sections, such as "AccessToken", each of which is an object of entries. Merging two levels
+// combines entries added or removed by different clients while replacing each changed entry whole.
+const mergeDepth = 2
+
+// merge combines concurrent changes to cached data. "base" is the data as of this Cache's last sync,
+// "ours" is the data this Cache wants to write, and "theirs" is what another client wrote after the
+// sync. merge applies the differences between base and ours to theirs, preferring ours when both
+// changed the same entry. When base or theirs isn't a JSON object, merge treats it as empty.
+func merge(base, ours, theirs []byte) ([]byte, error) {
+	o := map[string]json.RawMessage{}
+	if err := json.Unmarshal(ours, &o); err != nil {
+		return nil, err
+	}
+	m := mergeObjects(object(base), o, object(theirs), mergeDepth-1)
+	return json.Marshal(m)
+}
+
+// mergeObjects merges key by key, recursing into values which are objects in ours and theirs
+// until "depth" reaches zero
+func mergeObjects(base, ours, theirs map[string]json.RawMessage, depth int) map[string]json.RawMessage {
+	m := make(map[string]json.RawMessage, len(theirs))
+	for k, v := range theirs {
+		m[k] = v
+	}
+	for k := range base {
+		if _, ok := ours[k]; !ok {
+			// ours deleted this key
+			delete(m, k)
+		}
+	}
+	for k, v := range ours {
+		b, inBase := base[k]
+		if inBase && equalJSON(b, v) {
+			// ours didn't change this value, so theirs is current
+			continue
+		}
+		t, inTheirs := theirs[k]
+		if depth > 0 && inTheirs {
+			tObj, oObj := object(t), object(v)
+			if tObj != nil && oObj != nil {
+				if merged, err := json.Marshal(mergeObjects(object(b), oObj, tObj, depth-1)); err == nil {
+					m[k] = merged
+					continue
+				}
+			}
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// object unmarshals a JSON object, returning nil when b isn't one
+func object(b []byte) map[string]json.RawMessage {
+	var m map[string]json.RawMessage
+	if json.Unmarshal(b, &m) != nil {
+		return nil
+	}
+	return m
+}
+
+// equalJSON returns true when a and b are the same JSON ignoring insignificant whitespace
+func equalJSON(a, b []byte) bool {
+	var x, y bytes.Buffer
+	if json.Compact(&x, a) != nil || json.Compact(&y, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(x.Bytes(), y.Bytes())
+}
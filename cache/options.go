@@ -0,0 +1,223 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-extensions-for-go/cache/compat"
+)
+
+// TimestampMode determines how [Cache] uses its timestamp file.
+type TimestampMode int
+
+const (
+	// TimestampCreate is the default mode. Export updates the timestamp file's modification time,
+	// creating the file and any directories in its path when they don't exist. Replace reads from
+	// the accessor only when the modification time indicates stored data has changed.
+	TimestampCreate TimestampMode = iota
+	// TimestampExisting is like TimestampCreate except that Export never creates the timestamp file.
+	// Use it when something else, such as an installer, is responsible for creating the file.
+	TimestampExisting
+	// TimestampDisabled makes Cache ignore the timestamp file. Replace reads from the accessor every time
+	// unless Cache uses optimistic concurrency with an accessor implementing [accessor.VersionReader], in
+	// which case Replace reads only when the accessor's version changed.
+	TimestampDisabled
+)
+
+// ReadOnlyPolicy determines how a read-only Cache responds to [Cache.Export]. See [WithReadOnly].
+type ReadOnlyPolicy int
+
+const (
+	// ExportIgnore makes Export return nil without writing anything.
+	ExportIgnore ReadOnlyPolicy = iota
+	// ExportError makes Export return [ErrReadOnly]. MSAL clients return this error from
+	// any method which would modify the cache, for example when acquiring a token from
+	// Azure AD rather than the cache.
+	ExportError
+)
+
+// ErrReadOnly is the error Export returns when a read-only Cache has the policy [ExportError].
+var ErrReadOnly = errors.New("cache is read-only")
+
+type option func(*Cache) error
+
+// WithCompatibility makes Cache follow the lock protocol of the MSAL extension library "p" identifies,
+// so that it can share a cache with applications using that library. The accessor should follow the
+// same library's storage conventions; see package [compat] for details. Cache writes the library's debug
+// information to the lock file. The .NET library locks the lock file by opening it with FileShare.None,
+// which on Linux and macOS takes the same lock Cache does and on Windows excludes Cache's handle, so
+// Cache locks the file as usual with [compat.DotNet]. The Python library acquires the lock by creating
+// the lock file before locking it, so Cache does likewise with [compat.Python]: another process's lock
+// file then excludes Cache even before that process locks it. When the file exists but no process has
+// locked it, Cache waits briefly before concluding that its creator abandoned it. A Cache using another
+// library's conventions can't use optimistic concurrency (see [WithOptimisticConcurrency]) or an accessor
+// implementing [accessor.Locker], because that library's clients coordinate only through the lock file.
+func WithCompatibility(p compat.Profile) option {
+	return func(c *Cache) error {
+		switch p {
+		case compat.Go, compat.DotNet, compat.Python:
+			c.compat = p
+			return nil
+		default:
+			return fmt.Errorf("unknown compatibility profile %d", p)
+		}
+	}
+}
+
+// WithLockPath sets the path of the lock file Cache uses to coordinate with other processes. The
+// default is the timestamp file's path with ".lockfile" appended. Other processes sharing the cache
+// must use the same lock file.
+func WithLockPath(p string) option {
+	return func(c *Cache) error {
+		if p == "" {
+			return errors.New("lock path can't be empty")
+		}
+		c.lockPath = p
+		return nil
+	}
+}
+
+// WithLockTimeout sets how long [Cache.Export] tries to acquire the file lock when its context has
+// no deadline. The default is 5 seconds.
+func WithLockTimeout(d time.Duration) option {
+	return func(c *Cache) error {
+		if d <= 0 {
+			return errors.New("lock timeout must be positive")
+		}
+		c.lockTimeout = d
+		return nil
+	}
+}
+
+// WithLogger sets a Logger to receive debug records explaining Cache's decisions, for example
+// why it did or didn't read from the accessor. These records never include cached data. By
+// default, Cache doesn't log.
+func WithLogger(l *slog.Logger) option {
+	return func(c *Cache) error {
+		c.logger = l
+		return nil
+	}
+}
+
+// WithOptimisticConcurrency makes Cache coordinate with other clients by writing conditionally instead
+// of locking. The accessor must implement [accessor.Versioned]. [Cache.Export] writes only when stored
+// data hasn't changed since Cache last read or wrote it. When it has, Export reads the stored data and
+// merges it with the data to write, keeping entries other clients added and preferring the exporting
+// client's version of entries both changed, and then tries again until it succeeds or the lock timeout
+// expires (see [WithLockTimeout]). Export doesn't use a lock file in this mode, and Cache doesn't
+// support a version file (see [WithVersionFile]). When the timestamp file is disabled and the accessor
+// implements [accessor.VersionReader], Replace reads from the accessor only when the version changed.
+func WithOptimisticConcurrency() option {
+	return func(c *Cache) error {
+		c.optimistic = true
+		return nil
+	}
+}
+
+// WithPermissions sets the permissions of directories and files Cache creates, before the process
+// umask is applied. The defaults are 0700 for directories and 0600 for files. The owner must have
+// full access to directories and read/write access to files. Windows ignores these permissions.
+func WithPermissions(dir, file os.FileMode) option {
+	return func(c *Cache) error {
+		if dir&^os.ModePerm != 0 || file&^os.ModePerm != 0 {
+			return errors.New("permissions may include only permission bits")
+		}
+		if dir&0700 != 0700 {
+			return errors.New("directory permissions must grant the owner full access")
+		}
+		if file&0600 != 0600 {
+			return errors.New("file permissions must grant the owner read and write access")
+		}
+		c.dirPerm = dir
+		c.filePerm = file
+		return nil
+	}
+}
+
+// WithReadTimeout sets how long [Cache.Replace] tries to read from the accessor when its context
+// has no deadline. The default is 1 second.
+func WithReadTimeout(d time.Duration) option {
+	return func(c *Cache) error {
+		if d <= 0 {
+			return errors.New("read timeout must be positive")
+		}
+		c.readTimeout = d
+		return nil
+	}
+}
+
+// WithReadOnly makes Cache read-only, for applications which only consume data another process
+// writes. A read-only Cache never writes to the accessor and never creates files or directories,
+// so it can use a cache on a read-only file system. Export has the behavior "p" specifies. Replace
+// works as usual except that it takes a shared file lock, when the lock file exists, while reading
+// from the accessor. This lets it wait for another process to finish writing.
+func WithReadOnly(p ReadOnlyPolicy) option {
+	return func(c *Cache) error {
+		switch p {
+		case ExportIgnore, ExportError:
+			c.readOnly = true
+			c.readOnlyPolicy = p
+			return nil
+		default:
+			return fmt.Errorf("unknown read-only policy %d", p)
+		}
+	}
+}
+
+// WithRetryDelay sets how long Cache waits between attempts to acquire the file lock or to read
+// well-formed data from the accessor. The first delay is "initial"; each subsequent delay doubles
+// the previous one, up to "max". Equal values give a constant delay, and zero values no delay. The
+// initial delay must be positive when the maximum is. The default is a constant 10 milliseconds.
+func WithRetryDelay(initial, max time.Duration) option {
+	return func(c *Cache) error {
+		if initial < 0 {
+			return errors.New("retry delay can't be negative")
+		}
+		if max < initial {
+			return errors.New("maximum retry delay can't be less than the initial delay")
+		}
+		if initial == 0 && max > 0 {
+			// doubling a zero delay never reaches max, so Cache would retry without delay
+			return errors.New("initial retry delay must be positive when the maximum delay is")
+		}
+		c.retryDelay = initial
+		c.maxRetryDelay = max
+		return nil
+	}
+}
+
+// WithVersionFile enables change detection by content version. Export records a generation
+// counter, which increases with every write, and a hash of the written data in a file at path "p".
+// Replace reads from the accessor when the generation differs from the one it last saw, in addition
+// to when the timestamp file's modification time changes. This detects changes the modification
+// time can't, for example when two writes happen within the file system's time resolution or the
+// system clock moves backward. When the version file is missing or malformed, Cache relies on the
+// timestamp file alone. All processes sharing the cache should use the same version file.
+func WithVersionFile(p string) option {
+	return func(c *Cache) error {
+		if p == "" {
+			return errors.New("version file path can't be empty")
+		}
+		c.versionPath = p
+		return nil
+	}
+}
+
+// WithTimestampMode sets how Cache uses its timestamp file. The default is [TimestampCreate].
+func WithTimestampMode(m TimestampMode) option {
+	return func(c *Cache) error {
+		switch m {
+		case TimestampCreate, TimestampExisting, TimestampDisabled:
+			c.tsMode = m
+			return nil
+		default:
+			return fmt.Errorf("unknown timestamp mode %d", m)
+		}
+	}
+}
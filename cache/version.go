@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root for license information.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// version identifies a state of stored data by a generation counter, which Export increments
+// on every write, and a hash of the data. Cache keeps it in the version file.
+type version struct {
+	gen  uint64
+	hash [sha256.Size]byte
+}
+
+func newVersion(gen uint64, data []byte) version {
+	return version{gen: gen, hash: sha256.Sum256(data)}
+}
+
+// matches returns true when "data" is the data "v" describes
+func (v version) matches(data []byte) bool {
+	return v.hash == sha256.Sum256(data)
+}
+
+func (v version) String() string {
+	return fmt.Sprintf("%d %s", v.gen, hex.EncodeToString(v.hash[:]))
+}
+
+// readVersion reads a version file. The file's content is the generation as a decimal integer
+// followed by a space and the hex encoded SHA-256 hash of the data.
+func readVersion(p string) (version, error) {
+	v := version{}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return v, err
+	}
+	gen, hash, found := strings.Cut(strings.TrimSpace(string(b)), " ")
+	if !found {
+		return v, errors.New("malformed version file")
+	}
+	if v.gen, err = strconv.ParseUint(gen, 10, 64); err != nil {
+		return v, fmt.Errorf("malformed generation in version file: %w", err)
+	}
+	h, err := hex.DecodeString(hash)
+	if err != nil || len(h) != len(v.hash) {
+		return v, errors.New("malformed hash in version file")
+	}
+	copy(v.hash[:], h)
+	return v, nil
+}
+
+// writeVersion replaces the content of a version file. It writes a temporary file and renames
+// it so that readers, which don't acquire the file lock, never see a partial write.
+func writeVersion(p string, v version, dirPerm, filePerm os.FileMode) error {
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.WriteString(v.String() + "\n")
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		if err = os.Chmod(tmp, filePerm); err == nil {
+			err = os.Rename(tmp, p)
+		}
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}